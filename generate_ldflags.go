@@ -18,11 +18,29 @@ func main() {
     }
     headOID := strings.TrimSpace(string(commitBytes))
 
+    // Get the semantic version from the latest release tag, if any
+    version := "0.0.0-dev"
+    cmd = exec.Command("git", "describe", "--tags", "--abbrev=0")
+    if tagBytes, err := cmd.Output(); err == nil {
+        version = strings.TrimPrefix(strings.TrimSpace(string(tagBytes)), "v")
+    }
+
     // Get build date
     buildDate := time.Now().Format(time.RFC3339)
 
     // Construct ldflags
-    ldflags := fmt.Sprintf("-X 'github.com/7db9a/machtiani/internal/api.HeadOID=%s' -X 'github.com/7db9a/machtiani/internal/api.BuildDate=%s'", headOID, buildDate)
+    ldflags := fmt.Sprintf("-X 'github.com/7db9a/machtiani/internal/api.HeadOID=%s' -X 'github.com/7db9a/machtiani/internal/api.BuildDate=%s' -X 'github.com/7db9a/machtiani/internal/api.Version=%s'", headOID, buildDate, version)
+
+    // Release builds can bake in where self-update looks for releases and the
+    // key their artifacts are signed with
+    for variable, name := range map[string]string{
+        "MACHTIANI_UPDATE_MANIFEST_URL": "DefaultManifestURL",
+        "MACHTIANI_UPDATE_PUBLIC_KEY":   "PublicKey",
+    } {
+        if value := os.Getenv(variable); value != "" {
+            ldflags += fmt.Sprintf(" -X 'github.com/7db9a/machtiani/internal/update.%s=%s'", name, value)
+        }
+    }
 
     fmt.Println(ldflags)
 }
@@ -1,15 +1,17 @@
 package api
 
 import (
+    "context"
     "strings"
     "encoding/json"
     "fmt"
-    "bytes"
     "log"
     "net/http"
-    "io/ioutil"
+    "net/url"
     "time"
 
+    "github.com/7db9a/machtiani/internal/pricing"
+    "github.com/7db9a/machtiani/internal/usage"
     "github.com/7db9a/machtiani/internal/utils"
 )
 var (
@@ -37,23 +39,43 @@ type LoadResponse struct {
 type StatusResponse struct {
     LockFilePresent  bool   `json:"lock_file_present"`
     LockTimeDuration float64 `json:"lock_time_duration"` // New field added
+    // Phase, Progress and Message are only reported by servers that track
+    // indexing progress. Progress is the completed fraction, 0 to 1.
+    Phase    string   `json:"phase,omitempty"`
+    Progress *float64 `json:"progress,omitempty"`
+    Message  string   `json:"message,omitempty"`
 }
 
+// Message is an earlier turn of a conversation, sent along with a prompt.
+type Message struct {
+    Role    string `json:"role"` // "user" or "assistant"
+    Content string `json:"content"`
+}
+
+// GenerateRequest holds the parameters of a /generate-response call.
+type GenerateRequest struct {
+    Prompt         string    // the question to answer
+    Messages       []Message // the conversation before Prompt, oldest first
+    Project        string
+    Mode           string
+    Model          string
+    MatchStrength  string
+    ModelAPIKey    string
+    CodeHostAPIKey string
+    CodeHostURL    string
+    IgnoreFiles    []string
+}
 
-func AddRepository(codeURL string, name string, apiKey *string, openAIAPIKey string, repoManagerURL string, force bool) (AddRepositoryResponse, error) {
-    config, ignoreFiles, err := utils.LoadConfigAndIgnoreFiles()
-    if err != nil {
-        return AddRepositoryResponse{}, err
-    }
 
-    fmt.Println() // Prints a new line
-    fmt.Println("Ignoring files based on .machtiani.ignore:")
+func (c *Client) AddRepository(ctx context.Context, codeURL string, name string, apiKey *string, openAIAPIKey string, ignoreFiles []string, force bool) (AddRepositoryResponse, error) {
+    c.println() // Prints a new line
+    c.println("Ignoring files based on .machtiani.ignore:")
     if len(ignoreFiles) == 0 {
-        fmt.Println("No files to ignore.")
+        c.println("No files to ignore.")
     } else {
-        fmt.Println() // Prints another new line
+        c.println() // Prints another new line
         for _, path := range ignoreFiles {
-            fmt.Println(path)
+            c.println(path)
         }
     }
 
@@ -73,85 +95,65 @@ func AddRepository(codeURL string, name string, apiKey *string, openAIAPIKey str
         return AddRepositoryResponse{}, fmt.Errorf("error marshaling JSON: %w", err)
     }
 
-    tokenCountEmbedding, tokenCountInference, err := getTokenCount(fmt.Sprintf("%s/add-repository/", repoManagerURL), bytes.NewBuffer(jsonData))
+    endpoint := fmt.Sprintf("%s/add-repository/", c.RepoManagerURL)
+    tokenCountEmbedding, tokenCountInference, err := c.getTokenCount(ctx, endpoint, jsonData)
     if err != nil {
-        fmt.Printf("Error getting token count: %v\n", err)
+        c.printf("Error getting token count: %v\n", err)
         return AddRepositoryResponse{}, err
     }
 
     // Print the token counts separately
-    fmt.Printf("Estimated embedding tokens: %d\n", tokenCountEmbedding)
-    fmt.Printf("Estimated inference tokens: %d\n", tokenCountInference)
+    c.printf("Estimated embedding tokens: %d\n", tokenCountEmbedding)
+    c.printf("Estimated inference tokens: %d\n", tokenCountInference)
+    c.printIndexingCost(tokenCountEmbedding, tokenCountInference)
+
+    spend := usage.Entry{Command: usage.CommandStore, Project: name, EmbeddingTokens: tokenCountEmbedding, InferenceTokens: tokenCountInference, Estimated: true}
+    if err := c.Budget.Check(spend); err != nil {
+        return AddRepositoryResponse{}, err
+    }
 
-    // Check if the user wants to proceed
     // Check if the user wants to proceed or if force is enabled
-    if force || confirmProceed() {
+    proceed, err := c.confirmProceed(ctx, force)
+    if err != nil {
+        return AddRepositoryResponse{}, err
+    }
+    if proceed {
         // Start the spinner
-        done := make(chan bool)
-        go utils.Spinner(done)
+        stopSpinner := utils.StartSpinnerOn(c.out())
+        defer stopSpinner()
 
         // Proceed with sending the POST request
-        req, err := http.NewRequest("POST", fmt.Sprintf("%s/add-repository/", repoManagerURL), bytes.NewBuffer(jsonData))
-        if err != nil {
-            return AddRepositoryResponse{}, fmt.Errorf("error creating request: %w", err)
-        }
-
-        // Set API Gateway headers if not blank
-        if config.Environment.APIGatewayHostKey != "" && config.Environment.APIGatewayHostValue != "" {
-            req.Header.Set(config.Environment.APIGatewayHostKey, config.Environment.APIGatewayHostValue)
-        }
-        req.Header.Set(config.Environment.ContentTypeKey, config.Environment.ContentTypeValue)
-
-        client := &http.Client{
-            Timeout: 20 * time.Minute,
-        }
-        resp, err := client.Do(req) // Use the client to execute the request
+        started := time.Now()
+        status, body, err := c.doRetry(ctx, c.Timeouts.Default, http.MethodPost, endpoint, jsonData, false)
         if err != nil {
             return AddRepositoryResponse{}, fmt.Errorf("error sending request to add repository: %w", err)
         }
-        defer resp.Body.Close()
 
         // Handle the response
-        if resp.StatusCode != http.StatusOK {
-            body, _ := ioutil.ReadAll(resp.Body)
-            return AddRepositoryResponse{}, fmt.Errorf("error adding repository: %s", body)
+        if status != http.StatusOK {
+            return AddRepositoryResponse{}, fmt.Errorf("error adding repository: %w", newError(http.MethodPost, endpoint, status, body))
         }
-        // Stop the spinner
-        done <- true
-
-        // Clear the spinner on completion
-        fmt.Print("\r ") // Clear the spinner output
 
         // Successfully added the repository, decode the response into the defined struct
         var responseMessage AddRepositoryResponse
-        if err := json.NewDecoder(resp.Body).Decode(&responseMessage); err != nil {
+        if err := json.Unmarshal(body, &responseMessage); err != nil {
             return AddRepositoryResponse{}, fmt.Errorf("error decoding response: %w", err)
         }
 
+        c.RecordUsage(spend, started)
         return responseMessage, nil
     } else {
-        // User chose not to proceed, return an AddRepositoryResponse with fields indicating operation aborted
-        abortedResponse := AddRepositoryResponse{
-            Message:              "Operation aborted by user",
-            FullPath:             "Operation aborted",
-            ApiKeyProvided:       false,
-            OpenAiApiKeyProvided: false,
-        }
-        return abortedResponse, nil
+        // User chose not to proceed
+        return AddRepositoryResponse{}, ErrAborted
     }
 }
 
 // FetchAndCheckoutBranch sends a request to fetch and checkout a branch.
-func FetchAndCheckoutBranch(codeURL string, name string, branchName string, apiKey *string, openAIAPIKey string, force bool) (string, error) {
-    config, ignoreFiles, err := utils.LoadConfigAndIgnoreFiles()
-    if err != nil {
-        return "", err
-    }
-
+func (c *Client) FetchAndCheckoutBranch(ctx context.Context, codeURL string, name string, branchName string, apiKey *string, openAIAPIKey string, ignoreFiles []string, force bool) (string, error) {
     // Print the file paths
-    fmt.Println("Parsed file paths from machtiani.ignore:")
+    c.println("Parsed file paths from machtiani.ignore:")
     for _, path := range ignoreFiles {
-        fmt.Println(path)
+        c.println(path)
     }
 
     // Prepare the data to be sent in the request
@@ -169,78 +171,58 @@ func FetchAndCheckoutBranch(codeURL string, name string, branchName string, apiK
         return "", fmt.Errorf("error marshaling JSON: %w", err)
     }
 
-    repoManagerURL := config.Environment.RepoManagerURL
-    if repoManagerURL == "" {
-        return "", fmt.Errorf("MACHTIANI_REPO_MANAGER_URL environment variable is not set")
-    }
-
-    tokenCountEmbedding, tokenCountInference , err := getTokenCount(fmt.Sprintf("%s/fetch-and-checkout/", repoManagerURL), bytes.NewBuffer(jsonData))
+    endpoint := fmt.Sprintf("%s/fetch-and-checkout/", c.RepoManagerURL)
+    tokenCountEmbedding, tokenCountInference , err := c.getTokenCount(ctx, endpoint, jsonData)
     if err != nil {
-        fmt.Printf("Error getting token count: %v\n", err)
+        c.printf("Error getting token count: %v\n", err)
         return "", err
     }
 
     // Print the token counts separately
-    fmt.Printf("Estimated embedding tokens: %d\n", tokenCountEmbedding)
-    fmt.Printf("Estimated inference tokens: %d\n", tokenCountInference)
+    c.printf("Estimated embedding tokens: %d\n", tokenCountEmbedding)
+    c.printf("Estimated inference tokens: %d\n", tokenCountInference)
+    c.printIndexingCost(tokenCountEmbedding, tokenCountInference)
+
+    spend := usage.Entry{Command: usage.CommandSync, Project: name, EmbeddingTokens: tokenCountEmbedding, InferenceTokens: tokenCountInference, Estimated: true}
+    if err := c.Budget.Check(spend); err != nil {
+        return "", err
+    }
 
     // Check if the user wants to proceed or if force is enabled
-    if force || confirmProceed() {
+    proceed, err := c.confirmProceed(ctx, force)
+    if err != nil {
+        return "", err
+    }
+    if proceed {
         // Start the spinner
-        done := make(chan bool)
-        go utils.Spinner(done)
-
-        req, err := http.NewRequest("POST", fmt.Sprintf("%s/fetch-and-checkout/", repoManagerURL), bytes.NewBuffer(jsonData))
-        if err != nil {
-            return "", fmt.Errorf("error creating request: %w", err)
-        }
+        stopSpinner := utils.StartSpinnerOn(c.out())
+        defer stopSpinner()
 
-        // Set API Gateway headers if not blank
-        if config.Environment.APIGatewayHostKey != "" && config.Environment.APIGatewayHostValue != "" {
-            req.Header.Set(config.Environment.APIGatewayHostKey, config.Environment.APIGatewayHostValue)
-        }
-        req.Header.Set(config.Environment.ContentTypeKey, config.Environment.ContentTypeValue)
-
-        client := &http.Client{
-            Timeout: 20 * time.Minute,
-        }
-        resp, err := client.Do(req)
+        started := time.Now()
+        status, body, err := c.doRetry(ctx, c.Timeouts.Default, http.MethodPost, endpoint, jsonData, false)
         if err != nil {
             return "", fmt.Errorf("error making request: %w", err)
         }
-        defer resp.Body.Close()
 
-        if resp.StatusCode != http.StatusOK {
-            body, _ := ioutil.ReadAll(resp.Body)
-            return "", fmt.Errorf("error: received status code %d from the server: %s", resp.StatusCode, body)
+        if status != http.StatusOK {
+            return "", fmt.Errorf("error syncing repository: %w", newError(http.MethodPost, endpoint, status, body))
         }
 
-        body, err := ioutil.ReadAll(resp.Body)
-        if err != nil {
-            return "", fmt.Errorf("error reading response body: %w", err)
-        }
-
-        // Stop the spinner
-        done <- true
-
-        // Clear the spinner on completion
-        fmt.Print("\r ") // Clear the spinner output
-
+        c.RecordUsage(spend, started)
         return fmt.Sprintf("Successfully synced the repository: %s.\nServer response: %s", name, string(body)), nil
     } else {
-        return "Operation aborted by user", nil
+        return "", ErrAborted
     }
 }
 
-func DeleteStore(projectName string, codehostURL string, ignoreFiles []string, vcsType string, apiKey *string, openaiAPIKey *string, repoManagerURL string, force bool) (DeleteStoreResponse, error) {
-    config, _, err := utils.LoadConfigAndIgnoreFiles()
+func (c *Client) DeleteStore(ctx context.Context, projectName string, codehostURL string, ignoreFiles []string, vcsType string, apiKey *string, openaiAPIKey *string, force bool) (DeleteStoreResponse, error) {
+    proceed, err := c.confirmProceed(ctx, force)
     if err != nil {
         return DeleteStoreResponse{}, err
     }
-
-    if force || confirmProceed() {
-        done := make(chan bool)
-        go utils.Spinner(done)
+    if proceed {
+        stopSpinner := utils.StartSpinnerOn(c.out())
+        defer stopSpinner()
 
         // Prepare the data to be sent in the request
         data := map[string]interface{}{
@@ -257,163 +239,123 @@ func DeleteStore(projectName string, codehostURL string, ignoreFiles []string, v
             return DeleteStoreResponse{}, fmt.Errorf("error marshaling JSON: %w", err)
         }
 
-        req, err := http.NewRequest("POST", fmt.Sprintf("%s/delete-store/", repoManagerURL), bytes.NewBuffer(jsonData))
-        if err != nil {
-            return DeleteStoreResponse{}, fmt.Errorf("error creating request: %w", err)
-        }
-
-        // Set API Gateway headers if not blank
-        if config.Environment.APIGatewayHostKey != "" && config.Environment.APIGatewayHostValue != "" {
-            req.Header.Set(config.Environment.APIGatewayHostKey, config.Environment.APIGatewayHostValue)
-        }
-        req.Header.Set(config.Environment.ContentTypeKey, config.Environment.ContentTypeValue)
-
-        client := &http.Client{
-            Timeout: 20 * time.Minute,
-        }
-        resp, err := client.Do(req)
+        endpoint := fmt.Sprintf("%s/delete-store/", c.RepoManagerURL)
+        started := time.Now()
+        status, body, err := c.doRetry(ctx, c.Timeouts.Default, http.MethodPost, endpoint, jsonData, false)
         if err != nil {
             return DeleteStoreResponse{}, fmt.Errorf("error sending request to delete store: %w", err)
         }
-        defer resp.Body.Close()
 
-        if resp.StatusCode != http.StatusOK {
-            body, _ := ioutil.ReadAll(resp.Body)
-            return DeleteStoreResponse{}, fmt.Errorf("error deleting store: %s", body)
+        if status != http.StatusOK {
+            return DeleteStoreResponse{}, fmt.Errorf("error deleting store: %w", newError(http.MethodPost, endpoint, status, body))
         }
 
-        done <- true
-
         var responseMessage DeleteStoreResponse
-        if err := json.NewDecoder(resp.Body).Decode(&responseMessage); err != nil {
+        if err := json.Unmarshal(body, &responseMessage); err != nil {
             return DeleteStoreResponse{}, fmt.Errorf("error decoding response: %w", err)
         }
 
+        c.RecordUsage(usage.Entry{Command: usage.CommandDelete, Project: projectName}, started)
         return responseMessage, nil
 
     } else {
-        abortedResponse := DeleteStoreResponse{
-            Message: "Operation aborted by user",
-        }
-
-        return abortedResponse, nil
+        return DeleteStoreResponse{}, ErrAborted
     }
 }
 
-func GenerateResponse(prompt, project, mode, model, matchStrength string, force bool) (map[string]interface{}, error) {
-
-    config, ignoreFiles, err := utils.LoadConfigAndIgnoreFiles()
-    if err != nil {
-        log.Fatalf("Error loading config: %v", err)
-    }
-
-    // Print the file paths
-    fmt.Println("Parsed file paths from machtiani.ignore:")
-    for _, path := range ignoreFiles {
-        fmt.Println(path)
+// payload encodes the request body sent to /generate-response.
+func (r GenerateRequest) payload(stream bool) ([]byte, error) {
+    payload := map[string]interface{}{
+        "prompt":          r.Prompt,
+        "project":         r.Project,
+        "mode":            r.Mode,
+        "model":           r.Model,
+        "match_strength":  r.MatchStrength,
+        "api_key":        r.ModelAPIKey,
+        "codehost_api_key": r.CodeHostAPIKey,
+        "codehost_url":   r.CodeHostURL,
+        "ignore_files": r.IgnoreFiles,
     }
-
-    // Retrieve the codehost URL based on the current Git project.
-    codehostURL, err := utils.GetCodehostURLFromCurrentRepository()
-    if err != nil {
-        return nil, fmt.Errorf("failed to get codehost URL: %w", err)
+    if len(r.Messages) > 0 {
+        payload["messages"] = r.Messages
     }
-
-    payload := map[string]interface{}{
-        "prompt":          prompt,
-        "project":         project,
-        "mode":            mode,
-        "model":           model,
-        "match_strength":  matchStrength,
-        "api_key":        config.Environment.ModelAPIKey,
-        "codehost_api_key": config.Environment.CodeHostAPIKey,
-        "codehost_url":   codehostURL, // Include the codehost_url here
-        "ignore_files": ignoreFiles,
+    if stream {
+        payload["stream"] = true
     }
 
     payloadBytes, err := json.Marshal(payload)
     if err != nil {
         return nil, fmt.Errorf("failed to marshal JSON: %w", err)
     }
+    return payloadBytes, nil
+}
 
-    endpoint := config.Environment.MachtianiURL
-    if endpoint == "" {
-        return nil, fmt.Errorf("MACHTIANI_URL environment variable is not set")
+// GenerateResponse asks the server to answer request.Prompt.
+func (c *Client) GenerateResponse(ctx context.Context, request GenerateRequest) (GenerateResponseResult, error) {
+    // Print the file paths
+    c.println("Parsed file paths from machtiani.ignore:")
+    for _, path := range request.IgnoreFiles {
+        c.println(path)
     }
 
-    req, err := http.NewRequest("POST", fmt.Sprintf("%s/generate-response", endpoint), bytes.NewBuffer(payloadBytes))
+    payloadBytes, err := request.payload(false)
     if err != nil {
-        return nil, fmt.Errorf("failed to create request: %w", err)
-    }
-
-    // Set API Gateway headers if not blank
-    if config.Environment.APIGatewayHostKey != "" && config.Environment.APIGatewayHostValue != "" {
-        req.Header.Set(config.Environment.APIGatewayHostKey, config.Environment.APIGatewayHostValue)
-    }
-    req.Header.Set(config.Environment.ContentTypeKey, config.Environment.ContentTypeValue)
-
-    // Create a new HTTP client with a timeout
-    client := &http.Client{
-        Timeout: 20 * time.Minute,
+        return GenerateResponseResult{}, err
     }
 
     // Start the spinner (if needed)
-    done := make(chan bool)
-    go utils.Spinner(done)
+    stopSpinner := utils.StartSpinnerOn(c.out())
+    defer stopSpinner()
 
-    resp, err := client.Do(req)
+    endpoint := fmt.Sprintf("%s/generate-response", c.MachtianiURL)
+    status, body, err := c.do(ctx, c.Timeouts.Default, http.MethodPost, endpoint, payloadBytes)
     if err != nil {
-        return nil, fmt.Errorf("failed to make API request: %w", err)
+        return GenerateResponseResult{}, fmt.Errorf("failed to make API request: %w", err)
     }
-    defer resp.Body.Close()
 
-    var result map[string]interface{}
-    if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-        return nil, fmt.Errorf("failed to decode JSON response: %w", err)
+    if status != http.StatusOK {
+        return GenerateResponseResult{}, newError(http.MethodPost, endpoint, status, body)
     }
 
-    // Stop the spinner
-    done <- true
-
-    // Clear the spinner on completion
-    fmt.Print("\r ") // Clear the spinner output
+    result, err := DecodeGenerateResponseResult(body)
+    if err != nil {
+        return GenerateResponseResult{}, err
+    }
 
     return result, nil
 }
 
-func getTokenCount(endpoint string, buffer *bytes.Buffer) (int, int, error) {
-    config, err := utils.LoadConfig()
-    if err != nil {
-        log.Fatalf("Error loading config: %v", err)
-    }
+// GenerateFilename asks the server for a chat filename that summarizes prompt.
+func (c *Client) GenerateFilename(ctx context.Context, prompt string, apiKey string) (string, error) {
+    endpoint := fmt.Sprintf("%s/generate-filename?context=%s&api_key=%s", c.MachtianiURL, url.QueryEscape(prompt), url.QueryEscape(apiKey))
 
-    req, err := http.NewRequest("POST", fmt.Sprintf("%stoken-count", endpoint), buffer)
+    status, body, err := c.do(ctx, c.Timeouts.Filename, http.MethodGet, endpoint, nil)
     if err != nil {
-        return 0, 0, fmt.Errorf("error creating request: %w", err)
+        return "", fmt.Errorf("failed to call generate-filename endpoint: %v", err)
     }
 
-    req.Header.Set(config.Environment.ContentTypeKey, config.Environment.ContentTypeValue)
+    if status != http.StatusOK {
+        return "", newError(http.MethodGet, endpoint, status, body)
+    }
 
-    if config.Environment.APIGatewayHostKey != "" && config.Environment.APIGatewayHostValue != "" {
-        req.Header.Set(config.Environment.APIGatewayHostKey, config.Environment.APIGatewayHostValue)
+    var filename string
+    if err := json.Unmarshal(body, &filename); err != nil {
+        return "", fmt.Errorf("failed to decode response from generate-filename endpoint: %v", err)
     }
 
-    client := &http.Client{Timeout: 20 * time.Minute}
-    response, err := client.Do(req)
+    return filename, nil
+}
+
+func (c *Client) getTokenCount(ctx context.Context, endpoint string, payload []byte) (int, int, error) {
+    endpoint = fmt.Sprintf("%stoken-count", endpoint)
+    // Counting tokens has no side effects, so it is always safe to retry.
+    status, body, err := c.doRetry(ctx, c.Timeouts.TokenCount, http.MethodPost, endpoint, payload, true)
     if err != nil {
         return 0, 0, fmt.Errorf("error sending request to token count endpoint: %w", err)
     }
-    defer response.Body.Close()
-
-    if response.StatusCode != http.StatusOK {
-        body, _ := ioutil.ReadAll(response.Body)
-        return 0, 0, fmt.Errorf("error getting token count: %s", body)
-    }
 
-    // Log response body for debugging
-    body, err := ioutil.ReadAll(response.Body)
-    if err != nil {
-        return 0, 0, fmt.Errorf("error reading response body: %v", err)
+    if status != http.StatusOK {
+        return 0, 0, fmt.Errorf("error getting token count: %w", newError(http.MethodPost, endpoint, status, body))
     }
 
     // Decode the JSON response into the new struct
@@ -426,101 +368,49 @@ func getTokenCount(endpoint string, buffer *bytes.Buffer) (int, int, error) {
     return tokenCountResponse.EmbeddingTokens, tokenCountResponse.InferenceTokens, nil
 }
 
-func CheckStatus(codehostURL string, apiKey *string) (StatusResponse, error) {
-    config, _, err := utils.LoadConfigAndIgnoreFiles()
-    if err != nil {
-        return StatusResponse{}, err
-    }
-
-    repoManagerURL := config.Environment.RepoManagerURL
-    if repoManagerURL == "" {
-        return StatusResponse{}, fmt.Errorf("MACHTIANI_REPO_MANAGER_URL environment variable is not set")
-    }
-
+func (c *Client) CheckStatus(ctx context.Context, codehostURL string, apiKey *string) (StatusResponse, error) {
     // Prepare the request URL
-    statusURL := fmt.Sprintf("%s/status?codehost_url=%s", repoManagerURL, codehostURL)
+    query := url.Values{}
+    query.Set("codehost_url", codehostURL)
     if apiKey != nil {
-        statusURL += fmt.Sprintf("&api_key=%s", *apiKey)
-    }
-
-    // Create the HTTP GET request
-    req, err := http.NewRequest("GET", statusURL, nil)
-    if err != nil {
-        return StatusResponse{}, fmt.Errorf("error creating request: %w", err)
-    }
-
-    // Set API Gateway headers if not blank
-    if config.Environment.APIGatewayHostKey != "" && config.Environment.APIGatewayHostValue != "" {
-        req.Header.Set(config.Environment.APIGatewayHostKey, config.Environment.APIGatewayHostValue)
+        query.Set("api_key", *apiKey)
     }
-    req.Header.Set(config.Environment.ContentTypeKey, config.Environment.ContentTypeValue)
+    statusURL := fmt.Sprintf("%s/status?%s", c.RepoManagerURL, query.Encode())
 
-    client := &http.Client{Timeout: 20 * time.Minute}
-    resp, err := client.Do(req)
+    status, body, err := c.doRetry(ctx, c.Timeouts.Status, http.MethodGet, statusURL, nil, true)
     if err != nil {
         return StatusResponse{}, fmt.Errorf("error sending request to status endpoint: %w", err)
     }
-    defer resp.Body.Close()
 
-    if resp.StatusCode != http.StatusOK {
-        body, _ := ioutil.ReadAll(resp.Body)
-        return StatusResponse{}, fmt.Errorf("error checking status: %s", body)
+    if status != http.StatusOK {
+        return StatusResponse{}, fmt.Errorf("error checking status: %w", newError(http.MethodGet, statusURL, status, body))
     }
 
     var statusResponse StatusResponse
-    if err := json.NewDecoder(resp.Body).Decode(&statusResponse); err != nil {
+    if err := json.Unmarshal(body, &statusResponse); err != nil {
         return StatusResponse{}, fmt.Errorf("error decoding status response: %w", err)
     }
 
     return statusResponse, nil
 }
 
-func GetInstallInfo() (bool, string, error) {
-    config, _, err := utils.LoadConfigAndIgnoreFiles()
-    if err != nil {
-        return false, "", fmt.Errorf("error loading config: %w", err)
-    }
-
-    machtianiURL := config.Environment.MachtianiURL
-    if machtianiURL == "" {
-        return false, "", fmt.Errorf("MACHTIANI_URL environment variable is not set")
-    }
+func (c *Client) GetInstallInfo(ctx context.Context) (bool, string, error) {
     // Define the URL for the get-head-oid endpoint
-    endpoint := fmt.Sprintf("%s/get-head-oid", machtianiURL) // Change this URL based on your FastAPI server configuration
+    endpoint := fmt.Sprintf("%s/get-head-oid", c.MachtianiURL)
 
-    // Create a new HTTP GET request
-    req, err := http.NewRequest("GET", endpoint, nil)
-    if err != nil {
-        return false, "", fmt.Errorf("error creating request: %w", err)
-    }
-
-    // Set API Gateway headers if not blank
-    if config.Environment.APIGatewayHostKey != "" && config.Environment.APIGatewayHostValue != "" {
-        req.Header.Set(config.Environment.APIGatewayHostKey, config.Environment.APIGatewayHostValue)
-    }
-    req.Header.Set(config.Environment.ContentTypeKey, config.Environment.ContentTypeValue)
-
-    // Create a new HTTP client with a timeout
-    client := &http.Client{
-        Timeout: 20 * time.Second, // Set an appropriate timeout
-    }
-
-    // Send the request
-    resp, err := client.Do(req)
+    status, body, err := c.do(ctx, c.Timeouts.InstallInfo, http.MethodGet, endpoint, nil)
     if err != nil {
         return false, "", fmt.Errorf("error sending request: %w", err)
     }
-    defer resp.Body.Close()
 
     // Check if the response status is OK
-    if resp.StatusCode != http.StatusOK {
-        body, _ := ioutil.ReadAll(resp.Body)
-        return false, "", fmt.Errorf("error: received status code %d from the server: %s", resp.StatusCode, body)
+    if status != http.StatusOK {
+        return false, "", newError(http.MethodGet, endpoint, status, body)
     }
 
     // Decode the response body
     var response map[string]string
-    if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+    if err := json.Unmarshal(body, &response); err != nil {
         return false, "", fmt.Errorf("error decoding response: %w", err)
     }
 
@@ -539,10 +429,59 @@ func GetInstallInfo() (bool, string, error) {
 
 
 
-// confirmProceed prompts the user for confirmation to proceed
-func confirmProceed() bool {
-    var response string
-    fmt.Print("Do you wish to proceed? (y/n): ")
-    fmt.Scanln(&response)
-    return strings.ToLower(response) == "y"
+// RecordUsage adds entry to the usage ledger with its cost and the time
+// since started. The operation already succeeded, so a failure to record it
+// is only logged.
+func (c *Client) RecordUsage(entry usage.Entry, started time.Time) {
+    entry.Duration = time.Since(started).Seconds()
+    if cost, ok := c.Pricing.EntryCost(entry); ok {
+        entry.Cost = cost
+    }
+    if err := c.Budget.Record(entry); err != nil {
+        log.Printf("Warning: failed to record usage: %v", err)
+    }
+}
+
+// printIndexingCost prints the dollar estimate for indexing the given token
+// counts, or a hint when the indexing models have no price configured.
+func (c *Client) printIndexingCost(embeddingTokens, inferenceTokens int) {
+    embedding, inference, ok := c.Pricing.IndexingCost(embeddingTokens, inferenceTokens)
+    if !ok {
+        c.printf("Estimated cost: unknown (add %s and %s to the pricing section of your config)\n", c.Pricing.EmbeddingModel, c.Pricing.InferenceModel)
+        return
+    }
+    c.printf("Estimated cost: %s (embedding %s with %s, inference %s with %s)\n",
+        pricing.FormatUSD(embedding+inference),
+        pricing.FormatUSD(embedding), c.Pricing.EmbeddingModel,
+        pricing.FormatUSD(inference), c.Pricing.InferenceModel)
+}
+
+// confirmProceed prompts the user for confirmation to proceed, unless force
+// or AssumeYes is set. Without a terminal to ask on it fails with
+// ErrNotInteractive rather than waiting on input that never comes. It gives
+// up with ctx's error if ctx is cancelled while waiting.
+func (c *Client) confirmProceed(ctx context.Context, force bool) (bool, error) {
+    if force || c.AssumeYes {
+        return true, nil
+    }
+    in := c.in()
+    if !utils.IsTerminal(in) {
+        return false, ErrNotInteractive
+    }
+
+    c.printf("Do you wish to proceed? (y/n): ")
+    answer := make(chan string, 1)
+    go func() {
+        var response string
+        fmt.Fscanln(in, &response)
+        answer <- response
+    }()
+
+    select {
+    case <-ctx.Done():
+        c.println()
+        return false, ctx.Err()
+    case response := <-answer:
+        return strings.ToLower(response) == "y", nil
+    }
 }
@@ -0,0 +1,212 @@
+package api
+
+import (
+    "bytes"
+    "context"
+    "errors"
+    "fmt"
+    "io"
+    "net/http"
+    "net/url"
+    "os"
+    "time"
+
+    "github.com/7db9a/machtiani/internal/budget"
+    "github.com/7db9a/machtiani/internal/pricing"
+    "github.com/7db9a/machtiani/internal/utils"
+)
+
+// Timeouts bounds each kind of call made by a Client. A zero duration leaves
+// the call bounded only by the caller's context.
+type Timeouts struct {
+    Default     time.Duration // repository operations and chat responses
+    TokenCount  time.Duration
+    Status      time.Duration
+    InstallInfo time.Duration
+    Filename    time.Duration
+}
+
+// DefaultTimeouts mirrors the limits the CLI has always used.
+var DefaultTimeouts = Timeouts{
+    Default:     20 * time.Minute,
+    TokenCount:  20 * time.Minute,
+    Status:      time.Minute,
+    InstallInfo: 20 * time.Second,
+    Filename:    time.Minute,
+}
+
+// sharedTransport is reused by every Client so connections are pooled
+// across calls.
+var sharedTransport http.RoundTripper = http.DefaultTransport.(*http.Transport).Clone()
+
+// Client talks to the machtiani and repo-manager services. Build it once from
+// the loaded config with NewClient and share it between calls.
+type Client struct {
+    MachtianiURL   string
+    RepoManagerURL string
+    Header         http.Header // sent with every request
+    Timeouts       Timeouts
+    Retry          RetryPolicy // applied to repo-manager calls
+    Pricing        pricing.Table // turns token counts into cost estimates
+    Budget         *budget.Budget // token limits, checked before spending
+    Out            io.Writer      // progress, estimates and confirmation prompts
+    In             io.Reader      // answers to confirmation prompts
+    AssumeYes      bool           // answer yes to confirmation prompts
+
+    httpClient *http.Client
+}
+
+// NewClient builds a Client from config.
+func NewClient(config utils.Config) (*Client, error) {
+    if config.Environment.MachtianiURL == "" {
+        return nil, fmt.Errorf("MACHTIANI_URL environment variable is not set")
+    }
+    if config.Environment.RepoManagerURL == "" {
+        return nil, fmt.Errorf("MACHTIANI_REPO_MANAGER_URL environment variable is not set")
+    }
+
+    retry, err := RetryPolicyFromConfig(config)
+    if err != nil {
+        return nil, err
+    }
+
+    prices, err := pricing.FromConfig(config)
+    if err != nil {
+        return nil, err
+    }
+
+    limits, err := budget.FromConfig(config)
+    if err != nil {
+        return nil, err
+    }
+
+    header := make(http.Header)
+    // Set API Gateway headers if not blank
+    if config.Environment.APIGatewayHostKey != "" && config.Environment.APIGatewayHostValue != "" {
+        header.Set(config.Environment.APIGatewayHostKey, config.Environment.APIGatewayHostValue)
+    }
+    header.Set(config.Environment.ContentTypeKey, config.Environment.ContentTypeValue)
+
+    return &Client{
+        MachtianiURL:   config.Environment.MachtianiURL,
+        RepoManagerURL: config.Environment.RepoManagerURL,
+        Header:         header,
+        Timeouts:       DefaultTimeouts,
+        Retry:          retry,
+        Pricing:        prices,
+        Budget:         limits,
+        Out:            os.Stdout,
+        In:             os.Stdin,
+        httpClient:     &http.Client{Transport: sharedTransport},
+    }, nil
+}
+
+// do sends a request carrying the client's default headers and returns the
+// status code and full response body. The call is bounded by timeout on top
+// of ctx.
+func (c *Client) do(ctx context.Context, timeout time.Duration, method, endpoint string, payload []byte) (int, []byte, error) {
+    status, _, body, err := c.roundTrip(ctx, timeout, method, endpoint, payload, nil)
+    return status, body, err
+}
+
+// roundTrip is do with extra request headers and the response headers
+// handed back.
+func (c *Client) roundTrip(ctx context.Context, timeout time.Duration, method, endpoint string, payload []byte, extra http.Header) (int, http.Header, []byte, error) {
+    resp, cancel, err := c.send(ctx, timeout, method, endpoint, payload, extra)
+    if err != nil {
+        return 0, nil, nil, err
+    }
+    defer cancel()
+    defer resp.Body.Close()
+
+    data, err := io.ReadAll(resp.Body)
+    if err != nil {
+        return resp.StatusCode, resp.Header, nil, fmt.Errorf("error reading response body: %w", err)
+    }
+
+    return resp.StatusCode, resp.Header, data, nil
+}
+
+// send issues a request and hands back the open response. The caller must
+// close the body and then call the returned cancel func. extra headers are
+// applied after the client's defaults.
+func (c *Client) send(ctx context.Context, timeout time.Duration, method, endpoint string, payload []byte, extra http.Header) (*http.Response, context.CancelFunc, error) {
+    cancel := context.CancelFunc(func() {})
+    if timeout > 0 {
+        ctx, cancel = context.WithTimeout(ctx, timeout)
+    }
+
+    var body io.Reader
+    if payload != nil {
+        body = bytes.NewReader(payload)
+    }
+
+    req, err := http.NewRequestWithContext(ctx, method, endpoint, body)
+    if err != nil {
+        cancel()
+        return nil, nil, fmt.Errorf("error creating request: %w", err)
+    }
+    for key, values := range c.Header {
+        req.Header[key] = append([]string(nil), values...)
+    }
+    for key, values := range extra {
+        req.Header[key] = append([]string(nil), values...)
+    }
+
+    resp, err := c.httpClient.Do(req)
+    if err != nil {
+        cancel()
+        // The *url.Error repeats the full URL, query string and API key
+        // included, so only its cause is kept.
+        var urlErr *url.Error
+        if errors.As(err, &urlErr) {
+            err = urlErr.Err
+        }
+        return nil, nil, &NetworkError{Endpoint: endpointPath(endpoint), Method: method, Err: err}
+    }
+
+    return resp, cancel, nil
+}
+
+// Transport returns the RoundTripper the client sends requests through.
+func (c *Client) Transport() http.RoundTripper {
+    return c.httpClient.Transport
+}
+
+// SetTransport replaces the RoundTripper the client sends requests through,
+// for example to record or replay a session.
+func (c *Client) SetTransport(transport http.RoundTripper) {
+    c.httpClient = &http.Client{Transport: transport}
+}
+
+// Ping sends a GET to baseURL with the client's headers and reports how
+// long the server took to answer. Any HTTP response counts as reachable, so
+// status is returned rather than turned into an error.
+func (c *Client) Ping(ctx context.Context, baseURL string) (latency time.Duration, status int, err error) {
+    start := time.Now()
+    status, _, _, err = c.roundTrip(ctx, c.Timeouts.InstallInfo, http.MethodGet, baseURL, nil, nil)
+    return time.Since(start), status, err
+}
+
+// printf writes progress for the user to c.Out.
+func (c *Client) printf(format string, args ...interface{}) {
+    fmt.Fprintf(c.out(), format, args...)
+}
+
+func (c *Client) println(args ...interface{}) {
+    fmt.Fprintln(c.out(), args...)
+}
+
+func (c *Client) out() io.Writer {
+    if c.Out == nil {
+        return os.Stdout
+    }
+    return c.Out
+}
+
+func (c *Client) in() io.Reader {
+    if c.In == nil {
+        return os.Stdin
+    }
+    return c.In
+}
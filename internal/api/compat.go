@@ -0,0 +1,215 @@
+package api
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "io/ioutil"
+    "net/http"
+    "os"
+    "path/filepath"
+    "time"
+
+    "github.com/7db9a/machtiani/internal/semver"
+)
+
+// DevVersion is the version of binaries built without release ldflags.
+const DevVersion = "0.0.0-dev"
+
+// Version is the semantic version of this CLI, set at build time.
+var Version = DevVersion
+
+// CapabilityIdempotencyKey means Idempotency-Key is honored on repository
+// operations.
+const CapabilityIdempotencyKey = "idempotency-key"
+
+// Capabilities are the protocol features this CLI supports. They are sent
+// with the compatibility check so the server can tailor its answer.
+var Capabilities = []string{
+    "stream",                 // SSE and NDJSON streaming of generate-response
+    CapabilityIdempotencyKey, // Idempotency-Key on repository operations
+    "token-usage",     // usage reported in generate-response
+    "status-progress", // phase and progress reported by /status
+    "messages",        // earlier turns of a chat sent as messages with the prompt
+}
+
+// Compatibility is the outcome of a compatibility check.
+type Compatibility struct {
+    Compatible    bool      `json:"compatible"`
+    ClientVersion string    `json:"client_version"`
+    ServerVersion string    `json:"server_version,omitempty"`
+    MinVersion    string    `json:"min_version,omitempty"`
+    MaxVersion    string    `json:"max_version,omitempty"`
+    Deprecations  []string  `json:"deprecations,omitempty"`
+    Capabilities  []string  `json:"capabilities,omitempty"` // of the server
+    Message       string    `json:"message,omitempty"`      // update instructions
+    Legacy        bool      `json:"legacy,omitempty"`       // decided by the head_oid check
+    CheckedAt     time.Time `json:"checked_at"`
+}
+
+// Supports reports whether the server announced capability. Servers that
+// predate the compatibility check support none.
+func (c Compatibility) Supports(capability string) bool {
+    for _, supported := range c.Capabilities {
+        if supported == capability {
+            return true
+        }
+    }
+    return false
+}
+
+// compatibilityResponse is the body of POST /compatibility.
+type compatibilityResponse struct {
+    ServerVersion string   `json:"server_version"`
+    MinVersion    string   `json:"min_version"`
+    MaxVersion    string   `json:"max_version"`
+    Compatible    *bool    `json:"compatible"` // overrides the range when set
+    Deprecations  []string `json:"deprecations"`
+    Capabilities  []string `json:"capabilities"`
+    Message       string   `json:"message"`
+}
+
+// CheckCompatibility asks the server whether this CLI is supported. The
+// client sends its Version and Capabilities, and the server answers with the
+// range of versions it supports. Servers without the /compatibility endpoint
+// fall back to the exact head_oid match of GetInstallInfo.
+func (c *Client) CheckCompatibility(ctx context.Context) (Compatibility, error) {
+    result := Compatibility{ClientVersion: Version, CheckedAt: time.Now()}
+
+    payload, err := json.Marshal(map[string]interface{}{
+        "client_version": Version,
+        "head_oid":       HeadOID,
+        "capabilities":   Capabilities,
+    })
+    if err != nil {
+        return result, fmt.Errorf("error marshaling JSON: %w", err)
+    }
+
+    endpoint := fmt.Sprintf("%s/compatibility", c.MachtianiURL)
+    status, body, err := c.do(ctx, c.Timeouts.InstallInfo, http.MethodPost, endpoint, payload)
+    if err != nil {
+        return result, fmt.Errorf("error sending request: %w", err)
+    }
+
+    if status == http.StatusNotFound || status == http.StatusMethodNotAllowed {
+        compatible, message, err := c.GetInstallInfo(ctx)
+        if err != nil {
+            return result, err
+        }
+        result.Compatible, result.Message, result.Legacy = compatible, message, true
+        return result, nil
+    }
+    if status != http.StatusOK {
+        return result, newError(http.MethodPost, endpoint, status, body)
+    }
+
+    var response compatibilityResponse
+    if err := json.Unmarshal(body, &response); err != nil {
+        return result, fmt.Errorf("error decoding compatibility response: %w", err)
+    }
+    result.ServerVersion = response.ServerVersion
+    result.MinVersion = response.MinVersion
+    result.MaxVersion = response.MaxVersion
+    result.Deprecations = response.Deprecations
+    result.Capabilities = response.Capabilities
+    result.Message = response.Message
+
+    if response.Compatible != nil {
+        result.Compatible = *response.Compatible
+        return result, nil
+    }
+    result.Compatible, err = inRange(Version, response.MinVersion, response.MaxVersion)
+    if err != nil {
+        return result, err
+    }
+    return result, nil
+}
+
+// inRange reports whether version lies within [min, max]; empty bounds are
+// open. Development builds have no meaningful version and are let through.
+func inRange(version, min, max string) (bool, error) {
+    if version == DevVersion {
+        return true, nil
+    }
+    v, err := semver.Parse(version)
+    if err != nil {
+        return false, fmt.Errorf("client version: %w", err)
+    }
+    if min != "" {
+        lower, err := semver.Parse(min)
+        if err != nil {
+            return false, fmt.Errorf("server min_version: %w", err)
+        }
+        if v.Compare(lower) < 0 {
+            return false, nil
+        }
+    }
+    if max != "" {
+        upper, err := semver.Parse(max)
+        if err != nil {
+            return false, fmt.Errorf("server max_version: %w", err)
+        }
+        if v.Compare(upper) > 0 {
+            return false, nil
+        }
+    }
+    return true, nil
+}
+
+// CompatibilityCache keeps the last successful compatibility check on disk
+// so commands do not pay for a round trip every time.
+type CompatibilityCache struct {
+    Path string
+    TTL  time.Duration
+}
+
+// DefaultCompatibilityTTL is how long a successful check is trusted.
+const DefaultCompatibilityTTL = time.Hour
+
+// DefaultCompatibilityCache returns a cache in the user cache directory.
+func DefaultCompatibilityCache(ttl time.Duration) (*CompatibilityCache, error) {
+    dir, err := os.UserCacheDir()
+    if err != nil {
+        return nil, fmt.Errorf("failed to get cache directory: %w", err)
+    }
+    return &CompatibilityCache{Path: filepath.Join(dir, "machtiani", "compatibility.json"), TTL: ttl}, nil
+}
+
+// cachedCompatibility is the cache file, keyed by server and build.
+type cachedCompatibility map[string]Compatibility
+
+func (c *Client) compatibilityKey() string {
+    return c.MachtianiURL + " " + Version + " " + HeadOID
+}
+
+// CheckCompatibilityCached returns a cached compatible result younger than
+// the cache TTL, or checks with the server and caches a compatible answer.
+// Incompatible answers are never cached, so an upgrade takes effect at once.
+func (c *Client) CheckCompatibilityCached(ctx context.Context, cache *CompatibilityCache) (Compatibility, error) {
+    if cache == nil || cache.TTL <= 0 {
+        return c.CheckCompatibility(ctx)
+    }
+
+    entries := cachedCompatibility{}
+    if data, err := ioutil.ReadFile(cache.Path); err == nil {
+        json.Unmarshal(data, &entries)
+    }
+    key := c.compatibilityKey()
+    if cached, ok := entries[key]; ok && cached.Compatible && time.Since(cached.CheckedAt) < cache.TTL {
+        return cached, nil
+    }
+
+    result, err := c.CheckCompatibility(ctx)
+    if err != nil || !result.Compatible {
+        return result, err
+    }
+
+    entries[key] = result
+    if data, err := json.MarshalIndent(entries, "", "  "); err == nil {
+        // The cache is an optimization; failing to write it is not an error.
+        if os.MkdirAll(filepath.Dir(cache.Path), 0755) == nil {
+            ioutil.WriteFile(cache.Path, data, 0644)
+        }
+    }
+    return result, nil
+}
@@ -0,0 +1,108 @@
+package api
+
+import (
+    "context"
+    "encoding/json"
+    "net/http"
+    "path/filepath"
+    "sync/atomic"
+    "testing"
+    "time"
+)
+
+func withVersion(t *testing.T, version string) {
+    original := Version
+    Version = version
+    t.Cleanup(func() { Version = original })
+}
+
+func TestCheckCompatibility_Range(t *testing.T) {
+    withVersion(t, "1.4.0")
+    var request map[string]interface{}
+    client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+        json.NewDecoder(r.Body).Decode(&request)
+        w.Write([]byte(`{"server_version": "2.1.0", "min_version": "1.2.0", "max_version": "1.9.9", "deprecations": ["mode super is going away"], "capabilities": ["stream", "idempotency-key"]}`))
+    })
+
+    result, err := client.CheckCompatibility(context.Background())
+    if err != nil {
+        t.Fatalf("Unexpected error: %v", err)
+    }
+    if !result.Compatible || result.Legacy || len(result.Deprecations) != 1 {
+        t.Errorf("Unexpected result: %+v", result)
+    }
+    if !result.Supports(CapabilityIdempotencyKey) || result.Supports("messages") {
+        t.Errorf("Expected the server's capabilities, got %v", result.Capabilities)
+    }
+    if request["client_version"] != "1.4.0" || request["capabilities"] == nil {
+        t.Errorf("Expected the version and capabilities to be sent, got %v", request)
+    }
+
+    withVersion(t, "2.0.0")
+    if result, _ := client.CheckCompatibility(context.Background()); result.Compatible {
+        t.Errorf("Expected 2.0.0 to be above the supported range")
+    }
+    withVersion(t, "1.2.0-rc.1")
+    if result, _ := client.CheckCompatibility(context.Background()); result.Compatible {
+        t.Errorf("Expected a prerelease of the minimum to be below the supported range")
+    }
+    withVersion(t, DevVersion)
+    if result, _ := client.CheckCompatibility(context.Background()); !result.Compatible {
+        t.Errorf("Expected development builds to be let through")
+    }
+}
+
+func TestCheckCompatibility_LegacyFallback(t *testing.T) {
+    client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+        if r.URL.Path == "/compatibility" {
+            http.NotFound(w, r)
+            return
+        }
+        w.Write([]byte(`{"head_oid": "` + HeadOID + `", "message": "update"}`))
+    })
+
+    result, err := client.CheckCompatibility(context.Background())
+    if err != nil {
+        t.Fatalf("Unexpected error: %v", err)
+    }
+    if !result.Compatible || !result.Legacy {
+        t.Errorf("Expected a compatible legacy result, got %+v", result)
+    }
+}
+
+func TestCheckCompatibilityCached(t *testing.T) {
+    withVersion(t, "1.0.0")
+    var calls int32
+    client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+        atomic.AddInt32(&calls, 1)
+        w.Write([]byte(`{"min_version": "1.0.0", "max_version": "1.0.0"}`))
+    })
+    cache := &CompatibilityCache{Path: filepath.Join(t.TempDir(), "compat.json"), TTL: time.Hour}
+
+    for i := 0; i < 3; i++ {
+        if result, err := client.CheckCompatibilityCached(context.Background(), cache); err != nil || !result.Compatible {
+            t.Fatalf("Expected a compatible result, got %+v, %v", result, err)
+        }
+    }
+    if calls != 1 {
+        t.Errorf("Expected one request within the TTL, got %d", calls)
+    }
+
+    cache.TTL = time.Nanosecond
+    time.Sleep(time.Millisecond)
+    client.CheckCompatibilityCached(context.Background(), cache)
+    if calls != 2 {
+        t.Errorf("Expected an expired entry to be rechecked, got %d requests", calls)
+    }
+
+    withVersion(t, "1.1.0")
+    cache.TTL = time.Hour
+    for i := 0; i < 2; i++ {
+        if result, _ := client.CheckCompatibilityCached(context.Background(), cache); result.Compatible {
+            t.Fatalf("Expected 1.1.0 to be incompatible")
+        }
+    }
+    if calls != 4 {
+        t.Errorf("Expected incompatible results not to be cached, got %d requests", calls)
+    }
+}
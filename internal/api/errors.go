@@ -0,0 +1,139 @@
+package api
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net/http"
+    "net/url"
+    "strings"
+)
+
+// ErrAborted is returned when the user declines the confirmation prompt.
+var ErrAborted = errors.New("operation aborted by user")
+
+// ErrNotInteractive is returned when an operation needs confirmation but
+// stdin is not a terminal to ask on.
+var ErrNotInteractive = errors.New("confirmation required but stdin is not a terminal; rerun with --yes or --force to proceed")
+
+// Server error codes the CLI treats specially. Servers that predate error
+// codes are classified by status code alone.
+const (
+    CodeLockPresent  = "lock_present"
+    CodeUnauthorized = "unauthorized"
+    CodeIncompatible = "incompatible_version"
+)
+
+// Error is returned when a machtiani service answers with a non-OK status.
+type Error struct {
+    Endpoint   string // request path, without the query string
+    Method     string
+    StatusCode int
+    Code       string // machine-readable code from the server, if any
+    Message    string
+}
+
+func (e *Error) Error() string {
+    msg := e.Message
+    if msg == "" {
+        msg = http.StatusText(e.StatusCode)
+    }
+    if e.Code != "" {
+        return fmt.Sprintf("%s %s returned %d (%s): %s", e.Method, e.Endpoint, e.StatusCode, e.Code, msg)
+    }
+    return fmt.Sprintf("%s %s returned %d: %s", e.Method, e.Endpoint, e.StatusCode, msg)
+}
+
+// IsAuth reports whether the server rejected the credentials.
+func (e *Error) IsAuth() bool {
+    return e.Code == CodeUnauthorized || e.StatusCode == http.StatusUnauthorized || e.StatusCode == http.StatusForbidden
+}
+
+// IsBusy reports whether the server refused because the project is locked,
+// typically while it is still being indexed.
+func (e *Error) IsBusy() bool {
+    return e.Code == CodeLockPresent || e.StatusCode == http.StatusLocked
+}
+
+// IsIncompatible reports whether the server refused this client version.
+func (e *Error) IsIncompatible() bool {
+    return e.Code == CodeIncompatible || e.StatusCode == http.StatusUpgradeRequired
+}
+
+// NetworkError is returned when a request never got an HTTP response, for
+// example because the server is unreachable or the connection dropped.
+type NetworkError struct {
+    Endpoint string
+    Method   string
+    Err      error
+}
+
+func (e *NetworkError) Error() string {
+    return fmt.Sprintf("%s %s: %v", e.Method, e.Endpoint, e.Err)
+}
+
+func (e *NetworkError) Unwrap() error {
+    return e.Err
+}
+
+// newError builds an *Error from a non-OK response. The body may be a JSON
+// object carrying code/message/error/detail keys (detail is what FastAPI
+// uses), or plain text.
+func newError(method, endpoint string, status int, body []byte) *Error {
+    apiErr := &Error{
+        Endpoint:   endpointPath(endpoint),
+        Method:     method,
+        StatusCode: status,
+    }
+
+    var payload struct {
+        Code    string          `json:"code"`
+        Message string          `json:"message"`
+        Error   string          `json:"error"`
+        Detail  json.RawMessage `json:"detail"`
+    }
+    if err := json.Unmarshal(body, &payload); err != nil {
+        apiErr.Message = strings.TrimSpace(string(body))
+        return apiErr
+    }
+
+    apiErr.Code = payload.Code
+    apiErr.Message = payload.Message
+    if apiErr.Message == "" {
+        apiErr.Message = payload.Error
+    }
+    if len(payload.Detail) > 0 {
+        var detail string
+        var detailObject struct {
+            Code    string `json:"code"`
+            Message string `json:"message"`
+        }
+        if json.Unmarshal(payload.Detail, &detail) == nil {
+            if apiErr.Message == "" {
+                apiErr.Message = detail
+            }
+        } else if json.Unmarshal(payload.Detail, &detailObject) == nil {
+            if apiErr.Code == "" {
+                apiErr.Code = detailObject.Code
+            }
+            if apiErr.Message == "" {
+                apiErr.Message = detailObject.Message
+            }
+        }
+    }
+    if apiErr.Message == "" {
+        apiErr.Message = strings.TrimSpace(string(body))
+    }
+
+    return apiErr
+}
+
+// endpointPath strips the scheme, host and query from endpoint so errors
+// never echo api keys passed as query parameters.
+func endpointPath(endpoint string) string {
+    parsed, err := url.Parse(endpoint)
+    if err != nil {
+        return endpoint
+    }
+    return parsed.Path
+}
@@ -0,0 +1,82 @@
+package api
+
+import (
+    "context"
+    "errors"
+    "net/http"
+    "strings"
+    "testing"
+)
+
+func TestNewError_ParsesServerBodies(t *testing.T) {
+    tests := []struct {
+        name        string
+        status      int
+        body        string
+        wantCode    string
+        wantMessage string
+    }{
+        {"plain text", http.StatusInternalServerError, "boom\n", "", "boom"},
+        {"code and message", http.StatusLocked, `{"code": "lock_present", "message": "still indexing"}`, CodeLockPresent, "still indexing"},
+        {"fastapi string detail", http.StatusBadRequest, `{"detail": "bad branch"}`, "", "bad branch"},
+        {"fastapi object detail", http.StatusConflict, `{"detail": {"code": "lock_present", "message": "locked"}}`, CodeLockPresent, "locked"},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            err := newError(http.MethodPost, "http://localhost:5070/add-repository/?api_key=secret", tt.status, []byte(tt.body))
+            if err.Code != tt.wantCode || err.Message != tt.wantMessage {
+                t.Errorf("Expected code %q and message %q, got %q and %q", tt.wantCode, tt.wantMessage, err.Code, err.Message)
+            }
+            if err.Endpoint != "/add-repository/" {
+                t.Errorf("Expected the endpoint path without query, got: %s", err.Endpoint)
+            }
+        })
+    }
+}
+
+func TestError_Classification(t *testing.T) {
+    if !(&Error{StatusCode: http.StatusUnauthorized}).IsAuth() {
+        t.Errorf("Expected 401 to be an auth failure")
+    }
+    if !(&Error{StatusCode: http.StatusConflict, Code: CodeLockPresent}).IsBusy() {
+        t.Errorf("Expected lock_present to mean the server is busy")
+    }
+    if !(&Error{StatusCode: http.StatusUpgradeRequired}).IsIncompatible() {
+        t.Errorf("Expected 426 to mean an incompatible version")
+    }
+}
+
+func TestCheckStatus_NetworkErrorHidesAPIKey(t *testing.T) {
+    client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {})
+    client.Retry.MaxAttempts = 1
+    client.RepoManagerURL = "http://127.0.0.1:1"
+    apiKey := "secret-key"
+
+    _, err := client.CheckStatus(context.Background(), "https://github.com/example/repo", &apiKey)
+
+    var netErr *NetworkError
+    if !errors.As(err, &netErr) {
+        t.Fatalf("Expected a *NetworkError, got: %v", err)
+    }
+    if strings.Contains(err.Error(), apiKey) {
+        t.Errorf("Expected the API key to be left out of the error, got: %v", err)
+    }
+}
+
+func TestCheckStatus_ReturnsTypedError(t *testing.T) {
+    client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+        w.WriteHeader(http.StatusForbidden)
+        w.Write([]byte(`{"detail": "invalid api key"}`))
+    })
+
+    _, err := client.CheckStatus(context.Background(), "https://github.com/example/repo", nil)
+
+    var apiErr *Error
+    if !errors.As(err, &apiErr) {
+        t.Fatalf("Expected an *Error, got: %v", err)
+    }
+    if apiErr.StatusCode != http.StatusForbidden || apiErr.Method != http.MethodGet || apiErr.Endpoint != "/status" {
+        t.Errorf("Unexpected error fields: %+v", apiErr)
+    }
+}
@@ -0,0 +1,87 @@
+package api
+
+import (
+    "encoding/json"
+    "fmt"
+)
+
+// GenerateResponseVersion is the newest /generate-response result schema this
+// client understands. Servers that predate versioning omit the field.
+const GenerateResponseVersion = 1
+
+// GenerateResponseResult is the decoded body of a /generate-response call.
+// Fields the client does not know about are ignored, so newer servers can add
+// to the result without breaking older clients.
+type GenerateResponseResult struct {
+    Version            int             `json:"version,omitempty"`
+    Machtiani          string          `json:"machtiani,omitempty"`
+    OpenAIResponse     string          `json:"openai_response"`
+    RetrievedFilePaths []string        `json:"retrieved_file_paths"`
+    Error              string          `json:"error,omitempty"`
+    Usage              *TokenUsage     `json:"usage,omitempty"`
+    MatchedCommits     []MatchedCommit `json:"matched_commits,omitempty"`
+    FileScores         []FileScore     `json:"file_scores,omitempty"`
+    Warnings           []string        `json:"warnings,omitempty"`
+}
+
+// TokenUsage reports the tokens the server spent answering a prompt.
+type TokenUsage struct {
+    PromptTokens     int `json:"prompt_tokens"`
+    CompletionTokens int `json:"completion_tokens"`
+    EmbeddingTokens  int `json:"embedding_tokens,omitempty"`
+    TotalTokens      int `json:"total_tokens"`
+}
+
+// MatchedCommit is a commit the server matched against the prompt.
+type MatchedCommit struct {
+    OID     string  `json:"oid"`
+    Message string  `json:"message,omitempty"`
+    Score   float64 `json:"score,omitempty"`
+}
+
+// FileScore is the retrieval score of a single file.
+type FileScore struct {
+    Path  string  `json:"path"`
+    Score float64 `json:"score"`
+}
+
+// MissingFieldError reports a field the result must carry but the server
+// left out.
+type MissingFieldError struct {
+    Field string
+}
+
+func (e *MissingFieldError) Error() string {
+    return fmt.Sprintf("generate-response result is missing %q", e.Field)
+}
+
+// DecodeGenerateResponseResult decodes a /generate-response body. An answer
+// must carry openai_response and retrieved_file_paths unless the server sent
+// an error or a machtiani message instead; a missing field is reported as a
+// *MissingFieldError.
+func DecodeGenerateResponseResult(data []byte) (GenerateResponseResult, error) {
+    var result GenerateResponseResult
+    if err := json.Unmarshal(data, &result); err != nil {
+        return GenerateResponseResult{}, fmt.Errorf("failed to decode JSON response: %w", err)
+    }
+
+    if result.Version > GenerateResponseVersion {
+        result.Warnings = append(result.Warnings, fmt.Sprintf("server sent result version %d, this client understands up to %d; consider updating", result.Version, GenerateResponseVersion))
+    }
+
+    if result.Error != "" || result.Machtiani != "" {
+        return result, nil
+    }
+
+    var present map[string]json.RawMessage
+    if err := json.Unmarshal(data, &present); err != nil {
+        return GenerateResponseResult{}, fmt.Errorf("failed to decode JSON response: %w", err)
+    }
+    for _, field := range []string{"openai_response", "retrieved_file_paths"} {
+        if _, ok := present[field]; !ok {
+            return result, &MissingFieldError{Field: field}
+        }
+    }
+
+    return result, nil
+}
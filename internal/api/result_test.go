@@ -0,0 +1,61 @@
+package api
+
+import (
+    "errors"
+    "testing"
+)
+
+func TestDecodeGenerateResponseResult_ToleratesUnknownFields(t *testing.T) {
+    body := `{
+        "version": 1,
+        "openai_response": "answer",
+        "retrieved_file_paths": ["a.go"],
+        "usage": {"prompt_tokens": 10, "completion_tokens": 5, "total_tokens": 15},
+        "file_scores": [{"path": "a.go", "score": 0.9}],
+        "some_future_field": {"nested": true}
+    }`
+
+    result, err := DecodeGenerateResponseResult([]byte(body))
+    if err != nil {
+        t.Fatalf("DecodeGenerateResponseResult() failed: %v", err)
+    }
+    if result.OpenAIResponse != "answer" || len(result.RetrievedFilePaths) != 1 {
+        t.Errorf("Unexpected result: %+v", result)
+    }
+    if result.Usage == nil || result.Usage.TotalTokens != 15 {
+        t.Errorf("Expected usage to be decoded, got: %+v", result.Usage)
+    }
+    if len(result.FileScores) != 1 || result.FileScores[0].Score != 0.9 {
+        t.Errorf("Expected file scores to be decoded, got: %+v", result.FileScores)
+    }
+}
+
+func TestDecodeGenerateResponseResult_MissingField(t *testing.T) {
+    _, err := DecodeGenerateResponseResult([]byte(`{"openai_response": "answer"}`))
+
+    var missing *MissingFieldError
+    if !errors.As(err, &missing) {
+        t.Fatalf("Expected a MissingFieldError, got: %v", err)
+    }
+    if missing.Field != "retrieved_file_paths" {
+        t.Errorf("Expected retrieved_file_paths to be reported missing, got: %s", missing.Field)
+    }
+}
+
+func TestDecodeGenerateResponseResult_ErrorAndMessageSkipValidation(t *testing.T) {
+    for _, body := range []string{`{"error": "boom"}`, `{"machtiani": "still indexing"}`} {
+        if _, err := DecodeGenerateResponseResult([]byte(body)); err != nil {
+            t.Errorf("Expected %s to decode without error, got: %v", body, err)
+        }
+    }
+}
+
+func TestDecodeGenerateResponseResult_NewerVersionWarns(t *testing.T) {
+    result, err := DecodeGenerateResponseResult([]byte(`{"version": 99, "openai_response": "", "retrieved_file_paths": []}`))
+    if err != nil {
+        t.Fatalf("DecodeGenerateResponseResult() failed: %v", err)
+    }
+    if len(result.Warnings) != 1 {
+        t.Errorf("Expected a version warning, got: %v", result.Warnings)
+    }
+}
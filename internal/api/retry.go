@@ -0,0 +1,201 @@
+package api
+
+import (
+    "context"
+    "crypto/rand"
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "log"
+    mathrand "math/rand"
+    "net/http"
+    "net/url"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/7db9a/machtiani/internal/utils"
+)
+
+// IdempotencyKeyHeader carries the key that lets the server recognize a
+// retried request it has already processed.
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// RetryPolicy controls how repo-manager calls are retried after transient
+// failures: network errors, 429 and most 5xx responses.
+type RetryPolicy struct {
+    MaxAttempts    int           // total attempts, including the first; 1 disables retries
+    InitialBackoff time.Duration // wait before the first retry
+    MaxBackoff     time.Duration // upper bound for the computed backoff
+    Multiplier     float64       // backoff growth per attempt
+    Jitter         float64       // fraction of each backoff that is randomized, 0 to 1
+}
+
+// DefaultRetryPolicy is used when the config does not override it.
+var DefaultRetryPolicy = RetryPolicy{
+    MaxAttempts:    4,
+    InitialBackoff: time.Second,
+    MaxBackoff:     30 * time.Second,
+    Multiplier:     2,
+    Jitter:         0.5,
+}
+
+// RetryPolicyFromConfig applies the retry section of config on top of
+// DefaultRetryPolicy.
+func RetryPolicyFromConfig(config utils.Config) (RetryPolicy, error) {
+    policy := DefaultRetryPolicy
+    if config.Retry.MaxAttempts > 0 {
+        policy.MaxAttempts = config.Retry.MaxAttempts
+    }
+    if config.Retry.InitialBackoff != "" {
+        d, err := time.ParseDuration(config.Retry.InitialBackoff)
+        if err != nil {
+            return policy, fmt.Errorf("invalid retry INITIAL_BACKOFF: %w", err)
+        }
+        policy.InitialBackoff = d
+    }
+    if config.Retry.MaxBackoff != "" {
+        d, err := time.ParseDuration(config.Retry.MaxBackoff)
+        if err != nil {
+            return policy, fmt.Errorf("invalid retry MAX_BACKOFF: %w", err)
+        }
+        policy.MaxBackoff = d
+    }
+    return policy, nil
+}
+
+// backoff returns the wait before retry number attempt (starting at 1).
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+    d := float64(p.InitialBackoff)
+    for i := 1; i < attempt; i++ {
+        d *= p.Multiplier
+        if p.MaxBackoff > 0 && d >= float64(p.MaxBackoff) {
+            break
+        }
+    }
+    if p.MaxBackoff > 0 && d > float64(p.MaxBackoff) {
+        d = float64(p.MaxBackoff)
+    }
+    if p.Jitter > 0 {
+        d -= d * p.Jitter * mathrand.Float64()
+    }
+    return time.Duration(d)
+}
+
+type idempotencyKeyContext struct{}
+
+// WithIdempotencyKey attaches key to ctx. Non-idempotent requests made with
+// the returned context send the key and become safe to retry.
+func WithIdempotencyKey(ctx context.Context, key string) context.Context {
+    return context.WithValue(ctx, idempotencyKeyContext{}, key)
+}
+
+func idempotencyKeyFrom(ctx context.Context) string {
+    key, _ := ctx.Value(idempotencyKeyContext{}).(string)
+    return key
+}
+
+// NewIdempotencyKey returns a random key suitable for WithIdempotencyKey.
+func NewIdempotencyKey() string {
+    buf := make([]byte, 16)
+    if _, err := rand.Read(buf); err != nil {
+        return strconv.FormatInt(time.Now().UnixNano(), 16)
+    }
+    return hex.EncodeToString(buf)
+}
+
+// doRetry behaves like do but retries transient failures according to
+// c.Retry. Requests that are not idempotent are only retried once they carry
+// an idempotency key, either from ctx or handed back by the server.
+func (c *Client) doRetry(ctx context.Context, timeout time.Duration, method, endpoint string, payload []byte, idempotent bool) (int, []byte, error) {
+    extra := http.Header{}
+    retryable := idempotent
+    if !idempotent {
+        if key := idempotencyKeyFrom(ctx); key != "" {
+            extra.Set(IdempotencyKeyHeader, key)
+            retryable = true
+        }
+    }
+
+    for attempt := 1; ; attempt++ {
+        status, header, body, err := c.roundTrip(ctx, timeout, method, endpoint, payload, extra)
+        if !isTransient(status, err) || attempt >= c.Retry.MaxAttempts || ctx.Err() != nil {
+            return status, body, err
+        }
+
+        if !retryable {
+            serverKey := header.Get(IdempotencyKeyHeader)
+            if serverKey == "" {
+                return status, body, err
+            }
+            extra.Set(IdempotencyKeyHeader, serverKey)
+            retryable = true
+        }
+
+        wait := c.Retry.backoff(attempt)
+        if status == http.StatusTooManyRequests || status == http.StatusServiceUnavailable {
+            if d, ok := retryAfter(header.Get("Retry-After"), time.Now()); ok {
+                wait = d
+            }
+        }
+
+        log.Printf("Retrying %s %s in %s (attempt %d of %d): %s", method, endpointPath(endpoint), wait.Round(time.Millisecond), attempt+1, c.Retry.MaxAttempts, retryReason(endpoint, status, err))
+
+        timer := time.NewTimer(wait)
+        select {
+        case <-ctx.Done():
+            timer.Stop()
+            return 0, nil, &NetworkError{Endpoint: endpointPath(endpoint), Method: method, Err: ctx.Err()}
+        case <-timer.C:
+        }
+    }
+}
+
+// retryReason describes a failed attempt for the retry log. It never
+// includes the query string of endpoint, which may carry the API key.
+func retryReason(endpoint string, status int, err error) string {
+    if err == nil {
+        return fmt.Sprintf("status %d", status)
+    }
+    reason := err.Error()
+    var netErr *NetworkError
+    if errors.As(err, &netErr) && netErr.Err != nil {
+        reason = netErr.Err.Error()
+    }
+    if parsed, parseErr := url.Parse(endpoint); parseErr == nil && parsed.RawQuery != "" {
+        reason = strings.ReplaceAll(reason, parsed.RawQuery, "[query redacted]")
+    }
+    return reason
+}
+
+// isTransient reports whether a failed attempt is worth retrying.
+func isTransient(status int, err error) bool {
+    if err != nil {
+        var netErr *NetworkError
+        return errors.As(err, &netErr) && !errors.Is(err, context.Canceled)
+    }
+    switch status {
+    case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway,
+        http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+        return true
+    }
+    return false
+}
+
+// retryAfter parses a Retry-After header given either in seconds or as an
+// HTTP date.
+func retryAfter(value string, now time.Time) (time.Duration, bool) {
+    if value == "" {
+        return 0, false
+    }
+    if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+        return time.Duration(seconds) * time.Second, true
+    }
+    if at, err := http.ParseTime(value); err == nil {
+        if d := at.Sub(now); d > 0 {
+            return d, true
+        }
+        return 0, true
+    }
+    return 0, false
+}
@@ -0,0 +1,123 @@
+package api
+
+import (
+    "bytes"
+    "context"
+    "errors"
+    "log"
+    "net/http"
+    "strings"
+    "sync/atomic"
+    "testing"
+    "time"
+)
+
+func fastRetries(client *Client) {
+    client.Retry = RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond, Multiplier: 2}
+}
+
+func TestCheckStatus_RetriesTransientFailures(t *testing.T) {
+    var calls int32
+    client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+        if atomic.AddInt32(&calls, 1) < 3 {
+            w.Header().Set("Retry-After", "0")
+            w.WriteHeader(http.StatusServiceUnavailable)
+            return
+        }
+        w.Write([]byte(`{"lock_file_present": false, "lock_time_duration": 0}`))
+    })
+    fastRetries(client)
+
+    if _, err := client.CheckStatus(context.Background(), "https://github.com/example/repo", nil); err != nil {
+        t.Fatalf("CheckStatus() failed: %v", err)
+    }
+    if calls != 3 {
+        t.Errorf("Expected 3 attempts, got %d", calls)
+    }
+}
+
+func TestDoRetry_PostNeedsIdempotencyKey(t *testing.T) {
+    var calls int32
+    var keys []string
+    client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+        atomic.AddInt32(&calls, 1)
+        keys = append(keys, r.Header.Get(IdempotencyKeyHeader))
+        w.WriteHeader(http.StatusBadGateway)
+    })
+    fastRetries(client)
+
+    client.doRetry(context.Background(), 0, http.MethodPost, client.RepoManagerURL+"/delete-store/", []byte(`{}`), false)
+    if calls != 1 {
+        t.Errorf("Expected a POST without idempotency key to be sent once, got %d attempts", calls)
+    }
+
+    calls, keys = 0, nil
+    ctx := WithIdempotencyKey(context.Background(), "abc")
+    client.doRetry(ctx, 0, http.MethodPost, client.RepoManagerURL+"/delete-store/", []byte(`{}`), false)
+    if calls != 3 {
+        t.Errorf("Expected a POST with idempotency key to be retried, got %d attempts", calls)
+    }
+    for _, key := range keys {
+        if key != "abc" {
+            t.Errorf("Expected every attempt to carry the idempotency key, got %q", key)
+        }
+    }
+}
+
+func TestDoRetry_ServerProvidedIdempotencyKey(t *testing.T) {
+    var calls int32
+    var lastKey string
+    client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+        lastKey = r.Header.Get(IdempotencyKeyHeader)
+        if atomic.AddInt32(&calls, 1) == 1 {
+            w.Header().Set(IdempotencyKeyHeader, "from-server")
+            w.WriteHeader(http.StatusServiceUnavailable)
+            return
+        }
+        w.Write([]byte(`{}`))
+    })
+    fastRetries(client)
+
+    status, _, err := client.doRetry(context.Background(), 0, http.MethodPost, client.RepoManagerURL+"/add-repository/", []byte(`{}`), false)
+    if err != nil || status != http.StatusOK {
+        t.Fatalf("Expected the retry to succeed, got status %d, err %v", status, err)
+    }
+    if lastKey != "from-server" {
+        t.Errorf("Expected the retry to send the server's key, got %q", lastKey)
+    }
+}
+
+func TestDoRetry_LogHidesAPIKey(t *testing.T) {
+    var logged bytes.Buffer
+    defer log.SetOutput(log.Writer())
+    log.SetOutput(&logged)
+
+    client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+        panic(http.ErrAbortHandler) // drop the connection
+    })
+    fastRetries(client)
+    apiKey := "secret-key"
+    client.CheckStatus(context.Background(), "https://github.com/example/repo", &apiKey)
+
+    if !strings.Contains(logged.String(), "Retrying GET /status") || strings.Contains(logged.String(), apiKey) {
+        t.Errorf("Expected the retries to be logged without the API key, got:\n%s", logged.String())
+    }
+
+    reason := retryReason("http://localhost/status?api_key=secret-key", 0, &NetworkError{Err: errors.New(`Get "http://localhost/status?api_key=secret-key": EOF`)})
+    if strings.Contains(reason, apiKey) {
+        t.Errorf("Expected the query to be redacted, got %q", reason)
+    }
+}
+
+func TestRetryAfter(t *testing.T) {
+    now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+    if d, ok := retryAfter("7", now); !ok || d != 7*time.Second {
+        t.Errorf("Expected 7s, got %v (%v)", d, ok)
+    }
+    if d, ok := retryAfter(now.Add(time.Minute).Format(http.TimeFormat), now); !ok || d != time.Minute {
+        t.Errorf("Expected 1m, got %v (%v)", d, ok)
+    }
+    if _, ok := retryAfter("soon", now); ok {
+        t.Errorf("Expected an invalid header to be ignored")
+    }
+}
@@ -0,0 +1,197 @@
+package api
+
+import (
+    "bufio"
+    "context"
+    "encoding/json"
+    "fmt"
+    "io"
+    "mime"
+    "net/http"
+    "strings"
+)
+
+// Streaming responses from /generate-response.
+//
+// A request sent with "stream": true is answered either with server-sent
+// events (text/event-stream) or with newline-delimited JSON
+// (application/x-ndjson). Both carry the same chunk objects: a "token" key
+// holds the next piece of the answer, and any other keys, such as
+// retrieved_file_paths or error, are merged into the final result. A server
+// without streaming support answers with a plain JSON body, which is treated
+// as a single chunk.
+
+const streamAccept = "text/event-stream, application/x-ndjson, application/json"
+
+// maxStreamLine bounds a single SSE or JSON line.
+const maxStreamLine = 10 * 1024 * 1024
+
+// GenerateResponseStream asks the server to stream its answer and calls
+// onToken with each piece of text as it arrives. The returned result has the
+// same shape as GenerateResponse, with OpenAIResponse holding the full text.
+func (c *Client) GenerateResponseStream(ctx context.Context, request GenerateRequest, onToken func(string)) (GenerateResponseResult, error) {
+    // Print the file paths
+    c.println("Parsed file paths from machtiani.ignore:")
+    for _, path := range request.IgnoreFiles {
+        c.println(path)
+    }
+
+    payloadBytes, err := request.payload(true)
+    if err != nil {
+        return GenerateResponseResult{}, err
+    }
+
+    header := http.Header{}
+    header.Set("Accept", streamAccept)
+    endpoint := fmt.Sprintf("%s/generate-response", c.MachtianiURL)
+    resp, cancel, err := c.send(ctx, c.Timeouts.Default, http.MethodPost, endpoint, payloadBytes, header)
+    if err != nil {
+        return GenerateResponseResult{}, fmt.Errorf("failed to make API request: %w", err)
+    }
+    defer cancel()
+    defer resp.Body.Close()
+
+    if resp.StatusCode != http.StatusOK {
+        body, _ := io.ReadAll(resp.Body)
+        return GenerateResponseResult{}, newError(http.MethodPost, endpoint, resp.StatusCode, body)
+    }
+
+    acc := &streamAccumulator{fields: map[string]json.RawMessage{}, onToken: onToken}
+
+    mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+    switch mediaType {
+    case "text/event-stream":
+        err = readEventStream(resp.Body, acc.add)
+    case "application/x-ndjson", "application/jsonl":
+        err = readJSONLines(resp.Body, acc.add)
+    default:
+        body, err := io.ReadAll(resp.Body)
+        if err != nil {
+            return GenerateResponseResult{}, fmt.Errorf("error reading response body: %w", err)
+        }
+        result, err := DecodeGenerateResponseResult(body)
+        if err != nil {
+            return GenerateResponseResult{}, err
+        }
+        if onToken != nil {
+            onToken(result.OpenAIResponse)
+        }
+        return result, nil
+    }
+    if err != nil {
+        return GenerateResponseResult{}, err
+    }
+
+    body, err := acc.result()
+    if err != nil {
+        return GenerateResponseResult{}, err
+    }
+    return DecodeGenerateResponseResult(body)
+}
+
+// streamAccumulator collects streamed chunks into a single result body.
+type streamAccumulator struct {
+    text    strings.Builder
+    fields  map[string]json.RawMessage
+    onToken func(string)
+}
+
+func (a *streamAccumulator) add(chunk map[string]json.RawMessage) error {
+    for key, value := range chunk {
+        if key == "token" {
+            var token string
+            if err := json.Unmarshal(value, &token); err != nil {
+                return fmt.Errorf("failed to decode stream token: %w", err)
+            }
+            a.text.WriteString(token)
+            if a.onToken != nil {
+                a.onToken(token)
+            }
+            continue
+        }
+        a.fields[key] = value
+    }
+    return nil
+}
+
+// result encodes the collected fields, filling openai_response from the
+// streamed text when the server did not send it whole.
+func (a *streamAccumulator) result() ([]byte, error) {
+    if _, ok := a.fields["openai_response"]; !ok && a.text.Len() > 0 {
+        text, err := json.Marshal(a.text.String())
+        if err != nil {
+            return nil, err
+        }
+        a.fields["openai_response"] = text
+    }
+    return json.Marshal(a.fields)
+}
+
+// readEventStream parses server-sent events and hands each data payload to
+// handle. A "[DONE]" payload ends the stream.
+func readEventStream(r io.Reader, handle func(map[string]json.RawMessage) error) error {
+    scanner := bufio.NewScanner(r)
+    scanner.Buffer(make([]byte, 64*1024), maxStreamLine)
+
+    var data []string
+    dispatch := func() (bool, error) {
+        if len(data) == 0 {
+            return false, nil
+        }
+        payload := strings.Join(data, "\n")
+        data = data[:0]
+        if payload == "[DONE]" {
+            return true, nil
+        }
+        var chunk map[string]json.RawMessage
+        if err := json.Unmarshal([]byte(payload), &chunk); err != nil {
+            return false, fmt.Errorf("failed to decode stream chunk: %w", err)
+        }
+        return false, handle(chunk)
+    }
+
+    for scanner.Scan() {
+        line := scanner.Text()
+        switch {
+        case line == "":
+            done, err := dispatch()
+            if err != nil || done {
+                return err
+            }
+        case strings.HasPrefix(line, ":"):
+            // Comment, used by servers as a keep-alive.
+        case strings.HasPrefix(line, "data:"):
+            data = append(data, strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+        }
+    }
+    if err := scanner.Err(); err != nil {
+        return fmt.Errorf("error reading response stream: %w", err)
+    }
+
+    _, err := dispatch()
+    return err
+}
+
+// readJSONLines parses newline-delimited JSON chunks.
+func readJSONLines(r io.Reader, handle func(map[string]json.RawMessage) error) error {
+    scanner := bufio.NewScanner(r)
+    scanner.Buffer(make([]byte, 64*1024), maxStreamLine)
+
+    for scanner.Scan() {
+        line := strings.TrimSpace(scanner.Text())
+        if line == "" {
+            continue
+        }
+        var chunk map[string]json.RawMessage
+        if err := json.Unmarshal([]byte(line), &chunk); err != nil {
+            return fmt.Errorf("failed to decode stream chunk: %w", err)
+        }
+        if err := handle(chunk); err != nil {
+            return err
+        }
+    }
+    if err := scanner.Err(); err != nil {
+        return fmt.Errorf("error reading response stream: %w", err)
+    }
+    return nil
+}
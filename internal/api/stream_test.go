@@ -0,0 +1,93 @@
+package api
+
+import (
+    "context"
+    "fmt"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+
+    "github.com/7db9a/machtiani/internal/utils"
+)
+
+func newTestClient(t *testing.T, handler http.HandlerFunc) *Client {
+    server := httptest.NewServer(handler)
+    t.Cleanup(server.Close)
+
+    var config utils.Config
+    config.Environment.MachtianiURL = server.URL
+    config.Environment.RepoManagerURL = server.URL
+    config.Environment.ContentTypeKey = "Content-Type"
+    config.Environment.ContentTypeValue = "application/json"
+
+    client, err := NewClient(config)
+    if err != nil {
+        t.Fatalf("NewClient() failed: %v", err)
+    }
+    return client
+}
+
+func TestGenerateResponseStream_EventStream(t *testing.T) {
+    client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Type", "text/event-stream")
+        fmt.Fprint(w, ": keep-alive\n\n")
+        fmt.Fprint(w, "data: {\"token\": \"Hello\"}\n\n")
+        fmt.Fprint(w, "data: {\"token\": \", world\"}\n\n")
+        fmt.Fprint(w, "data: {\"retrieved_file_paths\": [\"main.go\"]}\n\n")
+        fmt.Fprint(w, "data: [DONE]\n\n")
+    })
+
+    var tokens []string
+    result, err := client.GenerateResponseStream(context.Background(), GenerateRequest{Prompt: "hi"}, func(token string) {
+        tokens = append(tokens, token)
+    })
+    if err != nil {
+        t.Fatalf("GenerateResponseStream() failed: %v", err)
+    }
+
+    if strings.Join(tokens, "|") != "Hello|, world" {
+        t.Errorf("Unexpected tokens: %q", tokens)
+    }
+    if result.OpenAIResponse != "Hello, world" {
+        t.Errorf("Expected accumulated openai_response, got: %v", result.OpenAIResponse)
+    }
+    if len(result.RetrievedFilePaths) != 1 || result.RetrievedFilePaths[0] != "main.go" {
+        t.Errorf("Expected one retrieved file path, got: %v", result.RetrievedFilePaths)
+    }
+}
+
+func TestGenerateResponseStream_JSONLines(t *testing.T) {
+    client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Type", "application/x-ndjson")
+        fmt.Fprintln(w, `{"token": "a"}`)
+        fmt.Fprintln(w, ``)
+        fmt.Fprintln(w, `{"token": "b", "retrieved_file_paths": []}`)
+    })
+
+    result, err := client.GenerateResponseStream(context.Background(), GenerateRequest{Prompt: "hi"}, nil)
+    if err != nil {
+        t.Fatalf("GenerateResponseStream() failed: %v", err)
+    }
+    if result.OpenAIResponse != "ab" {
+        t.Errorf("Expected openai_response 'ab', got: %v", result.OpenAIResponse)
+    }
+}
+
+func TestGenerateResponseStream_PlainJSONFallback(t *testing.T) {
+    client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Type", "application/json")
+        fmt.Fprint(w, `{"openai_response": "whole answer", "retrieved_file_paths": []}`)
+    })
+
+    var streamed string
+    result, err := client.GenerateResponseStream(context.Background(), GenerateRequest{Prompt: "hi"}, func(token string) {
+        streamed += token
+    })
+    if err != nil {
+        t.Fatalf("GenerateResponseStream() failed: %v", err)
+    }
+    if streamed != "whole answer" || result.OpenAIResponse != "whole answer" {
+        t.Errorf("Expected the whole answer to be passed through, got: %q / %v", streamed, result.OpenAIResponse)
+    }
+}
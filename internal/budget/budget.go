@@ -0,0 +1,150 @@
+// Package budget enforces the token limits configured in the budget section
+// of .machtiani-config.yml. Limits hold even with --force; only an explicit
+// override lets an operation through.
+package budget
+
+import (
+    "fmt"
+    "strings"
+    "time"
+
+    "github.com/7db9a/machtiani/internal/usage"
+    "github.com/7db9a/machtiani/internal/utils"
+)
+
+// Limits are token caps. Zero means no limit.
+type Limits struct {
+    PerStore  int
+    PerSync   int
+    PerPrompt int
+    PerDay    int // over the last 24 hours
+}
+
+// Budget checks operations against Limits and records what they spent in
+// Ledger.
+type Budget struct {
+    Limits   Limits
+    Ledger   *usage.Ledger
+    Override bool // let operations over the limits through
+
+    now func() time.Time
+}
+
+// FromConfig builds a Budget from the budget and usage sections of config.
+func FromConfig(config utils.Config) (*Budget, error) {
+    ledger, err := usage.LedgerFromConfig(config)
+    if err != nil {
+        return nil, err
+    }
+    limits := Limits{
+        PerStore:  config.Budget.MaxTokensPerStore,
+        PerSync:   config.Budget.MaxTokensPerSync,
+        PerPrompt: config.Budget.MaxTokensPerPrompt,
+        PerDay:    config.Budget.MaxTokensPerDay,
+    }
+    if limits.PerStore < 0 || limits.PerSync < 0 || limits.PerPrompt < 0 || limits.PerDay < 0 {
+        return nil, fmt.Errorf("invalid budget: limits must not be negative")
+    }
+    return &Budget{Limits: limits, Ledger: ledger, now: time.Now}, nil
+}
+
+// ExceededError is returned when an operation would go over a limit.
+type ExceededError struct {
+    Entry     usage.Entry // what the operation would spend
+    Limit     string      // "per-store", "per-sync", "per-prompt" or "daily"
+    Max       int
+    UsedToday int // tokens in the ledger over the last 24 hours
+}
+
+func (e *ExceededError) Error() string {
+    var b strings.Builder
+    fmt.Fprintf(&b, "%s would exceed the %s budget of %s tokens\n", e.Entry.Command, e.Limit, formatTokens(e.Max))
+    if e.Entry.Estimated {
+        b.WriteString("Token counts below are approximate estimates; actual usage may differ.\n")
+    }
+    for _, line := range breakdown(e.Entry) {
+        fmt.Fprintf(&b, "  %-22s %s\n", line[0], line[1])
+    }
+    fmt.Fprintf(&b, "  %-22s %s\n", "This operation", formatTokens(e.Entry.Tokens()))
+    if e.Limit == "daily" {
+        fmt.Fprintf(&b, "  %-22s %s\n", "Used in last 24h", formatTokens(e.UsedToday))
+        fmt.Fprintf(&b, "  %-22s %s\n", "Total", formatTokens(e.UsedToday+e.Entry.Tokens()))
+    }
+    b.WriteString("Rerun with --override-budget to proceed anyway, or raise the limit in the budget section of .machtiani-config.yml.")
+    return b.String()
+}
+
+// Check returns an *ExceededError if entry would go over the limit for its
+// command or over the daily limit, unless b.Override is set.
+func (b *Budget) Check(entry usage.Entry) error {
+    if b == nil || b.Override {
+        return nil
+    }
+
+    tokens := entry.Tokens()
+    limit, max := b.commandLimit(entry.Command)
+    if max > 0 && tokens > max {
+        return &ExceededError{Entry: entry, Limit: limit, Max: max}
+    }
+
+    if b.Limits.PerDay > 0 {
+        used, err := b.Ledger.TokensSince(b.now().Add(-24 * time.Hour))
+        if err != nil {
+            return fmt.Errorf("checking daily budget: %w", err)
+        }
+        if used+tokens > b.Limits.PerDay {
+            return &ExceededError{Entry: entry, Limit: "daily", Max: b.Limits.PerDay, UsedToday: used}
+        }
+    }
+    return nil
+}
+
+// Record adds entry to the ledger.
+func (b *Budget) Record(entry usage.Entry) error {
+    if b == nil || b.Ledger == nil {
+        return nil
+    }
+    if entry.Time.IsZero() {
+        entry.Time = b.now()
+    }
+    return b.Ledger.Append(entry)
+}
+
+func (b *Budget) commandLimit(command string) (string, int) {
+    switch command {
+    case usage.CommandStore:
+        return "per-store", b.Limits.PerStore
+    case usage.CommandSync:
+        return "per-sync", b.Limits.PerSync
+    case usage.CommandPrompt:
+        return "per-prompt", b.Limits.PerPrompt
+    }
+    return "", 0
+}
+
+// breakdown lists the non-zero token counts of entry.
+func breakdown(entry usage.Entry) [][2]string {
+    var lines [][2]string
+    add := func(label string, tokens int) {
+        if tokens > 0 {
+            lines = append(lines, [2]string{label, formatTokens(tokens)})
+        }
+    }
+    add("Embedding tokens", entry.EmbeddingTokens)
+    add("Inference tokens", entry.InferenceTokens)
+    add("Prompt tokens", entry.PromptTokens)
+    add("Completion tokens", entry.CompletionTokens)
+    return lines
+}
+
+// formatTokens formats n with thousands separators.
+func formatTokens(n int) string {
+    if n < 0 {
+        return "-" + formatTokens(-n)
+    }
+    s := fmt.Sprint(n)
+    for i := len(s) - 3; i > 0; i -= 3 {
+        s = s[:i] + "," + s[i:]
+    }
+    return s
+}
@@ -0,0 +1,77 @@
+package budget
+
+import (
+    "errors"
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/7db9a/machtiani/internal/usage"
+)
+
+func newTestBudget(t *testing.T, limits Limits) *Budget {
+    ledger := &usage.Ledger{Path: filepath.Join(t.TempDir(), "usage.jsonl")}
+    return &Budget{Limits: limits, Ledger: ledger, now: time.Now}
+}
+
+func TestCheck_PerOperationLimit(t *testing.T) {
+    b := newTestBudget(t, Limits{PerStore: 1000})
+    entry := usage.Entry{Command: usage.CommandStore, EmbeddingTokens: 900, InferenceTokens: 200, Estimated: true}
+
+    err := b.Check(entry)
+    var exceeded *ExceededError
+    if !errors.As(err, &exceeded) {
+        t.Fatalf("Expected an ExceededError, got %v", err)
+    }
+    for _, want := range []string{"per-store budget of 1,000 tokens", "Embedding tokens", "900", "This operation", "1,100", "approximate", "--override-budget"} {
+        if !strings.Contains(err.Error(), want) {
+            t.Errorf("Expected the message to contain %q, got:\n%s", want, err)
+        }
+    }
+
+    if err := b.Check(usage.Entry{Command: usage.CommandSync, EmbeddingTokens: 5000}); err != nil {
+        t.Errorf("Expected other commands to be unlimited, got %v", err)
+    }
+
+    b.Override = true
+    if err := b.Check(entry); err != nil {
+        t.Errorf("Expected the override to let the operation through, got %v", err)
+    }
+}
+
+func TestCheck_DailyLimit(t *testing.T) {
+    b := newTestBudget(t, Limits{PerDay: 1000})
+    now := time.Now()
+    b.Record(usage.Entry{Time: now.Add(-25 * time.Hour), Command: usage.CommandPrompt, PromptTokens: 5000})
+    b.Record(usage.Entry{Time: now.Add(-time.Hour), Command: usage.CommandPrompt, PromptTokens: 600})
+
+    if err := b.Check(usage.Entry{Command: usage.CommandPrompt, PromptTokens: 400}); err != nil {
+        t.Errorf("Expected usage older than a day to be ignored, got %v", err)
+    }
+
+    err := b.Check(usage.Entry{Command: usage.CommandPrompt, PromptTokens: 401})
+    var exceeded *ExceededError
+    if !errors.As(err, &exceeded) || exceeded.Limit != "daily" || exceeded.UsedToday != 600 {
+        t.Fatalf("Expected a daily ExceededError with 600 used, got %v", err)
+    }
+    if !strings.Contains(err.Error(), "Used in last 24h") {
+        t.Errorf("Expected the daily breakdown, got:\n%s", err)
+    }
+}
+
+func TestCheck_NilBudget(t *testing.T) {
+    var b *Budget
+    if err := b.Check(usage.Entry{Command: usage.CommandStore, EmbeddingTokens: 1}); err != nil {
+        t.Errorf("Expected a nil budget to allow everything, got %v", err)
+    }
+}
+
+func TestFormatTokens(t *testing.T) {
+    tests := map[int]string{0: "0", 999: "999", 1000: "1,000", 1234567: "1,234,567", -4500: "-4,500"}
+    for n, want := range tests {
+        if got := formatTokens(n); got != want {
+            t.Errorf("formatTokens(%d) = %q, want %q", n, got, want)
+        }
+    }
+}
@@ -0,0 +1,286 @@
+// Package cassette records the HTTP traffic of the CLI to disk and replays it
+// without network access. Each request/response pair is stored as one JSON
+// file ("cassette") named NNNN-METHOD-path.json, with API keys and code-host
+// tokens scrubbed, so a session can be attached to a bug report or turned
+// into a regression test.
+package cassette
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "net/http"
+    "net/url"
+    "os"
+    "path/filepath"
+    "sort"
+    "strings"
+    "sync"
+)
+
+// Redacted replaces every scrubbed value.
+const Redacted = "REDACTED"
+
+// Interaction is a single recorded request and its response.
+type Interaction struct {
+    Request  Request  `json:"request"`
+    Response Response `json:"response"`
+}
+
+// Request is the recorded, redacted form of an outgoing request.
+type Request struct {
+    Method string      `json:"method"`
+    URL    string      `json:"url"`
+    Header http.Header `json:"header,omitempty"`
+    Body   string      `json:"body,omitempty"`
+}
+
+// Response is the recorded, redacted form of a response. Error is set
+// instead when the request never got a response.
+type Response struct {
+    StatusCode int         `json:"status_code,omitempty"`
+    Header     http.Header `json:"header,omitempty"`
+    Body       string      `json:"body,omitempty"`
+    Error      string      `json:"error,omitempty"`
+}
+
+// Recorder is an http.RoundTripper that forwards requests to Next and writes
+// every exchange to Dir.
+type Recorder struct {
+    Dir  string
+    Next http.RoundTripper
+
+    // Secrets are literal values, such as configured API keys, scrubbed
+    // wherever they appear.
+    Secrets []string
+
+    mu    sync.Mutex
+    count int
+}
+
+// NewRecorder creates dir if needed and records into it, continuing the
+// numbering of any cassettes already there.
+func NewRecorder(dir string, next http.RoundTripper, secrets ...string) (*Recorder, error) {
+    if err := os.MkdirAll(dir, 0755); err != nil {
+        return nil, fmt.Errorf("failed to create cassette directory: %w", err)
+    }
+    existing, err := cassetteFiles(dir)
+    if err != nil {
+        return nil, err
+    }
+    return &Recorder{Dir: dir, Next: next, Secrets: secrets, count: len(existing)}, nil
+}
+
+// RoundTrip implements http.RoundTripper.
+func (r *Recorder) RoundTrip(req *http.Request) (*http.Response, error) {
+    var requestBody []byte
+    if req.Body != nil {
+        var err error
+        requestBody, err = io.ReadAll(req.Body)
+        req.Body.Close()
+        if err != nil {
+            return nil, err
+        }
+        req.Body = io.NopCloser(bytes.NewReader(requestBody))
+    }
+
+    interaction := Interaction{
+        Request: Request{
+            Method: req.Method,
+            URL:    r.redactURL(req.URL),
+            Header: r.redactHeader(req.Header),
+            Body:   r.redactBody(requestBody),
+        },
+    }
+
+    // The number is taken now so cassettes stay in request order even when
+    // a streamed response finishes after a later request.
+    number := r.reserve()
+
+    resp, err := r.Next.RoundTrip(req)
+    if err != nil {
+        interaction.Response.Error = r.redactString(err.Error())
+        if writeErr := r.write(number, interaction); writeErr != nil {
+            return nil, writeErr
+        }
+        return nil, err
+    }
+
+    interaction.Response = Response{
+        StatusCode: resp.StatusCode,
+        Header:     r.redactHeader(resp.Header),
+    }
+    resp.Body = &recordingBody{
+        body:        resp.Body,
+        recorder:    r,
+        number:      number,
+        interaction: interaction,
+    }
+    return resp, nil
+}
+
+func (r *Recorder) reserve() int {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+
+    r.count++
+    return r.count
+}
+
+func (r *Recorder) write(number int, interaction Interaction) error {
+    name := fmt.Sprintf("%04d-%s-%s.json", number, interaction.Request.Method, slug(interaction.Request.URL))
+    data, err := json.MarshalIndent(interaction, "", "  ")
+    if err != nil {
+        return fmt.Errorf("failed to encode cassette: %w", err)
+    }
+    if err := ioutil.WriteFile(filepath.Join(r.Dir, name), data, 0644); err != nil {
+        return fmt.Errorf("failed to write cassette: %w", err)
+    }
+    return nil
+}
+
+// recordingBody passes a response body through to the caller unchanged,
+// keeping a copy of what was read, and writes the cassette once the body
+// reaches EOF or is closed. Streamed answers therefore reach the caller as
+// they arrive instead of after the server has finished.
+type recordingBody struct {
+    body        io.ReadCloser
+    recorder    *Recorder
+    number      int
+    interaction Interaction
+
+    buf   bytes.Buffer
+    saved bool
+}
+
+func (b *recordingBody) Read(p []byte) (int, error) {
+    n, err := b.body.Read(p)
+    b.buf.Write(p[:n])
+    if err == io.EOF {
+        if saveErr := b.save(); saveErr != nil {
+            return n, saveErr
+        }
+    }
+    return n, err
+}
+
+func (b *recordingBody) Close() error {
+    err := b.body.Close()
+    if saveErr := b.save(); saveErr != nil {
+        return saveErr
+    }
+    return err
+}
+
+func (b *recordingBody) save() error {
+    if b.saved {
+        return nil
+    }
+    b.saved = true
+    b.interaction.Response.Body = b.recorder.redactBody(b.buf.Bytes())
+    return b.recorder.write(b.number, b.interaction)
+}
+
+// Replayer is an http.RoundTripper that answers from recorded cassettes
+// instead of the network. Requests are matched in recording order by method
+// and path; each cassette is used once.
+type Replayer struct {
+    mu           sync.Mutex
+    interactions []Interaction
+    used         []bool
+}
+
+// NewReplayer loads every cassette in dir.
+func NewReplayer(dir string) (*Replayer, error) {
+    files, err := cassetteFiles(dir)
+    if err != nil {
+        return nil, err
+    }
+    if len(files) == 0 {
+        return nil, fmt.Errorf("no cassettes found in %s", dir)
+    }
+
+    replayer := &Replayer{}
+    for _, file := range files {
+        data, err := ioutil.ReadFile(file)
+        if err != nil {
+            return nil, fmt.Errorf("failed to read cassette: %w", err)
+        }
+        var interaction Interaction
+        if err := json.Unmarshal(data, &interaction); err != nil {
+            return nil, fmt.Errorf("failed to decode cassette %s: %w", filepath.Base(file), err)
+        }
+        replayer.interactions = append(replayer.interactions, interaction)
+    }
+    replayer.used = make([]bool, len(replayer.interactions))
+    return replayer, nil
+}
+
+// RoundTrip implements http.RoundTripper.
+func (r *Replayer) RoundTrip(req *http.Request) (*http.Response, error) {
+    if req.Body != nil {
+        req.Body.Close()
+    }
+
+    r.mu.Lock()
+    defer r.mu.Unlock()
+
+    for i, interaction := range r.interactions {
+        if r.used[i] || interaction.Request.Method != req.Method || recordedPath(interaction.Request.URL) != req.URL.Path {
+            continue
+        }
+        r.used[i] = true
+
+        if interaction.Response.Error != "" {
+            return nil, fmt.Errorf("replayed error: %s", interaction.Response.Error)
+        }
+        header := interaction.Response.Header.Clone()
+        if header == nil {
+            header = http.Header{}
+        }
+        // Redaction may have changed the body length.
+        header.Del("Content-Length")
+        return &http.Response{
+            Status:        fmt.Sprintf("%d %s", interaction.Response.StatusCode, http.StatusText(interaction.Response.StatusCode)),
+            StatusCode:    interaction.Response.StatusCode,
+            Proto:         "HTTP/1.1",
+            ProtoMajor:    1,
+            ProtoMinor:    1,
+            Header:        header,
+            Body:          io.NopCloser(strings.NewReader(interaction.Response.Body)),
+            ContentLength: int64(len(interaction.Response.Body)),
+            Request:       req,
+        }, nil
+    }
+
+    return nil, fmt.Errorf("no recorded response for %s %s", req.Method, req.URL.Path)
+}
+
+// cassetteFiles lists the cassettes in dir in recording order.
+func cassetteFiles(dir string) ([]string, error) {
+    files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+    if err != nil {
+        return nil, err
+    }
+    sort.Strings(files)
+    return files, nil
+}
+
+func recordedPath(rawURL string) string {
+    parsed, err := url.Parse(rawURL)
+    if err != nil {
+        return rawURL
+    }
+    return parsed.Path
+}
+
+// slug turns the path of rawURL into a filename fragment.
+func slug(rawURL string) string {
+    path := strings.Trim(recordedPath(rawURL), "/")
+    if path == "" {
+        return "root"
+    }
+    return strings.NewReplacer("/", "_", ".", "_").Replace(path)
+}
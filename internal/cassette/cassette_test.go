@@ -0,0 +1,149 @@
+package cassette
+
+import (
+    "io"
+    "io/ioutil"
+    "net/http"
+    "net/http/httptest"
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestRedactBody_Streams(t *testing.T) {
+    r := &Recorder{}
+    for name, body := range map[string]string{
+        "sse":    "data: {\"token\": \"Hello\"}\n\ndata: {\"session_token\": \"abc123\"}\n\ndata: [DONE]\n\n",
+        "ndjson": "{\"token\": \"Hello\"}\n{\"session_token\": \"abc123\"}\n",
+    } {
+        got := r.redactBody([]byte(body))
+        if strings.Contains(got, "abc123") || !strings.Contains(got, `"token":"Hello"`) {
+            t.Errorf("Expected only the secret to be redacted from the %s stream, got:\n%s", name, got)
+        }
+    }
+}
+
+func TestRecordAndReplay(t *testing.T) {
+    server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Type", "application/json")
+        io.WriteString(w, `{"openai_response": "answer", "echo_key": "sk-secret"}`)
+    }))
+    defer server.Close()
+
+    dir := t.TempDir()
+    recorder, err := NewRecorder(dir, http.DefaultTransport, "sk-secret", "ghp_secret")
+    if err != nil {
+        t.Fatalf("NewRecorder() failed: %v", err)
+    }
+
+    body := `{"prompt": "hi", "api_key": "sk-secret", "codehost_api_key": "ghp_secret", "token": "kept"}`
+    req, _ := http.NewRequest(http.MethodPost, server.URL+"/generate-response?api_key=sk-secret", strings.NewReader(body))
+    req.Header.Set("X-Gateway-Key", "gateway-secret")
+    resp, err := (&http.Client{Transport: recorder}).Do(req)
+    if err != nil {
+        t.Fatalf("Recorded request failed: %v", err)
+    }
+    live, _ := io.ReadAll(resp.Body)
+    resp.Body.Close()
+
+    files, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+    if len(files) != 1 || filepath.Base(files[0]) != "0001-POST-generate-response.json" {
+        t.Fatalf("Expected one cassette, got: %v", files)
+    }
+    cassette, _ := ioutil.ReadFile(files[0])
+    for _, secret := range []string{"sk-secret", "ghp_secret", "gateway-secret"} {
+        if strings.Contains(string(cassette), secret) {
+            t.Errorf("Expected %q to be redacted from the cassette:\n%s", secret, cassette)
+        }
+    }
+    if !strings.Contains(string(cassette), `\"token\":\"kept\"`) {
+        t.Errorf("Expected non-secret keys to be kept:\n%s", cassette)
+    }
+
+    replayer, err := NewReplayer(dir)
+    if err != nil {
+        t.Fatalf("NewReplayer() failed: %v", err)
+    }
+    server.Close()
+
+    req, _ = http.NewRequest(http.MethodPost, "http://offline.invalid/generate-response", strings.NewReader(body))
+    resp, err = (&http.Client{Transport: replayer}).Do(req)
+    if err != nil {
+        t.Fatalf("Replayed request failed: %v", err)
+    }
+    replayed, _ := io.ReadAll(resp.Body)
+    resp.Body.Close()
+
+    if resp.StatusCode != http.StatusOK || !strings.Contains(string(replayed), `"openai_response":"answer"`) {
+        t.Errorf("Unexpected replayed response %d: %s", resp.StatusCode, replayed)
+    }
+    if strings.Contains(string(live), "REDACTED") {
+        t.Errorf("Expected the live response to be passed through untouched")
+    }
+
+    if _, err := (&http.Client{Transport: replayer}).Do(req); err == nil {
+        t.Errorf("Expected each cassette to be replayed only once")
+    }
+}
+
+func TestRecorder_Streams(t *testing.T) {
+    release := make(chan struct{})
+    server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Type", "text/event-stream")
+        io.WriteString(w, "data: {\"token\": \"Hello\"}\n\n")
+        w.(http.Flusher).Flush()
+        <-release
+        io.WriteString(w, "data: [DONE]\n\n")
+    }))
+    defer server.Close()
+    defer close(release)
+
+    dir := t.TempDir()
+    recorder, err := NewRecorder(dir, http.DefaultTransport)
+    if err != nil {
+        t.Fatalf("NewRecorder() failed: %v", err)
+    }
+
+    done := make(chan *http.Response)
+    go func() {
+        resp, err := (&http.Client{Transport: recorder}).Get(server.URL + "/generate-response")
+        if err != nil {
+            t.Errorf("Recorded request failed: %v", err)
+        }
+        done <- resp
+    }()
+
+    var resp *http.Response
+    select {
+    case resp = <-done:
+    case <-time.After(5 * time.Second):
+        t.Fatalf("Expected the response before the server finished the stream")
+    }
+    if resp == nil {
+        return
+    }
+    defer resp.Body.Close()
+
+    first := make([]byte, len("data: {\"token\": \"Hello\"}\n\n"))
+    if _, err := io.ReadFull(resp.Body, first); err != nil {
+        t.Fatalf("Failed to read the first chunk: %v", err)
+    }
+    if files, _ := filepath.Glob(filepath.Join(dir, "*.json")); len(files) != 0 {
+        t.Errorf("Expected no cassette before the stream ends, got: %v", files)
+    }
+
+    release <- struct{}{}
+    if _, err := io.ReadAll(resp.Body); err != nil {
+        t.Fatalf("Failed to read the rest of the stream: %v", err)
+    }
+
+    files, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+    if len(files) != 1 {
+        t.Fatalf("Expected one cassette after the stream ends, got: %v", files)
+    }
+    cassette, _ := ioutil.ReadFile(files[0])
+    if !strings.Contains(string(cassette), "Hello") || !strings.Contains(string(cassette), "[DONE]") {
+        t.Errorf("Expected the whole stream in the cassette:\n%s", cassette)
+    }
+}
@@ -0,0 +1,114 @@
+package cassette
+
+import (
+    "encoding/json"
+    "net/http"
+    "net/url"
+    "strings"
+)
+
+// isSecretName reports whether a header, query parameter or JSON key holds a
+// credential. The match is deliberately narrow so answer text streamed under
+// a "token" key is kept.
+func isSecretName(name string) bool {
+    name = strings.ToLower(strings.ReplaceAll(name, "-", "_"))
+    switch {
+    case name == "authorization", name == "proxy_authorization", name == "cookie", name == "set_cookie":
+        return true
+    case strings.HasSuffix(name, "_key"), strings.HasSuffix(name, "_token"), strings.HasSuffix(name, "_secret"):
+        return true
+    case name == "api_key", name == "apikey", name == "password":
+        return true
+    }
+    return false
+}
+
+// redactString scrubs the recorder's literal secrets from s.
+func (r *Recorder) redactString(s string) string {
+    for _, secret := range r.Secrets {
+        if secret != "" {
+            s = strings.ReplaceAll(s, secret, Redacted)
+        }
+    }
+    return s
+}
+
+func (r *Recorder) redactHeader(header http.Header) http.Header {
+    if len(header) == 0 {
+        return nil
+    }
+    out := make(http.Header, len(header))
+    for key, values := range header {
+        for _, value := range values {
+            if isSecretName(key) {
+                value = Redacted
+            }
+            out[key] = append(out[key], r.redactString(value))
+        }
+    }
+    return out
+}
+
+func (r *Recorder) redactURL(u *url.URL) string {
+    redacted := *u
+    if redacted.User != nil {
+        redacted.User = url.User(Redacted)
+    }
+    query := redacted.Query()
+    for key := range query {
+        if isSecretName(key) {
+            query.Set(key, Redacted)
+        }
+    }
+    redacted.RawQuery = query.Encode()
+    return r.redactString(redacted.String())
+}
+
+// redactBody scrubs secret keys from JSON bodies, including each event of a
+// server-sent event stream and each line of an NDJSON stream, and literal
+// secrets from everything else.
+func (r *Recorder) redactBody(body []byte) string {
+    if len(body) == 0 {
+        return ""
+    }
+
+    var value interface{}
+    if err := json.Unmarshal(body, &value); err == nil {
+        if data, err := json.Marshal(redactJSON(value)); err == nil {
+            return r.redactString(string(data))
+        }
+    }
+
+    lines := strings.Split(string(body), "\n")
+    for i, line := range lines {
+        prefix, payload := "", line
+        if strings.HasPrefix(line, "data:") {
+            prefix, payload = "data: ", strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+        }
+        var value interface{}
+        if err := json.Unmarshal([]byte(payload), &value); err == nil {
+            if data, err := json.Marshal(redactJSON(value)); err == nil {
+                lines[i] = prefix + string(data)
+            }
+        }
+    }
+    return r.redactString(strings.Join(lines, "\n"))
+}
+
+func redactJSON(value interface{}) interface{} {
+    switch v := value.(type) {
+    case map[string]interface{}:
+        for key, item := range v {
+            if isSecretName(key) && item != nil {
+                v[key] = Redacted
+                continue
+            }
+            v[key] = redactJSON(item)
+        }
+    case []interface{}:
+        for i, item := range v {
+            v[i] = redactJSON(item)
+        }
+    }
+    return value
+}
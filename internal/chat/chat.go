@@ -0,0 +1,301 @@
+// Package chat reads and writes the markdown chat files saved under
+// .machtiani/chat. A chat is a sequence of "# User" and "# Assistant"
+// sections; an assistant section may be followed by a "# Retrieved File
+// Paths" list of the files the answer was based on. Chats saved by this
+// version start with YAML front matter describing how the latest answer was
+// produced.
+package chat
+
+import (
+    "reflect"
+    "strings"
+    "time"
+
+    "gopkg.in/yaml.v2"
+)
+
+// Roles of the turns of a conversation.
+const (
+    User      = "user"
+    Assistant = "assistant"
+)
+
+// Section headings of a chat file.
+const (
+    userHeading      = "# User"
+    assistantHeading = "# Assistant"
+    retrievedHeading = "# Retrieved File Paths"
+)
+
+// Turn is one message of a conversation.
+type Turn struct {
+    Role               string   `json:"role"`
+    Content            string   `json:"content"`
+    RetrievedFilePaths []string `json:"retrieved_file_paths,omitempty"` // files the answer was based on; assistant turns only
+}
+
+// Transcript is a whole conversation, oldest turn first.
+type Transcript struct {
+    Meta  *Metadata // nil for chats saved without front matter
+    Turns []Turn
+}
+
+// Metadata is the front matter of a chat file. It records what is needed to
+// reproduce or audit the latest answer: the client and settings that asked
+// for it, and the state of the code it was based on. TotalUsage adds up the
+// tokens of every answer saved to the chat.
+type Metadata struct {
+    ClientVersion   string    `yaml:"client_version,omitempty" json:"client_version,omitempty"` // HeadOID of the client
+    Model           string    `yaml:"model,omitempty" json:"model,omitempty"`
+    Mode            string    `yaml:"mode,omitempty" json:"mode,omitempty"`
+    MatchStrength   string    `yaml:"match_strength,omitempty" json:"match_strength,omitempty"`
+    RemoteURL       string    `yaml:"remote_url,omitempty" json:"remote_url,omitempty"`
+    Branch          string    `yaml:"branch,omitempty" json:"branch,omitempty"`
+    HeadSHA         string    `yaml:"head_sha,omitempty" json:"head_sha,omitempty"`
+    DirtyWorktree   bool      `yaml:"dirty_worktree" json:"dirty_worktree"` // uncommitted changes to tracked files
+    Created         time.Time `yaml:"created" json:"created"`
+    Updated         time.Time `yaml:"updated" json:"updated"`
+    TotalUsage      Usage     `yaml:"total_usage" json:"total_usage"`             // all answers of the chat
+    ServerLatencyMS int64     `yaml:"server_latency_ms" json:"server_latency_ms"` // latest answer
+}
+
+// Usage counts the tokens the server reported for the answers of a chat.
+type Usage struct {
+    PromptTokens     int `yaml:"prompt_tokens" json:"prompt_tokens"`
+    CompletionTokens int `yaml:"completion_tokens" json:"completion_tokens"`
+    EmbeddingTokens  int `yaml:"embedding_tokens" json:"embedding_tokens"`
+    TotalTokens      int `yaml:"total_tokens" json:"total_tokens"`
+}
+
+// frontMatterDelimiter opens and closes the front matter.
+const frontMatterDelimiter = "---"
+
+// Parse reads a chat file. Only the three section headings are recognized,
+// so answers may use their own "#" headings, and headings inside fenced code
+// blocks are content. Text before the first heading is a user turn, which
+// lets a plain question be used as a chat file. A leading block between "---"
+// lines is front matter, and left out of the conversation, only if it decodes
+// into Metadata; otherwise it is content, such as a question that opens with
+// a horizontal rule, and Meta is left nil.
+func Parse(markdown string) Transcript {
+    var t Transcript
+    var section string // heading of the section being read, "" before the first
+    var lines []string
+    fence := ""
+
+    markdown = strings.ReplaceAll(markdown, "\r\n", "\n")
+    if front, body, ok := splitFrontMatter(markdown); ok {
+        if meta, ok := decodeMetadata(front); ok {
+            t.Meta = meta
+            markdown = body
+        }
+    }
+
+    flush := func() {
+        content := trimBlankLines(strings.Join(lines, "\n"))
+        lines = nil
+        switch section {
+        case "":
+            if content != "" {
+                t.Add(User, content)
+            }
+        case userHeading:
+            t.Add(User, content)
+        case assistantHeading:
+            t.Add(Assistant, content)
+        case retrievedHeading:
+            paths := parseList(content)
+            if n := len(t.Turns); n > 0 && t.Turns[n-1].Role == Assistant {
+                t.Turns[n-1].RetrievedFilePaths = append(t.Turns[n-1].RetrievedFilePaths, paths...)
+            }
+        }
+    }
+
+    for _, line := range strings.Split(markdown, "\n") {
+        if fence == "" {
+            if heading, ok := sectionHeading(line); ok {
+                flush()
+                section = heading
+                continue
+            }
+        }
+        fence = updateFence(fence, line)
+        lines = append(lines, line)
+    }
+    flush()
+    return t
+}
+
+// Add appends a turn with content to t.
+func (t *Transcript) Add(role, content string) {
+    t.Turns = append(t.Turns, Turn{Role: role, Content: content})
+}
+
+// Markdown writes t in the format Parse reads, ending with a newline: the
+// front matter, if t has metadata, followed by the Body.
+func (t Transcript) Markdown() string {
+    body := t.Body()
+    if t.Meta == nil {
+        return body
+    }
+    front, err := yaml.Marshal(t.Meta)
+    if err != nil {
+        return body // Metadata holds nothing yaml cannot encode
+    }
+    markdown := frontMatterDelimiter + "\n" + string(front) + frontMatterDelimiter + "\n"
+    if body != "" {
+        markdown += "\n" + body
+    }
+    return markdown
+}
+
+// Body writes the conversation of t without its front matter, for showing it
+// to the user.
+func (t Transcript) Body() string {
+    var sections []string
+    for _, turn := range t.Turns {
+        heading := userHeading
+        if turn.Role == Assistant {
+            heading = assistantHeading
+        }
+        sections = append(sections, heading+"\n\n"+turn.Content)
+        if len(turn.RetrievedFilePaths) > 0 {
+            list := make([]string, len(turn.RetrievedFilePaths))
+            for i, path := range turn.RetrievedFilePaths {
+                list[i] = "- " + path
+            }
+            sections = append(sections, retrievedHeading+"\n\n"+strings.Join(list, "\n"))
+        }
+    }
+    if len(sections) == 0 {
+        return ""
+    }
+    return strings.Join(sections, "\n\n") + "\n"
+}
+
+// Pending splits t into the turns before its final question and the
+// question itself. ok is false if t does not end with a user turn, i.e.
+// there is nothing left to answer.
+func (t Transcript) Pending() (prior []Turn, question string, ok bool) {
+    n := len(t.Turns)
+    if n == 0 || t.Turns[n-1].Role != User || strings.TrimSpace(t.Turns[n-1].Content) == "" {
+        return t.Turns, "", false
+    }
+    return t.Turns[:n-1], t.Turns[n-1].Content, true
+}
+
+// FirstQuestion returns the content of the first user turn, or "".
+func (t Transcript) FirstQuestion() string {
+    for _, turn := range t.Turns {
+        if turn.Role == User {
+            return turn.Content
+        }
+    }
+    return ""
+}
+
+// splitFrontMatter separates the front matter from the rest of markdown. It
+// only recognizes a block that opens on the first line and is closed.
+func splitFrontMatter(markdown string) (front, body string, ok bool) {
+    lines := strings.Split(markdown, "\n")
+    if strings.TrimRight(lines[0], " \t") != frontMatterDelimiter {
+        return "", markdown, false
+    }
+    for i := 1; i < len(lines); i++ {
+        if line := strings.TrimRight(lines[i], " \t"); line == frontMatterDelimiter || line == "..." {
+            return strings.Join(lines[1:i], "\n"), strings.Join(lines[i+1:], "\n"), true
+        }
+    }
+    return "", markdown, false
+}
+
+// decodeMetadata decodes front matter. It must be a YAML mapping with at
+// least one Metadata key that decodes without errors.
+func decodeMetadata(front string) (*Metadata, bool) {
+    var fields map[string]interface{}
+    if err := yaml.Unmarshal([]byte(front), &fields); err != nil {
+        return nil, false
+    }
+    known := false
+    for key := range fields {
+        known = known || metadataKeys[key]
+    }
+    var meta Metadata
+    if !known || yaml.Unmarshal([]byte(front), &meta) != nil {
+        return nil, false
+    }
+    return &meta, true
+}
+
+// metadataKeys are the YAML keys of Metadata.
+var metadataKeys = func() map[string]bool {
+    keys := map[string]bool{}
+    fields := reflect.TypeOf(Metadata{})
+    for i := 0; i < fields.NumField(); i++ {
+        name := strings.Split(fields.Field(i).Tag.Get("yaml"), ",")[0]
+        keys[name] = true
+    }
+    return keys
+}()
+
+// sectionHeading reports whether line is one of the section headings, which
+// are matched regardless of case and surrounding spaces.
+func sectionHeading(line string) (string, bool) {
+    trimmed := strings.TrimSpace(line)
+    for _, heading := range []string{userHeading, assistantHeading, retrievedHeading} {
+        if strings.EqualFold(trimmed, heading) {
+            return heading, true
+        }
+    }
+    return "", false
+}
+
+// updateFence tracks fenced code blocks. fence is the marker of the open
+// block, or "" outside one; the block closes on a line starting with at
+// least as long a run of the same character.
+func updateFence(fence, line string) string {
+    trimmed := strings.TrimLeft(line, " ")
+    if len(line)-len(trimmed) > 3 {
+        return fence // indented code, not a fence
+    }
+    for _, char := range []string{"`", "~"} {
+        run := len(trimmed) - len(strings.TrimLeft(trimmed, char))
+        if run < 3 {
+            continue
+        }
+        switch {
+        case fence == "":
+            return strings.Repeat(char, run)
+        case strings.HasPrefix(fence, char) && run >= len(fence) && strings.TrimSpace(trimmed[run:]) == "":
+            return ""
+        }
+    }
+    return fence
+}
+
+// parseList returns the items of a markdown bullet list.
+func parseList(content string) []string {
+    var items []string
+    for _, line := range strings.Split(content, "\n") {
+        line = strings.TrimSpace(line)
+        for _, bullet := range []string{"- ", "* ", "+ "} {
+            if strings.HasPrefix(line, bullet) {
+                if item := strings.TrimSpace(line[len(bullet):]); item != "" {
+                    items = append(items, item)
+                }
+                break
+            }
+        }
+    }
+    return items
+}
+
+// trimBlankLines removes the blank lines around content and trailing
+// spaces, keeping the indentation of its first line.
+func trimBlankLines(content string) string {
+    lines := strings.Split(content, "\n")
+    for len(lines) > 0 && strings.TrimSpace(lines[0]) == "" {
+        lines = lines[1:]
+    }
+    return strings.TrimRight(strings.Join(lines, "\n"), " \t\n")
+}
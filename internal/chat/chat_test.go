@@ -0,0 +1,119 @@
+package chat
+
+import (
+    "reflect"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestRoundTrip(t *testing.T) {
+    transcripts := []Transcript{
+        {},
+        {Turns: []Turn{{Role: User, Content: "Where is the handler?"}}},
+        {Turns: []Turn{
+            {Role: User, Content: "Where is the handler?"},
+            {Role: Assistant, Content: "# Overview\n\nIn `api.go`:\n\n```markdown\n# User\n\nnot a turn\n```", RetrievedFilePaths: []string{"internal/api/api.go", "README.md"}},
+            {Role: User, Content: "    indented code first\nthen text"},
+            {Role: Assistant, Content: ""},
+            {Role: User, Content: "And the tests?"},
+        }},
+        {Meta: &Metadata{}},
+        {
+            Meta: &Metadata{
+                ClientVersion:   "abc123",
+                Model:           "gpt-4o",
+                Mode:            "commit",
+                RemoteURL:       "https://github.com/example/project.git",
+                HeadSHA:         "0123456789abcdef",
+                DirtyWorktree:   true,
+                Created:         time.Date(2024, 5, 1, 9, 30, 0, 0, time.UTC),
+                Updated:         time.Date(2024, 5, 1, 9, 31, 12, 0, time.UTC),
+                TotalUsage:      Usage{PromptTokens: 1200, CompletionTokens: 300, EmbeddingTokens: 40, TotalTokens: 1540},
+                ServerLatencyMS: 2345,
+            },
+            Turns: []Turn{{Role: User, Content: "---\nnot front matter\n---"}},
+        },
+    }
+    for _, transcript := range transcripts {
+        markdown := transcript.Markdown()
+        parsed := Parse(markdown)
+        if !reflect.DeepEqual(parsed, transcript) {
+            t.Errorf("Parse(Markdown()) changed the transcript:\n got  %#v\n want %#v\nfrom:\n%s", parsed, transcript, markdown)
+        }
+        if again := parsed.Markdown(); again != markdown {
+            t.Errorf("Markdown is not stable:\n%q\n%q", markdown, again)
+        }
+    }
+}
+
+func TestParse(t *testing.T) {
+    // The format saved before chats were parsed, edited by hand.
+    markdown := "Where is the handler?\r\n\r\n" +
+        "# assistant  \n\nIn api.go.\n\n" +
+        "~~~~\n# Assistant\n~~~\nstill code\n~~~~\n\n" +
+        "# Retrieved File Paths\n\n- internal/api/api.go\n* internal/cli/cli.go\nnot a path\n\n" +
+        "# User\n\nAnd the tests?\n"
+    want := Transcript{Turns: []Turn{
+        {Role: User, Content: "Where is the handler?"},
+        {Role: Assistant, Content: "In api.go.\n\n~~~~\n# Assistant\n~~~\nstill code\n~~~~", RetrievedFilePaths: []string{"internal/api/api.go", "internal/cli/cli.go"}},
+        {Role: User, Content: "And the tests?"},
+    }}
+    if got := Parse(markdown); !reflect.DeepEqual(got, want) {
+        t.Errorf("Parse() =\n%#v\nwant\n%#v", got, want)
+    }
+}
+
+func TestParse_FrontMatter(t *testing.T) {
+    markdown := "---\r\nmodel: gpt-4o\r\ntotal_usage:\r\n  total_tokens: 42\r\n---\r\n\r\n# User\r\n\r\nWhere?\r\n"
+    got := Parse(markdown)
+    if got.Meta == nil || got.Meta.Model != "gpt-4o" || got.Meta.TotalUsage.TotalTokens != 42 {
+        t.Errorf("Expected the front matter to be decoded, got %+v", got.Meta)
+    }
+    if len(got.Turns) != 1 || got.Turns[0].Content != "Where?" {
+        t.Errorf("Expected the front matter to be left out of the conversation, got %#v", got.Turns)
+    }
+    if body := got.Body(); strings.Contains(body, "gpt-4o") || !strings.HasPrefix(got.Markdown(), "---\nmodel: gpt-4o\n") {
+        t.Errorf("Expected the front matter in Markdown only, got body:\n%s", body)
+    }
+
+    // A block that does not decode into metadata is content.
+    got = Parse("---\nmodel: [unclosed\n---\n# User\n\nWhere?\n")
+    if got.Meta != nil || len(got.Turns) != 2 || got.Turns[0].Content != "---\nmodel: [unclosed\n---" {
+        t.Errorf("Unexpected parse of invalid front matter: %+v %#v", got.Meta, got.Turns)
+    }
+
+    // So is a question that opens with a horizontal rule.
+    question := "---\nThe build fails after the upgrade.\n---\nWhy?"
+    got = Parse(question + "\n")
+    if got.Meta != nil || len(got.Turns) != 1 || got.Turns[0].Content != question {
+        t.Errorf("Expected the horizontal rules to be kept in the question, got %+v %#v", got.Meta, got.Turns)
+    }
+    question = "---\nError: exit status 1\n---\nWhy?"
+    if got = Parse(question); got.Meta != nil || len(got.Turns) != 1 || got.Turns[0].Content != question {
+        t.Errorf("Expected a block without metadata keys to be kept in the question, got %+v %#v", got.Meta, got.Turns)
+    }
+
+    // Without a closing delimiter there is no front matter.
+    got = Parse("---\nWhere?\n")
+    if got.Meta != nil || len(got.Turns) != 1 || got.Turns[0].Content != "---\nWhere?" {
+        t.Errorf("Unexpected parse of an unclosed block: %+v %#v", got.Meta, got.Turns)
+    }
+}
+
+func TestPending(t *testing.T) {
+    transcript := Parse("# User\n\nWhere?\n\n# Assistant\n\nHere.\n\n# User\n\nWhy?\n")
+    prior, question, ok := transcript.Pending()
+    if !ok || question != "Why?" || len(prior) != 2 || prior[1].Content != "Here." {
+        t.Errorf("Unexpected pending question %q (ok %v) after %#v", question, ok, prior)
+    }
+    if transcript.FirstQuestion() != "Where?" {
+        t.Errorf("Unexpected first question %q", transcript.FirstQuestion())
+    }
+
+    for _, markdown := range []string{"", "# User\n\nWhere?\n\n# Assistant\n\nHere.\n", "# User\n\n"} {
+        if _, _, ok := Parse(markdown).Pending(); ok {
+            t.Errorf("Expected no pending question in %q", markdown)
+        }
+    }
+}
@@ -0,0 +1,300 @@
+package chat
+
+import (
+    "fmt"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "sort"
+    "strings"
+    "time"
+    "unicode/utf8"
+
+    "github.com/7db9a/machtiani/internal/utils"
+)
+
+// Library is the directory of saved chats, one markdown file per chat.
+type Library struct {
+    Dir string
+}
+
+// Entry is a saved chat.
+type Entry struct {
+    Name       string // file name without the .md extension
+    Path       string
+    Modified   time.Time
+    Transcript Transcript
+}
+
+// List returns the chats in the library, most recently modified first. A
+// missing directory is an empty library.
+func (l Library) List() ([]Entry, error) {
+    files, err := ioutil.ReadDir(l.Dir)
+    if os.IsNotExist(err) {
+        return nil, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+    var entries []Entry
+    for _, file := range files {
+        if file.IsDir() || filepath.Ext(file.Name()) != ".md" {
+            continue
+        }
+        entry, err := l.load(file.Name())
+        if err != nil {
+            return nil, err
+        }
+        entries = append(entries, entry)
+    }
+    sort.SliceStable(entries, func(i, j int) bool { return entries[i].Modified.After(entries[j].Modified) })
+    return entries, nil
+}
+
+// Load reads the chat called name, which may also be given as a file name
+// or a path inside the library.
+func (l Library) Load(name string) (Entry, error) {
+    file, err := l.file(name)
+    if err != nil {
+        return Entry{}, err
+    }
+    return l.load(file)
+}
+
+// Create saves content as a new chat called name and returns its path. If
+// a chat of that name exists, a counter is added to the name ("name-2")
+// rather than overwriting it.
+func (l Library) Create(name, content string) (string, error) {
+    name, err := checkName(name)
+    if err != nil {
+        return "", err
+    }
+    if err := os.MkdirAll(l.Dir, 0755); err != nil {
+        return "", fmt.Errorf("failed to create directory: %w", err)
+    }
+    for n := 1; ; n++ {
+        candidate := name
+        if n > 1 {
+            candidate = fmt.Sprintf("%s-%d", name, n)
+        }
+        path := filepath.Join(l.Dir, candidate+".md")
+        // Claiming the name first keeps two saves from picking the same one.
+        file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+        if os.IsExist(err) {
+            continue
+        }
+        if err != nil {
+            return "", err
+        }
+        file.Close()
+        if err := utils.WriteFileAtomic(path, []byte(content), 0644); err != nil {
+            os.Remove(path)
+            return "", err
+        }
+        return path, nil
+    }
+}
+
+// Remove deletes the chat called name and returns its path.
+func (l Library) Remove(name string) (string, error) {
+    file, err := l.file(name)
+    if err != nil {
+        return "", err
+    }
+    path := filepath.Join(l.Dir, file)
+    return path, os.Remove(path)
+}
+
+// Rename gives the chat called name the name newName and returns its new
+// path. It refuses to overwrite another chat.
+func (l Library) Rename(name, newName string) (string, error) {
+    file, err := l.file(name)
+    if err != nil {
+        return "", err
+    }
+    newName, err = checkName(newName)
+    if err != nil {
+        return "", err
+    }
+    target := filepath.Join(l.Dir, newName+".md")
+    if _, err := os.Stat(target); err == nil {
+        return "", fmt.Errorf("a chat named %q already exists", newName)
+    }
+    return target, os.Rename(filepath.Join(l.Dir, file), target)
+}
+
+// checkName returns name without a .md extension, or an error if it is not
+// a plain file name that would be listed.
+func checkName(name string) (string, error) {
+    name = strings.TrimSuffix(name, ".md")
+    if name == "" || name != filepath.Base(name) || strings.HasPrefix(name, ".") {
+        return "", fmt.Errorf("invalid chat name %q: use a plain file name", name)
+    }
+    return name, nil
+}
+
+// file resolves name to the file name of a chat in the library.
+func (l Library) file(name string) (string, error) {
+    base := filepath.Base(strings.TrimSuffix(name, ".md")) + ".md"
+    if dir := filepath.Dir(name); dir != "." && filepath.Clean(dir) != filepath.Clean(l.Dir) {
+        return "", fmt.Errorf("%s is not in the chat directory %s", name, l.Dir)
+    }
+    if _, err := os.Stat(filepath.Join(l.Dir, base)); err == nil {
+        return base, nil
+    }
+
+    message := fmt.Sprintf("no chat named %q in %s", strings.TrimSuffix(base, ".md"), l.Dir)
+    entries, _ := l.List()
+    var names []string
+    for _, entry := range entries {
+        names = append(names, entry.Name)
+    }
+    if suggestion := utils.Suggest(strings.TrimSuffix(base, ".md"), names); suggestion != "" {
+        message += fmt.Sprintf("; did you mean %q?", suggestion)
+    }
+    return "", fmt.Errorf("%s", message)
+}
+
+func (l Library) load(file string) (Entry, error) {
+    path := filepath.Join(l.Dir, file)
+    info, err := os.Stat(path)
+    if err != nil {
+        return Entry{}, err
+    }
+    content, err := ioutil.ReadFile(path)
+    if err != nil {
+        return Entry{}, err
+    }
+    return Entry{
+        Name:       strings.TrimSuffix(file, ".md"),
+        Path:       path,
+        Modified:   info.ModTime(),
+        Transcript: Parse(string(content)),
+    }, nil
+}
+
+// Match is a chat found by Search.
+type Match struct {
+    Entry
+    Score    float64
+    Snippets []Snippet
+}
+
+// Snippet is an excerpt of a chat around a match. Highlights are the byte
+// ranges of Text where the query terms occur.
+type Snippet struct {
+    Text       string
+    Highlights [][2]int
+}
+
+// maxSnippets bounds the excerpts returned for each match.
+const maxSnippets = 3
+
+// Search finds the chats that contain every word of query, ignoring case.
+// Matches are ranked by how often the words occur, counting questions twice
+// as much as answers and rewarding occurrences of the whole query, with
+// ties going to the most recent chat.
+func (l Library) Search(query string) ([]Match, error) {
+    terms := strings.Fields(strings.ToLower(query))
+    if len(terms) == 0 {
+        return nil, fmt.Errorf("the search query is empty")
+    }
+    phrase := strings.Join(terms, " ")
+
+    entries, err := l.List()
+    if err != nil {
+        return nil, err
+    }
+    var matches []Match
+    for _, entry := range entries {
+        match := Match{Entry: entry}
+        found := make(map[string]bool)
+        for _, turn := range entry.Transcript.Turns {
+            weight := 1.0
+            if turn.Role == User {
+                weight = 2
+            }
+            content := strings.ToLower(strings.Join(strings.Fields(turn.Content), " "))
+            hits := 0
+            for _, term := range terms {
+                if n := strings.Count(content, term); n > 0 {
+                    found[term] = true
+                    hits += n
+                }
+            }
+            if len(terms) > 1 {
+                hits += 3 * strings.Count(content, phrase)
+            }
+            match.Score += weight * float64(hits)
+            if hits > 0 && len(match.Snippets) < maxSnippets {
+                match.Snippets = append(match.Snippets, snippet(turn.Content, terms))
+            }
+        }
+        if len(found) == len(terms) {
+            matches = append(matches, match)
+        }
+    }
+    sort.SliceStable(matches, func(i, j int) bool { return matches[i].Score > matches[j].Score })
+    return matches, nil
+}
+
+// snippetRadius is how many characters of context a snippet keeps on each
+// side of the first match.
+const snippetRadius = 60
+
+// snippet excerpts content around the first occurrence of any of terms,
+// flattened to a single line.
+func snippet(content string, terms []string) Snippet {
+    text := strings.Join(strings.Fields(content), " ")
+    lower := strings.ToLower(text)
+    if len(lower) != len(text) {
+        // Lowercasing changed byte offsets; show the start without highlights.
+        return Snippet{Text: truncate(text, 2*snippetRadius)}
+    }
+
+    first := len(text)
+    for _, term := range terms {
+        if i := strings.Index(lower, term); i >= 0 && i < first {
+            first = i
+        }
+    }
+    start, end := first-snippetRadius, first+snippetRadius
+    prefix, suffix := "…", "…"
+    if start <= 0 {
+        start, prefix = 0, ""
+    }
+    if end >= len(text) {
+        end, suffix = len(text), ""
+    }
+    for start > 0 && !utf8.RuneStart(text[start]) {
+        start--
+    }
+    for end < len(text) && !utf8.RuneStart(text[end]) {
+        end++
+    }
+
+    s := Snippet{Text: prefix + text[start:end] + suffix}
+    excerpt := lower[start:end]
+    for i := 0; i < len(excerpt); {
+        best, length := -1, 0
+        for _, term := range terms {
+            if j := strings.Index(excerpt[i:], term); j >= 0 && (best < 0 || j < best || (j == best && len(term) > length)) {
+                best, length = j, len(term)
+            }
+        }
+        if best < 0 {
+            break
+        }
+        from := len(prefix) + i + best
+        s.Highlights = append(s.Highlights, [2]int{from, from + length})
+        i += best + length
+    }
+    return s
+}
+
+func truncate(text string, limit int) string {
+    if utf8.RuneCountInString(text) <= limit {
+        return text
+    }
+    return string([]rune(text)[:limit]) + "…"
+}
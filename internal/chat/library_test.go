@@ -0,0 +1,139 @@
+package chat
+
+import (
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+)
+
+func newTestLibrary(t *testing.T, chats map[string]string) Library {
+    library := Library{Dir: filepath.Join(t.TempDir(), "chat")}
+    if err := os.MkdirAll(library.Dir, 0755); err != nil {
+        t.Fatal(err)
+    }
+    modified := time.Now().Add(-time.Hour)
+    for name, content := range chats {
+        path := filepath.Join(library.Dir, name)
+        if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+            t.Fatal(err)
+        }
+        // Name order is age order: "a" is the oldest.
+        stamp := modified.Add(time.Duration(name[0]) * time.Minute)
+        os.Chtimes(path, stamp, stamp)
+    }
+    return library
+}
+
+func TestLibrary(t *testing.T) {
+    library := newTestLibrary(t, map[string]string{
+        "a_handler.md": "# User\n\nWhere is the handler?\n\n# Assistant\n\nIn api.go.\n",
+        "b_sync.md":    "# User\n\nWhy does sync fail?\n",
+        "notes.txt":    "not a chat",
+    })
+
+    entries, err := library.List()
+    if err != nil {
+        t.Fatalf("Unexpected error: %v", err)
+    }
+    if len(entries) != 2 || entries[0].Name != "b_sync" || entries[1].Transcript.FirstQuestion() != "Where is the handler?" {
+        t.Fatalf("Expected the two chats newest first, got %+v", entries)
+    }
+
+    for _, name := range []string{"a_handler", "a_handler.md", filepath.Join(library.Dir, "a_handler.md")} {
+        if entry, err := library.Load(name); err != nil || entry.Name != "a_handler" {
+            t.Errorf("Load(%q) = %+v, %v", name, entry, err)
+        }
+    }
+    if _, err := library.Load("a_handlr"); err == nil || !strings.Contains(err.Error(), `did you mean "a_handler"?`) {
+        t.Errorf("Expected a suggestion for a misspelled chat, got %v", err)
+    }
+    if _, err := library.Load("../a_handler"); err == nil {
+        t.Errorf("Expected a chat outside the library to be refused")
+    }
+
+    if _, err := library.Rename("a_handler", "b_sync"); err == nil {
+        t.Errorf("Expected renaming over another chat to fail")
+    }
+    if _, err := library.Rename("a_handler", "../escape"); err == nil {
+        t.Errorf("Expected a name with a path to be refused")
+    }
+    path, err := library.Rename("a_handler", "handler.md")
+    if err != nil || path != filepath.Join(library.Dir, "handler.md") {
+        t.Fatalf("Rename() = %q, %v", path, err)
+    }
+
+    if _, err := library.Remove("handler"); err != nil {
+        t.Fatalf("Unexpected error: %v", err)
+    }
+    if entries, _ := library.List(); len(entries) != 1 {
+        t.Errorf("Expected one chat left, got %+v", entries)
+    }
+
+    if entries, err := (Library{Dir: filepath.Join(library.Dir, "missing")}).List(); err != nil || len(entries) != 0 {
+        t.Errorf("Expected a missing directory to be an empty library, got %v, %v", entries, err)
+    }
+}
+
+func TestCreate(t *testing.T) {
+    library := Library{Dir: filepath.Join(t.TempDir(), "chat")}
+
+    var paths []string
+    for _, content := range []string{"first", "second", "third"} {
+        path, err := library.Create("question", content)
+        if err != nil {
+            t.Fatalf("Unexpected error: %v", err)
+        }
+        paths = append(paths, filepath.Base(path))
+    }
+    if strings.Join(paths, ",") != "question.md,question-2.md,question-3.md" {
+        t.Errorf("Expected a counter for names in use, got %v", paths)
+    }
+    if content, _ := ioutil.ReadFile(filepath.Join(library.Dir, "question.md")); string(content) != "first" {
+        t.Errorf("Expected the first chat to be kept, got %q", content)
+    }
+
+    if files, _ := ioutil.ReadDir(library.Dir); len(files) != 3 {
+        t.Errorf("Expected no temporary files to be left, got %d files", len(files))
+    }
+    if _, err := library.Create("../outside", "x"); err == nil {
+        t.Errorf("Expected a name with a path to be refused")
+    }
+}
+
+func TestSearch(t *testing.T) {
+    library := newTestLibrary(t, map[string]string{
+        "a_answer.md":   "# User\n\nHow do we deploy?\n\n# Assistant\n\nThe sync handler retries until the deploy succeeds.\n",
+        "b_question.md": "# User\n\nWhy does the sync handler fail?\n\n# Assistant\n\nIt times out.\n",
+        "c_partial.md":  "# User\n\nWhat does sync do?\n",
+    })
+
+    matches, err := library.Search("Sync  HANDLER")
+    if err != nil {
+        t.Fatalf("Unexpected error: %v", err)
+    }
+    if len(matches) != 2 || matches[0].Name != "b_question" || matches[1].Name != "a_answer" {
+        t.Fatalf("Expected the chat asking about it to rank first, got %+v", matches)
+    }
+
+    s := matches[1].Snippets[0]
+    var highlighted []string
+    for _, h := range s.Highlights {
+        highlighted = append(highlighted, s.Text[h[0]:h[1]])
+    }
+    if strings.Join(highlighted, ",") != "sync,handler" {
+        t.Errorf("Expected sync and handler to be highlighted in %q, got %q", s.Text, highlighted)
+    }
+
+    long := strings.Repeat("word ", 40) + "needle " + strings.Repeat("word ", 40)
+    s = snippet(long, []string{"needle"})
+    if !strings.HasPrefix(s.Text, "…") || !strings.HasSuffix(s.Text, "…") || s.Text[s.Highlights[0][0]:s.Highlights[0][1]] != "needle" {
+        t.Errorf("Expected an excerpt around the match, got %q %v", s.Text, s.Highlights)
+    }
+
+    if _, err := library.Search("  "); err == nil {
+        t.Errorf("Expected an empty query to be refused")
+    }
+}
@@ -0,0 +1,259 @@
+package cli
+
+import (
+    "bufio"
+    "context"
+    "fmt"
+    "io"
+    "log"
+    "strings"
+
+    "github.com/7db9a/machtiani/internal/api"
+    "github.com/7db9a/machtiani/internal/chat"
+    "github.com/7db9a/machtiani/internal/utils"
+)
+
+// chatHelp lists the commands understood inside a chat session.
+const chatHelp = `Commands:
+  /model [name]            Show or switch the model (gpt-4o, gpt-4o-mini).
+  /mode [mode]             Show or switch the search mode (pure-chat, commit, super).
+  /match-strength [level]  Show or switch the match strength (high, mid, low).
+  /files                   List the files retrieved for the last answer.
+  /save [name]             Save the session, as a new chat called <name> if a name is given.
+  /exit                    Save the session and leave. Ctrl-D does the same.
+`
+
+// chatSession is a conversation kept in a markdown file in the chat
+// directory, in the same format as the chats saved by prompts.
+type chatSession struct {
+    opts       promptOptions
+    remoteURL  string
+    transcript chat.Transcript
+    saver      *chatSaver
+    filename   string   // name of a new chat without extension; "" until the first answer
+    path       string   // where the session was last saved
+    retrieved  []string // files retrieved for the last answer
+    turns      int
+}
+
+// chatResult is the JSON document of a chat session.
+type chatResult struct {
+    ChatFile string `json:"chat_file,omitempty"`
+    Turns    int    `json:"turns"`
+    Model    string `json:"model"`
+    Mode     string `json:"mode"`
+}
+
+// handleChat runs a chat session, reading one question per line from in
+// until /exit or the end of input. Each question is sent along with the
+// conversation before it, and the session is saved after every answer.
+func handleChat(ctx context.Context, out *output, in io.Reader, client *api.Client, opts promptOptions, config *utils.Config, remoteURL string) error {
+    if opts.inPlace && opts.file == "" {
+        return fmt.Errorf("--in-place needs --file")
+    }
+    session := &chatSession{opts: opts, remoteURL: remoteURL, saver: newChatSaver(config, opts.file, opts.inPlace)}
+    if opts.file != "" {
+        content, err := readMarkdownFile(opts.file)
+        if err != nil {
+            return err
+        }
+        session.transcript = chat.Parse(content)
+        session.filename = chatFilename(opts.file)
+    }
+
+    interactive := utils.IsTerminal(in)
+    out.Printf("Chatting about %s with %s in %s mode. Type /help for commands.\n", remoteURL, opts.model, opts.mode)
+
+    // Lines are read in the background so Ctrl-C ends the session even while
+    // it waits for input.
+    lines := make(chan string)
+    scanErr := make(chan error, 1)
+    go func() {
+        defer close(lines)
+        scanner := bufio.NewScanner(in)
+        scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+        for scanner.Scan() {
+            lines <- scanner.Text()
+        }
+        scanErr <- scanner.Err()
+    }()
+
+    for {
+        if interactive {
+            out.Printf("> ")
+        }
+        var line string
+        var ok bool
+        select {
+        case <-ctx.Done():
+            out.Println()
+            return ctx.Err()
+        case line, ok = <-lines:
+        }
+        if !ok {
+            if err := <-scanErr; err != nil {
+                return fmt.Errorf("reading input: %w", err)
+            }
+            break
+        }
+
+        line = strings.TrimSpace(line)
+        if line == "" {
+            continue
+        }
+        if strings.HasPrefix(line, "/") {
+            done, err := session.command(out, line)
+            if err != nil {
+                log.Printf("Error: %v", err)
+            }
+            if done {
+                break
+            }
+            continue
+        }
+
+        if err := session.ask(ctx, out, client, config, line); err != nil {
+            if ctx.Err() != nil {
+                return err
+            }
+            // A failed question does not end the session.
+            log.Printf("Error: %v", err)
+        }
+    }
+
+    // Retry a save that failed after the last answer.
+    if session.turns > 0 && session.path == "" {
+        if err := session.save(ctx, client, config); err != nil {
+            return err
+        }
+        out.Printf("Chat saved to %s\n", session.path)
+    }
+    return out.emit(chatResult{ChatFile: session.path, Turns: session.turns, Model: session.opts.model, Mode: session.opts.mode})
+}
+
+// ask sends question with the conversation so far, shows the answer and
+// saves the session. A question that gets no answer is left out of the
+// session.
+func (s *chatSession) ask(ctx context.Context, out *output, client *api.Client, config *utils.Config, question string) error {
+    asked := len(s.transcript.Turns)
+    s.transcript.Add(chat.User, question)
+    apiResponse, _, shown, err := sendPrompt(ctx, out, client, &s.transcript, s.opts, config, s.remoteURL)
+    if err != nil || apiResponse.Machtiani != "" {
+        s.transcript.Turns = s.transcript.Turns[:asked]
+    }
+    if err != nil {
+        return err
+    }
+    if apiResponse.Machtiani != "" {
+        log.Printf("Machtiani Message: %s", apiResponse.Machtiani)
+        return nil
+    }
+
+    s.transcript.Turns = append(s.transcript.Turns, chat.Turn{Role: chat.Assistant, Content: apiResponse.OpenAIResponse, RetrievedFilePaths: apiResponse.RetrievedFilePaths})
+    s.retrieved = apiResponse.RetrievedFilePaths
+    s.turns++
+
+    if !out.json && !shown {
+        if err := renderMarkdown(out, apiResponse.OpenAIResponse); err != nil {
+            return err
+        }
+    }
+
+    previous := s.path
+    if err := s.save(ctx, client, config); err != nil {
+        return err
+    }
+    if s.path != previous {
+        out.Printf("Chat saved to %s\n", s.path)
+    }
+    return nil
+}
+
+// save writes the session to its chat file, asking the server for a name
+// based on the first question if it has none yet.
+func (s *chatSession) save(ctx context.Context, client *api.Client, config *utils.Config) error {
+    if s.saver.path == "" && s.filename == "" {
+        name, err := client.GenerateFilename(ctx, s.transcript.FirstQuestion(), config.Environment.ModelAPIKey)
+        if err != nil {
+            return fmt.Errorf("generating filename: %w", err)
+        }
+        s.filename = name
+    }
+    path, err := s.saver.save(s.filename, s.transcript.Markdown())
+    if err != nil {
+        return fmt.Errorf("saving chat: %w", err)
+    }
+    s.path = path
+    return nil
+}
+
+// command runs an in-session command and reports whether the session is
+// over.
+func (s *chatSession) command(out *output, line string) (bool, error) {
+    fields := strings.Fields(line)
+    name, args := fields[0], fields[1:]
+
+    setting := map[string]struct {
+        target  *string
+        options []string
+    }{
+        "/model":          {&s.opts.model, promptModels},
+        "/mode":           {&s.opts.mode, promptModes},
+        "/match-strength": {&s.opts.matchStrength, promptMatchStrengths},
+    }
+    if choice, ok := setting[name]; ok {
+        flagName := strings.TrimPrefix(name, "/")
+        if len(args) == 0 {
+            out.Printf("%s: %s\n", flagName, *choice.target)
+            return false, nil
+        }
+        if err := utils.CheckChoice(flagName, args[0], choice.options); err != nil {
+            return false, err
+        }
+        *choice.target = args[0]
+        out.Printf("%s set to %s\n", flagName, args[0])
+        return false, nil
+    }
+
+    switch name {
+    case "/help":
+        out.Printf("%s", chatHelp)
+    case "/files":
+        if len(s.retrieved) == 0 {
+            out.Println("No files were retrieved for the last answer.")
+        }
+        for _, path := range s.retrieved {
+            out.Println(path)
+        }
+    case "/save":
+        if len(s.transcript.Turns) == 0 {
+            return false, fmt.Errorf("nothing to save yet")
+        }
+        // Saving needs no server call once the session has a name.
+        var path string
+        var err error
+        switch {
+        case len(args) > 0:
+            s.filename = chatFilename(args[0])
+            path, err = s.saver.saveAs(s.filename, s.transcript.Markdown())
+        case s.saver.path == "" && s.filename == "":
+            return false, fmt.Errorf("the session has no name yet; use /save <name>")
+        default:
+            path, err = s.saver.save(s.filename, s.transcript.Markdown())
+        }
+        if err != nil {
+            return false, fmt.Errorf("saving chat: %w", err)
+        }
+        s.path = path
+        out.Printf("Chat saved to %s\n", path)
+    case "/exit", "/quit":
+        return true, nil
+    default:
+        commands := []string{"/help", "/model", "/mode", "/match-strength", "/files", "/save", "/exit", "/quit"}
+        if suggestion := utils.Suggest(name, commands); suggestion != "" {
+            return false, fmt.Errorf("unknown command %s; did you mean %s?", name, suggestion)
+        }
+        return false, fmt.Errorf("unknown command %s; type /help for the list", name)
+    }
+    return false, nil
+}
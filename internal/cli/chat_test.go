@@ -0,0 +1,94 @@
+package cli
+
+import (
+    "io/ioutil"
+    "os"
+    "strings"
+    "testing"
+
+    "github.com/7db9a/machtiani/internal/chat"
+    "github.com/7db9a/machtiani/internal/testserver"
+)
+
+// withStdin feeds input to the CLI's stdin for the rest of the test.
+func withStdin(t *testing.T, input string) {
+    reader, writer, err := os.Pipe()
+    if err != nil {
+        t.Fatalf("Failed to create pipe: %v", err)
+    }
+    go func() {
+        writer.WriteString(input)
+        writer.Close()
+    }()
+    originalStdin := os.Stdin
+    os.Stdin = reader
+    t.Cleanup(func() {
+        os.Stdin = originalStdin
+        reader.Close()
+    })
+}
+
+func TestChat(t *testing.T) {
+    server := setupProject(t)
+    server.SetAnswer(testserver.Answer{Text: "Use the handler in api.go.", RetrievedFilePaths: []string{"internal/api/api.go"}})
+    server.SetFilename("where_is_the_handler")
+    withStdin(t, "Where is the handler?\n/model gpt-4o\n/files\n/bogus\nAnd the tests?\n/exit\nNever asked\n")
+
+    code, out := runCLI(t, "chat")
+    if code != ExitOK {
+        t.Fatalf("Expected exit code %d, got %d\n%s", ExitOK, code, out)
+    }
+    for _, want := range []string{"model set to gpt-4o", "internal/api/api.go", "Chat saved to .machtiani/chat/where_is_the_handler.md"} {
+        if !strings.Contains(out, want) {
+            t.Errorf("Expected output to contain %q, got:\n%s", want, out)
+        }
+    }
+
+    requests := server.Requests(testserver.PathGenerateResponse)
+    if len(requests) != 2 {
+        t.Fatalf("Expected two questions to be sent, got %d", len(requests))
+    }
+    if requests[0].Body["prompt"] != "Where is the handler?" || requests[0].Body["model"] != defaultModel {
+        t.Errorf("Unexpected first request: %v", requests[0].Body)
+    }
+    messages, _ := requests[1].Body["messages"].([]interface{})
+    if requests[1].Body["model"] != "gpt-4o" || requests[1].Body["prompt"] != "And the tests?" || len(messages) != 2 {
+        t.Errorf("Expected the second question to carry the conversation as messages, got: %v", requests[1].Body)
+    } else if first, _ := messages[0].(map[string]interface{}); first["role"] != "user" || first["content"] != "Where is the handler?" {
+        t.Errorf("Unexpected first message: %v", messages[0])
+    }
+    if got := len(server.Requests(testserver.PathGenerateFilename)); got != 1 {
+        t.Errorf("Expected the session to be named once, got %d calls", got)
+    }
+
+    content, err := ioutil.ReadFile(".machtiani/chat/where_is_the_handler.md")
+    if err != nil {
+        t.Fatalf("Expected the session to be saved: %v", err)
+    }
+    if strings.Count(string(content), "# User") != 2 || strings.Count(string(content), "# Assistant") != 2 {
+        t.Errorf("Expected both turns in the chat file, got:\n%s", content)
+    }
+}
+
+func TestChat_Resume(t *testing.T) {
+    server := setupProject(t)
+    server.SetAnswer(testserver.Answer{Text: "It is in cli_test.go."})
+    ioutil.WriteFile("earlier.md", []byte("# User\n\nWhere is the handler?\n\n# Assistant\n\nIn api.go.\n"), 0644)
+    withStdin(t, "And the tests?\n")
+
+    code, out := runCLI(t, "chat", "--file", "earlier.md", "--mode", "pure-chat")
+    if code != ExitOK {
+        t.Fatalf("Expected exit code %d, got %d\n%s", ExitOK, code, out)
+    }
+    content, err := ioutil.ReadFile(".machtiani/chat/earlier.md")
+    if err != nil {
+        t.Fatalf("Expected the session to be saved under its name: %v", err)
+    }
+    body := chat.Parse(string(content)).Body()
+    if !strings.HasPrefix(body, "# User\n\nWhere is the handler?") || !strings.Contains(body, "# User\n\nAnd the tests?\n\n# Assistant\n\nIt is in cli_test.go.") {
+        t.Errorf("Expected the new turn after the earlier one, got:\n%s", content)
+    }
+    if len(server.Requests(testserver.PathGenerateFilename)) != 0 {
+        t.Errorf("Expected a resumed session to keep its name")
+    }
+}
@@ -0,0 +1,297 @@
+package cli
+
+import (
+    "context"
+    "fmt"
+    "io"
+    "strings"
+    "text/tabwriter"
+    "time"
+
+    "github.com/7db9a/machtiani/internal/api"
+    "github.com/7db9a/machtiani/internal/chat"
+    "github.com/7db9a/machtiani/internal/utils"
+)
+
+// chatsSubcommands are the actions of the chats command.
+var chatsSubcommands = []string{"list", "show", "search", "rename", "rm"}
+
+// chatsOptions are the flags of the chats command.
+type chatsOptions struct {
+    force bool // remove without asking
+    yes   bool // the global --yes
+    in    io.Reader
+}
+
+// chatSummary describes a saved chat in `chats list`.
+type chatSummary struct {
+    Name          string    `json:"name"`
+    Path          string    `json:"path"`
+    Updated       time.Time `json:"updated"`
+    Questions     int       `json:"questions"`
+    Model         string    `json:"model,omitempty"`
+    Mode          string    `json:"mode,omitempty"`
+    Project       string    `json:"project,omitempty"`
+    FirstQuestion string    `json:"first_question"`
+}
+
+// chatDocument is a whole saved chat in `chats show`.
+type chatDocument struct {
+    chatSummary
+    Metadata *chat.Metadata `json:"metadata,omitempty"`
+    Turns    []chat.Turn    `json:"turns"`
+}
+
+// chatMatch is a search result in `chats search`.
+type chatMatch struct {
+    chatSummary
+    Score    float64       `json:"score"`
+    Snippets []chatSnippet `json:"snippets"`
+}
+
+type chatSnippet struct {
+    Text       string   `json:"text"`
+    Highlights [][2]int `json:"highlights"` // byte ranges of Text that match the query
+}
+
+// chatChange reports a chat that was renamed or removed.
+type chatChange struct {
+    Action string `json:"action"`
+    Name   string `json:"name"`
+    Path   string `json:"path"`
+    From   string `json:"from,omitempty"`
+}
+
+// handleChats runs a subcommand of the chats command on the chats saved in
+// library.
+func handleChats(ctx context.Context, out *output, library chat.Library, args []string, opts chatsOptions) error {
+    action, args := args[0], args[1:]
+    want := func(usage string, min, max int) error {
+        if len(args) < min || (max >= 0 && len(args) > max) {
+            return fmt.Errorf("usage: machtiani chats %s %s", action, usage)
+        }
+        return nil
+    }
+
+    switch action {
+    case "list":
+        if err := want("", 0, 0); err != nil {
+            return err
+        }
+        return listChats(out, library)
+    case "show":
+        if err := want("<name>", 1, 1); err != nil {
+            return err
+        }
+        return showChat(out, library, args[0])
+    case "search":
+        if err := want("<query>", 1, -1); err != nil {
+            return err
+        }
+        return searchChats(out, library, strings.Join(args, " "))
+    case "rename":
+        if err := want("<name> <new-name>", 2, 2); err != nil {
+            return err
+        }
+        path, err := library.Rename(args[0], args[1])
+        if err != nil {
+            return err
+        }
+        out.Printf("Renamed %s to %s\n", args[0], path)
+        return out.emit(chatChange{Action: "renamed", Name: strings.TrimSuffix(args[1], ".md"), Path: path, From: args[0]})
+    case "rm":
+        if err := want("<name>...", 1, -1); err != nil {
+            return err
+        }
+        return removeChats(ctx, out, library, args, opts)
+    }
+
+    message := fmt.Sprintf("unknown action %q; must be one of %s", action, strings.Join(chatsSubcommands, ", "))
+    if suggestion := utils.Suggest(action, chatsSubcommands); suggestion != "" {
+        message += fmt.Sprintf("; did you mean %q?", suggestion)
+    }
+    return fmt.Errorf("%s", message)
+}
+
+func listChats(out *output, library chat.Library) error {
+    entries, err := library.List()
+    if err != nil {
+        return fmt.Errorf("listing chats: %w", err)
+    }
+    summaries := []chatSummary{}
+    for _, entry := range entries {
+        summaries = append(summaries, summarizeChat(entry))
+    }
+    if out.json {
+        return out.emit(summaries)
+    }
+    if len(summaries) == 0 {
+        out.Printf("No chats saved in %s.\n", library.Dir)
+        return nil
+    }
+
+    tw := tabwriter.NewWriter(out.stdout, 0, 0, 2, ' ', 0)
+    fmt.Fprintln(tw, "NAME\tUPDATED\tQUESTIONS\tMODEL\tMODE\tPROJECT\tFIRST QUESTION")
+    for _, s := range summaries {
+        fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\t%s\t%s\n", s.Name, s.Updated.Format("2006-01-02 15:04"), s.Questions,
+            orDash(s.Model), orDash(s.Mode), orDash(s.Project), oneLine(s.FirstQuestion, 60))
+    }
+    return tw.Flush()
+}
+
+func showChat(out *output, library chat.Library, name string) error {
+    entry, err := library.Load(name)
+    if err != nil {
+        return err
+    }
+    if out.json {
+        return out.emit(chatDocument{chatSummary: summarizeChat(entry), Metadata: entry.Transcript.Meta, Turns: entry.Transcript.Turns})
+    }
+    return renderMarkdown(out, entry.Transcript.Body())
+}
+
+func searchChats(out *output, library chat.Library, query string) error {
+    matches, err := library.Search(query)
+    if err != nil {
+        return err
+    }
+    results := []chatMatch{}
+    for _, match := range matches {
+        result := chatMatch{chatSummary: summarizeChat(match.Entry), Score: match.Score}
+        for _, s := range match.Snippets {
+            result.Snippets = append(result.Snippets, chatSnippet{Text: s.Text, Highlights: s.Highlights})
+        }
+        results = append(results, result)
+    }
+    if out.json {
+        return out.emit(results)
+    }
+    if len(results) == 0 {
+        out.Printf("No chats in %s match %q.\n", library.Dir, query)
+        return nil
+    }
+
+    // On a terminal matches are shown in bold; elsewhere they are marked
+    // the way markdown would.
+    open, close := "**", "**"
+    if out.textIsTerminal() {
+        open, close = "\033[1m", "\033[0m"
+    }
+    for _, result := range results {
+        out.Printf("%s  (score %g, %s)\n", result.Path, result.Score, result.Updated.Format("2006-01-02 15:04"))
+        for _, s := range result.Snippets {
+            out.Printf("    %s\n", highlight(s.Text, s.Highlights, open, close))
+        }
+    }
+    return nil
+}
+
+func removeChats(ctx context.Context, out *output, library chat.Library, names []string, opts chatsOptions) error {
+    var entries []chat.Entry
+    for _, name := range names {
+        entry, err := library.Load(name)
+        if err != nil {
+            return err
+        }
+        entries = append(entries, entry)
+    }
+
+    if !opts.force && !opts.yes {
+        if !utils.IsTerminal(opts.in) {
+            return api.ErrNotInteractive
+        }
+        for _, entry := range entries {
+            out.Printf("%s  %s\n", entry.Path, oneLine(entry.Transcript.FirstQuestion(), 60))
+        }
+        proceed, err := confirm(ctx, out, opts.in, fmt.Sprintf("Remove %d chat(s)? (y/n): ", len(entries)))
+        if err != nil {
+            return err
+        }
+        if !proceed {
+            return api.ErrAborted
+        }
+    }
+
+    var removed []chatChange
+    for _, entry := range entries {
+        path, err := library.Remove(entry.Name)
+        if err != nil {
+            return fmt.Errorf("removing %s: %w", entry.Name, err)
+        }
+        out.Printf("Removed %s\n", path)
+        removed = append(removed, chatChange{Action: "removed", Name: entry.Name, Path: path})
+    }
+    return out.emit(removed)
+}
+
+// confirm asks question on in and reports whether the answer was yes.
+func confirm(ctx context.Context, out *output, in io.Reader, question string) (bool, error) {
+    out.Printf("%s", question)
+    answer := make(chan string, 1)
+    go func() {
+        var response string
+        fmt.Fscanln(in, &response)
+        answer <- response
+    }()
+
+    select {
+    case <-ctx.Done():
+        out.Println()
+        return false, ctx.Err()
+    case response := <-answer:
+        return strings.ToLower(response) == "y", nil
+    }
+}
+
+func summarizeChat(entry chat.Entry) chatSummary {
+    questions := 0
+    for _, turn := range entry.Transcript.Turns {
+        if turn.Role == chat.User {
+            questions++
+        }
+    }
+    summary := chatSummary{
+        Name:          entry.Name,
+        Path:          entry.Path,
+        Updated:       entry.Modified,
+        Questions:     questions,
+        FirstQuestion: entry.Transcript.FirstQuestion(),
+    }
+    // Chats saved before front matter was added do not record how they
+    // were answered.
+    if meta := entry.Transcript.Meta; meta != nil {
+        summary.Model = meta.Model
+        summary.Mode = meta.Mode
+        summary.Project = meta.RemoteURL
+    }
+    return summary
+}
+
+// highlight wraps the byte ranges of text in open and close.
+func highlight(text string, ranges [][2]int, open, close string) string {
+    var b strings.Builder
+    last := 0
+    for _, r := range ranges {
+        b.WriteString(text[last:r[0]])
+        b.WriteString(open + text[r[0]:r[1]] + close)
+        last = r[1]
+    }
+    b.WriteString(text[last:])
+    return b.String()
+}
+
+// oneLine flattens text to a single line of at most limit characters.
+func oneLine(text string, limit int) string {
+    text = strings.Join(strings.Fields(text), " ")
+    if runes := []rune(text); len(runes) > limit {
+        return string(runes[:limit-1]) + "…"
+    }
+    return text
+}
+
+func orDash(value string) string {
+    if value == "" {
+        return "-"
+    }
+    return value
+}
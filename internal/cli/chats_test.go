@@ -0,0 +1,95 @@
+package cli
+
+import (
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/7db9a/machtiani/internal/utils"
+)
+
+// saveChats writes chats to the chat directory, the first one oldest.
+func saveChats(t *testing.T, chats ...[2]string) {
+    if err := os.MkdirAll(utils.DefaultChatDir, 0755); err != nil {
+        t.Fatal(err)
+    }
+    modified := time.Now().Add(-time.Hour)
+    for i, c := range chats {
+        path := filepath.Join(utils.DefaultChatDir, c[0]+".md")
+        if err := ioutil.WriteFile(path, []byte(c[1]), 0644); err != nil {
+            t.Fatal(err)
+        }
+        stamp := modified.Add(time.Duration(i) * time.Minute)
+        os.Chtimes(path, stamp, stamp)
+    }
+}
+
+func TestChats(t *testing.T) {
+    setupProject(t)
+    saveChats(t,
+        [2]string{"deploy", "# User\n\nHow do we deploy?\n\n# Assistant\n\nThe sync handler retries the deploy.\n"},
+        [2]string{"sync_handler", "---\nmodel: gpt-4o\nmode: super\n---\n\n# User\n\nWhy does the sync handler fail?\n\n# Assistant\n\nIt times out.\n"},
+    )
+
+    code, out := runCLI(t, "chats", "list")
+    if code != ExitOK || !strings.Contains(out, "FIRST QUESTION") || strings.Index(out, "sync_handler") > strings.Index(out, "deploy") {
+        t.Errorf("Expected the chats newest first, got %d:\n%s", code, out)
+    }
+    if !strings.Contains(out, "gpt-4o  super") {
+        t.Errorf("Expected the model and mode from the front matter, got:\n%s", out)
+    }
+
+    code, out = runCLI(t, "chats", "search", "sync", "handler")
+    if code != ExitOK || strings.Index(out, "sync_handler.md") > strings.Index(out, "deploy.md") {
+        t.Errorf("Expected the chat asking about the handler to rank first, got %d:\n%s", code, out)
+    }
+    if !strings.Contains(out, "The **sync** **handler** retries") {
+        t.Errorf("Expected the matches to be highlighted, got:\n%s", out)
+    }
+
+    var matches []chatMatch
+    code, out = runCLI(t, "--output", "json", "chats", "search", "deploy")
+    decodeOutput(t, out, &matches)
+    if code != ExitOK || len(matches) != 1 || matches[0].Name != "deploy" || len(matches[0].Snippets) != 2 {
+        t.Errorf("Unexpected search result %d: %+v", code, matches)
+    }
+
+    code, out = runCLI(t, "chats", "show", "deploy")
+    if code != ExitOK || !strings.Contains(out, "How do we deploy?") {
+        t.Errorf("Expected the chat to be rendered, got %d:\n%s", code, out)
+    }
+
+    if code, out = runCLI(t, "chats", "rename", "deploy", "deploys"); code != ExitOK {
+        t.Errorf("Unexpected failure renaming a chat: %d\n%s", code, out)
+    }
+    if code, _ = runCLI(t, "chats", "show", "deploy"); code != ExitError {
+        t.Errorf("Expected the old name to be gone, got %d", code)
+    }
+    if code, _ = runCLI(t, "chats", "shw", "deploys"); code != ExitError {
+        t.Errorf("Expected an unknown action to fail, got %d", code)
+    }
+}
+
+func TestChats_Remove(t *testing.T) {
+    setupProject(t)
+    saveChats(t, [2]string{"old", "# User\n\nOld question?\n"}, [2]string{"keep", "# User\n\nKeep me.\n"})
+    withStdin(t, "y\n")
+
+    // A pipe is not a terminal, so nothing is removed without --yes.
+    if code, _ := runCLI(t, "chats", "rm", "old"); code != ExitAborted {
+        t.Errorf("Expected exit code %d without a terminal, got %d", ExitAborted, code)
+    }
+    if _, err := os.Stat(filepath.Join(utils.DefaultChatDir, "old.md")); err != nil {
+        t.Fatalf("Expected the chat to be kept: %v", err)
+    }
+
+    if code, out := runCLI(t, "--yes", "chats", "rm", "old"); code != ExitOK || !strings.Contains(out, "Removed .machtiani/chat/old.md") {
+        t.Errorf("Expected the chat to be removed, got %d:\n%s", code, out)
+    }
+    if _, err := os.Stat(filepath.Join(utils.DefaultChatDir, "keep.md")); err != nil {
+        t.Errorf("Expected the other chat to be kept: %v", err)
+    }
+}
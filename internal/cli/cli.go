@@ -1,99 +1,148 @@
 package cli
 
 import (
-    "flag"
+    "context"
     "fmt"
     "log"
     "os"
+    "os/signal"
+    "syscall"
     "time"
 
     "github.com/7db9a/machtiani/internal/api"
+    "github.com/7db9a/machtiani/internal/cassette"
     "github.com/7db9a/machtiani/internal/utils"
-    "github.com/7db9a/machtiani/internal/git"
 )
 
 func Execute() {
-    config, err := utils.LoadConfig()
+    os.Exit(Run(os.Args[1:]))
+}
+
+// Run executes the CLI with args, which exclude the program name, and
+// returns the process exit code.
+func Run(args []string) int {
+    // The completion scripts call back with the words typed so far, global
+    // flags included.
+    if len(args) > 0 && args[0] == "__complete" {
+        printCompletions(os.Stdout, newCompleter().complete(args[1:]))
+        return ExitOK
+    }
+
+    opts, args, err := extractGlobalFlags(args)
     if err != nil {
-        log.Fatalf("Error loading config: %v", err)
+        return newOutput(outputText).reportError(err)
     }
+    out := newOutput(opts.output)
 
-    fs := flag.NewFlagSet("machtiani", flag.ContinueOnError)
-    remoteName := fs.String("remote", "origin", "Name of the remote repository")
-    branchName := fs.String("branch-name", "", "Branch name")
-    forceFlag := fs.Bool("force", false, "Skip confirmation prompt and proceed with the operation.")
+    // Cancel in-flight requests on Ctrl-C or SIGTERM. Once cancelled, the
+    // default handlers are restored so a second Ctrl-C exits immediately.
+    ctx, stopSignals := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+    defer stopSignals()
+    go func() {
+        <-ctx.Done()
+        stopSignals()
+    }()
 
-    compatible, message, err := api.GetInstallInfo()
+    cmd, args, err := resolveCommand(args)
     if err != nil {
-        log.Printf("Error getting install info: %v", err)
-        os.Exit(1)
+        return out.reportError(err)
     }
+    return out.reportError(runCommand(ctx, cmd, args, &environment{opts: opts, out: out}))
+}
 
-    if !compatible {
-        log.Printf("This CLI is no longer compatible with the current environment. Please update to the latest version by following the below instructions\n\n%v", message)
-        os.Exit(1)
+// load reads the config and creates the API client.
+func (env *environment) load() error {
+    config, err := utils.LoadConfig()
+    if err != nil {
+        return withExitCode(ExitConfig, fmt.Errorf("loading config: %w", err))
     }
 
-
-    // Use the new remote URL function
-    remoteURL, err := git.GetRemoteURL(remoteName)
+    client, err := api.NewClient(config)
     if err != nil {
-        log.Printf("Error getting remote url: %v", err)
-        os.Exit(1)
+        return withExitCode(ExitConfig, fmt.Errorf("creating API client: %w", err))
     }
-    fmt.Printf("Using remote URL: %s\n", remoteURL)
-    projectName :=  remoteURL
+    client.Budget.Override = env.opts.overrideBudget
+    client.Out = env.out.text
+    client.AssumeYes = env.opts.yes
 
-    var apiKey *string = utils.GetCodeHostAPIKey(config)
+    env.config, env.client = config, client
+    return nil
+}
 
-    // Check if no command is provided
-    if len(os.Args) < 2 {
-        printHelp()
-        return // Exit after printing help
+// connect sets up recording or replaying of HTTP traffic and checks that the
+// server supports this CLI.
+func (env *environment) connect(ctx context.Context) error {
+    switch {
+    case env.opts.replay != "":
+        replayer, err := cassette.NewReplayer(env.opts.replay)
+        if err != nil {
+            return fmt.Errorf("loading recorded session: %w", err)
+        }
+        env.client.SetTransport(replayer)
+    case env.opts.record != "":
+        recorder, err := cassette.NewRecorder(env.opts.record, env.client.Transport(),
+            env.config.Environment.ModelAPIKey, env.config.Environment.CodeHostAPIKey, env.config.Environment.APIGatewayHostValue)
+        if err != nil {
+            return fmt.Errorf("starting session recording: %w", err)
+        }
+        env.client.SetTransport(recorder)
     }
 
-    command := os.Args[1]
-    switch command {
-    case "status":
-        handleStatus(&config, remoteURL, apiKey)
-        return // Exit after handling status
-    case "git-store":
-        // Parse flags for git-store
-        utils.ParseFlags(fs, os.Args[2:]) // Use the new helper function
-        // Call the new function to handle git-store
-        handleGitStore(remoteURL, apiKey, *forceFlag, config)
-        return // Exit after handling git-store
-    case "git-sync":
-        utils.ParseFlags(fs, os.Args[2:]) // Use the new helper function
-        // Call the HandleGitSync function
-        if err := handleGitSync(remoteURL, *branchName, apiKey, *forceFlag, config); err != nil {
-            log.Printf("Error handling git-sync: %v", err)
-            os.Exit(1)
+    // A recorded session must contain the handshake to be replayable on a
+    // machine whose cache is cold, so neither mode uses the cache.
+    cached := env.opts.record == "" && env.opts.replay == ""
+    compatibility, err := checkCompatibility(ctx, env.client, env.config, cached)
+    env.compatibility = compatibility
+    return err
+}
+
+// idempotent attaches a fresh idempotency key to ctx when the server honors
+// them, which lets a repository operation be retried safely. Without one the
+// request is not retried once it has been sent.
+func (env *environment) idempotent(ctx context.Context) context.Context {
+    if !env.compatibility.Supports(api.CapabilityIdempotencyKey) {
+        return ctx
+    }
+    return api.WithIdempotencyKey(ctx, api.NewIdempotencyKey())
+}
+
+// checkCompatibility refuses to continue if the server does not support this
+// CLI version, and prints any deprecation warnings it sends. Without cached
+// the server is always asked.
+func checkCompatibility(ctx context.Context, client *api.Client, config utils.Config, cached bool) (api.Compatibility, error) {
+    ttl := api.DefaultCompatibilityTTL
+    if config.Compatibility.CacheTTL != "" {
+        d, err := time.ParseDuration(config.Compatibility.CacheTTL)
+        if err != nil {
+            return api.Compatibility{}, withExitCode(ExitConfig, fmt.Errorf("invalid compatibility CACHE_TTL: %w", err))
         }
-        return
-    case "git-delete":
-        utils.ParseFlags(fs, os.Args[2:]) // Use the new helper function
-        if remoteURL == "" {
-            log.Printf("Error: --remote must be provided.")
-            os.Exit(1)
+        ttl = d
+    }
+    cache, err := api.DefaultCompatibilityCache(ttl)
+    if err != nil || !cached {
+        cache = nil
+    }
+
+    result, err := client.CheckCompatibilityCached(ctx, cache)
+    if err != nil {
+        return result, fmt.Errorf("checking compatibility: %w", err)
+    }
+    for _, deprecation := range result.Deprecations {
+        log.Printf("Warning: %s", deprecation)
+    }
+    if !result.Compatible {
+        supported := ""
+        if result.MinVersion != "" || result.MaxVersion != "" {
+            supported = fmt.Sprintf(" (this CLI is %s; the server supports %s to %s)", result.ClientVersion, orAny(result.MinVersion), orAny(result.MaxVersion))
         }
-        // Define additional parameters for git-delete
-        ignoreFiles := []string{} // Populate this list as needed
-        vcsType := "git"          // Set the VCS type as needed
-        openaiAPIKey := config.Environment.ModelAPIKey // Adjust as necessary
-        // Call the handleGitDelete function
-        handleGitDelete(remoteURL, projectName, ignoreFiles, vcsType, apiKey, &openaiAPIKey, *forceFlag, config)
-        return
-    case "help":
-        printHelp()
-        return // Exit after printing help
-    default:
-        startTime := time.Now() // Start the timer here
-        args := os.Args[1:]
-        handlePrompt(args, &config, &remoteURL, apiKey)
-        duration := time.Since(startTime)
-        fmt.Printf("Total response handling took %s\n", duration) // Print total duration
-        return
+        return result, withExitCode(ExitIncompatible, fmt.Errorf("This CLI is no longer compatible with the current environment%s. Please update to the latest version by running `machtiani self-update` or by following the below instructions\n\n%v", supported, result.Message))
     }
+    return result, nil
 }
 
+func orAny(version string) string {
+    if version == "" {
+        return "any"
+    }
+    return version
+}
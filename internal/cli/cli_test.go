@@ -0,0 +1,859 @@
+package cli
+
+import (
+    "bytes"
+    "encoding/json"
+    "io"
+    "io/ioutil"
+    "log"
+    "net/http"
+    "os"
+    "os/exec"
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/7db9a/machtiani/internal/api"
+    "github.com/7db9a/machtiani/internal/chat"
+    "github.com/7db9a/machtiani/internal/testserver"
+    "github.com/7db9a/machtiani/internal/usage"
+)
+
+const testRemoteURL = "https://github.com/example/project.git"
+
+// setupProject starts a fake backend and moves into a fresh git repository
+// whose .machtiani-config.yml points at it.
+func setupProject(t *testing.T) *testserver.Server {
+    server := testserver.New()
+    t.Cleanup(server.Close)
+    // Keep the usage ledger out of the real home directory.
+    t.Setenv("HOME", t.TempDir())
+
+    dir := t.TempDir()
+    for _, args := range [][]string{
+        {"init", "-q"},
+        {"remote", "add", "origin", testRemoteURL},
+    } {
+        cmd := exec.Command("git", args...)
+        cmd.Dir = dir
+        if out, err := cmd.CombinedOutput(); err != nil {
+            t.Fatalf("git %v failed: %v\n%s", args, err, out)
+        }
+    }
+
+    if err := ioutil.WriteFile(filepath.Join(dir, ".machtiani-config.yml"), []byte(server.ConfigYAML()), 0644); err != nil {
+        t.Fatalf("Failed to write config: %v", err)
+    }
+
+    originalDir, err := os.Getwd()
+    if err != nil {
+        t.Fatalf("Failed to get working directory: %v", err)
+    }
+    if err := os.Chdir(dir); err != nil {
+        t.Fatalf("Failed to change directory: %v", err)
+    }
+    t.Cleanup(func() { os.Chdir(originalDir) })
+
+    return server
+}
+
+// runCLI runs the CLI with args and returns its exit code and stdout.
+func runCLI(t *testing.T, args ...string) (int, string) {
+    reader, writer, err := os.Pipe()
+    if err != nil {
+        t.Fatalf("Failed to create pipe: %v", err)
+    }
+    originalStdout := os.Stdout
+    os.Stdout = writer
+
+    output := make(chan string)
+    go func() {
+        var buf bytes.Buffer
+        io.Copy(&buf, reader)
+        output <- buf.String()
+    }()
+
+    code := Run(args)
+
+    writer.Close()
+    os.Stdout = originalStdout
+    return code, <-output
+}
+
+func TestStatus_Ready(t *testing.T) {
+    server := setupProject(t)
+
+    code, out := runCLI(t, "status")
+    if code != ExitOK {
+        t.Fatalf("Expected exit code %d, got %d", ExitOK, code)
+    }
+    if !strings.Contains(out, "Project is ready for chat!") {
+        t.Errorf("Expected ready message, got: %s", out)
+    }
+
+    requests := server.Requests(testserver.PathStatus)
+    if len(requests) != 1 || requests[0].Query.Get("codehost_url") != testRemoteURL {
+        t.Errorf("Expected one status request for %s, got: %+v", testRemoteURL, requests)
+    }
+}
+
+func TestStatus_Locked(t *testing.T) {
+    server := setupProject(t)
+    server.SetLocked(true, 90*time.Second)
+
+    code, out := runCLI(t, "status")
+    if code != ExitOK {
+        t.Fatalf("Expected exit code %d, got %d", ExitOK, code)
+    }
+    if !strings.Contains(out, "Lock duration: 00:01:30") {
+        t.Errorf("Expected lock duration, got: %s", out)
+    }
+}
+
+func TestStatus_Wait(t *testing.T) {
+    server := setupProject(t)
+    server.SetLocked(true, time.Minute)
+    server.SetProgress("embedding", 0.42)
+    server.UnlockAfter(2)
+
+    code, out := runCLI(t, "status", "--wait", "--wait-interval", "1ms")
+    if code != ExitOK {
+        t.Fatalf("Expected exit code %d, got %d\n%s", ExitOK, code, out)
+    }
+    for _, want := range []string{"embedding 42%", "Project is ready for chat! (waited"} {
+        if !strings.Contains(out, want) {
+            t.Errorf("Expected output to contain %q, got: %s", want, out)
+        }
+    }
+    if got := len(server.Requests(testserver.PathStatus)); got != 3 {
+        t.Errorf("Expected 3 status polls, got %d", got)
+    }
+}
+
+func TestStatus_WaitTimeout(t *testing.T) {
+    server := setupProject(t)
+    server.SetLocked(true, time.Minute)
+
+    code, out := runCLI(t, "status", "--wait", "--wait-interval", "5ms", "--wait-timeout", "30ms")
+    if code != ExitTimeout {
+        t.Fatalf("Expected exit code %d, got %d\n%s", ExitTimeout, code, out)
+    }
+}
+
+func TestStatus_WaitPollsAtDeadline(t *testing.T) {
+    server := setupProject(t)
+    server.SetLocked(true, time.Minute)
+    server.UnlockAfter(1)
+
+    // The interval is longer than the timeout, so the second poll is made
+    // at the deadline.
+    code, out := runCLI(t, "status", "--wait", "--wait-interval", "1h", "--wait-timeout", "50ms")
+    if code != ExitOK || !strings.Contains(out, "Project is ready for chat!") {
+        t.Fatalf("Expected a last poll at the deadline to find the project ready, got %d\n%s", code, out)
+    }
+    if got := len(server.Requests(testserver.PathStatus)); got != 2 {
+        t.Errorf("Expected 2 status polls, got %d", got)
+    }
+}
+
+func TestGitStore(t *testing.T) {
+    server := setupProject(t)
+    ioutil.WriteFile(".machtiani.ignore", []byte("# comment\nvendor/\n"), 0644)
+
+    code, out := runCLI(t, "git-store", "--force")
+    if code != ExitOK {
+        t.Fatalf("Expected exit code %d, got %d\n%s", ExitOK, code, out)
+    }
+    if !strings.Contains(out, "Repository added") {
+        t.Errorf("Expected server message, got: %s", out)
+    }
+
+    requests := server.Requests(testserver.PathAddRepository)
+    if len(requests) != 1 {
+        t.Fatalf("Expected one add-repository request, got %d", len(requests))
+    }
+    body := requests[0].Body
+    if body["codehost_url"] != testRemoteURL || body["api_key"] != "ghp_test" {
+        t.Errorf("Unexpected add-repository payload: %v", body)
+    }
+    if ignore, _ := body["ignore_files"].([]interface{}); len(ignore) != 1 || ignore[0] != "vendor/" {
+        t.Errorf("Expected ignore files from .machtiani.ignore, got: %v", body["ignore_files"])
+    }
+    // The fake predates the compatibility check, so it announces no support
+    // for idempotency keys.
+    if key := requests[0].Header.Get("Idempotency-Key"); key != "" {
+        t.Errorf("Expected no idempotency key for a server that does not support them, got %q", key)
+    }
+    if len(server.Requests(testserver.PathAddRepositoryCount)) != 1 {
+        t.Errorf("Expected the token count to be requested before storing")
+    }
+    // 1000 embedding tokens with text-embedding-3-large and 200 inference
+    // tokens with gpt-4o-mini.
+    if !strings.Contains(out, "Estimated cost: $0.0002 (embedding $0.0001") {
+        t.Errorf("Expected a cost estimate, got: %s", out)
+    }
+}
+
+func TestGitStore_IdempotencyKey(t *testing.T) {
+    server := setupProject(t)
+    server.SetCompatibility("", "")
+
+    if code, out := runCLI(t, "git-store", "--force"); code != ExitOK {
+        t.Fatalf("Expected exit code %d, got %d\n%s", ExitOK, code, out)
+    }
+    requests := server.Requests(testserver.PathAddRepository)
+    if len(requests) != 1 || requests[0].Header.Get("Idempotency-Key") == "" {
+        t.Errorf("Expected add-repository to carry an idempotency key when the server supports them")
+    }
+}
+
+func TestDeprecatedFlags(t *testing.T) {
+    server := setupProject(t)
+    var logged bytes.Buffer
+    defer log.SetOutput(log.Writer())
+    log.SetOutput(&logged)
+
+    if code, out := runCLI(t, "--force", "Where is the handler?"); code != ExitOK {
+        t.Errorf("Expected a prompt with --force to succeed, got %d\n%s", code, out)
+    }
+    if code, out := runCLI(t, "git-store", "--branch", "master", "--force"); code != ExitOK || len(server.Requests(testserver.PathAddRepository)) != 1 {
+        t.Errorf("Expected git-store with --branch to succeed, got %d\n%s", code, out)
+    }
+    for _, want := range []string{"--force is deprecated", "--branch is deprecated"} {
+        if !strings.Contains(logged.String(), want) {
+            t.Errorf("Expected a warning that %q, got:\n%s", want, logged.String())
+        }
+    }
+}
+
+func TestGitStore_Wait(t *testing.T) {
+    server := setupProject(t)
+
+    code, out := runCLI(t, "git-store", "--force", "--wait")
+    if code != ExitOK {
+        t.Fatalf("Expected exit code %d, got %d\n%s", ExitOK, code, out)
+    }
+    if strings.Contains(out, "Please check back") || !strings.Contains(out, "Project is ready for chat!") {
+        t.Errorf("Expected to wait instead of asking to check back, got: %s", out)
+    }
+    if len(server.Requests(testserver.PathStatus)) != 1 {
+        t.Errorf("Expected the status to be polled after storing")
+    }
+}
+
+func TestGitStore_NonInteractive(t *testing.T) {
+    server := setupProject(t)
+    t.Setenv("MACHTIANI_NONINTERACTIVE", "1")
+
+    code, out := runCLI(t, "git-store")
+    if code != ExitAborted {
+        t.Fatalf("Expected exit code %d without a terminal to confirm on, got %d\n%s", ExitAborted, code, out)
+    }
+    if strings.Contains(out, "Do you wish to proceed?") || len(server.Requests(testserver.PathAddRepository)) != 0 {
+        t.Errorf("Expected to fail before asking or storing, got: %s", out)
+    }
+
+    if code, out := runCLI(t, "git-store", "--yes"); code != ExitOK {
+        t.Fatalf("Expected --yes to proceed, got %d\n%s", code, out)
+    }
+    if len(server.Requests(testserver.PathAddRepository)) != 1 {
+        t.Errorf("Expected the repository to be stored with --yes")
+    }
+}
+
+func TestGitStore_ServerBusy(t *testing.T) {
+    server := setupProject(t)
+    server.SetLocked(true, time.Minute)
+
+    if code, _ := runCLI(t, "git-store", "--force"); code != ExitServerBusy {
+        t.Errorf("Expected exit code %d, got %d", ExitServerBusy, code)
+    }
+}
+
+func TestGitStore_RetriesGatewayHiccup(t *testing.T) {
+    server := setupProject(t)
+    server.SetCompatibility("", "")
+    server.On(testserver.PathAddRepository, testserver.Behavior{Status: http.StatusBadGateway, Body: "bad gateway", Times: 1})
+
+    if code, out := runCLI(t, "git-store", "--force"); code != ExitOK {
+        t.Fatalf("Expected exit code %d, got %d\n%s", ExitOK, code, out)
+    }
+    if got := len(server.Requests(testserver.PathAddRepository)); got != 2 {
+        t.Errorf("Expected the request to be retried once, got %d attempts", got)
+    }
+}
+
+func TestGitStore_NoRetryWithoutIdempotencyKeys(t *testing.T) {
+    server := setupProject(t)
+    server.On(testserver.PathAddRepository, testserver.Behavior{Status: http.StatusBadGateway, Body: "bad gateway", Times: 1})
+
+    if code, _ := runCLI(t, "git-store", "--force"); code != ExitError {
+        t.Errorf("Expected exit code %d, got %d", ExitError, code)
+    }
+    if got := len(server.Requests(testserver.PathAddRepository)); got != 1 {
+        t.Errorf("Expected a server without idempotency keys to get the request once, got %d attempts", got)
+    }
+}
+
+func TestGitStore_OverBudget(t *testing.T) {
+    server := setupProject(t)
+    server.SetTokenCounts(5000, 1000)
+    config := server.ConfigYAML() + "budget:\n  MAX_TOKENS_PER_STORE: 4000\n"
+    ioutil.WriteFile(".machtiani-config.yml", []byte(config), 0644)
+
+    if code, _ := runCLI(t, "git-store", "--force"); code != ExitBudget {
+        t.Fatalf("Expected --force not to bypass the budget, got exit code %d", code)
+    }
+    if len(server.Requests(testserver.PathAddRepository)) != 0 {
+        t.Fatalf("Expected no add-repository request over budget")
+    }
+
+    if code, out := runCLI(t, "git-store", "--force", "--override-budget"); code != ExitOK {
+        t.Fatalf("Expected --override-budget to proceed, got %d\n%s", code, out)
+    }
+    if len(server.Requests(testserver.PathAddRepository)) != 1 {
+        t.Errorf("Expected the repository to be stored with --override-budget")
+    }
+}
+
+func TestPrompt_DailyBudget(t *testing.T) {
+    server := setupProject(t)
+    config := server.ConfigYAML() + "budget:\n  MAX_TOKENS_PER_DAY: 10\n"
+    ioutil.WriteFile(".machtiani-config.yml", []byte(config), 0644)
+
+    if code, out := runCLI(t, "Where is the handler?"); code != ExitOK {
+        t.Fatalf("Expected the first prompt to fit the daily budget, got %d\n%s", code, out)
+    }
+    if code, _ := runCLI(t, "Where is the handler now?"); code != ExitBudget {
+        t.Errorf("Expected the daily budget to refuse the second prompt, got %d", code)
+    }
+    if got := len(server.Requests(testserver.PathGenerateResponse)); got != 1 {
+        t.Errorf("Expected one generate-response request, got %d", got)
+    }
+}
+
+func TestUsageReport(t *testing.T) {
+    setupProject(t)
+
+    if code, out := runCLI(t, "git-store", "--force"); code != ExitOK {
+        t.Fatalf("Expected git-store to succeed, got %d\n%s", code, out)
+    }
+    if code, out := runCLI(t, "--mode", "pure-chat", "Where is the handler?"); code != ExitOK {
+        t.Fatalf("Expected the prompt to succeed, got %d\n%s", code, out)
+    }
+
+    code, out := runCLI(t, "usage", "--by", "command", "--format", "json")
+    if code != ExitOK {
+        t.Fatalf("Expected exit code %d, got %d\n%s", ExitOK, code, out)
+    }
+    var summaries []usage.Summary
+    if err := json.Unmarshal([]byte(out), &summaries); err != nil {
+        t.Fatalf("Expected JSON output, got %v:\n%s", err, out)
+    }
+    if len(summaries) != 2 || summaries[0].Key != "git-store" || summaries[0].TotalTokens != 1200 || summaries[1].Key != "prompt" {
+        t.Errorf("Unexpected summaries: %+v", summaries)
+    }
+
+    code, out = runCLI(t, "usage", "--raw", "--format", "csv")
+    if code != ExitOK || !strings.Contains(out, "prompt,"+testRemoteURL+",gpt-4o-mini,pure-chat,") {
+        t.Errorf("Expected the prompt in the CSV export, got %d:\n%s", code, out)
+    }
+}
+
+func TestGitSync(t *testing.T) {
+    server := setupProject(t)
+
+    code, out := runCLI(t, "git-sync", "--branch-name", "main", "--force")
+    if code != ExitOK {
+        t.Fatalf("Expected exit code %d, got %d\n%s", ExitOK, code, out)
+    }
+    if !strings.Contains(out, "Successfully synced the repository") {
+        t.Errorf("Expected sync message, got: %s", out)
+    }
+
+    requests := server.Requests(testserver.PathFetchAndCheckout)
+    if len(requests) != 1 || requests[0].Body["branch_name"] != "main" {
+        t.Errorf("Expected one fetch-and-checkout request for main, got: %+v", requests)
+    }
+}
+
+func TestGitSync_RequiresBranch(t *testing.T) {
+    server := setupProject(t)
+
+    if code, _ := runCLI(t, "git-sync", "--force"); code != ExitError {
+        t.Errorf("Expected exit code %d, got %d", ExitError, code)
+    }
+    if len(server.Requests(testserver.PathFetchAndCheckout)) != 0 {
+        t.Errorf("Expected no sync request without a branch")
+    }
+}
+
+func TestGitDelete(t *testing.T) {
+    server := setupProject(t)
+
+    code, out := runCLI(t, "git-delete", "--force")
+    if code != ExitOK {
+        t.Fatalf("Expected exit code %d, got %d\n%s", ExitOK, code, out)
+    }
+    if !strings.Contains(out, "Store deleted") {
+        t.Errorf("Expected delete message, got: %s", out)
+    }
+    if requests := server.Requests(testserver.PathDeleteStore); len(requests) != 1 || requests[0].Body["project_name"] != testRemoteURL {
+        t.Errorf("Expected one delete-store request, got: %+v", requests)
+    }
+}
+
+func TestPrompt_SavesChat(t *testing.T) {
+    server := setupProject(t)
+    server.SetAnswer(testserver.Answer{Text: "Use the handler in api.go.", RetrievedFilePaths: []string{"internal/api/api.go"}})
+    server.SetFilename("where_is_the_handler")
+
+    code, out := runCLI(t, "--model", "gpt-4o", "Where is the handler?")
+    if code != ExitOK {
+        t.Fatalf("Expected exit code %d, got %d\n%s", ExitOK, code, out)
+    }
+
+    if !strings.Contains(out, "Estimated prompt tokens: ~5, approximate (about <$0.0001 with gpt-4o,") {
+        t.Errorf("Expected a prompt estimate, got: %s", out)
+    }
+
+    content, err := ioutil.ReadFile(".machtiani/chat/where_is_the_handler.md")
+    if err != nil {
+        t.Fatalf("Expected chat file to be saved: %v", err)
+    }
+    for _, want := range []string{"# User\n\nWhere is the handler?", "# Assistant\n\nUse the handler in api.go.", "- internal/api/api.go"} {
+        if !strings.Contains(string(content), want) {
+            t.Errorf("Expected chat file to contain %q, got:\n%s", want, content)
+        }
+    }
+
+    requests := server.Requests(testserver.PathGenerateResponse)
+    if len(requests) != 1 || requests[0].Body["model"] != "gpt-4o" || requests[0].Body["prompt"] != "Where is the handler?" {
+        t.Errorf("Unexpected generate-response requests: %+v", requests)
+    }
+}
+
+func TestPrompt_DoesNotOverwriteChats(t *testing.T) {
+    server := setupProject(t)
+    server.SetAnswer(testserver.Answer{Text: "In api.go."})
+    server.SetFilename("where_is_the_handler")
+    os.MkdirAll(".machtiani/chat", 0755)
+    ioutil.WriteFile(".machtiani/chat/where_is_the_handler.md", []byte("# User\n\nAn earlier question\n"), 0644)
+    ioutil.WriteFile("notes.md", []byte("# User\n\nWhere is the handler?\n"), 0644)
+
+    if code, out := runCLI(t, "Where is the handler?"); code != ExitOK || !strings.Contains(out, "saved to .machtiani/chat/where_is_the_handler-2.md") {
+        t.Errorf("Expected a new name for the chat, got %d:\n%s", code, out)
+    }
+    if content, _ := ioutil.ReadFile(".machtiani/chat/where_is_the_handler.md"); string(content) != "# User\n\nAn earlier question\n" {
+        t.Errorf("Expected the earlier chat to be kept, got:\n%s", content)
+    }
+
+    // A file outside the chat directory is copied into it, unless the
+    // answer is asked for in place.
+    if code, out := runCLI(t, "--file", "notes.md"); code != ExitOK || !strings.Contains(out, "saved to .machtiani/chat/notes.md") {
+        t.Errorf("Expected the chat to be saved as a new chat, got %d:\n%s", code, out)
+    }
+    if content, _ := ioutil.ReadFile("notes.md"); strings.Contains(string(content), "In api.go.") {
+        t.Errorf("Expected notes.md to be left alone without --in-place")
+    }
+    if code, out := runCLI(t, "--file", "notes.md", "--in-place"); code != ExitOK || !strings.Contains(out, "saved to notes.md") {
+        t.Errorf("Expected the answer to be saved in place, got %d:\n%s", code, out)
+    }
+    if content, _ := ioutil.ReadFile("notes.md"); !strings.Contains(string(content), "# Assistant\n\nIn api.go.") {
+        t.Errorf("Expected the answer in notes.md, got:\n%s", content)
+    }
+    if code, _ := runCLI(t, "--in-place", "Where?"); code != ExitError {
+        t.Errorf("Expected --in-place without --file to be refused, got %d", code)
+    }
+}
+
+func TestPrompt_ConfiguredChatDir(t *testing.T) {
+    server := setupProject(t)
+    server.SetFilename("where_is_the_handler")
+    ioutil.WriteFile(".machtiani-config.yml", []byte(server.ConfigYAML()+"chat:\n  DIR: answers\n"), 0644)
+
+    if code, out := runCLI(t, "Where is the handler?"); code != ExitOK {
+        t.Fatalf("Expected exit code %d, got %d\n%s", ExitOK, code, out)
+    }
+    if _, err := os.Stat(filepath.Join("answers", "where_is_the_handler.md")); err != nil {
+        t.Errorf("Expected the chat in the configured directory: %v", err)
+    }
+    if code, out := runCLI(t, "chats", "list"); code != ExitOK || !strings.Contains(out, "where_is_the_handler") {
+        t.Errorf("Expected chats to list the configured directory, got %d:\n%s", code, out)
+    }
+}
+
+func TestPrompt_Stream(t *testing.T) {
+    server := setupProject(t)
+    server.SetAnswer(testserver.Answer{Text: "streamed answer text", RetrievedFilePaths: []string{"a.go"}})
+
+    code, out := runCLI(t, "--stream", "--file", "question.md")
+    if code != ExitError {
+        t.Fatalf("Expected a missing --file to fail, got %d\n%s", code, out)
+    }
+
+    ioutil.WriteFile("question.md", []byte("# User\n\nExplain a.go"), 0644)
+    code, out = runCLI(t, "--stream", "--file", "question.md")
+    if code != ExitOK {
+        t.Fatalf("Expected exit code %d, got %d\n%s", ExitOK, code, out)
+    }
+
+    content, err := ioutil.ReadFile(".machtiani/chat/question.md")
+    if err != nil {
+        t.Fatalf("Expected chat file to be saved: %v", err)
+    }
+    if !strings.Contains(string(content), "# Assistant\n\nstreamed answer text") {
+        t.Errorf("Expected the streamed answer to be saved, got:\n%s", content)
+    }
+    // A pipe cannot be redrawn, so the streamed text is all that is shown.
+    if got := strings.Count(out, "streamed answer text"); got != 1 {
+        t.Errorf("Expected the answer to be printed once, got %d times:\n%s", got, out)
+    }
+    if stream, _ := server.Requests(testserver.PathGenerateResponse)[0].Body["stream"].(bool); !stream {
+        t.Errorf("Expected the request to ask for a stream")
+    }
+}
+
+func TestPrompt_FileSendsEarlierTurns(t *testing.T) {
+    server := setupProject(t)
+    server.SetAnswer(testserver.Answer{
+        Text:               "In cli_test.go.",
+        RetrievedFilePaths: []string{"internal/cli/cli_test.go"},
+        Extra:              map[string]interface{}{"usage": map[string]int{"prompt_tokens": 100, "completion_tokens": 20, "embedding_tokens": 30, "total_tokens": 150}},
+    })
+    frontMatter := "---\nmodel: gpt-4o\ncreated: 2024-05-01T09:30:00Z\ntotal_usage:\n  total_tokens: 1000\n---\n\n"
+    chatFile := "# User\n\nWhere is the handler?\n\n# Assistant\n\nIn api.go.\n\n# Retrieved File Paths\n\n- internal/api/api.go\n"
+    ioutil.WriteFile("question.md", []byte(frontMatter+chatFile), 0644)
+
+    if code, out := runCLI(t, "--file", "question.md"); code != ExitError || len(server.Requests(testserver.PathGenerateResponse)) != 0 {
+        t.Fatalf("Expected a chat without a new question to be refused, got %d\n%s", code, out)
+    }
+
+    code, out := runCLI(t, "--file", "question.md", "And the tests?")
+    if code != ExitOK {
+        t.Fatalf("Expected exit code %d, got %d\n%s", ExitOK, code, out)
+    }
+    body := server.Requests(testserver.PathGenerateResponse)[0].Body
+    messages, _ := json.Marshal(body["messages"])
+    if body["prompt"] != "And the tests?" || string(messages) != `[{"content":"Where is the handler?","role":"user"},{"content":"In api.go.","role":"assistant"}]` {
+        t.Errorf("Expected the earlier turns as messages without retrieved paths, got prompt %q and messages %s", body["prompt"], messages)
+    }
+
+    content, err := ioutil.ReadFile(".machtiani/chat/question.md")
+    if err != nil {
+        t.Fatalf("Expected chat file to be saved: %v", err)
+    }
+    saved := chat.Parse(string(content))
+    want := chatFile + "\n# User\n\nAnd the tests?\n\n# Assistant\n\nIn cli_test.go.\n\n# Retrieved File Paths\n\n- internal/cli/cli_test.go\n"
+    if !strings.HasPrefix(string(content), "---\n") || saved.Body() != want {
+        t.Errorf("Expected the new turn to be appended after the front matter, got:\n%s", content)
+    }
+    meta := saved.Meta
+    if meta == nil || meta.Model != defaultModel || meta.Mode != defaultMode || meta.RemoteURL != testRemoteURL || meta.ClientVersion != api.HeadOID {
+        t.Fatalf("Expected the settings of the answer in the front matter, got %+v", meta)
+    }
+    if meta.Created.Format(time.RFC3339) != "2024-05-01T09:30:00Z" || !meta.Updated.After(meta.Created) || meta.TotalUsage.TotalTokens != 1150 || meta.TotalUsage.EmbeddingTokens != 30 {
+        t.Errorf("Expected the chat's creation time and tokens to carry over, got %+v", meta)
+    }
+}
+
+func TestPrompt_ServerError(t *testing.T) {
+    server := setupProject(t)
+    server.SetAnswer(testserver.Answer{Error: "model overloaded"})
+
+    if code, _ := runCLI(t, "hello"); code != ExitError {
+        t.Errorf("Expected exit code %d, got %d", ExitError, code)
+    }
+}
+
+func TestAuthFailure(t *testing.T) {
+    server := setupProject(t)
+    server.On(testserver.PathStatus, testserver.Behavior{Status: http.StatusUnauthorized, Body: `{"detail": "bad token"}`})
+
+    if code, _ := runCLI(t, "status"); code != ExitAuth {
+        t.Errorf("Expected exit code %d, got %d", ExitAuth, code)
+    }
+}
+
+func TestIncompatibleServer(t *testing.T) {
+    server := setupProject(t)
+    server.SetHeadOID("some-other-commit")
+
+    if code, _ := runCLI(t, "status"); code != ExitIncompatible {
+        t.Errorf("Expected exit code %d, got %d", ExitIncompatible, code)
+    }
+}
+
+func TestCompatibility_VersionRange(t *testing.T) {
+    server := setupProject(t)
+    originalVersion := api.Version
+    api.Version = "1.4.0"
+    t.Cleanup(func() { api.Version = originalVersion })
+
+    server.SetCompatibility("2.0.0", "")
+    if code, _ := runCLI(t, "status"); code != ExitIncompatible {
+        t.Errorf("Expected exit code %d below the supported range, got %d", ExitIncompatible, code)
+    }
+
+    // A redeploy with a different head_oid no longer matters.
+    server.SetHeadOID("some-other-commit")
+    server.SetCompatibility("1.0.0", "1.9.9")
+    for i := 0; i < 2; i++ {
+        if code, out := runCLI(t, "status"); code != ExitOK {
+            t.Fatalf("Expected exit code %d within the supported range, got %d\n%s", ExitOK, code, out)
+        }
+    }
+    if got := len(server.Requests(testserver.PathCompatibility)); got != 2 {
+        t.Errorf("Expected the compatible answer to be cached, got %d compatibility requests", got)
+    }
+}
+
+func TestRemoteFlag(t *testing.T) {
+    server := setupProject(t)
+    const forkURL = "https://github.com/example/fork.git"
+    if out, err := exec.Command("git", "remote", "add", "upstream", forkURL).CombinedOutput(); err != nil {
+        t.Fatalf("git remote add failed: %v\n%s", err, out)
+    }
+
+    if code, out := runCLI(t, "status", "--remote", "upstream"); code != ExitOK || !strings.Contains(out, forkURL) {
+        t.Fatalf("Expected status of the upstream remote, got %d:\n%s", code, out)
+    }
+    requests := server.Requests(testserver.PathStatus)
+    if len(requests) != 1 || requests[0].Query.Get("codehost_url") != forkURL {
+        t.Errorf("Expected the status request to use %s, got: %+v", forkURL, requests)
+    }
+}
+
+func TestUnknownFlagRejectedPerCommand(t *testing.T) {
+    server := setupProject(t)
+
+    // --branch-name belongs to git-sync, not git-store.
+    if code, _ := runCLI(t, "git-store", "--branch-name", "main", "--force"); code != ExitError {
+        t.Errorf("Expected exit code %d, got %d", ExitError, code)
+    }
+    if code, _ := runCLI(t, "status", "--project", "x"); code != ExitError {
+        t.Errorf("Expected exit code %d, got %d", ExitError, code)
+    }
+    if got := len(server.Requests("")); got != 0 {
+        t.Errorf("Expected usage errors to be caught before any request, got %d requests", got)
+    }
+}
+
+func TestPrompt_FlagsAfterPrompt(t *testing.T) {
+    server := setupProject(t)
+    server.SetFilename("where_is_the_handler")
+
+    if code, out := runCLI(t, "Where is the handler?", "--model", "gpt-4o"); code != ExitOK {
+        t.Fatalf("Expected exit code %d, got %d\n%s", ExitOK, code, out)
+    }
+    requests := server.Requests(testserver.PathGenerateResponse)
+    if len(requests) != 1 || requests[0].Body["model"] != "gpt-4o" || requests[0].Body["prompt"] != "Where is the handler?" {
+        t.Errorf("Expected one gpt-4o request for the prompt, got: %+v", requests)
+    }
+}
+
+func TestTyposSuggestInsteadOfSending(t *testing.T) {
+    server := setupProject(t)
+
+    for _, args := range [][]string{
+        {"--model", "gpt4o", "Where is the handler?"},
+        {"--mdoe", "commit", "Where is the handler?"},
+        {"git-stor"},
+    } {
+        if code, _ := runCLI(t, args...); code != ExitError {
+            t.Errorf("Expected exit code %d for %q, got %d", ExitError, args, code)
+        }
+    }
+    if got := len(server.Requests("")); got != 0 {
+        t.Errorf("Expected typos to be caught before any request, got %d requests", got)
+    }
+
+    if _, _, err := resolveCommand([]string{"git-stor"}); err == nil || !strings.Contains(err.Error(), `did you mean "git-store"?`) {
+        t.Errorf("Expected a suggestion for the command, got %v", err)
+    }
+    cmd := promptCommand()
+    if _, err := cmd.parse(cmd.flagSet(), []string{"--model", "gpt4o"}); err == nil || !strings.Contains(err.Error(), `did you mean "gpt-4o"?`) {
+        t.Errorf("Expected a suggestion for the model, got %v", err)
+    }
+    _, err := cmd.parse(cmd.flagSet(), []string{"--mdoe", "commit"})
+    if err := cmd.usageError(err); !strings.Contains(err.Error(), "did you mean --mode?") {
+        t.Errorf("Expected a suggestion for the flag, got %v", err)
+    }
+}
+
+func TestCommandHelp(t *testing.T) {
+    server := setupProject(t)
+    server.Close()
+
+    for _, args := range [][]string{{"help", "git-sync"}, {"git-sync", "--help"}} {
+        code, out := runCLI(t, args...)
+        if code != ExitOK {
+            t.Fatalf("Expected exit code %d for %v, got %d", ExitOK, args, code)
+        }
+        for _, want := range []string{"Usage: machtiani git-sync --branch-name <branch> [flags]", "--branch-name branch", "--wait-timeout duration"} {
+            if !strings.Contains(out, want) {
+                t.Errorf("Expected the help of %v to contain %q, got:\n%s", args, want, out)
+            }
+        }
+    }
+
+    if code, _ := runCLI(t, "help", "no-such-command"); code != ExitError {
+        t.Errorf("Expected exit code %d for an unknown command, got %d", ExitError, code)
+    }
+}
+
+// The help is generated from the flags each command registers, so every
+// flag it documents must be accepted by that command.
+func TestHelp_MatchesFlags(t *testing.T) {
+    for _, cmd := range append([]*command{promptCommand()}, commands()...) {
+        var buf bytes.Buffer
+        writeCommandHelp(&buf, cmd, "")
+        fs := cmd.flagSet()
+        for _, field := range strings.Fields(buf.String()) {
+            if !strings.HasPrefix(field, "--") || len(field) < 3 {
+                continue
+            }
+            name := strings.Trim(strings.TrimPrefix(field, "--"), ".,)")
+            if fs.Lookup(name) == nil && cmd.name != "prompt" && findCommand("prompt").flagSet().Lookup(name) == nil {
+                t.Errorf("%s help mentions --%s, which it does not accept", cmd.name, name)
+            }
+        }
+    }
+
+    var buf bytes.Buffer
+    writeHelp(&buf)
+    for _, stale := range []string{" -project", "--branch "} {
+        if strings.Contains(buf.String(), stale) {
+            t.Errorf("Expected the help not to mention %q", stale)
+        }
+    }
+}
+
+func TestHelp_SkipsServer(t *testing.T) {
+    server := setupProject(t)
+    server.Close()
+
+    if code, out := runCLI(t, "help"); code != ExitOK || !strings.Contains(out, "Usage: machtiani") {
+        t.Errorf("Expected help without a server, got %d:\n%s", code, out)
+    }
+}
+
+func TestNetworkUnreachable(t *testing.T) {
+    server := setupProject(t)
+    server.Close()
+
+    if code, _ := runCLI(t, "status"); code != ExitNetwork {
+        t.Errorf("Expected exit code %d, got %d", ExitNetwork, code)
+    }
+}
+
+func TestMissingConfig(t *testing.T) {
+    setupProject(t)
+    os.Remove(".machtiani-config.yml")
+    t.Setenv("HOME", t.TempDir())
+
+    if code, _ := runCLI(t, "status"); code != ExitConfig {
+        t.Errorf("Expected exit code %d, got %d", ExitConfig, code)
+    }
+}
+
+func TestHelp(t *testing.T) {
+    setupProject(t)
+
+    code, out := runCLI(t, "help")
+    if code != ExitOK || !strings.Contains(out, "Usage: machtiani") {
+        t.Errorf("Expected help output, got %d:\n%s", code, out)
+    }
+}
+
+func TestVersion(t *testing.T) {
+    server := setupProject(t)
+    server.SetCompatibility("0.1.0", "")
+
+    code, out := runCLI(t, "version")
+    if code != ExitOK {
+        t.Fatalf("Expected exit code %d, got %d\n%s", ExitOK, code, out)
+    }
+    for _, want := range []string{"machtiani " + api.Version, "commit:      " + api.HeadOID, "version:     1.0.0", "compatible:  yes"} {
+        if !strings.Contains(out, want) {
+            t.Errorf("Expected output to contain %q, got:\n%s", want, out)
+        }
+    }
+
+    // The client info is still shown without a server.
+    server.Close()
+    if code, out := runCLI(t, "version"); code != ExitOK || !strings.Contains(out, "unreachable") {
+        t.Errorf("Expected version to report an unreachable server, got %d:\n%s", code, out)
+    }
+}
+
+func TestDoctor(t *testing.T) {
+    setupProject(t)
+    ioutil.WriteFile(".machtiani.ignore", []byte("vendor/\ndist/\n"), 0644)
+
+    code, out := runCLI(t, "doctor")
+    if code != ExitOK {
+        t.Fatalf("Expected exit code %d, got %d\n%s", ExitOK, code, out)
+    }
+    for _, want := range []string{
+        "[ok]   Loaded ",
+        "MODEL_API_KEY is set (*******, from config)",
+        "[ok]   MACHTIANI_URL (",
+        "[ok]   Remote origin = " + testRemoteURL,
+        ".machtiani.ignore lists 2 path(s)",
+    } {
+        if !strings.Contains(out, want) {
+            t.Errorf("Expected output to contain %q, got:\n%s", want, out)
+        }
+    }
+    if strings.Contains(out, "sk-test") || strings.Contains(out, "ghp_test") {
+        t.Errorf("Expected API keys to be redacted, got:\n%s", out)
+    }
+}
+
+func TestDoctor_ReportsProblems(t *testing.T) {
+    server := setupProject(t)
+    server.Close()
+
+    code, out := runCLI(t, "doctor")
+    if code != ExitError {
+        t.Fatalf("Expected exit code %d, got %d\n%s", ExitError, code, out)
+    }
+    if !strings.Contains(out, "[fail] MACHTIANI_URL") || !strings.Contains(out, "unreachable") {
+        t.Errorf("Expected the unreachable service to be reported, got:\n%s", out)
+    }
+
+    os.Remove(".machtiani-config.yml")
+    if code, out := runCLI(t, "doctor"); code != ExitError || !strings.Contains(out, "[fail] No config file") {
+        t.Errorf("Expected the missing config to be reported, got %d:\n%s", code, out)
+    }
+}
+
+func TestRecordAndReplay(t *testing.T) {
+    server := setupProject(t)
+    sessionDir := filepath.Join(t.TempDir(), "session")
+
+    // A warm compatibility cache must not keep the handshake out of the
+    // recording.
+    if code, out := runCLI(t, "status"); code != ExitOK {
+        t.Fatalf("Expected status to succeed, got %d\n%s", code, out)
+    }
+    if code, out := runCLI(t, "status", "--record", sessionDir); code != ExitOK {
+        t.Fatalf("Expected recording to succeed, got %d\n%s", code, out)
+    }
+    server.Close()
+
+    // Replay on a machine that has never talked to the server.
+    home := t.TempDir()
+    t.Setenv("HOME", home)
+    t.Setenv("XDG_CACHE_HOME", filepath.Join(home, ".cache"))
+
+    code, out := runCLI(t, "--replay", sessionDir, "status")
+    if code != ExitOK {
+        t.Fatalf("Expected replay to succeed offline, got %d\n%s", code, out)
+    }
+    if !strings.Contains(out, "Project is ready for chat!") {
+        t.Errorf("Expected the replayed status, got: %s", out)
+    }
+}
@@ -0,0 +1,693 @@
+package cli
+
+import (
+    "context"
+    "errors"
+    "flag"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "log"
+    "os"
+    "sort"
+    "strings"
+
+    "github.com/7db9a/machtiani/internal/api"
+    "github.com/7db9a/machtiani/internal/chat"
+    "github.com/7db9a/machtiani/internal/git"
+    "github.com/7db9a/machtiani/internal/usage"
+    "github.com/7db9a/machtiani/internal/utils"
+)
+
+// requirement is what Run must set up before a command can run.
+type requirement int
+
+const (
+    needsNothing requirement = iota // runs without a config
+    needsConfig                     // loads the config but stays offline
+    needsServer                     // talks to the server after a compatibility check
+)
+
+// command is a machtiani subcommand. Its flags, arguments and examples are
+// declared once and drive parsing, usage errors and help.
+type command struct {
+    name        string
+    summary     string   // one line for the command list
+    description string   // a few lines for the command's help
+    args        string   // positional arguments for the usage line, e.g. "[command]"
+    minArgs     int
+    maxArgs     int      // -1 for no limit
+    required    []string // flags that must be given
+    examples    []example
+    needs       requirement
+
+    // setup registers the command's flags on fs and returns the function
+    // that runs the command once fs has been parsed.
+    setup func(fs *flag.FlagSet) runFunc
+}
+
+type runFunc func(ctx context.Context, env *environment, args []string) error
+
+type example struct {
+    description string
+    command     string
+}
+
+// environment is what Run prepares for a command according to its needs.
+type environment struct {
+    opts          globalOptions
+    out           *output
+    config        utils.Config
+    client        *api.Client
+    compatibility api.Compatibility // the server's answer to the compatibility check
+}
+
+// remoteURL resolves the git remote a command operates on.
+func (env *environment) remoteURL(remoteName string) (string, error) {
+    remoteURL, err := git.GetRemoteURL(&remoteName)
+    if err != nil {
+        return "", fmt.Errorf("getting remote url: %w", err)
+    }
+    env.out.Printf("Using remote URL: %s\n", remoteURL)
+    return remoteURL, nil
+}
+
+// remoteFlag registers --remote on fs.
+func remoteFlag(fs *flag.FlagSet) *string {
+    return fs.String("remote", "origin", "Name of the git `remote` that identifies the project")
+}
+
+// enumValue is a string flag restricted to a fixed set of options. Typos
+// are rejected at parse time with a suggestion.
+type enumValue struct {
+    value   *string
+    options []string
+}
+
+func (e *enumValue) String() string {
+    if e.value == nil {
+        return ""
+    }
+    return *e.value
+}
+
+func (e *enumValue) Set(value string) error {
+    if !contains(e.options, value) {
+        message := "must be one of " + strings.Join(e.options, ", ")
+        if suggestion := utils.Suggest(value, e.options); suggestion != "" {
+            message += fmt.Sprintf("; did you mean %q?", suggestion)
+        }
+        return errors.New(message)
+    }
+    *e.value = value
+    return nil
+}
+
+// enumFlag registers a flag on fs that only accepts one of options.
+func enumFlag(fs *flag.FlagSet, target *string, name, value, usage string, options ...string) {
+    *target = value
+    fs.Var(&enumValue{value: target, options: options}, name, usage)
+}
+
+// deprecatedValue is a flag kept so that existing scripts keep working. It
+// has no effect; setting it prints a warning.
+type deprecatedValue struct {
+    name    string
+    boolean bool
+}
+
+func (d *deprecatedValue) String() string { return "" }
+
+func (d *deprecatedValue) IsBoolFlag() bool { return d.boolean }
+
+func (d *deprecatedValue) Set(value string) error {
+    log.Printf("Warning: --%s is deprecated and has no effect", d.name)
+    return nil
+}
+
+// deprecatedFlag registers a flag on fs that is accepted and ignored.
+// Boolean flags take no value.
+func deprecatedFlag(fs *flag.FlagSet, name string, boolean bool) {
+    fs.Var(&deprecatedValue{name: name, boolean: boolean}, name, "Deprecated; has no effect")
+}
+
+// visitFlags calls fn for the flags of fs that help and completion offer,
+// which leaves out deprecated ones.
+func visitFlags(fs *flag.FlagSet, fn func(*flag.Flag)) {
+    fs.VisitAll(func(f *flag.Flag) {
+        if _, deprecated := f.Value.(*deprecatedValue); !deprecated {
+            fn(f)
+        }
+    })
+}
+
+// promptCommand runs when the first argument is not a command name.
+func promptCommand() *command {
+    return &command{
+        name:        "prompt",
+        summary:     "Ask a question about the current project (the default command).",
+        description: "Sends the prompt, or the chat in --file, to Machtiani and saves the answer to the chat directory\n" +
+            "(.machtiani/chat unless chat.DIR is set in the config). A new chat never overwrites another:\n" +
+            "a name in use gets a counter suffix. A --file in the chat directory is updated; any other\n" +
+            "--file is copied into it as a new chat unless --in-place is given.\n" +
+            "The earlier turns of a chat are sent as context for its last \"# User\" question; a prompt\n" +
+            "given with --file is added to the chat as a new question. Saved chats start with YAML front\n" +
+            "matter recording the settings and commit of the latest answer and the tokens of all answers.",
+        args:        "<prompt>",
+        maxArgs:     -1,
+        needs:       needsServer,
+        examples: []example{
+            {"Providing a direct prompt:", `machtiani "Add a new endpoint to get stats."`},
+            {"Continuing an existing markdown chat file:", "machtiani --file .machtiani/chat/add_state_endpoint.md"},
+            {"Asking a follow-up question in a saved chat:", `machtiani --file .machtiani/chat/add_state_endpoint.md "Now add a test for it."`},
+            {"Answering the question in a notes file, in that file:", "machtiani --file docs/questions.md --in-place"},
+            {"Specifying additional parameters:", `machtiani --model gpt-4o --mode pure-chat --match-strength high "Add a new endpoint to get stats."`},
+            {"Streaming the answer as it is generated:", `machtiani --stream "Add a new endpoint to get stats."`},
+        },
+        setup: func(fs *flag.FlagSet) runFunc {
+            var opts promptOptions
+            promptFlags(fs, &opts)
+            fs.StringVar(&opts.file, "file", "", "Markdown chat `file` to continue instead of a prompt")
+            fs.BoolVar(&opts.inPlace, "in-place", false, "Save the answer to --file itself, even outside the chat directory")
+            fs.BoolVar(&opts.verbose, "verbose", false, "Print the arguments before sending the prompt")
+            deprecatedFlag(fs, "force", true)
+            remote := remoteFlag(fs)
+
+            return func(ctx context.Context, env *environment, args []string) error {
+                remoteURL, err := env.remoteURL(*remote)
+                if err != nil {
+                    return err
+                }
+                return handlePrompt(ctx, env.out, env.client, strings.Join(args, " "), opts, &env.config, &remoteURL, utils.GetCodeHostAPIKey(env.config))
+            }
+        },
+    }
+}
+
+// promptFlags registers the flags that shape an answer, shared by prompts
+// and chat sessions.
+func promptFlags(fs *flag.FlagSet, opts *promptOptions) {
+    enumFlag(fs, &opts.model, "model", defaultModel, "Model to use", promptModels...)
+    enumFlag(fs, &opts.matchStrength, "match-strength", defaultMatchStrength, "Match strength", promptMatchStrengths...)
+    enumFlag(fs, &opts.mode, "mode", defaultMode, "Search mode", promptModes...)
+    fs.BoolVar(&opts.stream, "stream", false, "Stream the answer as it is generated, then render it as markdown")
+}
+
+// commands returns the named commands in the order help lists them.
+func commands() []*command {
+    return []*command{
+        {
+            name:        "chat",
+            summary:     "Start an interactive chat session about the current project.",
+            description: "Reads questions from stdin and answers each with the conversation so far as context.\n" +
+                "The session is saved to the chat directory after every answer. Type /help in the session\n" +
+                "for commands to switch model or mode, list retrieved files, save under a name and exit.",
+            needs: needsServer,
+            examples: []example{
+                {"Exploring a codebase interactively:", "machtiani chat --model gpt-4o --mode super"},
+                {"Resuming a saved session:", "machtiani chat --file .machtiani/chat/add_state_endpoint.md"},
+            },
+            setup: func(fs *flag.FlagSet) runFunc {
+                var opts promptOptions
+                promptFlags(fs, &opts)
+                fs.StringVar(&opts.file, "file", "", "Markdown chat `file` to resume")
+                fs.BoolVar(&opts.inPlace, "in-place", false, "Save the session to --file itself, even outside the chat directory")
+                remote := remoteFlag(fs)
+                return func(ctx context.Context, env *environment, args []string) error {
+                    remoteURL, err := env.remoteURL(*remote)
+                    if err != nil {
+                        return err
+                    }
+                    return handleChat(ctx, env.out, os.Stdin, env.client, opts, &env.config, remoteURL)
+                }
+            },
+        },
+        {
+            name:        "chats",
+            summary:     "List, show, search, rename or remove the saved chats.",
+            description: "Manages the chats in the chat directory. `list` shows each chat with its first question,\n" +
+                "`show` renders one, `search` ranks the chats containing every word of a query and shows the\n" +
+                "matching excerpts, `rename` gives a chat a new name and `rm` deletes chats after confirmation.",
+            args:        "<list|show|search|rename|rm> [arguments]",
+            minArgs:     1,
+            maxArgs:     -1,
+            needs:       needsConfig,
+            examples: []example{
+                {"Finding the chat where the sync handler was discussed:", `machtiani chats search sync handler`},
+                {"Reading it again:", "machtiani chats show where_is_the_sync_handler"},
+                {"Removing chats without confirmation:", "machtiani chats rm --force old_question other_question"},
+            },
+            setup: func(fs *flag.FlagSet) runFunc {
+                var opts chatsOptions
+                fs.BoolVar(&opts.force, "force", false, "Remove without confirmation")
+                return func(ctx context.Context, env *environment, args []string) error {
+                    opts.yes, opts.in = env.opts.yes, os.Stdin
+                    return handleChats(ctx, env.out, chat.Library{Dir: utils.ChatDir(env.config)}, args, opts)
+                }
+            },
+        },
+        {
+            name:        "rerun",
+            summary:     "Ask the last question of a saved chat again and compare the answers.",
+            description: "Re-asks the last \"# User\" question of a chat against the current index, with the model,\n" +
+                "mode and match strength recorded in its front matter unless flags override them. The new\n" +
+                "answer is saved next to the chat; --diff compares it and its retrieved files with the old one.",
+            args:        "<chat>",
+            minArgs:     1,
+            maxArgs:     1,
+            needs:       needsServer,
+            examples: []example{
+                {"Checking whether a re-index changed an answer:", "machtiani rerun .machtiani/chat/add_state_endpoint.md --diff"},
+                {"Comparing another model side by side:", "machtiani rerun add_state_endpoint --model gpt-4o --side-by-side"},
+            },
+            setup: func(fs *flag.FlagSet) runFunc {
+                var opts rerunOptions
+                enumFlag(fs, &opts.model, "model", "", "Model to use instead of the chat's", promptModels...)
+                enumFlag(fs, &opts.matchStrength, "match-strength", "", "Match strength to use instead of the chat's", promptMatchStrengths...)
+                enumFlag(fs, &opts.mode, "mode", "", "Search mode to use instead of the chat's", promptModes...)
+                fs.BoolVar(&opts.stream, "stream", false, "Stream the answer as it is generated, then render it as markdown")
+                fs.BoolVar(&opts.diff, "diff", false, "Show a unified diff of the old and new answers and retrieved files")
+                fs.BoolVar(&opts.sideBySide, "side-by-side", false, "Show the diff in two columns (implies --diff)")
+                remote := remoteFlag(fs)
+                return func(ctx context.Context, env *environment, args []string) error {
+                    remoteURL, err := env.remoteURL(*remote)
+                    if err != nil {
+                        return err
+                    }
+                    return handleRerun(ctx, env.out, env.client, args[0], opts, &env.config, remoteURL)
+                }
+            },
+        },
+        {
+            name:        "git-store",
+            summary:     "Add a repository to the Machtiani system.",
+            description: "Uploads the repository at --remote for indexing, after showing the estimated cost.",
+            needs:       needsServer,
+            examples: []example{
+                {"Storing a repository and waiting until it can be queried:", `machtiani git-store --force --wait && machtiani "Summarize the architecture."`},
+            },
+            setup: func(fs *flag.FlagSet) runFunc {
+                remote := remoteFlag(fs)
+                force := fs.Bool("force", false, "Skip the confirmation prompt")
+                // The server always indexes the default branch.
+                deprecatedFlag(fs, "branch", false)
+                wait := waitFlags(fs)
+                return func(ctx context.Context, env *environment, args []string) error {
+                    waitOpts, err := wait(env.config)
+                    if err != nil {
+                        return err
+                    }
+                    remoteURL, err := env.remoteURL(*remote)
+                    if err != nil {
+                        return err
+                    }
+                    return handleGitStore(env.idempotent(ctx), env.out, env.client, remoteURL, utils.GetCodeHostAPIKey(env.config), *force, env.config, waitOpts)
+                }
+            },
+        },
+        {
+            name:        "git-sync",
+            summary:     "Fetch and index the latest commits of a branch of the repository.",
+            description: "Fetches --branch-name from --remote and indexes the new commits, after showing the estimated cost.",
+            required:    []string{"branch-name"},
+            needs:       needsServer,
+            examples: []example{
+                {"Syncing the main branch without confirmation:", "machtiani git-sync --branch-name main --force"},
+            },
+            setup: func(fs *flag.FlagSet) runFunc {
+                branch := fs.String("branch-name", "", "Name of the `branch` to sync")
+                remote := remoteFlag(fs)
+                force := fs.Bool("force", false, "Skip the confirmation prompt")
+                wait := waitFlags(fs)
+                return func(ctx context.Context, env *environment, args []string) error {
+                    waitOpts, err := wait(env.config)
+                    if err != nil {
+                        return err
+                    }
+                    remoteURL, err := env.remoteURL(*remote)
+                    if err != nil {
+                        return err
+                    }
+                    return handleGitSync(env.idempotent(ctx), env.out, env.client, remoteURL, *branch, utils.GetCodeHostAPIKey(env.config), *force, env.config, waitOpts)
+                }
+            },
+        },
+        {
+            name:        "git-delete",
+            summary:     "Remove a repository from the Machtiani system.",
+            description: "Deletes the stored index of the repository at --remote.",
+            needs:       needsServer,
+            setup: func(fs *flag.FlagSet) runFunc {
+                remote := remoteFlag(fs)
+                force := fs.Bool("force", false, "Skip the confirmation prompt")
+                return func(ctx context.Context, env *environment, args []string) error {
+                    remoteURL, err := env.remoteURL(*remote)
+                    if err != nil {
+                        return err
+                    }
+                    modelAPIKey := env.config.Environment.ModelAPIKey
+                    return handleGitDelete(env.idempotent(ctx), env.out, env.client, remoteURL, remoteURL, []string{}, "git", utils.GetCodeHostAPIKey(env.config), &modelAPIKey, *force)
+                }
+            },
+        },
+        {
+            name:        "status",
+            summary:     "Check the status of the current project. Use --wait to block until it is ready.",
+            description: "Reports whether the project is ready for chat.",
+            needs:       needsServer,
+            setup: func(fs *flag.FlagSet) runFunc {
+                remote := remoteFlag(fs)
+                wait := waitFlags(fs)
+                return func(ctx context.Context, env *environment, args []string) error {
+                    waitOpts, err := wait(env.config)
+                    if err != nil {
+                        return err
+                    }
+                    remoteURL, err := env.remoteURL(*remote)
+                    if err != nil {
+                        return err
+                    }
+                    return handleStatus(ctx, env.out, env.client, remoteURL, utils.GetCodeHostAPIKey(env.config), waitOpts)
+                }
+            },
+        },
+        {
+            name:    "usage",
+            summary: "Summarize or export the local usage ledger.",
+            description: "Summarizes the tokens and estimated cost of every git-store, git-sync, git-delete and prompt,\n" +
+                "as recorded in the local usage ledger. Works offline.",
+            needs: needsConfig,
+            examples: []example{
+                {"Exporting last month's usage per repository for chargeback:", "machtiani usage --by project --since 30d --format csv > usage.csv"},
+            },
+            setup: func(fs *flag.FlagSet) runFunc {
+                var opts usageOptions
+                enumFlag(fs, &opts.by, "by", usage.ByDay, "Group entries by", usage.Groupings...)
+                enumFlag(fs, &opts.format, "format", "text", "Output format", "text", "csv", "json")
+                fs.StringVar(&opts.since, "since", "", "Only include entries since a date (2024-01-31) or a duration ago (24h, 30d)")
+                fs.StringVar(&opts.project, "project", "", "Only include entries for this project remote `URL`")
+                fs.BoolVar(&opts.raw, "raw", false, "Export the individual ledger entries instead of a summary (csv or json)")
+                return func(ctx context.Context, env *environment, args []string) error {
+                    // --output json asks for JSON unless --format says otherwise.
+                    if env.out.json && !isSet(fs, "format") {
+                        opts.format = "json"
+                    }
+                    return handleUsage(env.out, opts, env.config)
+                }
+            },
+        },
+        {
+            name:        "version",
+            summary:     "Show build info and whether the server supports this version.",
+            description: "Prints the version, commit and build date, and asks the configured server whether it supports them.",
+            setup: func(fs *flag.FlagSet) runFunc {
+                return func(ctx context.Context, env *environment, args []string) error {
+                    return handleVersion(ctx, env.out)
+                }
+            },
+        },
+        {
+            name:        "doctor",
+            summary:     "Check the config, credentials, services and repository, and report problems.",
+            description: "Runs every check and prints one line per result. Exits with 1 if any check fails.",
+            examples: []example{
+                {"Collecting diagnostics for a support request:", "machtiani doctor"},
+            },
+            setup: func(fs *flag.FlagSet) runFunc {
+                return func(ctx context.Context, env *environment, args []string) error {
+                    return handleDoctor(ctx, env.out)
+                }
+            },
+        },
+        {
+            name:    "self-update",
+            summary: "Download, verify and install the latest release.",
+            description: "Fetches the release manifest, checks its ed25519 signature, downloads the binary for this\n" +
+                "platform, checks its SHA-256 checksum and signature, and atomically replaces the running\n" +
+                "binary. If anything fails, the installed binary is left unchanged.",
+            setup: func(fs *flag.FlagSet) runFunc {
+                var opts selfUpdateOptions
+                fs.BoolVar(&opts.check, "check", false, "Only report whether an update is available")
+                fs.BoolVar(&opts.force, "force", false, "Reinstall even if the release is not newer")
+                fs.StringVar(&opts.manifest, "manifest", "", "Release manifest `URL` (overrides the config)")
+                return func(ctx context.Context, env *environment, args []string) error {
+                    return handleSelfUpdate(ctx, env.out, opts)
+                }
+            },
+        },
+        {
+            name:        "completion",
+            summary:     "Print a shell completion script for bash, zsh or fish.",
+            description: "Completes commands, flags, flag values, saved chats for --file and git remotes for --remote.",
+            args:        "<shell>",
+            minArgs:     1,
+            maxArgs:     1,
+            examples: []example{
+                {"Enabling completion in the current bash or zsh session:", "source <(machtiani completion bash)"},
+                {"Enabling completion in fish:", "machtiani completion fish > ~/.config/fish/completions/machtiani.fish"},
+            },
+            setup: func(fs *flag.FlagSet) runFunc {
+                return func(ctx context.Context, env *environment, args []string) error {
+                    if err := utils.CheckChoice("shell", args[0], completionShells); err != nil {
+                        return err
+                    }
+                    if env.out.json {
+                        var script strings.Builder
+                        writeCompletionScript(&script, args[0])
+                        return env.out.emit(completionResult{Shell: args[0], Script: script.String()})
+                    }
+                    return writeCompletionScript(env.out.stdout, args[0])
+                }
+            },
+        },
+        {
+            name:        "help",
+            summary:     "Show this help, or the help of one command.",
+            description: "Prints the overview, or the usage, flags and examples of a command.",
+            args:        "[command]",
+            maxArgs:     1,
+            setup: func(fs *flag.FlagSet) runFunc {
+                return func(ctx context.Context, env *environment, args []string) error {
+                    if len(args) == 0 {
+                        return printHelp(env.out)
+                    }
+                    cmd := findCommand(args[0])
+                    if cmd == nil {
+                        return fmt.Errorf("unknown command %q; run `machtiani help` for the list of commands", args[0])
+                    }
+                    return printCommandHelp(env.out, cmd)
+                }
+            },
+        },
+    }
+}
+
+// findCommand returns the command called name, including the prompt
+// command, or nil.
+func findCommand(name string) *command {
+    if name == "prompt" {
+        return promptCommand()
+    }
+    for _, cmd := range commands() {
+        if cmd.name == name {
+            return cmd
+        }
+    }
+    return nil
+}
+
+// resolveCommand picks the command for args and returns it with its
+// arguments. Anything that is not a command name is a prompt, except a
+// single word that looks like a mistyped command.
+func resolveCommand(args []string) (*command, []string, error) {
+    if len(args) == 0 || args[0] == "-h" || args[0] == "-help" || args[0] == "--help" {
+        return findCommand("help"), nil, nil
+    }
+    for _, cmd := range commands() {
+        if cmd.name == args[0] {
+            return cmd, args[1:], nil
+        }
+    }
+    if len(args) == 1 && !strings.HasPrefix(args[0], "-") && !strings.ContainsAny(args[0], " \t") {
+        if suggestion := utils.Suggest(args[0], commandNames()); suggestion != "" {
+            return nil, nil, fmt.Errorf("unknown command %q; did you mean %q?\nTo send it as a prompt instead, run: machtiani -- %s", args[0], suggestion, args[0])
+        }
+    }
+    return promptCommand(), args, nil
+}
+
+// parse parses args against the flags of cmd. Flags may come before or
+// after positional arguments; everything after "--" is positional.
+func (cmd *command) parse(fs *flag.FlagSet, args []string) ([]string, error) {
+    var positional []string
+    for {
+        if err := fs.Parse(args); err != nil {
+            return nil, err
+        }
+        remaining := fs.Args()
+        if consumed := len(args) - len(remaining); consumed > 0 && args[consumed-1] == "--" {
+            positional = append(positional, remaining...)
+            break
+        }
+        if len(remaining) == 0 {
+            break
+        }
+        positional = append(positional, remaining[0])
+        args = remaining[1:]
+    }
+
+    set := map[string]bool{}
+    fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+    for _, name := range cmd.required {
+        if !set[name] {
+            return nil, fmt.Errorf("flag --%s is required", name)
+        }
+    }
+
+    switch {
+    case len(positional) < cmd.minArgs:
+        return nil, fmt.Errorf("missing arguments")
+    case cmd.maxArgs >= 0 && len(positional) > cmd.maxArgs:
+        return nil, fmt.Errorf("unexpected argument %q", positional[cmd.maxArgs])
+    }
+    return positional, nil
+}
+
+// usageError explains a command line that cmd cannot parse.
+func (cmd *command) usageError(err error) error {
+    message := err.Error()
+    if name, ok := strings.CutPrefix(message, "flag provided but not defined: "); ok {
+        var names []string
+        visitFlags(cmd.flagSet(), func(f *flag.Flag) { names = append(names, f.Name) })
+        if suggestion := utils.Suggest(strings.TrimLeft(name, "-"), names); suggestion != "" {
+            message += fmt.Sprintf("; did you mean --%s?", suggestion)
+        }
+    }
+    return fmt.Errorf("%s\nUsage: %s\nRun `machtiani help %s` for its flags.", message, cmd.usageLine(), cmd.name)
+}
+
+// usageLine is the synopsis of cmd, e.g.
+// "machtiani git-sync --branch-name <branch> [flags]".
+func (cmd *command) usageLine() string {
+    fs := cmd.flagSet()
+    parts := []string{"machtiani"}
+    if cmd.name != "prompt" {
+        parts = append(parts, cmd.name)
+    }
+    for _, name := range cmd.required {
+        placeholder, _ := flag.UnquoteUsage(fs.Lookup(name))
+        parts = append(parts, fmt.Sprintf("--%s <%s>", name, placeholder))
+    }
+    if hasFlags(fs) {
+        parts = append(parts, "[flags]")
+    }
+    if cmd.args != "" {
+        parts = append(parts, cmd.args)
+    }
+    return strings.Join(parts, " ")
+}
+
+// flagSet returns a flag set with the flags of cmd registered.
+func (cmd *command) flagSet() *flag.FlagSet {
+    fs := flag.NewFlagSet(cmd.name, flag.ContinueOnError)
+    fs.SetOutput(ioutil.Discard)
+    cmd.setup(fs)
+    return fs
+}
+
+func hasFlags(fs *flag.FlagSet) bool {
+    any := false
+    visitFlags(fs, func(*flag.Flag) { any = true })
+    return any
+}
+
+// writeCommandHelp writes the usage, description, flags and examples of cmd,
+// each line prefixed with indent.
+func writeCommandHelp(w io.Writer, cmd *command, indent string) {
+    fs := cmd.flagSet()
+    fmt.Fprintf(w, "%s%s:\n", indent, cmd.name)
+    fmt.Fprintf(w, "%s  Usage: %s\n", indent, cmd.usageLine())
+    for _, line := range strings.Split(cmd.description, "\n") {
+        fmt.Fprintf(w, "%s  %s\n", indent, line)
+    }
+
+    if hasFlags(fs) {
+        fmt.Fprintf(w, "%s  Flags:\n", indent)
+        writeFlags(w, fs, cmd.required, indent+"    ")
+    }
+
+    if len(cmd.examples) > 0 {
+        fmt.Fprintf(w, "%s  Examples:\n", indent)
+        for _, ex := range cmd.examples {
+            fmt.Fprintf(w, "%s    %s\n", indent, ex.command)
+        }
+    }
+}
+
+// writeFlags lists the flags of fs in name order, one per line.
+func writeFlags(w io.Writer, fs *flag.FlagSet, required []string, indent string) {
+    var flags []*flag.Flag
+    visitFlags(fs, func(f *flag.Flag) { flags = append(flags, f) })
+    sort.Slice(flags, func(i, j int) bool { return flags[i].Name < flags[j].Name })
+
+    for _, f := range flags {
+        placeholder, usage := flag.UnquoteUsage(f)
+        if enum, ok := f.Value.(*enumValue); ok {
+            placeholder = strings.Join(enum.options, "|")
+        }
+        name := "--" + f.Name
+        if placeholder != "" {
+            name += " " + placeholder
+        }
+        switch {
+        case contains(required, f.Name):
+            usage += " (required)"
+        case f.DefValue != "" && f.DefValue != "false" && f.DefValue != "0" && f.DefValue != "0s":
+            usage += fmt.Sprintf(" (default: %s)", f.DefValue)
+        }
+        fmt.Fprintf(w, "%s%-26s %s.\n", indent, name, usage)
+    }
+}
+
+func contains(values []string, value string) bool {
+    for _, v := range values {
+        if v == value {
+            return true
+        }
+    }
+    return false
+}
+
+// isSet reports whether the flag called name was given on the command line.
+func isSet(fs *flag.FlagSet, name string) bool {
+    set := false
+    fs.Visit(func(f *flag.Flag) { set = set || f.Name == name })
+    return set
+}
+
+// runCommand parses args for cmd, prepares what env needs and runs it.
+func runCommand(ctx context.Context, cmd *command, args []string, env *environment) error {
+    fs := flag.NewFlagSet(cmd.name, flag.ContinueOnError)
+    fs.SetOutput(ioutil.Discard)
+    run := cmd.setup(fs)
+
+    positional, err := cmd.parse(fs, args)
+    if errors.Is(err, flag.ErrHelp) {
+        return printCommandHelp(env.out, cmd)
+    }
+    if err != nil {
+        return cmd.usageError(err)
+    }
+
+    if cmd.needs >= needsConfig {
+        if err := env.load(); err != nil {
+            return err
+        }
+    }
+    if cmd.needs >= needsServer {
+        if err := env.connect(ctx); err != nil {
+            return err
+        }
+    }
+    return run(ctx, env, positional)
+}
@@ -0,0 +1,264 @@
+package cli
+
+import (
+    "flag"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "os/exec"
+    "path/filepath"
+    "sort"
+    "strings"
+
+    "github.com/7db9a/machtiani/internal/utils"
+)
+
+// completionShells are the shells `machtiani completion` has scripts for.
+var completionShells = []string{"bash", "zsh", "fish"}
+
+// The scripts hand the words being completed to `machtiani __complete`, so
+// completions always match the commands and flags of the installed binary.
+// When it has no candidates the shell falls back to completing file names.
+const bashCompletion = `# bash completion for machtiani
+# Load it with: source <(machtiani completion bash)
+_machtiani() {
+    local IFS=$'\n'
+    COMPREPLY=($(machtiani __complete "${COMP_WORDS[@]:1:COMP_CWORD}" 2>/dev/null))
+}
+complete -o default -F _machtiani machtiani
+`
+
+const zshCompletion = `#compdef machtiani
+# zsh completion for machtiani
+# Load it with: source <(machtiani completion zsh)
+_machtiani() {
+    local -a candidates
+    candidates=("${(@f)$(machtiani __complete "${(@)words[2,CURRENT]}" 2>/dev/null)}")
+    if [[ -n "${candidates[1]}" ]]; then
+        compadd -- "${candidates[@]}"
+    else
+        _files
+    fi
+}
+compdef _machtiani machtiani
+`
+
+const fishCompletion = `# fish completion for machtiani
+# Load it with: machtiani completion fish | source
+function __machtiani_complete
+    set -l words (commandline -opc)
+    set -l current (commandline -ct)
+    set -l candidates (machtiani __complete $words[2..-1] "$current" 2>/dev/null)
+    if test (count $candidates) -gt 0
+        printf '%s\n' $candidates
+    else
+        __fish_complete_path "$current"
+    end
+end
+complete -c machtiani -f -a '(__machtiani_complete)'
+`
+
+// completionResult is the JSON document of the completion command.
+type completionResult struct {
+    Shell  string `json:"shell"`
+    Script string `json:"script"`
+}
+
+// writeCompletionScript writes the completion script for shell to w.
+func writeCompletionScript(w io.Writer, shell string) error {
+    scripts := map[string]string{"bash": bashCompletion, "zsh": zshCompletion, "fish": fishCompletion}
+    _, err := io.WriteString(w, scripts[shell])
+    return err
+}
+
+// completer lists the values that can complete a command line. Chat files
+// and git remotes come from the working directory.
+type completer struct {
+    chatDir string
+    remotes func() []string
+}
+
+func newCompleter() *completer {
+    chatDir := utils.DefaultChatDir
+    if config, err := utils.LoadConfig(); err == nil {
+        chatDir = utils.ChatDir(config)
+    }
+    return &completer{chatDir: chatDir, remotes: gitRemotes}
+}
+
+// complete returns the candidates for the last of words, which follow the
+// program name. The last word is the one being completed and may be empty.
+func (c *completer) complete(words []string) []string {
+    if len(words) == 0 {
+        words = []string{""}
+    }
+    current, before := words[len(words)-1], words[:len(words)-1]
+
+    // bash splits --flag=value into "--flag", "=" and "value".
+    if len(before) >= 2 && before[len(before)-1] == "=" {
+        before = before[:len(before)-1]
+    }
+
+    // Find the command, skipping global flags and their values.
+    cmd := promptCommand()
+    var cmdArgs []string
+    named := false
+    for i := 0; i < len(before); i++ {
+        word := before[i]
+        if isGlobalValueFlag(word) {
+            i++
+            continue
+        }
+        if !named && !strings.HasPrefix(word, "-") {
+            if found := findCommand(word); found != nil && word != "prompt" {
+                cmd, named = found, true
+                continue
+            }
+        }
+        cmdArgs = append(cmdArgs, word)
+    }
+    fs := cmd.flagSet()
+
+    // The value of a flag, given as "--flag value" or "--flag=value".
+    if name, value, ok := strings.Cut(current, "="); ok && strings.HasPrefix(name, "-") {
+        if strings.TrimLeft(name, "-") == "output" {
+            return withPrefix(name+"=", matching(outputFormats, value))
+        }
+        return withPrefix(name+"=", c.flagValues(fs.Lookup(strings.TrimLeft(name, "-")), value))
+    }
+    if len(before) > 0 {
+        previous := before[len(before)-1]
+        if strings.TrimLeft(previous, "-") == "output" {
+            return matching(outputFormats, current)
+        }
+        if isGlobalValueFlag(previous) {
+            return nil
+        }
+        if strings.HasPrefix(previous, "-") && !strings.Contains(previous, "=") {
+            if f := fs.Lookup(strings.TrimLeft(previous, "-")); f != nil && !isBoolFlag(f) {
+                return c.flagValues(f, current)
+            }
+        }
+    }
+
+    if strings.HasPrefix(current, "-") {
+        var names []string
+        visitFlags(fs, func(f *flag.Flag) { names = append(names, "--"+f.Name) })
+        for _, f := range globalFlags {
+            names = append(names, strings.Fields(f.name)[0])
+        }
+        return matching(names, current)
+    }
+
+    switch {
+    case !named && len(cmdArgs) == 0:
+        return matching(commandNames(), current)
+    case cmd.name == "help" && len(cmdArgs) == 0:
+        return matching(append(commandNames(), "prompt"), current)
+    case cmd.name == "completion" && len(cmdArgs) == 0:
+        return matching(completionShells, current)
+    case cmd.name == "rerun" && len(cmdArgs) == 0:
+        return matching(c.chatFiles(), current)
+    case cmd.name == "chats" && len(cmdArgs) == 0:
+        return matching(chatsSubcommands, current)
+    case cmd.name == "chats" && contains([]string{"show", "rename", "rm"}, cmdArgs[0]) && (cmdArgs[0] == "rm" || len(cmdArgs) == 1):
+        return matching(c.chatNames(), current)
+    }
+    return nil
+}
+
+func commandNames() []string {
+    var names []string
+    for _, cmd := range commands() {
+        names = append(names, cmd.name)
+    }
+    return names
+}
+
+// flagValues lists the values f accepts that start with prefix.
+func (c *completer) flagValues(f *flag.Flag, prefix string) []string {
+    if f == nil {
+        return nil
+    }
+    if enum, ok := f.Value.(*enumValue); ok {
+        return matching(enum.options, prefix)
+    }
+    switch f.Name {
+    case "remote":
+        return matching(c.remotes(), prefix)
+    case "file":
+        return matching(c.chatFiles(), prefix)
+    }
+    return nil
+}
+
+// chatFiles lists the saved chats, relative to the working directory.
+func (c *completer) chatFiles() []string {
+    entries, err := ioutil.ReadDir(c.chatDir)
+    if err != nil {
+        return nil
+    }
+    var files []string
+    for _, entry := range entries {
+        if !entry.IsDir() && strings.HasSuffix(entry.Name(), ".md") {
+            files = append(files, filepath.Join(c.chatDir, entry.Name()))
+        }
+    }
+    return files
+}
+
+// chatNames lists the names of the saved chats, as the chats command takes
+// them.
+func (c *completer) chatNames() []string {
+    var names []string
+    for _, file := range c.chatFiles() {
+        names = append(names, strings.TrimSuffix(filepath.Base(file), ".md"))
+    }
+    return names
+}
+
+// gitRemotes lists the remotes of the repository in the working directory.
+func gitRemotes() []string {
+    output, err := exec.Command("git", "remote").Output()
+    if err != nil {
+        return nil
+    }
+    return strings.Fields(string(output))
+}
+
+func isGlobalValueFlag(word string) bool {
+    name := strings.TrimLeft(word, "-")
+    return strings.HasPrefix(word, "-") && (name == "record" || name == "replay" || name == "output")
+}
+
+func isBoolFlag(f *flag.Flag) bool {
+    boolFlag, ok := f.Value.(interface{ IsBoolFlag() bool })
+    return ok && boolFlag.IsBoolFlag()
+}
+
+// matching returns the candidates that start with prefix, sorted.
+func matching(candidates []string, prefix string) []string {
+    var out []string
+    for _, candidate := range candidates {
+        if strings.HasPrefix(candidate, prefix) {
+            out = append(out, candidate)
+        }
+    }
+    sort.Strings(out)
+    return out
+}
+
+func withPrefix(prefix string, values []string) []string {
+    out := make([]string, len(values))
+    for i, value := range values {
+        out[i] = prefix + value
+    }
+    return out
+}
+
+// printCompletions prints one candidate per line for the shell scripts.
+func printCompletions(w io.Writer, candidates []string) {
+    for _, candidate := range candidates {
+        fmt.Fprintln(w, candidate)
+    }
+}
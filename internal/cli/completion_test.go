@@ -0,0 +1,75 @@
+package cli
+
+import (
+    "bytes"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "reflect"
+    "strings"
+    "testing"
+)
+
+func newTestCompleter(t *testing.T) *completer {
+    dir := filepath.Join(t.TempDir(), "chat")
+    if err := os.MkdirAll(dir, 0755); err != nil {
+        t.Fatal(err)
+    }
+    for _, name := range []string{"add_stats.md", "fix_sync.md", "notes.txt"} {
+        if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+            t.Fatal(err)
+        }
+    }
+    return &completer{chatDir: dir, remotes: func() []string { return []string{"origin", "upstream"} }}
+}
+
+func TestComplete(t *testing.T) {
+    c := newTestCompleter(t)
+    chat := func(name string) string { return filepath.Join(c.chatDir, name) }
+
+    cases := []struct {
+        words []string
+        want  []string
+    }{
+        {[]string{"git-s"}, []string{"git-store", "git-sync"}},
+        {[]string{"help", "ver"}, []string{"version"}},
+        {[]string{"completion", ""}, []string{"bash", "fish", "zsh"}},
+        {[]string{"git-sync", "--br"}, []string{"--branch-name"}},
+        {[]string{"git-store", "--remote", ""}, []string{"origin", "upstream"}},
+        {[]string{"git-store", "--remote=up"}, []string{"--remote=upstream"}},
+        {[]string{"--model", "gpt-4o-"}, []string{"gpt-4o-mini"}},
+        {[]string{"--mode", ""}, []string{"commit", "pure-chat", "super"}},
+        {[]string{"--match-strength", "=", "h"}, []string{"high"}},
+        {[]string{"usage", "--format", "j"}, []string{"json"}},
+        {[]string{"--file", ""}, []string{chat("add_stats.md"), chat("fix_sync.md")}},
+        {[]string{"chats", "r"}, []string{"rename", "rm"}},
+        {[]string{"rerun", ""}, []string{chat("add_stats.md"), chat("fix_sync.md")}},
+        {[]string{"chats", "show", ""}, []string{"add_stats", "fix_sync"}},
+        {[]string{"chats", "rename", "add_stats", ""}, nil},
+        {[]string{"--replay", "session", "sta"}, []string{"status"}},
+        {[]string{"--stream", "--ov"}, []string{"--override-budget"}},
+        {[]string{"--record", ""}, nil},
+        {[]string{"git-store", "--force", ""}, nil},
+    }
+    for _, tc := range cases {
+        if got := c.complete(tc.words); !reflect.DeepEqual(got, tc.want) {
+            t.Errorf("complete(%q) = %q, want %q", tc.words, got, tc.want)
+        }
+    }
+}
+
+func TestCompletionScripts(t *testing.T) {
+    for _, shell := range completionShells {
+        var buf bytes.Buffer
+        if err := writeCompletionScript(&buf, shell); err != nil {
+            t.Fatalf("Unexpected error: %v", err)
+        }
+        if !strings.Contains(buf.String(), "machtiani __complete") {
+            t.Errorf("Expected the %s script to call back into machtiani, got:\n%s", shell, buf.String())
+        }
+        fallback := map[string]string{"bash": "-o default", "zsh": "_files", "fish": "__fish_complete_path"}[shell]
+        if !strings.Contains(buf.String(), fallback) {
+            t.Errorf("Expected the %s script to fall back to file names with %s, got:\n%s", shell, fallback, buf.String())
+        }
+    }
+}
@@ -0,0 +1,237 @@
+package cli
+
+import (
+    "context"
+    "fmt"
+    "os"
+    "os/exec"
+    "path/filepath"
+    "strings"
+    "time"
+
+    "github.com/7db9a/machtiani/internal/api"
+    "github.com/7db9a/machtiani/internal/utils"
+)
+
+// doctorReport prints one line per check, and keeps the checks and counts
+// of failures and warnings for the JSON document.
+type doctorReport struct {
+    out      *output
+    current  string
+    Checks   []doctorCheck `json:"checks"`
+    Failures int           `json:"failures"`
+    Warnings int           `json:"warnings"`
+}
+
+// doctorCheck is the outcome of one check: "ok", "warn" or "fail".
+type doctorCheck struct {
+    Section string `json:"section"`
+    Status  string `json:"status"`
+    Message string `json:"message"`
+}
+
+func (r *doctorReport) add(status, format string, args ...interface{}) {
+    message := fmt.Sprintf(format, args...)
+    r.Checks = append(r.Checks, doctorCheck{Section: r.current, Status: status, Message: message})
+    r.out.Printf("%-6s %s\n", "["+status+"]", message)
+}
+
+func (r *doctorReport) ok(format string, args ...interface{}) {
+    r.add("ok", format, args...)
+}
+
+func (r *doctorReport) warn(format string, args ...interface{}) {
+    r.Warnings++
+    r.add("warn", format, args...)
+}
+
+func (r *doctorReport) fail(format string, args ...interface{}) {
+    r.Failures++
+    r.add("fail", format, args...)
+}
+
+func (r *doctorReport) section(title string) {
+    r.current = title
+    r.out.Printf("\n%s\n", title)
+}
+
+// handleDoctor checks the local setup and the services it points at, and
+// reports on each in turn. It fails if any check fails.
+func handleDoctor(ctx context.Context, out *output) error {
+    report := &doctorReport{out: out}
+
+    report.section("Build")
+    report.ok("machtiani %s (commit %s, built %s)", api.Version, api.HeadOID, api.BuildDate)
+
+    report.section("Config")
+    config, configOK := doctorConfig(report)
+
+    if configOK {
+        report.section("Credentials")
+        doctorCredentials(report, config)
+
+        report.section("Services")
+        doctorServices(ctx, report, config)
+    }
+
+    report.section("Repository")
+    doctorRepository(report)
+
+    report.section("Tools")
+    if path, err := exec.LookPath("aicommit"); err == nil {
+        report.ok("aicommit found at %s", path)
+    } else {
+        report.warn("aicommit not found on PATH; commit message generation is unavailable")
+    }
+
+    if ctx.Err() != nil {
+        return ctx.Err()
+    }
+    out.Println()
+    // The report is the document even when checks failed.
+    if err := out.emit(report); err != nil {
+        return err
+    }
+    if report.Failures > 0 {
+        return fmt.Errorf("doctor found %d problem(s) and %d warning(s)", report.Failures, report.Warnings)
+    }
+    out.Printf("No problems found (%d warning(s)).\n", report.Warnings)
+    return nil
+}
+
+func doctorConfig(report *doctorReport) (utils.Config, bool) {
+    path, err := utils.FindConfigFile()
+    if err != nil {
+        report.fail("No config file: looked for .machtiani-config.yml in the current and home directories")
+        return utils.Config{}, false
+    }
+    if absolute, err := filepath.Abs(path); err == nil {
+        path = absolute
+    }
+    report.ok("Loaded %s", path)
+
+    config, err := utils.LoadConfig()
+    if err != nil {
+        report.fail("Config is invalid: %v", err)
+        return config, false
+    }
+
+    required := []struct{ key, value string }{
+        {"MACHTIANI_URL", config.Environment.MachtianiURL},
+        {"MACHTIANI_REPO_MANAGER_URL", config.Environment.RepoManagerURL},
+        {"CONTENT_TYPE_KEY", config.Environment.ContentTypeKey},
+        {"CONTENT_TYPE_VALUE", config.Environment.ContentTypeValue},
+    }
+    for _, item := range required {
+        report.ok("%s = %s", item.key, item.value)
+    }
+
+    if _, err := api.NewClient(config); err != nil {
+        report.fail("Config is invalid: %v", err)
+        return config, false
+    }
+    return config, true
+}
+
+func doctorCredentials(report *doctorReport, config utils.Config) {
+    source := "config"
+    if os.Getenv("MODEL_API_KEY") != "" {
+        source = "MODEL_API_KEY environment variable"
+    }
+    if key := config.Environment.ModelAPIKey; key != "" {
+        report.ok("MODEL_API_KEY is set (%s, from %s)", redactSecret(key), source)
+    } else {
+        report.fail("MODEL_API_KEY is not set; prompts and indexing need a model API key")
+    }
+
+    if key := config.Environment.CodeHostAPIKey; key != "" {
+        report.ok("CODE_HOST_API_KEY is set (%s)", redactSecret(key))
+    } else {
+        report.warn("CODE_HOST_API_KEY is not set; only public repositories can be stored")
+    }
+
+    gatewayKey, gatewayValue := config.Environment.APIGatewayHostKey, config.Environment.APIGatewayHostValue
+    switch {
+    case gatewayKey != "" && gatewayValue != "":
+        report.ok("API gateway header %s is set (%s)", gatewayKey, redactSecret(gatewayValue))
+    case gatewayKey != "" || gatewayValue != "":
+        report.warn("Only one of API_GATEWAY_HOST_KEY and API_GATEWAY_HOST_VALUE is set; the gateway header is not sent")
+    }
+}
+
+func doctorServices(ctx context.Context, report *doctorReport, config utils.Config) {
+    client, err := api.NewClient(config)
+    if err != nil {
+        report.fail("Cannot create API client: %v", err)
+        return
+    }
+
+    reachable := true
+    for _, service := range []struct{ name, url string }{
+        {"MACHTIANI_URL", config.Environment.MachtianiURL},
+        {"MACHTIANI_REPO_MANAGER_URL", config.Environment.RepoManagerURL},
+    } {
+        latency, status, err := client.Ping(ctx, service.url)
+        if err != nil {
+            report.fail("%s (%s) is unreachable: %v", service.name, service.url, err)
+            reachable = false
+            continue
+        }
+        report.ok("%s (%s) answered HTTP %d in %s", service.name, service.url, status, latency.Round(time.Millisecond))
+    }
+    if !reachable {
+        return
+    }
+
+    result, err := client.CheckCompatibility(ctx)
+    switch {
+    case err != nil:
+        report.fail("Compatibility check failed: %v", err)
+    case !result.Compatible:
+        report.fail("This CLI (%s) is not supported by the server: %s", result.ClientVersion, strings.TrimSpace(result.Message))
+    case result.Legacy:
+        report.ok("Server accepts this build (legacy head_oid check)")
+    default:
+        report.ok("Server %s supports this CLI (%s to %s)", orAny(result.ServerVersion), orAny(result.MinVersion), orAny(result.MaxVersion))
+    }
+    if result.Compatible {
+        for _, deprecation := range result.Deprecations {
+            report.warn("Deprecated: %s", deprecation)
+        }
+    }
+}
+
+func doctorRepository(report *doctorReport) {
+    output, err := exec.Command("git", "rev-parse", "--show-toplevel").Output()
+    if err != nil {
+        report.fail("Not inside a git repository; run machtiani from a clone of the project")
+        return
+    }
+    report.ok("Git repository at %s", strings.TrimSpace(string(output)))
+
+    remote := "origin"
+    if remoteURL, err := utils.GetCodehostURLFromCurrentRepository(); err == nil {
+        report.ok("Remote %s = %s", remote, remoteURL)
+    } else {
+        report.fail("Remote %s is not set; add it with `git remote add %s <url>`", remote, remote)
+    }
+
+    if _, err := os.Stat(".machtiani.ignore"); os.IsNotExist(err) {
+        report.ok("No .machtiani.ignore; every file is indexed")
+        return
+    }
+    patterns, err := utils.LoadIgnoreFiles()
+    if err != nil {
+        report.fail(".machtiani.ignore could not be read: %v", err)
+        return
+    }
+    report.ok(".machtiani.ignore lists %d path(s)", len(patterns))
+}
+
+// redactSecret keeps just enough of a key to tell which one is configured.
+func redactSecret(secret string) string {
+    if len(secret) <= 8 {
+        return strings.Repeat("*", len(secret))
+    }
+    return secret[:3] + "..." + secret[len(secret)-4:]
+}
@@ -0,0 +1,87 @@
+package cli
+
+import (
+    "context"
+    "errors"
+
+    "github.com/7db9a/machtiani/internal/api"
+    "github.com/7db9a/machtiani/internal/budget"
+)
+
+// Exit codes returned by machtiani. Scripts depend on these values, so
+// existing codes must never be renumbered.
+const (
+    ExitOK           = 0
+    ExitError        = 1   // any failure not covered below
+    ExitConfig       = 2   // config file missing or invalid
+    ExitNetwork      = 3   // a service could not be reached
+    ExitAuth         = 4   // credentials were rejected
+    ExitServerBusy   = 5   // the project is locked, usually still being indexed
+    ExitIncompatible = 6   // this CLI version is not supported by the server
+    ExitAborted      = 7   // the user declined the confirmation prompt
+    ExitTimeout      = 8   // --wait gave up before the project finished processing
+    ExitBudget       = 9   // the operation would exceed a configured token budget
+    ExitInterrupted  = 130 // cancelled with Ctrl-C or SIGTERM
+)
+
+// exitError pins an error to a specific exit code.
+type exitError struct {
+    code int
+    err  error
+}
+
+func (e *exitError) Error() string {
+    return e.err.Error()
+}
+
+func (e *exitError) Unwrap() error {
+    return e.err
+}
+
+// withExitCode makes err exit the process with code.
+func withExitCode(code int, err error) error {
+    return &exitError{code: code, err: err}
+}
+
+// exitCode maps err to one of the documented exit codes.
+func exitCode(err error) int {
+    if err == nil {
+        return ExitOK
+    }
+
+    var pinned *exitError
+    if errors.As(err, &pinned) {
+        return pinned.code
+    }
+    if errors.Is(err, api.ErrAborted) || errors.Is(err, api.ErrNotInteractive) {
+        return ExitAborted
+    }
+    if errors.Is(err, context.Canceled) {
+        return ExitInterrupted
+    }
+
+    var budgetErr *budget.ExceededError
+    if errors.As(err, &budgetErr) {
+        return ExitBudget
+    }
+
+    var apiErr *api.Error
+    if errors.As(err, &apiErr) {
+        switch {
+        case apiErr.IsAuth():
+            return ExitAuth
+        case apiErr.IsBusy():
+            return ExitServerBusy
+        case apiErr.IsIncompatible():
+            return ExitIncompatible
+        }
+        return ExitError
+    }
+
+    var netErr *api.NetworkError
+    if errors.As(err, &netErr) {
+        return ExitNetwork
+    }
+
+    return ExitError
+}
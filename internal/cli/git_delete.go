@@ -1,19 +1,18 @@
 package cli
 
 import (
-    "fmt"
-    "log"
+    "context"
 
     "github.com/7db9a/machtiani/internal/api"
-    "github.com/7db9a/machtiani/internal/utils"
 )
 
-func handleGitDelete(remoteURL string, projectName string, ignoreFiles []string, vcsType string, apiKey *string, openaiAPIKey *string, forceFlag bool, config utils.Config) {
+func handleGitDelete(ctx context.Context, out *output, client *api.Client, remoteURL string, projectName string, ignoreFiles []string, vcsType string, apiKey *string, openaiAPIKey *string, forceFlag bool) error {
     // Call the updated DeleteStore function
-    response, err := api.DeleteStore(projectName, remoteURL, ignoreFiles, vcsType, apiKey, openaiAPIKey, config.Environment.RepoManagerURL, forceFlag)
+    response, err := client.DeleteStore(ctx, projectName, remoteURL, ignoreFiles, vcsType, apiKey, openaiAPIKey, forceFlag)
     if err != nil {
-        log.Fatalf("Error deleting store: %v", err)
+        return err
     }
 
-    fmt.Println(response.Message)
+    out.Println(response.Message)
+    return out.emit(projectResult{Project: remoteURL, Message: response.Message})
 }
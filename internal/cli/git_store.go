@@ -1,22 +1,47 @@
 package cli
 
 import (
-    "fmt"
-    "log"
+    "context"
     "github.com/7db9a/machtiani/internal/api"
     "github.com/7db9a/machtiani/internal/utils"
 )
 
-func handleGitStore(remoteURL string, apiKey *string, forceFlag bool, config utils.Config) {
+// projectResult is the JSON document of the commands that change a project
+// on the server.
+type projectResult struct {
+    Project       string  `json:"project"`
+    Branch        string  `json:"branch,omitempty"`
+    Message       string  `json:"message"`
+    FullPath      string  `json:"full_path,omitempty"`
+    Ready         bool    `json:"ready,omitempty"`
+    WaitedSeconds float64 `json:"waited_seconds,omitempty"`
+}
+
+func handleGitStore(ctx context.Context, out *output, client *api.Client, remoteURL string, apiKey *string, forceFlag bool, config utils.Config, wait waitOptions) error {
+    ignoreFiles, err := utils.LoadIgnoreFiles()
+    if err != nil {
+        return err
+    }
+
     // Call the new function to add the repository
-    response, err := api.AddRepository(remoteURL, remoteURL, apiKey, config.Environment.ModelAPIKey, config.Environment.RepoManagerURL, forceFlag)
+    response, err := client.AddRepository(ctx, remoteURL, remoteURL, apiKey, config.Environment.ModelAPIKey, ignoreFiles, forceFlag)
     if err != nil {
-        log.Fatalf("Error adding repository: %v", err)
+        return err
     }
+    result := projectResult{Project: remoteURL, Message: response.Message, FullPath: response.FullPath}
 
-    fmt.Println(response.Message)
+    out.Println(response.Message)
     // Print the success message
-    fmt.Println("---")
-    fmt.Println("Your repo is getting added to machtiani is in progress!")
-    fmt.Println("Please check back by running `machtiani status` to see if it completed.")
+    out.Println("---")
+    out.Println("Your repo is getting added to machtiani is in progress!")
+    if wait.enabled {
+        waited, err := waitForProject(ctx, out, client, remoteURL, apiKey, wait)
+        if err != nil {
+            return err
+        }
+        result.Ready, result.WaitedSeconds = true, waited.Seconds()
+        return out.emit(result)
+    }
+    out.Println("Please check back by running `machtiani status` to see if it completed.")
+    return out.emit(result)
 }
@@ -1,24 +1,38 @@
 package cli
 
 import (
+    "context"
     "fmt"
 
     "github.com/7db9a/machtiani/internal/api"
     "github.com/7db9a/machtiani/internal/utils"
 )
 
-func handleGitSync(remoteURL, branchName string, apiKey *string, force bool, config utils.Config) error {
+func handleGitSync(ctx context.Context, out *output, client *api.Client, remoteURL, branchName string, apiKey *string, force bool, config utils.Config, wait waitOptions) error {
     if remoteURL == "" || branchName == "" {
-        return fmt.Errorf("Error: all flags --remote and --branch-name must be provided.")
+        return fmt.Errorf("all flags --remote and --branch-name must be provided.")
+    }
+
+    ignoreFiles, err := utils.LoadIgnoreFiles()
+    if err != nil {
+        return err
     }
 
     // Call the function to fetch and checkout the branch
-    message, err := api.FetchAndCheckoutBranch(remoteURL, remoteURL, branchName, apiKey, config.Environment.ModelAPIKey, force)
+    message, err := client.FetchAndCheckoutBranch(ctx, remoteURL, remoteURL, branchName, apiKey, config.Environment.ModelAPIKey, ignoreFiles, force)
     if err != nil {
-        return fmt.Errorf("Error syncing repository: %w", err)
+        return fmt.Errorf("syncing repository: %w", err)
     }
+    result := projectResult{Project: remoteURL, Branch: branchName, Message: message}
 
     // Print the returned message
-    fmt.Println(message)
-    return nil
+    out.Println(message)
+    if wait.enabled {
+        waited, err := waitForProject(ctx, out, client, remoteURL, apiKey, wait)
+        if err != nil {
+            return err
+        }
+        result.Ready, result.WaitedSeconds = true, waited.Seconds()
+    }
+    return out.emit(result)
 }
@@ -0,0 +1,97 @@
+package cli
+
+import (
+    "fmt"
+    "strconv"
+    "strings"
+
+    "github.com/7db9a/machtiani/internal/utils"
+)
+
+// globalOptions are flags accepted anywhere on the command line, before or
+// after the command.
+type globalOptions struct {
+    record         string // directory to record HTTP cassettes into
+    replay         string // directory to replay HTTP cassettes from
+    overrideBudget bool   // let operations over the configured budget through
+    yes            bool   // answer yes to confirmation prompts
+    output         string // text or json
+}
+
+// extractGlobalFlags removes the global flags from args and returns them
+// along with the remaining arguments. Everything after "--" is left alone.
+func extractGlobalFlags(args []string) (globalOptions, []string, error) {
+    opts := globalOptions{output: outputText}
+    var rest []string
+
+    for i := 0; i < len(args); i++ {
+        arg := args[i]
+        if arg == "--" {
+            rest = append(rest, args[i:]...)
+            break
+        }
+        if !strings.HasPrefix(arg, "-") {
+            rest = append(rest, arg)
+            continue
+        }
+
+        name, value, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+        var toggle *bool
+        switch name {
+        case "override-budget":
+            toggle = &opts.overrideBudget
+        case "yes", "y":
+            toggle = &opts.yes
+        }
+        if toggle != nil {
+            set, err := strconv.ParseBool(value)
+            if !hasValue {
+                set, err = true, nil
+            }
+            if err != nil {
+                return opts, nil, fmt.Errorf("invalid value %q for flag --%s", value, name)
+            }
+            *toggle = set
+            continue
+        }
+
+        var target *string
+        switch name {
+        case "record":
+            target = &opts.record
+        case "replay":
+            target = &opts.replay
+        case "output":
+            target = &opts.output
+        default:
+            rest = append(rest, arg)
+            continue
+        }
+
+        if !hasValue {
+            if i+1 >= len(args) {
+                return opts, nil, fmt.Errorf("flag --%s needs a value", name)
+            }
+            i++
+            value = args[i]
+        }
+        *target = value
+    }
+
+    if err := utils.CheckChoice("--output", opts.output, outputFormats); err != nil {
+        return opts, nil, err
+    }
+    if opts.record != "" && opts.replay != "" {
+        return opts, nil, fmt.Errorf("--record and --replay cannot be used together")
+    }
+    return opts, rest, nil
+}
+
+// globalFlags documents the flags extractGlobalFlags understands.
+var globalFlags = []struct{ name, usage string }{
+    {"--record dir", "Record every HTTP request and response to dir, with API keys and tokens redacted."},
+    {"--replay dir", "Serve responses recorded with --record from dir instead of the network."},
+    {"--override-budget", "Proceed even if the operation exceeds a configured token budget."},
+    {"--yes", "Answer yes to confirmation prompts (short: -y). Needed to proceed when stdin is not a terminal."},
+    {"--output text|json", "Print prose (text, the default), or one JSON document on stdout with diagnostics on stderr."},
+}
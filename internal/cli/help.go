@@ -1,68 +1,221 @@
 package cli
 
 import (
+    "flag"
     "fmt"
+    "io"
+    "sort"
+    "strings"
 )
 
-func printHelp() {
-    helpText := `Usage: machtiani [flags] [prompt]
-
-    Machtiani is a command-line interface (CLI) tool designed to facilitate code chat and information retrieval from code repositories.
-
-    Commands:
-      git-store                    Add a repository to the Machtiani system.
-      git-sync                     Fetch and checkout a specific branch of the repository.
-      git-delete                   Remove a repository from the Machtiani system.
-      status                       Check the status of the current project.
-
-    Global Flags:
-      -file string                 Path to the markdown file (optional).
-      -project string              Name of the project (optional).
-      -model string                Model to use (options: gpt-4o, gpt-4o-mini; default: gpt-4o-mini).
-      -match-strength string       Match strength (options: high, mid, low; default: mid).
-      -mode string                 Search mode (options: pure-chat, commit, super; default: commit).
-      --force                      Skip confirmation prompt and proceed with the operation.
-      -verbose                     Enable verbose output.
-
-    Subcommands:
-
-    git-store:
-      Usage: machtiani git-store --branch <default_branch> --remote <remote_name> [--force]
-      Adds a repository to Machtiani system.
-      Flags:
-        --branch string            Name of the default branch (required).
-        --remote string            Name of the remote repository (default: "origin").
-        --force                    Skip confirmation prompt.
-
-    git-sync:
-      Usage: machtiani git-sync --branch <default_branch> --remote <remote_name> [--force]
-      Syncs with a specific branch of the repository.
-      Flags:
-        --branch string            Name of the branch (required).
-        --remote string            Name of the remote repository (default: "origin").
-        --force                    Skip confirmation prompt.
-
-    git-delete:
-      Usage: machtiani git-delete --remote <remote_name> [--force]
-      Removes a repository from Machtiani system.
-      Flags:
-        --remote string            Name of the remote repository (required).
-        --force                    Skip confirmation prompt.
-
-    Examples:
-      Providing a direct prompt:
-        machtiani "Add a new endpoint to get stats."
-
-      Using an existing markdown chat file:
-        machtiani --file .machtiani/chat/add_state_endpoint.md
-
-      Specifying additional parameters:
-        machtiani "Add a new endpoint to get stats." --model gpt-4o --mode pure-chat --match-strength high
-
-      Using the '--force' flag to skip confirmation:
-        machtiani git-store --branch master --force
-
-    `
-    fmt.Println(helpText)
+// helpTopics documents the config sections that tune the commands.
+const helpTopics = `    Retries:
+      Calls to the repo manager are retried on network errors, 429 and 5xx responses with
+      exponential backoff, honoring Retry-After. Tune this in .machtiani-config.yml:
+
+        retry:
+          MAX_ATTEMPTS: 4          # total attempts; 1 disables retries
+          INITIAL_BACKOFF: "1s"
+          MAX_BACKOFF: "30s"
+
+    Waiting:
+      status, git-store and git-sync accept --wait. The defaults for --wait-interval and
+      --wait-timeout can be set in .machtiani-config.yml:
+
+        wait:
+          INTERVAL: "5s"
+          TIMEOUT: "30m"
+
+    Cost Estimates:
+      git-store and git-sync show the estimated dollar cost of indexing before asking to proceed,
+      and prompts show a local estimate of their token count and input cost. Prices are in US
+      dollars per million tokens; override or add models in .machtiani-config.yml:
+
+        pricing:
+          EMBEDDING_MODEL: "text-embedding-3-large"   # used to price embedding tokens
+          INFERENCE_MODEL: "gpt-4o-mini"              # used to price indexing inference tokens
+          MODELS:
+            gpt-4o:
+              INPUT: 2.50
+              OUTPUT: 10.00
+
+    Budgets:
+      Token limits refuse git-store, git-sync and prompts that would exceed them, even with
+      --force, unless --override-budget is given. Zero or unset means no limit. The daily
+      limit counts the last 24 hours of the usage ledger (~/.machtiani/usage.jsonl).
+
+        budget:
+          MAX_TOKENS_PER_STORE: 5000000
+          MAX_TOKENS_PER_SYNC: 1000000
+          MAX_TOKENS_PER_PROMPT: 50000
+          MAX_TOKENS_PER_DAY: 10000000
+        usage:
+          LEDGER_PATH: "~/.machtiani/usage.jsonl"
+
+    Compatibility:
+      Before talking to the server, machtiani sends its version and capabilities and checks that
+      the server supports it. A successful check is cached for an hour; deprecation warnings from
+      the server are printed to stderr. help, usage, version, doctor and self-update skip the check.
+
+        compatibility:
+          CACHE_TTL: "1h"          # "0s" checks before every command
+
+    Non-interactive Use:
+      When stdout is not a terminal the spinner is replaced by a "Still working..." line every 30
+      seconds and answers are rendered without colors. When stdin is not a terminal, commands that
+      would ask for confirmation fail with exit code 7 unless --yes or --force is given. Set
+      MACHTIANI_NONINTERACTIVE=1 to get the same behavior on CI systems that allocate a terminal.
+
+    Updates:
+      self-update reads the release manifest from the URL built into the binary, or from an internal
+      mirror set in .machtiani-config.yml:
+
+        update:
+          MANIFEST_URL: "https://mirror.example.com/machtiani/manifest.json"
+
+      The manifest and every binary must be signed with the release key built into machtiani; no
+      config file can change it. Mirrors that sign their own builds ship binaries built with
+      MACHTIANI_UPDATE_PUBLIC_KEY set to their key.
+
+`
+
+// helpExitCodes documents the exit codes in exit.go.
+const helpExitCodes = `    Exit Codes:
+      0                            Success.
+      1                            Unclassified error.
+      2                            Config file missing or invalid.
+      3                            A Machtiani service could not be reached.
+      4                            Credentials were rejected.
+      5                            The project is locked, usually because it is still being indexed.
+      6                            This CLI version is not compatible with the server.
+      7                            The operation was aborted at the confirmation prompt, or needed
+                                   confirmation without a terminal and --yes.
+      8                            --wait timed out before the project finished processing.
+      9                            The operation would exceed a configured token budget.
+      130                          The operation was cancelled with Ctrl-C or SIGTERM. A cancelled prompt
+                                   is still saved to the chat directory with a note that it was cancelled.
+
+`
+
+// printHelp prints the overview of every command. The command sections are
+// generated from the command registry, so they cannot drift from the flags
+// the commands actually accept. With --output json it emits the registry
+// itself, for tools that wrap machtiani.
+func printHelp(out *output) error {
+    if out.json {
+        result := helpResult{}
+        for _, cmd := range append([]*command{promptCommand()}, commands()...) {
+            result.Commands = append(result.Commands, describeCommand(cmd))
+        }
+        for _, f := range globalFlags {
+            result.GlobalFlags = append(result.GlobalFlags, flagDoc{Name: strings.Fields(f.name)[0], Usage: f.usage})
+        }
+        return out.emit(result)
+    }
+    writeHelp(out.stdout)
+    return nil
+}
+
+// printCommandHelp prints the help of cmd, or emits its description with
+// --output json.
+func printCommandHelp(out *output, cmd *command) error {
+    if out.json {
+        return out.emit(describeCommand(cmd))
+    }
+    writeCommandHelp(out.stdout, cmd, "")
+    return nil
+}
+
+// helpResult is the JSON document of the help command.
+type helpResult struct {
+    Commands    []commandDoc `json:"commands"`
+    GlobalFlags []flagDoc    `json:"global_flags"`
+}
+
+type commandDoc struct {
+    Name        string    `json:"name"`
+    Summary     string    `json:"summary"`
+    Description string    `json:"description"`
+    Usage       string    `json:"usage"`
+    Flags       []flagDoc `json:"flags"`
+    Examples    []exampleDoc `json:"examples,omitempty"`
+}
+
+type exampleDoc struct {
+    Description string `json:"description"`
+    Command     string `json:"command"`
+}
+
+type flagDoc struct {
+    Name     string   `json:"name"`
+    Value    string   `json:"value,omitempty"` // placeholder of the value; empty for switches
+    Usage    string   `json:"usage"`
+    Default  string   `json:"default,omitempty"`
+    Options  []string `json:"options,omitempty"`
+    Required bool     `json:"required,omitempty"`
 }
 
+// describeCommand is the help of cmd as data.
+func describeCommand(cmd *command) commandDoc {
+    doc := commandDoc{Name: cmd.name, Summary: cmd.summary, Description: cmd.description, Usage: cmd.usageLine(), Flags: []flagDoc{}}
+    for _, ex := range cmd.examples {
+        doc.Examples = append(doc.Examples, exampleDoc{Description: ex.description, Command: ex.command})
+    }
+    fs := cmd.flagSet()
+    visitFlags(fs, func(f *flag.Flag) {
+        placeholder, usage := flag.UnquoteUsage(f)
+        fd := flagDoc{Name: "--" + f.Name, Value: placeholder, Usage: usage, Default: f.DefValue, Required: contains(cmd.required, f.Name)}
+        if enum, ok := f.Value.(*enumValue); ok {
+            fd.Options = enum.options
+        }
+        if isBoolFlag(f) {
+            fd.Default = ""
+        }
+        doc.Flags = append(doc.Flags, fd)
+    })
+    sort.Slice(doc.Flags, func(i, j int) bool { return doc.Flags[i].Name < doc.Flags[j].Name })
+    return doc
+}
+
+func writeHelp(w io.Writer) {
+    all := append([]*command{promptCommand()}, commands()...)
+
+    fmt.Fprintln(w, "Usage: machtiani [global flags] <command> [flags] [arguments]")
+    fmt.Fprintln(w, "       machtiani [global flags] [prompt flags] <prompt>")
+    fmt.Fprintln(w)
+    fmt.Fprintln(w, "    Machtiani is a command-line interface (CLI) tool designed to facilitate code chat and information retrieval from code repositories.")
+    fmt.Fprintln(w)
+
+    fmt.Fprintln(w, "    Commands:")
+    for _, cmd := range all {
+        fmt.Fprintf(w, "      %-28s %s\n", cmd.name, cmd.summary)
+    }
+    fmt.Fprintln(w)
+
+    fmt.Fprintln(w, "    Global Flags:")
+    fmt.Fprintln(w, "      These are accepted before or after any command.")
+    for _, f := range globalFlags {
+        fmt.Fprintf(w, "      %-28s %s\n", f.name, f.usage)
+    }
+    fmt.Fprintln(w)
+
+    fmt.Fprintln(w, "    Subcommands:")
+    for _, cmd := range all {
+        fmt.Fprintln(w)
+        writeCommandHelp(w, cmd, "    ")
+    }
+    fmt.Fprintln(w)
+
+    fmt.Fprint(w, helpTopics)
+    fmt.Fprint(w, helpExitCodes)
+
+    fmt.Fprintln(w, "    Examples:")
+    for _, cmd := range all {
+        for _, ex := range cmd.examples {
+            fmt.Fprintf(w, "      %s\n        %s\n\n", ex.description, ex.command)
+        }
+    }
+    fmt.Fprintln(w, "      Recording a session to attach to a bug report, then replaying it offline:")
+    fmt.Fprintln(w, "        machtiani --record ./session \"Why does the sync fail?\"")
+    fmt.Fprintln(w, "        machtiani --replay ./session \"Why does the sync fail?\"")
+}
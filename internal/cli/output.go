@@ -0,0 +1,95 @@
+package cli
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log"
+    "os"
+
+    "github.com/7db9a/machtiani/internal/api"
+    "github.com/7db9a/machtiani/internal/utils"
+)
+
+// Output formats accepted by --output.
+const (
+    outputText = "text"
+    outputJSON = "json"
+)
+
+var outputFormats = []string{outputText, outputJSON}
+
+// output is where a command reports to the user. In text mode everything is
+// printed to stdout as prose. In JSON mode the prose, progress and warnings
+// go to stderr, and the command writes a single JSON document to stdout with
+// emit, so scripts can parse stdout without scraping.
+type output struct {
+    json    bool
+    stdout  *os.File // the command's result
+    text    *os.File // prose: stdout in text mode, stderr in JSON mode
+    emitted bool
+}
+
+func newOutput(format string) *output {
+    if format == outputJSON {
+        return &output{json: true, stdout: os.Stdout, text: os.Stderr}
+    }
+    return &output{stdout: os.Stdout, text: os.Stdout}
+}
+
+func (o *output) Printf(format string, args ...interface{}) {
+    fmt.Fprintf(o.text, format, args...)
+}
+
+func (o *output) Println(args ...interface{}) {
+    fmt.Fprintln(o.text, args...)
+}
+
+// textIsTerminal reports whether prose is shown on a terminal, where it
+// can be redrawn in place.
+func (o *output) textIsTerminal() bool {
+    return utils.IsTerminal(o.text)
+}
+
+// emit writes result to stdout as the command's JSON document. It does
+// nothing in text mode, where the prose already said everything.
+func (o *output) emit(result interface{}) error {
+    if !o.json {
+        return nil
+    }
+    o.emitted = true
+    encoder := json.NewEncoder(o.stdout)
+    encoder.SetIndent("", "  ")
+    encoder.SetEscapeHTML(false)
+    return encoder.Encode(result)
+}
+
+// errorResult is the JSON document of a command that failed.
+type errorResult struct {
+    Error    string `json:"error"`
+    ExitCode int    `json:"exit_code"`
+}
+
+// reportError prints err, if any, and returns the matching exit code. In
+// JSON mode a command that failed before emitting its result emits an
+// errorResult instead, so stdout always holds one document.
+func (o *output) reportError(err error) int {
+    code := exitCode(err)
+    switch code {
+    case ExitOK:
+    case ExitAborted:
+        if errors.Is(err, api.ErrNotInteractive) {
+            log.Printf("Error: %v", err)
+            break
+        }
+        fmt.Fprintln(o.text, "Operation aborted by user")
+    case ExitInterrupted:
+        fmt.Fprintln(o.text, "Operation cancelled")
+    default:
+        log.Printf("Error: %v", err)
+    }
+    if err != nil && o.json && !o.emitted {
+        o.emit(errorResult{Error: err.Error(), ExitCode: code})
+    }
+    return code
+}
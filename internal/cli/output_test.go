@@ -0,0 +1,110 @@
+package cli
+
+import (
+    "encoding/json"
+    "io/ioutil"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/7db9a/machtiani/internal/testserver"
+)
+
+// decodeOutput parses stdout as a single JSON document into v.
+func decodeOutput(t *testing.T, out string, v interface{}) {
+    decoder := json.NewDecoder(strings.NewReader(out))
+    if err := decoder.Decode(v); err != nil {
+        t.Fatalf("Expected stdout to be a JSON document: %v\n%s", err, out)
+    }
+    if decoder.More() {
+        t.Fatalf("Expected stdout to hold exactly one JSON document, got:\n%s", out)
+    }
+}
+
+func TestOutputJSON_Status(t *testing.T) {
+    server := setupProject(t)
+    server.SetLocked(true, 90*time.Second)
+    server.SetProgress("embedding", 0.5)
+
+    code, out := runCLI(t, "status", "--output", "json")
+    if code != ExitOK {
+        t.Fatalf("Expected exit code %d, got %d\n%s", ExitOK, code, out)
+    }
+    var result statusResult
+    decodeOutput(t, out, &result)
+    if result.Ready || result.Project != testRemoteURL || result.LockDurationSeconds != 90 || result.Phase != "embedding" {
+        t.Errorf("Unexpected status document: %+v", result)
+    }
+
+    // The flag is global, so it may also come first.
+    server.SetLocked(false, 0)
+    _, out = runCLI(t, "--output=json", "status")
+    decodeOutput(t, out, &result)
+    if !result.Ready {
+        t.Errorf("Expected the project to be ready, got: %+v", result)
+    }
+}
+
+func TestOutputJSON_Prompt(t *testing.T) {
+    server := setupProject(t)
+    server.SetAnswer(testserver.Answer{Text: "Use the handler in api.go.", RetrievedFilePaths: []string{"internal/api/api.go"}})
+    server.SetFilename("where_is_the_handler")
+
+    code, out := runCLI(t, "--output", "json", "Where is the handler?")
+    if code != ExitOK {
+        t.Fatalf("Expected exit code %d, got %d\n%s", ExitOK, code, out)
+    }
+    var result promptResult
+    decodeOutput(t, out, &result)
+    if result.Answer != "Use the handler in api.go." || result.ChatFile != ".machtiani/chat/where_is_the_handler.md" || result.Model != defaultModel {
+        t.Errorf("Unexpected prompt document: %+v", result)
+    }
+    if len(result.RetrievedFilePaths) != 1 || result.RetrievedFilePaths[0] != "internal/api/api.go" {
+        t.Errorf("Expected the retrieved file paths, got: %v", result.RetrievedFilePaths)
+    }
+    if _, err := ioutil.ReadFile(result.ChatFile); err != nil {
+        t.Errorf("Expected the chat to be saved: %v", err)
+    }
+}
+
+func TestOutputJSON_Error(t *testing.T) {
+    server := setupProject(t)
+    server.SetAnswer(testserver.Answer{Error: "model overloaded"})
+
+    code, out := runCLI(t, "--output", "json", "hello")
+    if code != ExitError {
+        t.Fatalf("Expected exit code %d, got %d\n%s", ExitError, code, out)
+    }
+    var result errorResult
+    decodeOutput(t, out, &result)
+    if result.ExitCode != ExitError || !strings.Contains(result.Error, "model overloaded") {
+        t.Errorf("Unexpected error document: %+v", result)
+    }
+}
+
+func TestOutputJSON_Help(t *testing.T) {
+    setupProject(t)
+
+    code, out := runCLI(t, "help", "git-sync", "--output", "json")
+    if code != ExitOK {
+        t.Fatalf("Expected exit code %d, got %d\n%s", ExitOK, code, out)
+    }
+    var doc commandDoc
+    decodeOutput(t, out, &doc)
+    found := false
+    for _, f := range doc.Flags {
+        found = found || (f.Name == "--branch-name" && f.Required)
+    }
+    if doc.Name != "git-sync" || !found {
+        t.Errorf("Expected git-sync with a required --branch-name, got: %+v", doc)
+    }
+}
+
+func TestOutputFlag_RejectsUnknownFormat(t *testing.T) {
+    setupProject(t)
+
+    code, out := runCLI(t, "--output", "jsn", "status")
+    if code != ExitError {
+        t.Errorf("Expected exit code %d, got %d\n%s", ExitError, code, out)
+    }
+}
@@ -1,17 +1,21 @@
 package cli
 
 import (
-    "encoding/json"
-    "flag"
+    "context"
+    "errors"
     "fmt"
     "io/ioutil"
     "log"
-    "net/http"
-    "net/url"
     "path"
+    "path/filepath"
     "strings"
+    "time"
 
     "github.com/7db9a/machtiani/internal/api"
+    "github.com/7db9a/machtiani/internal/chat"
+    "github.com/7db9a/machtiani/internal/git"
+    "github.com/7db9a/machtiani/internal/pricing"
+    "github.com/7db9a/machtiani/internal/usage"
     "github.com/7db9a/machtiani/internal/utils"
     "github.com/charmbracelet/glamour"
 )
@@ -22,195 +26,397 @@ const (
     defaultMode         = "commit"
 )
 
-func handlePrompt(args []string, config *utils.Config, remoteURL *string, apiKey *string) {
-    fs := flag.NewFlagSet("machtiani", flag.ContinueOnError)
-    modelFlag := fs.String("model", defaultModel, "Model to use (options: gpt-4o, gpt-4o-mini)")
-    matchStrengthFlag := fs.String("match-strength", defaultMatchStrength, "Match strength (options: high, mid, low)")
-    modeFlag := fs.String("mode", defaultMode, "Search mode: pure-chat, commit, or super")
-    fileFlag := fs.String("file", "", "Path to the markdown file")
-    forceFlag := fs.Bool("force", false, "Force the operation")
-    verboseFlag := fs.Bool("verbose", false, "Enable verbose output")
-
-    // Parse the flags from args
-    err := fs.Parse(args)
-    if err != nil {
-        log.Fatalf("Error parsing flags: %v", err)
-    }
+// The values the prompt flags accept.
+var (
+    promptModels         = []string{"gpt-4o", "gpt-4o-mini"}
+    promptMatchStrengths = []string{"high", "mid", "low"}
+    promptModes          = []string{"pure-chat", "commit", "super"}
+)
 
-    // Collect non-flag arguments (the prompt)
-    promptParts := fs.Args()
-    prompt := strings.Join(promptParts, " ")
+// promptOptions are the flags of a prompt.
+type promptOptions struct {
+    model         string
+    matchStrength string
+    mode          string
+    file          string
+    inPlace       bool // save to file itself, wherever it is
+    verbose       bool
+    stream        bool
+}
 
-    // If --file flag is provided, read the content from the file
-    if *fileFlag != "" {
-        content, err := ioutil.ReadFile(*fileFlag)
+// promptResult is the JSON document of a prompt.
+type promptResult struct {
+    Answer             string          `json:"answer"`
+    RetrievedFilePaths []string        `json:"retrieved_file_paths"`
+    ChatFile           string          `json:"chat_file,omitempty"`
+    Machtiani          string          `json:"machtiani,omitempty"`
+    Model              string          `json:"model"`
+    Mode               string          `json:"mode"`
+    Usage              *api.TokenUsage `json:"usage,omitempty"`
+    Warnings           []string        `json:"warnings,omitempty"`
+    DurationSeconds    float64         `json:"duration_seconds"`
+}
+
+func handlePrompt(ctx context.Context, out *output, client *api.Client, prompt string, opts promptOptions, config *utils.Config, remoteURL *string, apiKey *string) error {
+    startTime := time.Now()
+
+    // The conversation to answer: the chat in --file, where a prompt is a
+    // follow-up question, or a new one.
+    var conversation chat.Transcript
+    if opts.inPlace && opts.file == "" {
+        return fmt.Errorf("--in-place needs --file")
+    }
+    saver := newChatSaver(config, opts.file, opts.inPlace)
+    if opts.file != "" {
+        content, err := readMarkdownFile(opts.file)
         if err != nil {
-            log.Fatalf("Error reading markdown file: %v", err)
+            return err
         }
-        prompt = string(content) // Set prompt to the content of the file
+        conversation = chat.Parse(content)
     } else if prompt == "" {
-        log.Fatal("Error: No prompt provided. Please provide either a prompt or a markdown file.")
+        return fmt.Errorf("No prompt provided. Please provide either a prompt or a markdown file.")
     }
-
-    if *verboseFlag {
-        printVerboseInfo(*fileFlag, *modelFlag, *matchStrengthFlag, *modeFlag, prompt)
+    if prompt != "" {
+        conversation.Add(chat.User, prompt)
     }
-
-    apiResponse, err := api.GenerateResponse(prompt, *remoteURL, *modeFlag, *modelFlag, *matchStrengthFlag, *forceFlag)
-    if err != nil {
-        log.Fatalf("Error making API call: %v", err)
+    _, question, ok := conversation.Pending()
+    if !ok {
+        return fmt.Errorf("the chat in %s has no new question; add one under a \"# User\" heading or pass it as a prompt", opts.file)
     }
 
-    if errorMsg, ok := apiResponse["error"].(string); ok {
-        log.Fatalf("Error from API: %s", errorMsg)
+    if opts.verbose {
+        printVerboseInfo(out, opts.file, opts.model, opts.matchStrength, opts.mode, question)
     }
 
-    // Determine the filename to save the response
-    filename := path.Base(*fileFlag)
-
-    // Strip all extensions from the filename
-    for ext := path.Ext(filename); ext != ""; ext = path.Ext(filename) {
-        filename = strings.TrimSuffix(filename, ext)
+    apiResponse, partial, shown, err := sendPrompt(ctx, out, client, &conversation, opts, config, *remoteURL)
+    if err != nil {
+        if errors.Is(err, context.Canceled) {
+            saveCancelledChat(out, saver, conversation, partial, opts.file)
+        }
+        return err
     }
 
-    if filename == "" || filename == "." {
-        filename, err = generateFilename(prompt, config.Environment.ModelAPIKey)
+    // Determine the filename to save the response
+    filename := chatFilename(opts.file)
+    if saver.path == "" && filename == "" {
+        filename, err = client.GenerateFilename(ctx, question, config.Environment.ModelAPIKey)
         if err != nil {
-            log.Fatalf("Error generating filename: %v", err)
+            return fmt.Errorf("generating filename: %w", err)
         }
     }
 
-    handleAPIResponse(prompt, apiResponse, filename, *fileFlag)
+    chatFile, err := handleAPIResponse(out, saver, conversation, apiResponse, filename, shown)
+    if err != nil {
+        return err
+    }
+    out.Printf("Total response handling took %s\n", time.Since(startTime))
+
+    retrieved := apiResponse.RetrievedFilePaths
+    if retrieved == nil {
+        retrieved = []string{}
+    }
+    return out.emit(promptResult{
+        Answer:             apiResponse.OpenAIResponse,
+        RetrievedFilePaths: retrieved,
+        ChatFile:           chatFile,
+        Machtiani:          apiResponse.Machtiani,
+        Model:              opts.model,
+        Mode:               opts.mode,
+        Usage:              apiResponse.Usage,
+        Warnings:           apiResponse.Warnings,
+        DurationSeconds:    time.Since(startTime).Seconds(),
+    })
 }
 
-func generateFilename(context string, apiKey string) (string, error) {
-    config, err := utils.LoadConfig()
-    if err != nil {
-        log.Fatalf("Error loading config: %v", err)
+// sendPrompt asks the final question of conversation, with the turns before
+// it as messages. It checks the budget first and records the tokens spent
+// after, and streams the answer to out with opts.stream. Once answered, the
+// metadata of conversation describes the answer, and shown reports whether
+// the streamed answer was left on out.text, which is not a terminal that it
+// can be erased from, so rendering it again would print it twice. On
+// failure it also returns whatever part of the answer had arrived.
+func sendPrompt(ctx context.Context, out *output, client *api.Client, conversation *chat.Transcript, opts promptOptions, config *utils.Config, remoteURL string) (apiResponse api.GenerateResponseResult, partial string, shown bool, err error) {
+    prior, question, ok := conversation.Pending()
+    if !ok {
+        return apiResponse, "", false, fmt.Errorf("the conversation has no question to answer")
+    }
+    var messages []api.Message
+    text := []string{question}
+    for _, turn := range prior {
+        messages = append(messages, api.Message{Role: turn.Role, Content: turn.Content})
+        text = append(text, turn.Content)
     }
 
-    endpoint := config.Environment.MachtianiURL
-    if endpoint == "" {
-        return "", fmt.Errorf("MACHTIANI_URL environment variable is not set")
+    estimatedTokens := printPromptEstimate(out, client.Pricing, opts.model, strings.Join(text, "\n\n"))
+    spend := usage.Entry{Command: usage.CommandPrompt, Project: remoteURL, Model: opts.model, Mode: opts.mode, PromptTokens: estimatedTokens, Estimated: true}
+    if err := client.Budget.Check(spend); err != nil {
+        return apiResponse, "", false, err
     }
 
-    url := fmt.Sprintf("%s/generate-filename?context=%s&api_key=%s", endpoint, url.QueryEscape(context), url.QueryEscape(apiKey))
+    ignoreFiles, err := utils.LoadIgnoreFiles()
+    if err != nil {
+        return apiResponse, "", false, err
+    }
 
-    req, err := http.NewRequest("GET", url, nil)
+    // Retrieve the codehost URL based on the current Git project.
+    codehostURL, err := utils.GetCodehostURLFromCurrentRepository()
     if err != nil {
-        return "", fmt.Errorf("failed to create request: %v", err)
+        return apiResponse, "", false, fmt.Errorf("getting codehost URL: %w", err)
     }
 
-    if config.Environment.APIGatewayHostKey != "" && config.Environment.APIGatewayHostValue != "" {
-        req.Header.Set(config.Environment.APIGatewayHostKey, config.Environment.APIGatewayHostValue)
+    request := api.GenerateRequest{
+        Prompt:         question,
+        Messages:       messages,
+        Project:        remoteURL,
+        Mode:           opts.mode,
+        Model:          opts.model,
+        MatchStrength:  opts.matchStrength,
+        ModelAPIKey:    config.Environment.ModelAPIKey,
+        CodeHostAPIKey: config.Environment.CodeHostAPIKey,
+        CodeHostURL:    codehostURL,
+        IgnoreFiles:    ignoreFiles,
     }
-    req.Header.Set(config.Environment.ContentTypeKey, config.Environment.ContentTypeValue)
 
-    client := &http.Client{}
-    resp, err := client.Do(req)
+    var streamed strings.Builder
+    started := time.Now()
+    if opts.stream {
+        printer := newStreamPrinter(out.text)
+        apiResponse, err = client.GenerateResponseStream(ctx, request, func(token string) {
+            streamed.WriteString(token)
+            printer.Write(token)
+        })
+        if err == nil {
+            printer.Clear()
+            shown = !printer.tty && streamed.Len() > 0
+        } else {
+            out.Println()
+        }
+    } else {
+        apiResponse, err = client.GenerateResponse(ctx, request)
+    }
+    latency := time.Since(started)
     if err != nil {
-        return "", fmt.Errorf("failed to call generate-filename endpoint: %v", err)
+        return apiResponse, streamed.String(), false, fmt.Errorf("making API call: %w", err)
+    }
+
+    if apiResponse.Error != "" {
+        return apiResponse, "", false, fmt.Errorf("from API: %s", apiResponse.Error)
     }
-    defer resp.Body.Close()
 
-    if resp.StatusCode != http.StatusOK {
-        body, _ := ioutil.ReadAll(resp.Body)
-        return "", fmt.Errorf("generate-filename endpoint returned status %d: %s", resp.StatusCode, string(body))
+    if apiResponse.Usage != nil {
+        spend.EmbeddingTokens = apiResponse.Usage.EmbeddingTokens
+        spend.PromptTokens = apiResponse.Usage.PromptTokens
+        spend.CompletionTokens = apiResponse.Usage.CompletionTokens
+        spend.Estimated = false
     }
+    client.RecordUsage(spend, started)
+    stampChat(conversation, opts, remoteURL, apiResponse.Usage, latency)
 
-    var filename string
-    if err := json.NewDecoder(resp.Body).Decode(&filename); err != nil {
-        return "", fmt.Errorf("failed to decode response from generate-filename endpoint: %v", err)
+    for _, warning := range apiResponse.Warnings {
+        log.Printf("Warning from API: %s", warning)
     }
+    return apiResponse, "", shown, nil
+}
 
-    return filename, nil
+// stampChat records in the metadata of conversation the settings, code
+// state and latency of its latest answer, and adds the answer's tokens to
+// the total of the chat. The state of the repository is left out where git
+// cannot tell it, e.g. before the first commit.
+func stampChat(conversation *chat.Transcript, opts promptOptions, remoteURL string, tokens *api.TokenUsage, latency time.Duration) {
+    now := time.Now().UTC().Truncate(time.Second)
+    meta := chat.Metadata{Created: now}
+    if conversation.Meta != nil {
+        meta = *conversation.Meta
+    }
+    if meta.Created.IsZero() {
+        meta.Created = now
+    }
+    meta.Updated = now
+    meta.ClientVersion = api.HeadOID
+    meta.Model = opts.model
+    meta.Mode = opts.mode
+    meta.MatchStrength = opts.matchStrength
+    meta.RemoteURL = remoteURL
+    meta.Branch, _ = git.GetCurrentBranch()
+    meta.HeadSHA, _ = git.GetHeadCommit()
+    meta.DirtyWorktree, _ = git.HasUncommittedChanges()
+    if tokens != nil {
+        meta.TotalUsage.PromptTokens += tokens.PromptTokens
+        meta.TotalUsage.CompletionTokens += tokens.CompletionTokens
+        meta.TotalUsage.EmbeddingTokens += tokens.EmbeddingTokens
+        meta.TotalUsage.TotalTokens += tokens.TotalTokens
+    }
+    meta.ServerLatencyMS = latency.Milliseconds()
+    conversation.Meta = &meta
 }
 
-func handleAPIResponse(prompt string, apiResponse map[string]interface{}, filename string, fileFlag string) {
-    // Timing within this function is no longer needed since the timing is handled in Execute
+// chatFilename derives the chat filename from the --file flag, or returns
+// "" when there is none.
+func chatFilename(fileFlag string) string {
+    filename := path.Base(fileFlag)
 
-    // Check for the "machtiani" key first
-    if machtianiMsg, ok := apiResponse["machtiani"].(string); ok {
-        log.Printf("Machtiani Message: %s", machtianiMsg)
-        return // Exit early since we do not have further responses to handle
+    // Strip all extensions from the filename
+    for ext := path.Ext(filename); ext != ""; ext = path.Ext(filename) {
+        filename = strings.TrimSuffix(filename, ext)
     }
 
-    openAIResponse, ok := apiResponse["openai_response"].(string)
-    if !ok {
-        log.Fatalf("Error: openai_response key missing")
+    if filename == "." {
+        return ""
     }
+    return filename
+}
 
-    var retrievedFilePaths []string
-    if paths, exists := apiResponse["retrieved_file_paths"].([]interface{}); exists {
-        for _, path := range paths {
-            if filePath, valid := path.(string); valid {
-                retrievedFilePaths = append(retrievedFilePaths, filePath)
-            }
-        }
-    } else {
-        log.Fatalf("Error: retrieved_file_paths key missing")
+// chatSaver saves a conversation as it grows. The first save of a new chat
+// picks a name no other chat has; later saves replace that file.
+type chatSaver struct {
+    library chat.Library
+    path    string // the file saves replace; "" until a new chat is first saved
+}
+
+// newChatSaver returns the saver of the conversation read from file, or of
+// a new one if file is "". A chat in the chat directory is updated, as is
+// any other file with inPlace; otherwise the conversation is saved as a new
+// chat named after file.
+func newChatSaver(config *utils.Config, file string, inPlace bool) *chatSaver {
+    saver := &chatSaver{library: chat.Library{Dir: utils.ChatDir(*config)}}
+    if file != "" && (inPlace || inDir(file, saver.library.Dir)) {
+        saver.path = file
     }
+    return saver
+}
 
-    markdownContent := createMarkdownContent(prompt, openAIResponse, retrievedFilePaths, fileFlag)
-    renderMarkdown(markdownContent)
+// save writes content and returns its path. name is the name of a new chat.
+func (s *chatSaver) save(name, content string) (string, error) {
+    if s.path != "" {
+        return s.path, utils.WriteFileAtomic(s.path, []byte(content), 0644)
+    }
+    saved, err := s.library.Create(name, content)
+    if err != nil {
+        return "", err
+    }
+    s.path = saved
+    return saved, nil
+}
 
-    // Save the response to the markdown file with the provided filename
-    tempFile, err := utils.CreateTempMarkdownFile(markdownContent, filename) // Pass the filename
+// saveAs saves content as a new chat called name, which later saves replace.
+func (s *chatSaver) saveAs(name, content string) (string, error) {
+    s.path = ""
+    return s.save(name, content)
+}
+
+// inDir reports whether file is directly in dir.
+func inDir(file, dir string) bool {
+    absFile, err := filepath.Abs(file)
     if err != nil {
-        log.Fatalf("Error creating markdown file: %v", err)
+        return false
     }
+    absDir, err := filepath.Abs(dir)
+    return err == nil && filepath.Dir(absFile) == absDir
+}
 
-    fmt.Printf("Response saved to %s\n", tempFile)
+// saveCancelledChat records a prompt whose request was cancelled, along with
+// any part of the answer that was streamed before the cancellation.
+func saveCancelledChat(out *output, saver *chatSaver, conversation chat.Transcript, partialAnswer, fileFlag string) {
+    filename := chatFilename(fileFlag)
+    if filename == "" {
+        filename = "cancelled-" + time.Now().Format("20060102-150405")
+    }
+
+    note := "_Request cancelled before an answer was received._"
+    if partialAnswer != "" {
+        note = partialAnswer + "\n\n_Request cancelled before the answer was complete._"
+    }
+
+    conversation.Add(chat.Assistant, note)
+    tempFile, err := saver.save(filename, conversation.Markdown())
+    if err != nil {
+        log.Printf("Error saving cancelled chat: %v", err)
+        return
+    }
+    out.Printf("Cancelled request saved to %s\n", tempFile)
 }
 
-func createMarkdownContent(prompt, openAIResponse string, retrievedFilePaths []string, fileFlag string) string {
-    var markdownContent string
-    if fileFlag != "" {
-        markdownContent = fmt.Sprintf("%s\n\n# Assistant\n\n%s", readMarkdownFile(fileFlag), openAIResponse)
-    } else {
-        markdownContent = fmt.Sprintf("# User\n\n%s\n\n# Assistant\n\n%s", prompt, openAIResponse)
+// handleAPIResponse shows the answer, unless it was already shown while it
+// streamed, and saves the chat, returning the path of the chat file, or ""
+// when the server sent a message instead of an answer.
+func handleAPIResponse(out *output, saver *chatSaver, conversation chat.Transcript, apiResponse api.GenerateResponseResult, filename string, shown bool) (string, error) {
+    // Check for the machtiani message first
+    if apiResponse.Machtiani != "" {
+        log.Printf("Machtiani Message: %s", apiResponse.Machtiani)
+        return "", nil // Exit early since we do not have further responses to handle
     }
 
-    if len(retrievedFilePaths) > 0 {
-        markdownContent += "\n\n# Retrieved File Paths\n\n"
-        for _, path := range retrievedFilePaths {
-            markdownContent += fmt.Sprintf("- %s\n", path)
+    conversation.Turns = append(conversation.Turns, chat.Turn{Role: chat.Assistant, Content: apiResponse.OpenAIResponse, RetrievedFilePaths: apiResponse.RetrievedFilePaths})
+    // In JSON mode the answer is part of the document; rendering it to
+    // stderr as well would only duplicate it. The front matter is for the
+    // file, not the reader.
+    if !out.json && !shown {
+        if err := renderMarkdown(out, conversation.Body()); err != nil {
+            return "", err
         }
     }
 
-    return markdownContent
+    // Save the response, to a new chat named filename unless the chat
+    // already has a file
+    tempFile, err := saver.save(filename, conversation.Markdown())
+    if err != nil {
+        return "", fmt.Errorf("creating markdown file: %w", err)
+    }
+
+    out.Printf("Response saved to %s\n", tempFile)
+    return tempFile, nil
 }
 
-func renderMarkdown(content string) {
+func renderMarkdown(out *output, content string) error {
+    // Off a terminal, style escapes would end up in logs as garbage.
+    style := glamour.WithAutoStyle()
+    if !out.textIsTerminal() {
+        style = glamour.WithStandardStyle("notty")
+    }
     renderer, err := glamour.NewTermRenderer(
-        glamour.WithAutoStyle(),
+        style,
         glamour.WithWordWrap(120),
     )
     if err != nil {
-        log.Fatalf("Error creating renderer: %v", err)
+        return fmt.Errorf("creating renderer: %w", err)
     }
 
-    out, err := renderer.Render(content)
+    rendered, err := renderer.Render(content)
     if err != nil {
-        log.Fatalf("Error rendering Markdown: %v", err)
+        return fmt.Errorf("rendering Markdown: %w", err)
     }
 
-    fmt.Println(out)
+    out.Println(rendered)
+    return nil
 }
 
-func readMarkdownFile(path string) string {
+func readMarkdownFile(path string) (string, error) {
     content, err := ioutil.ReadFile(path)
     if err != nil {
-        log.Fatalf("Error reading markdown file: %v", err)
+        return "", fmt.Errorf("reading markdown file: %w", err)
+    }
+    return string(content), nil
+}
+
+// printPromptEstimate prints and returns a local estimate of the tokens and
+// input cost of prompt. The count is approximate, and the server adds
+// retrieved code to the prompt, so the real cost is usually higher.
+func printPromptEstimate(out *output, prices pricing.Table, model, prompt string) int {
+    tokens := pricing.EstimateTokens(prompt)
+    cost, ok := prices.InputCost(model, tokens)
+    if !ok {
+        out.Printf("Estimated prompt tokens: ~%d, approximate (no price configured for %s)\n", tokens, model)
+        return tokens
     }
-    return string(content)
+    out.Printf("Estimated prompt tokens: ~%d, approximate (about %s with %s, before retrieved code is added)\n", tokens, pricing.FormatUSD(cost), model)
+    return tokens
 }
 
-func printVerboseInfo(markdown, model, matchStrength, mode, prompt string) {
-    fmt.Println("Arguments passed:")
-    fmt.Printf("Markdown file: %s\n", markdown)
-    fmt.Printf("Model: %s\n", model)
-    fmt.Printf("Match strength: %s\n", matchStrength)
-    fmt.Printf("Mode: %s\n", mode)
-    fmt.Printf("Prompt: %s\n", prompt)
+func printVerboseInfo(out *output, markdown, model, matchStrength, mode, prompt string) {
+    out.Println("Arguments passed:")
+    out.Printf("Markdown file: %s\n", markdown)
+    out.Printf("Model: %s\n", model)
+    out.Printf("Match strength: %s\n", matchStrength)
+    out.Printf("Mode: %s\n", mode)
+    out.Printf("Prompt: %s\n", prompt)
 }
@@ -0,0 +1,195 @@
+package cli
+
+import (
+    "context"
+    "fmt"
+    "log"
+    "os"
+    "path/filepath"
+    "strings"
+    "time"
+
+    "github.com/7db9a/machtiani/internal/api"
+    "github.com/7db9a/machtiani/internal/chat"
+    "github.com/7db9a/machtiani/internal/diff"
+    "github.com/7db9a/machtiani/internal/utils"
+    "golang.org/x/term"
+)
+
+// rerunOptions are the flags of the rerun command. Settings left empty are
+// taken from the chat's front matter.
+type rerunOptions struct {
+    model         string
+    matchStrength string
+    mode          string
+    stream        bool
+    diff          bool
+    sideBySide    bool
+}
+
+// rerunResult is the JSON document of a rerun.
+type rerunResult struct {
+    ChatFile                   string          `json:"chat_file"`
+    RerunFile                  string          `json:"rerun_file"`
+    Question                   string          `json:"question"`
+    Model                      string          `json:"model"`
+    Mode                       string          `json:"mode"`
+    MatchStrength              string          `json:"match_strength"`
+    Answer                     string          `json:"answer"`
+    RetrievedFilePaths         []string        `json:"retrieved_file_paths"`
+    PreviousAnswer             string          `json:"previous_answer"`
+    PreviousRetrievedFilePaths []string        `json:"previous_retrieved_file_paths"`
+    Usage                      *api.TokenUsage `json:"usage,omitempty"`
+    AnswerDiff                 string          `json:"answer_diff,omitempty"`
+    RetrievedFilePathsDiff     string          `json:"retrieved_file_paths_diff,omitempty"`
+}
+
+// handleRerun asks the last question of a saved chat again, against the
+// current index and with the chat's settings unless opts overrides them,
+// and saves the new answer in a file next to the chat.
+func handleRerun(ctx context.Context, out *output, client *api.Client, target string, opts rerunOptions, config *utils.Config, remoteURL string) error {
+    path, err := resolveChatFile(target, utils.ChatDir(*config))
+    if err != nil {
+        return err
+    }
+    content, err := readMarkdownFile(path)
+    if err != nil {
+        return err
+    }
+    saved := chat.Parse(content)
+
+    // The conversation up to the last question, and the answer it got.
+    last := -1
+    for i, turn := range saved.Turns {
+        if turn.Role == chat.User {
+            last = i
+        }
+    }
+    if last < 0 {
+        return fmt.Errorf("the chat in %s has no question to rerun", path)
+    }
+    var previous chat.Turn
+    if last+1 < len(saved.Turns) {
+        previous = saved.Turns[last+1]
+    }
+    conversation := chat.Transcript{Turns: append([]chat.Turn(nil), saved.Turns[:last+1]...)}
+
+    prompt := promptOptions{model: opts.model, matchStrength: opts.matchStrength, mode: opts.mode, stream: opts.stream}
+    var meta chat.Metadata
+    if saved.Meta != nil {
+        meta = *saved.Meta
+    }
+    prompt.model = firstNonEmpty(prompt.model, meta.Model, defaultModel)
+    prompt.mode = firstNonEmpty(prompt.mode, meta.Mode, defaultMode)
+    prompt.matchStrength = firstNonEmpty(prompt.matchStrength, meta.MatchStrength, defaultMatchStrength)
+    question := saved.Turns[last].Content
+    out.Printf("Rerunning %q with %s in %s mode (match strength %s)\n", oneLine(question, 60), prompt.model, prompt.mode, prompt.matchStrength)
+    if meta.HeadSHA != "" {
+        out.Printf("The saved answer was based on commit %s\n", meta.HeadSHA)
+    }
+
+    apiResponse, _, shown, err := sendPrompt(ctx, out, client, &conversation, prompt, config, remoteURL)
+    if err != nil {
+        return err
+    }
+    if apiResponse.Machtiani != "" {
+        log.Printf("Machtiani Message: %s", apiResponse.Machtiani)
+        return nil
+    }
+    answer := chat.Turn{Role: chat.Assistant, Content: apiResponse.OpenAIResponse, RetrievedFilePaths: apiResponse.RetrievedFilePaths}
+    conversation.Turns = append(conversation.Turns, answer)
+
+    if !out.json && !shown {
+        if err := renderMarkdown(out, answer.Content); err != nil {
+            return err
+        }
+    }
+
+    rerunPath, err := chat.Library{Dir: filepath.Dir(path)}.Create(rerunName(path, time.Now()), conversation.Markdown())
+    if err != nil {
+        return fmt.Errorf("saving rerun: %w", err)
+    }
+    out.Printf("Rerun saved to %s\n", rerunPath)
+
+    result := rerunResult{
+        ChatFile:                   path,
+        RerunFile:                  rerunPath,
+        Question:                   question,
+        Model:                      prompt.model,
+        Mode:                       prompt.mode,
+        MatchStrength:              prompt.matchStrength,
+        Answer:                     answer.Content,
+        RetrievedFilePaths:         nonNil(answer.RetrievedFilePaths),
+        PreviousAnswer:             previous.Content,
+        PreviousRetrievedFilePaths: nonNil(previous.RetrievedFilePaths),
+        Usage:                      apiResponse.Usage,
+    }
+    if opts.diff || opts.sideBySide {
+        compare := func(a, b string) string {
+            if opts.sideBySide {
+                return diff.SideBySide(path, rerunPath, a, b, diffWidth(out))
+            }
+            return diff.Unified(path, rerunPath, a, b, 3)
+        }
+        result.AnswerDiff = compare(previous.Content, answer.Content)
+        result.RetrievedFilePathsDiff = compare(strings.Join(previous.RetrievedFilePaths, "\n"), strings.Join(answer.RetrievedFilePaths, "\n"))
+        printDiff(out, "Answer", result.AnswerDiff)
+        printDiff(out, "Retrieved file paths", result.RetrievedFilePathsDiff)
+    }
+    return out.emit(result)
+}
+
+// resolveChatFile finds the chat called target, which is either a path or
+// the name of a chat in chatDir.
+func resolveChatFile(target, chatDir string) (string, error) {
+    if _, err := os.Stat(target); err == nil {
+        return target, nil
+    }
+    entry, err := chat.Library{Dir: chatDir}.Load(target)
+    if err != nil {
+        return "", err
+    }
+    return entry.Path, nil
+}
+
+// rerunName names the chat a rerun of the chat at path is saved as, next
+// to it.
+func rerunName(path string, now time.Time) string {
+    base := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+    return fmt.Sprintf("%s.rerun-%s", base, now.Format("20060102-150405"))
+}
+
+func printDiff(out *output, what, text string) {
+    if text == "" {
+        out.Printf("%s: unchanged\n", what)
+        return
+    }
+    out.Printf("%s diff:\n%s", what, text)
+}
+
+// diffWidth is the width of a side-by-side diff: the terminal's, or a wide
+// default for files and pipes.
+func diffWidth(out *output) int {
+    if out.textIsTerminal() {
+        if width, _, err := term.GetSize(int(out.text.Fd())); err == nil && width > 0 {
+            return width
+        }
+    }
+    return 160
+}
+
+func firstNonEmpty(values ...string) string {
+    for _, value := range values {
+        if value != "" {
+            return value
+        }
+    }
+    return ""
+}
+
+func nonNil(paths []string) []string {
+    if paths == nil {
+        return []string{}
+    }
+    return paths
+}
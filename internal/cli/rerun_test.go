@@ -0,0 +1,65 @@
+package cli
+
+import (
+    "io/ioutil"
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/7db9a/machtiani/internal/chat"
+    "github.com/7db9a/machtiani/internal/testserver"
+    "github.com/7db9a/machtiani/internal/utils"
+)
+
+func TestRerun(t *testing.T) {
+    server := setupProject(t)
+    server.SetAnswer(testserver.Answer{Text: "The handler is in api.go.\nIt retries.", RetrievedFilePaths: []string{"internal/api/api.go", "internal/api/retry.go"}})
+    saveChats(t, [2]string{"handler", "---\nmodel: gpt-4o\nmode: super\nmatch_strength: high\n---\n\n" +
+        "# User\n\nWhat is the project?\n\n# Assistant\n\nA CLI.\n\n" +
+        "# User\n\nWhere is the handler?\n\n# Assistant\n\nThe handler is in cli.go.\nIt retries.\n\n# Retrieved File Paths\n\n- internal/cli/cli.go\n- internal/api/api.go\n"})
+
+    code, out := runCLI(t, "rerun", "handler", "--mode", "commit", "--diff")
+    if code != ExitOK {
+        t.Fatalf("Expected exit code %d, got %d\n%s", ExitOK, code, out)
+    }
+
+    requests := server.Requests(testserver.PathGenerateResponse)
+    if len(requests) != 1 {
+        t.Fatalf("Expected one question to be sent, got %d", len(requests))
+    }
+    body := requests[0].Body
+    messages, _ := body["messages"].([]interface{})
+    if body["prompt"] != "Where is the handler?" || len(messages) != 2 {
+        t.Errorf("Expected the last question with the turns before it, got %v", body)
+    }
+    if body["model"] != "gpt-4o" || body["mode"] != "commit" || body["match_strength"] != "high" {
+        t.Errorf("Expected the chat's settings unless overridden, got %v", body)
+    }
+
+    for _, want := range []string{"-The handler is in cli.go.\n+The handler is in api.go.\n It retries.", "-internal/cli/cli.go\n internal/api/api.go\n+internal/api/retry.go"} {
+        if !strings.Contains(out, want) {
+            t.Errorf("Expected the diff to contain %q, got:\n%s", want, out)
+        }
+    }
+
+    files, _ := filepath.Glob(filepath.Join(utils.DefaultChatDir, "handler.rerun-*.md"))
+    if len(files) != 1 {
+        t.Fatalf("Expected the rerun to be saved next to the chat, got %v", files)
+    }
+    content, _ := ioutil.ReadFile(files[0])
+    rerun := chat.Parse(string(content))
+    if len(rerun.Turns) != 4 || rerun.Turns[3].Content != "The handler is in api.go.\nIt retries." || rerun.Meta == nil || rerun.Meta.Mode != "commit" {
+        t.Errorf("Unexpected rerun file:\n%s", content)
+    }
+    if original, _ := ioutil.ReadFile(filepath.Join(utils.DefaultChatDir, "handler.md")); !strings.Contains(string(original), "in cli.go") {
+        t.Errorf("Expected the original chat to be kept, got:\n%s", original)
+    }
+}
+
+func TestRerunName(t *testing.T) {
+    now := time.Date(2024, 5, 1, 9, 30, 0, 0, time.UTC)
+    if got := rerunName("notes/question.md", now); got != "question.rerun-20240501-093000" {
+        t.Errorf("Unexpected rerun name %q", got)
+    }
+}
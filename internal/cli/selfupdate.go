@@ -0,0 +1,87 @@
+package cli
+
+import (
+    "context"
+    "fmt"
+
+    "github.com/7db9a/machtiani/internal/api"
+    "github.com/7db9a/machtiani/internal/update"
+    "github.com/7db9a/machtiani/internal/utils"
+)
+
+// selfUpdateOptions are the flags of the self-update command.
+type selfUpdateOptions struct {
+    check    bool
+    force    bool
+    manifest string
+}
+
+// selfUpdateResult is the JSON document of the self-update command.
+type selfUpdateResult struct {
+    CurrentVersion  string `json:"current_version"`
+    LatestVersion   string `json:"latest_version"`
+    UpdateAvailable bool   `json:"update_available"`
+    Installed       bool   `json:"installed"`
+    Artifact        string `json:"artifact,omitempty"`
+    Path            string `json:"path,omitempty"`
+    Notes           string `json:"notes,omitempty"`
+}
+
+// handleSelfUpdate installs the latest release over the running binary. It
+// works without a config file, in which case the manifest URL built into the
+// binary is used. Releases are always verified against the built-in key.
+func handleSelfUpdate(ctx context.Context, out *output, opts selfUpdateOptions) error {
+    var config utils.Config
+    if _, err := utils.FindConfigFile(); err == nil {
+        loaded, err := utils.LoadConfig()
+        if err != nil {
+            return withExitCode(ExitConfig, fmt.Errorf("loading config: %w", err))
+        }
+        config = loaded
+    }
+    manifestURL := config.Update.ManifestURL
+    if opts.manifest != "" {
+        manifestURL = opts.manifest
+    }
+
+    updater, err := update.New(manifestURL, api.Version)
+    if err != nil {
+        return withExitCode(ExitConfig, err)
+    }
+
+    manifest, artifact, newer, err := updater.Check(ctx)
+    if err != nil {
+        return err
+    }
+    result := selfUpdateResult{CurrentVersion: api.Version, LatestVersion: manifest.Version, UpdateAvailable: newer, Notes: manifest.Notes}
+    out.Printf("Current version: %s\n", api.Version)
+    out.Printf("Latest version:  %s\n", manifest.Version)
+    if !newer && !opts.force {
+        out.Println("machtiani is up to date.")
+        return out.emit(result)
+    }
+    if opts.check {
+        if newer {
+            out.Println("An update is available; run `machtiani self-update` to install it.")
+        }
+        return out.emit(result)
+    }
+    if !newer {
+        // --force reinstalls the current release, which Check does not
+        // resolve an artifact for.
+        if artifact, err = updater.Artifact(manifest); err != nil {
+            return err
+        }
+    }
+
+    out.Printf("Installing %s %s to %s...\n", artifact.Name, manifest.Version, updater.ExecutablePath)
+    if err := updater.Apply(ctx, artifact); err != nil {
+        return fmt.Errorf("self-update failed, the installed binary is unchanged: %w", err)
+    }
+    result.Installed, result.Artifact, result.Path = true, artifact.Name, updater.ExecutablePath
+    out.Printf("Updated machtiani to %s.\n", manifest.Version)
+    if manifest.Notes != "" {
+        out.Printf("\n%s\n", manifest.Notes)
+    }
+    return out.emit(result)
+}
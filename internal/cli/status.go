@@ -1,29 +1,53 @@
 package cli
 
 import (
-    "fmt"
-    "log"
+    "context"
     "time"
 
     "github.com/7db9a/machtiani/internal/api"
-    "github.com/7db9a/machtiani/internal/utils"
 )
 
-func handleStatus(config *utils.Config, remoteURL string, apiKey *string) {
+// statusResult is the JSON document of the status command.
+type statusResult struct {
+    Project             string   `json:"project"`
+    Ready               bool     `json:"ready"`
+    LockDurationSeconds float64  `json:"lock_duration_seconds,omitempty"`
+    Phase               string   `json:"phase,omitempty"`
+    Progress            *float64 `json:"progress,omitempty"`
+    Message             string   `json:"message,omitempty"`
+    WaitedSeconds       float64  `json:"waited_seconds,omitempty"`
+}
+
+func handleStatus(ctx context.Context, out *output, client *api.Client, remoteURL string, apiKey *string, wait waitOptions) error {
     // Call CheckStatus
-    statusResponse, err := api.CheckStatus(remoteURL, apiKey)
+    statusResponse, err := client.CheckStatus(ctx, remoteURL, apiKey)
     if err != nil {
-        log.Fatalf("Error checking status: %v", err)
+        return err
+    }
+    result := statusResult{
+        Project:             remoteURL,
+        Ready:               !statusResponse.LockFilePresent,
+        LockDurationSeconds: statusResponse.LockTimeDuration,
+        Phase:               statusResponse.Phase,
+        Progress:            statusResponse.Progress,
+        Message:             statusResponse.Message,
     }
 
     // Output the result
     if statusResponse.LockFilePresent {
-        fmt.Println("Project is getting processed and not ready for chat.")
+        out.Println("Project is getting processed and not ready for chat.")
         // Convert the float64 seconds to a duration (in nanoseconds)
         duration := time.Duration(statusResponse.LockTimeDuration * float64(time.Second))
-        // Format the duration to show hours, minutes, seconds
-        fmt.Printf("Lock duration: %02d:%02d:%02d\n", int(duration.Hours()), int(duration.Minutes())%60, int(duration.Seconds())%60)
+        out.Printf("Lock duration: %s\n", formatClock(duration))
+        if wait.enabled {
+            waited, err := waitForProject(ctx, out, client, remoteURL, apiKey, wait)
+            if err != nil {
+                return err
+            }
+            result = statusResult{Project: remoteURL, Ready: true, WaitedSeconds: waited.Seconds()}
+        }
     } else {
-        fmt.Println("Project is ready for chat!")
+        out.Println("Project is ready for chat!")
     }
+    return out.emit(result)
 }
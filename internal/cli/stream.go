@@ -0,0 +1,68 @@
+package cli
+
+import (
+    "fmt"
+    "os"
+
+    "github.com/7db9a/machtiani/internal/utils"
+    "github.com/mattn/go-runewidth"
+    "golang.org/x/term"
+)
+
+// streamPrinter writes streamed answer text to the terminal as it arrives and
+// keeps track of how many rows it used, so the raw text can be replaced by
+// the rendered markdown once the answer is complete.
+type streamPrinter struct {
+    out   *os.File
+    tty   bool
+    width int
+    rows  int
+    col   int
+}
+
+func newStreamPrinter(out *os.File) *streamPrinter {
+    p := &streamPrinter{out: out}
+    if utils.IsTerminal(out) {
+        if width, _, err := term.GetSize(int(out.Fd())); err == nil && width > 0 {
+            p.tty = true
+            p.width = width
+        }
+    }
+    return p
+}
+
+// Write prints a piece of streamed text.
+func (p *streamPrinter) Write(text string) {
+    fmt.Fprint(p.out, text)
+    if !p.tty {
+        return
+    }
+    for _, r := range text {
+        if r == '\n' {
+            p.rows++
+            p.col = 0
+            continue
+        }
+        w := runewidth.RuneWidth(r)
+        if p.col+w > p.width {
+            p.rows++
+            p.col = 0
+        }
+        p.col += w
+    }
+}
+
+// Clear erases the streamed text from the terminal. When output is not a
+// terminal the text is left in place and only terminated with a newline.
+func (p *streamPrinter) Clear() {
+    if !p.tty {
+        fmt.Fprintln(p.out)
+        return
+    }
+    fmt.Fprint(p.out, "\r")
+    if p.rows > 0 {
+        fmt.Fprintf(p.out, "\x1b[%dA", p.rows)
+    }
+    fmt.Fprint(p.out, "\x1b[J")
+    p.rows, p.col = 0, 0
+}
@@ -0,0 +1,107 @@
+package cli
+
+import (
+    "fmt"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/7db9a/machtiani/internal/usage"
+    "github.com/7db9a/machtiani/internal/utils"
+)
+
+// usageOptions are the flags of the usage command.
+type usageOptions struct {
+    by      string
+    format  string
+    since   string
+    project string
+    raw     bool
+}
+
+// handleUsage summarizes or exports the local usage ledger. It works offline
+// and outside a git repository. With --output json the report is always
+// JSON, as that is the document the command emits.
+func handleUsage(out *output, opts usageOptions, config utils.Config) error {
+    if out.json && opts.format != "json" {
+        return fmt.Errorf("--format %s cannot be combined with --output json", opts.format)
+    }
+    since, err := parseSince(opts.since, time.Now())
+    if err != nil {
+        return err
+    }
+
+    ledger, err := usage.LedgerFromConfig(config)
+    if err != nil {
+        return err
+    }
+    entries, err := ledger.Entries(since)
+    if err != nil {
+        return err
+    }
+    if opts.project != "" {
+        var filtered []usage.Entry
+        for _, entry := range entries {
+            if entry.Project == opts.project {
+                filtered = append(filtered, entry)
+            }
+        }
+        entries = filtered
+    }
+
+    if opts.raw {
+        switch opts.format {
+        case "csv":
+            return usage.WriteEntriesCSV(out.stdout, entries)
+        case "json":
+            if entries == nil {
+                entries = []usage.Entry{}
+            }
+            out.emitted = true
+            return usage.WriteJSON(out.stdout, entries)
+        }
+        return fmt.Errorf("--raw needs --format csv or json")
+    }
+
+    summaries, err := usage.Summarize(entries, opts.by)
+    if err != nil {
+        return err
+    }
+    switch opts.format {
+    case "text":
+        if len(entries) == 0 {
+            out.Printf("No usage recorded in %s.\n", ledger.Path)
+            return nil
+        }
+        return usage.WriteTable(out.stdout, opts.by, summaries)
+    case "csv":
+        return usage.WriteSummaryCSV(out.stdout, opts.by, summaries)
+    case "json":
+        if summaries == nil {
+            summaries = []usage.Summary{}
+        }
+        out.emitted = true
+        return usage.WriteJSON(out.stdout, summaries)
+    }
+    return fmt.Errorf("unknown format %q (options: text, csv, json)", opts.format)
+}
+
+// parseSince turns --since into a cutoff time. It accepts a date, a Go
+// duration or a number of days such as "30d". An empty value means no cutoff.
+func parseSince(value string, now time.Time) (time.Time, error) {
+    if value == "" {
+        return time.Time{}, nil
+    }
+    if date, err := time.ParseInLocation("2006-01-02", value, time.Local); err == nil {
+        return date, nil
+    }
+    if days := strings.TrimSuffix(value, "d"); days != value {
+        if n, err := strconv.Atoi(days); err == nil && n >= 0 {
+            return now.AddDate(0, 0, -n), nil
+        }
+    }
+    if d, err := time.ParseDuration(value); err == nil && d >= 0 {
+        return now.Add(-d), nil
+    }
+    return time.Time{}, fmt.Errorf("invalid --since %q: use a date like 2006-01-02 or a duration like 24h or 30d", value)
+}
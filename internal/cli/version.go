@@ -0,0 +1,88 @@
+package cli
+
+import (
+    "context"
+    "runtime"
+    "strings"
+
+    "github.com/7db9a/machtiani/internal/api"
+    "github.com/7db9a/machtiani/internal/utils"
+)
+
+// versionResult is the JSON document of the version command.
+type versionResult struct {
+    Version   string        `json:"version"`
+    Commit    string        `json:"commit"`
+    BuildDate string        `json:"build_date"`
+    Go        string        `json:"go"`
+    OS        string        `json:"os"`
+    Arch      string        `json:"arch"`
+    Server    serverVersion `json:"server"`
+}
+
+type serverVersion struct {
+    URL           string             `json:"url,omitempty"`
+    Error         string             `json:"error,omitempty"` // why the server could not be asked
+    Compatibility *api.Compatibility `json:"compatibility,omitempty"`
+}
+
+// handleVersion prints the build info baked in by generate_ldflags and, when
+// a config can be loaded, what the server says about this version.
+func handleVersion(ctx context.Context, out *output) error {
+    result := versionResult{Version: api.Version, Commit: api.HeadOID, BuildDate: api.BuildDate, Go: runtime.Version(), OS: runtime.GOOS, Arch: runtime.GOARCH}
+    out.Printf("machtiani %s\n", api.Version)
+    out.Printf("  commit:      %s\n", api.HeadOID)
+    out.Printf("  built:       %s\n", api.BuildDate)
+    out.Printf("  go:          %s %s/%s\n", runtime.Version(), runtime.GOOS, runtime.GOARCH)
+
+    config, err := utils.LoadConfig()
+    if err != nil {
+        out.Printf("server:        unknown (%v)\n", err)
+        result.Server.Error = err.Error()
+        return out.emit(result)
+    }
+    client, err := api.NewClient(config)
+    if err != nil {
+        out.Printf("server:        unknown (%v)\n", err)
+        result.Server.Error = err.Error()
+        return out.emit(result)
+    }
+
+    out.Printf("server:        %s\n", config.Environment.MachtianiURL)
+    result.Server.URL = config.Environment.MachtianiURL
+    compatibility, err := client.CheckCompatibility(ctx)
+    if err != nil {
+        if ctx.Err() != nil {
+            return ctx.Err()
+        }
+        out.Printf("  unreachable: %v\n", err)
+        result.Server.Error = err.Error()
+        return out.emit(result)
+    }
+    printCompatibility(out, compatibility)
+    result.Server.Compatibility = &compatibility
+    return out.emit(result)
+}
+
+// printCompatibility describes the outcome of a compatibility check.
+func printCompatibility(out *output, result api.Compatibility) {
+    if result.Legacy {
+        out.Println("  protocol:    legacy (exact head_oid match)")
+    } else {
+        if result.ServerVersion != "" {
+            out.Printf("  version:     %s\n", result.ServerVersion)
+        }
+        out.Printf("  supported:   %s to %s\n", orAny(result.MinVersion), orAny(result.MaxVersion))
+    }
+    if result.Compatible {
+        out.Println("  compatible:  yes")
+    } else {
+        out.Println("  compatible:  no")
+        if result.Message != "" {
+            out.Printf("  update:      %s\n", strings.ReplaceAll(strings.TrimSpace(result.Message), "\n", "\n               "))
+        }
+    }
+    for _, deprecation := range result.Deprecations {
+        out.Printf("  deprecated:  %s\n", deprecation)
+    }
+}
@@ -0,0 +1,155 @@
+package cli
+
+import (
+    "context"
+    "flag"
+    "fmt"
+    "strings"
+    "time"
+
+    "github.com/7db9a/machtiani/internal/api"
+    "github.com/7db9a/machtiani/internal/utils"
+)
+
+// Defaults for --wait when neither the flags nor the config set them.
+const (
+    defaultWaitInterval = 5 * time.Second
+    defaultWaitTimeout  = 30 * time.Minute
+)
+
+// waitOptions controls polling of the project status until its lock clears.
+type waitOptions struct {
+    enabled  bool
+    interval time.Duration
+    timeout  time.Duration
+}
+
+// waitFlags registers --wait, --wait-interval and --wait-timeout on fs. The
+// returned function resolves the parsed flags against the wait section of
+// config and must be called after fs is parsed.
+func waitFlags(fs *flag.FlagSet) func(config utils.Config) (waitOptions, error) {
+    wait := fs.Bool("wait", false, "Poll the project status until processing finishes, showing elapsed time and progress")
+    interval := fs.Duration("wait-interval", 0, "Time between status checks with --wait (default: 5s)")
+    timeout := fs.Duration("wait-timeout", 0, "Give up waiting after this long (default: 30m)")
+
+    return func(config utils.Config) (waitOptions, error) {
+        opts := waitOptions{enabled: *wait, interval: defaultWaitInterval, timeout: defaultWaitTimeout}
+        if config.Wait.Interval != "" {
+            d, err := time.ParseDuration(config.Wait.Interval)
+            if err != nil {
+                return opts, withExitCode(ExitConfig, fmt.Errorf("invalid wait INTERVAL: %w", err))
+            }
+            opts.interval = d
+        }
+        if config.Wait.Timeout != "" {
+            d, err := time.ParseDuration(config.Wait.Timeout)
+            if err != nil {
+                return opts, withExitCode(ExitConfig, fmt.Errorf("invalid wait TIMEOUT: %w", err))
+            }
+            opts.timeout = d
+        }
+        if *interval > 0 {
+            opts.interval = *interval
+        }
+        if *timeout > 0 {
+            opts.timeout = *timeout
+        }
+        return opts, nil
+    }
+}
+
+// waitForProject polls the status of the project at remoteURL until it is no
+// longer locked, showing the elapsed time and any progress the server
+// reports. Polls, retries included, stop at the deadline opts.timeout sets,
+// where the status is checked one last time before it fails with
+// ExitTimeout.
+func waitForProject(ctx context.Context, out *output, client *api.Client, remoteURL string, apiKey *string, opts waitOptions) (time.Duration, error) {
+    start := time.Now()
+    deadline := start.Add(opts.timeout)
+    tty := out.textIsTerminal()
+    drawn := false
+    lastDetails := ""
+
+    // endLine terminates the in-place progress line before other output.
+    endLine := func() {
+        if tty && drawn {
+            out.Println()
+        }
+    }
+
+    for {
+        // The last poll, at the deadline, gets the client's usual timeout.
+        last := !time.Now().Before(deadline)
+        pollCtx, cancel := ctx, context.CancelFunc(func() {})
+        if !last {
+            pollCtx, cancel = context.WithDeadline(ctx, deadline)
+        }
+        statusResponse, err := client.CheckStatus(pollCtx, remoteURL, apiKey)
+        cancel()
+        if err != nil {
+            if !last && ctx.Err() == nil && !time.Now().Before(deadline) {
+                // The deadline cut the retries short; check one last time.
+                continue
+            }
+            endLine()
+            return time.Since(start), err
+        }
+        if !statusResponse.LockFilePresent {
+            endLine()
+            waited := time.Since(start)
+            out.Printf("Project is ready for chat! (waited %s)\n", formatClock(waited))
+            return waited, nil
+        }
+
+        details := waitDetails(statusResponse)
+        line := fmt.Sprintf("Waiting for project to finish processing... %s elapsed", formatClock(time.Since(start)))
+        if details != "" {
+            line += " | " + details
+        }
+        switch {
+        case tty:
+            // Redraw a single line in place.
+            out.Printf("\r\033[K%s", line)
+        case !drawn || details != lastDetails:
+            // Logs only get a line when the reported progress changes.
+            out.Println(line)
+        }
+        drawn = true
+        lastDetails = details
+
+        if last {
+            endLine()
+            return time.Since(start), withExitCode(ExitTimeout, fmt.Errorf("timed out after %s waiting for the project to finish processing; check again with `machtiani status`", opts.timeout))
+        }
+
+        timer := time.NewTimer(min(opts.interval, time.Until(deadline)))
+        select {
+        case <-ctx.Done():
+            timer.Stop()
+            endLine()
+            return time.Since(start), ctx.Err()
+        case <-timer.C:
+        }
+    }
+}
+
+// waitDetails describes the progress a server reported for a locked
+// project, or returns "" if it reported none.
+func waitDetails(statusResponse api.StatusResponse) string {
+    var details []string
+    if statusResponse.Phase != "" {
+        details = append(details, statusResponse.Phase)
+    }
+    if statusResponse.Progress != nil {
+        details = append(details, fmt.Sprintf("%.0f%%", *statusResponse.Progress*100))
+    }
+    if statusResponse.Message != "" {
+        details = append(details, statusResponse.Message)
+    }
+    return strings.Join(details, " ")
+}
+
+// formatClock formats d as hh:mm:ss.
+func formatClock(d time.Duration) string {
+    return fmt.Sprintf("%02d:%02d:%02d", int(d.Hours()), int(d.Minutes())%60, int(d.Seconds())%60)
+}
@@ -0,0 +1,228 @@
+// Package diff compares texts line by line and formats the differences as
+// a unified diff or as two columns side by side.
+package diff
+
+import (
+    "fmt"
+    "strings"
+
+    "github.com/mattn/go-runewidth"
+)
+
+// Op is what an edit does to a line.
+type Op int
+
+const (
+    Equal  Op = iota // the line is in both texts
+    Delete           // the line is only in the first text
+    Insert           // the line is only in the second text
+)
+
+// Edit is one line of a diff.
+type Edit struct {
+    Op   Op
+    Line string
+}
+
+// Lines returns the edits that turn a into b, keeping their longest common
+// subsequence of lines. Deletions come before insertions where both are
+// possible.
+func Lines(a, b []string) []Edit {
+    // Common leading and trailing lines need no table.
+    prefix := 0
+    for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+        prefix++
+    }
+    suffix := 0
+    for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+        suffix++
+    }
+
+    var edits []Edit
+    for _, line := range a[:prefix] {
+        edits = append(edits, Edit{Equal, line})
+    }
+    x, y := a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]
+
+    // lcs[i][j] is the length of the longest common subsequence of x[i:]
+    // and y[j:].
+    lcs := make([][]int, len(x)+1)
+    for i := range lcs {
+        lcs[i] = make([]int, len(y)+1)
+    }
+    for i := len(x) - 1; i >= 0; i-- {
+        for j := len(y) - 1; j >= 0; j-- {
+            switch {
+            case x[i] == y[j]:
+                lcs[i][j] = lcs[i+1][j+1] + 1
+            case lcs[i+1][j] >= lcs[i][j+1]:
+                lcs[i][j] = lcs[i+1][j]
+            default:
+                lcs[i][j] = lcs[i][j+1]
+            }
+        }
+    }
+
+    i, j := 0, 0
+    for i < len(x) && j < len(y) {
+        switch {
+        case x[i] == y[j]:
+            edits = append(edits, Edit{Equal, x[i]})
+            i++
+            j++
+        case lcs[i+1][j] >= lcs[i][j+1]:
+            edits = append(edits, Edit{Delete, x[i]})
+            i++
+        default:
+            edits = append(edits, Edit{Insert, y[j]})
+            j++
+        }
+    }
+    for ; i < len(x); i++ {
+        edits = append(edits, Edit{Delete, x[i]})
+    }
+    for ; j < len(y); j++ {
+        edits = append(edits, Edit{Insert, y[j]})
+    }
+
+    for _, line := range a[len(a)-suffix:] {
+        edits = append(edits, Edit{Equal, line})
+    }
+    return edits
+}
+
+// Unified formats the differences between a and b as a unified diff with
+// context lines around each change, labelling the texts fromName and
+// toName. It returns "" if the texts have the same lines.
+func Unified(fromName, toName, a, b string, context int) string {
+    edits := Lines(splitLines(a), splitLines(b))
+    if !changed(edits) {
+        return ""
+    }
+
+    // start[k] is the position in a and b before edit k.
+    start := make([][2]int, len(edits)+1)
+    for k, e := range edits {
+        start[k+1] = start[k]
+        if e.Op != Insert {
+            start[k+1][0]++
+        }
+        if e.Op != Delete {
+            start[k+1][1]++
+        }
+    }
+
+    var out strings.Builder
+    fmt.Fprintf(&out, "--- %s\n+++ %s\n", fromName, toName)
+    for k := 0; k < len(edits); {
+        for k < len(edits) && edits[k].Op == Equal {
+            k++
+        }
+        if k == len(edits) {
+            break
+        }
+
+        // A hunk runs until a stretch of unchanged lines too long to be
+        // context for both the change before and the change after it.
+        first, end := max(k-context, 0), k
+        for end < len(edits) {
+            if edits[end].Op != Equal {
+                end++
+                continue
+            }
+            run := end
+            for run < len(edits) && edits[run].Op == Equal {
+                run++
+            }
+            if run == len(edits) || run-end > 2*context {
+                end = min(end+context, len(edits))
+                break
+            }
+            end = run
+        }
+
+        from, to := start[first], start[end]
+        fmt.Fprintf(&out, "@@ -%s +%s @@\n", hunkRange(from[0], to[0]-from[0]), hunkRange(from[1], to[1]-from[1]))
+        for _, e := range edits[first:end] {
+            out.WriteString([]string{" ", "-", "+"}[e.Op] + e.Line + "\n")
+        }
+        k = end
+    }
+    return out.String()
+}
+
+// hunkRange formats the lines of one side of a hunk, which start after
+// line start and number count.
+func hunkRange(start, count int) string {
+    switch count {
+    case 0:
+        return fmt.Sprintf("%d,0", start)
+    case 1:
+        return fmt.Sprintf("%d", start+1)
+    }
+    return fmt.Sprintf("%d,%d", start+1, count)
+}
+
+// SideBySide formats a and b in two columns that fit in width, with the
+// markers of diff -y between them: "|" for a changed line, "<" for a line
+// only in a and ">" for a line only in b. Long lines are truncated. It
+// returns "" if the texts have the same lines.
+func SideBySide(fromName, toName, a, b string, width int) string {
+    edits := Lines(splitLines(a), splitLines(b))
+    if !changed(edits) {
+        return ""
+    }
+    column := max((width-3)/2, 10)
+
+    var out strings.Builder
+    row := func(left, marker, right string) {
+        line := runewidth.FillRight(runewidth.Truncate(left, column, "…"), column) + " " + marker + " " + runewidth.Truncate(right, column, "…")
+        out.WriteString(strings.TrimRight(line, " ") + "\n")
+    }
+    row(fromName, " ", toName)
+    row(strings.Repeat("-", column), " ", strings.Repeat("-", column))
+
+    for k := 0; k < len(edits); {
+        if edits[k].Op == Equal {
+            row(edits[k].Line, " ", edits[k].Line)
+            k++
+            continue
+        }
+        // Pair the deleted lines of a change with the inserted ones.
+        var deleted, inserted []string
+        for ; k < len(edits) && edits[k].Op == Delete; k++ {
+            deleted = append(deleted, edits[k].Line)
+        }
+        for ; k < len(edits) && edits[k].Op == Insert; k++ {
+            inserted = append(inserted, edits[k].Line)
+        }
+        for i := 0; i < len(deleted) || i < len(inserted); i++ {
+            switch {
+            case i >= len(inserted):
+                row(deleted[i], "<", "")
+            case i >= len(deleted):
+                row("", ">", inserted[i])
+            default:
+                row(deleted[i], "|", inserted[i])
+            }
+        }
+    }
+    return out.String()
+}
+
+func changed(edits []Edit) bool {
+    for _, e := range edits {
+        if e.Op != Equal {
+            return true
+        }
+    }
+    return false
+}
+
+// splitLines splits text into lines, ignoring a final newline.
+func splitLines(text string) []string {
+    if text == "" {
+        return nil
+    }
+    return strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+}
@@ -0,0 +1,67 @@
+package diff
+
+import (
+    "reflect"
+    "strings"
+    "testing"
+)
+
+func TestLines(t *testing.T) {
+    edits := Lines([]string{"a", "b", "c", "d"}, []string{"a", "c", "x", "d"})
+    want := []Edit{{Equal, "a"}, {Delete, "b"}, {Equal, "c"}, {Insert, "x"}, {Equal, "d"}}
+    if !reflect.DeepEqual(edits, want) {
+        t.Errorf("Lines() = %v, want %v", edits, want)
+    }
+    if edits := Lines(nil, []string{"a"}); !reflect.DeepEqual(edits, []Edit{{Insert, "a"}}) {
+        t.Errorf("Lines() from nothing = %v", edits)
+    }
+}
+
+func TestUnified(t *testing.T) {
+    var a, b []string
+    for i := 1; i <= 12; i++ {
+        line := string(rune('a' + i - 1))
+        a = append(a, line)
+        switch i {
+        case 2:
+            b = append(b, "B")
+        case 11:
+            // deleted
+        default:
+            b = append(b, line)
+        }
+    }
+    b = append(b, "m")
+
+    got := Unified("old.md", "new.md", strings.Join(a, "\n")+"\n", strings.Join(b, "\n")+"\n", 2)
+    want := "--- old.md\n+++ new.md\n" +
+        "@@ -1,4 +1,4 @@\n a\n-b\n+B\n c\n d\n" +
+        "@@ -9,4 +9,4 @@\n i\n j\n-k\n l\n+m\n"
+    if got != want {
+        t.Errorf("Unified() =\n%s\nwant\n%s", got, want)
+    }
+
+    if got := Unified("a", "b", "same\n", "same", 3); got != "" {
+        t.Errorf("Expected no diff between equal texts, got:\n%s", got)
+    }
+    if got := Unified("a", "b", "", "new\n", 3); got != "--- a\n+++ b\n@@ -0,0 +1 @@\n+new\n" {
+        t.Errorf("Unexpected diff from an empty text:\n%s", got)
+    }
+}
+
+func TestSideBySide(t *testing.T) {
+    got := SideBySide("old", "new", "same\nold line\ngone\n", "same\nnew line\n", 23)
+    want := "old          new\n" +
+        "----------   ----------\n" +
+        "same         same\n" +
+        "old line   | new line\n" +
+        "gone       <\n"
+    if got != want {
+        t.Errorf("SideBySide() =\n%s\nwant\n%s", got, want)
+    }
+
+    got = SideBySide("old", "new", "a line that is far too long\n", "", 23)
+    if !strings.Contains(got, "a line th… <") {
+        t.Errorf("Expected long lines to be truncated to the column, got:\n%s", got)
+    }
+}
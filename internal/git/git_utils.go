@@ -42,3 +42,32 @@ func getRemoteURL(remoteName string) (string, error) {
     }
     return strings.TrimSpace(string(output)), nil
 }
+
+// GetCurrentBranch returns the name of the checked out branch, or "HEAD"
+// when HEAD is detached.
+func GetCurrentBranch() (string, error) {
+    output, err := exec.Command("git", "rev-parse", "--abbrev-ref", "HEAD").Output()
+    if err != nil {
+        return "", fmt.Errorf("failed to get current branch: %w", err)
+    }
+    return strings.TrimSpace(string(output)), nil
+}
+
+// GetHeadCommit returns the SHA of the commit HEAD points to.
+func GetHeadCommit() (string, error) {
+    output, err := exec.Command("git", "rev-parse", "HEAD").Output()
+    if err != nil {
+        return "", fmt.Errorf("failed to get HEAD commit: %w", err)
+    }
+    return strings.TrimSpace(string(output)), nil
+}
+
+// HasUncommittedChanges reports whether tracked files differ from HEAD.
+// Untracked files, such as saved chats, do not count.
+func HasUncommittedChanges() (bool, error) {
+    output, err := exec.Command("git", "status", "--porcelain", "--untracked-files=no").Output()
+    if err != nil {
+        return false, fmt.Errorf("failed to get worktree status: %w", err)
+    }
+    return strings.TrimSpace(string(output)) != "", nil
+}
@@ -0,0 +1,141 @@
+// Package pricing turns token counts into estimated dollar costs. Prices come
+// from a built-in table that the pricing section of .machtiani-config.yml can
+// override or extend, since providers change them more often than we release.
+package pricing
+
+import (
+    "fmt"
+    "math"
+
+    "github.com/7db9a/machtiani/internal/usage"
+    "github.com/7db9a/machtiani/internal/utils"
+)
+
+// Models indexing is priced with when the config does not name them.
+const (
+    DefaultEmbeddingModel = "text-embedding-3-large"
+    DefaultInferenceModel = "gpt-4o-mini"
+)
+
+// DefaultModels holds list prices in US dollars per million tokens.
+var DefaultModels = map[string]utils.ModelPricing{
+    "gpt-4o":                 {Input: 2.50, Output: 10.00},
+    "gpt-4o-mini":            {Input: 0.15, Output: 0.60},
+    "text-embedding-3-large": {Input: 0.13},
+    "text-embedding-3-small": {Input: 0.02},
+}
+
+// Table prices models and knows which models the server indexes with.
+type Table struct {
+    Models         map[string]utils.ModelPricing
+    EmbeddingModel string
+    InferenceModel string
+}
+
+// Default returns the built-in table.
+func Default() Table {
+    models := make(map[string]utils.ModelPricing, len(DefaultModels))
+    for name, price := range DefaultModels {
+        models[name] = price
+    }
+    return Table{Models: models, EmbeddingModel: DefaultEmbeddingModel, InferenceModel: DefaultInferenceModel}
+}
+
+// FromConfig applies the pricing section of config on top of Default.
+func FromConfig(config utils.Config) (Table, error) {
+    table := Default()
+    for name, price := range config.Pricing.Models {
+        if price.Input < 0 || price.Output < 0 {
+            return table, fmt.Errorf("invalid pricing for model %s: prices must not be negative", name)
+        }
+        table.Models[name] = price
+    }
+    if config.Pricing.EmbeddingModel != "" {
+        table.EmbeddingModel = config.Pricing.EmbeddingModel
+    }
+    if config.Pricing.InferenceModel != "" {
+        table.InferenceModel = config.Pricing.InferenceModel
+    }
+    return table, nil
+}
+
+// Price returns the price of model, if the table has one.
+func (t Table) Price(model string) (utils.ModelPricing, bool) {
+    price, ok := t.Models[model]
+    return price, ok
+}
+
+// InputCost estimates the cost of sending tokens to model. ok is false when
+// the model has no price.
+func (t Table) InputCost(model string, tokens int) (cost float64, ok bool) {
+    price, ok := t.Price(model)
+    if !ok {
+        return 0, false
+    }
+    return Cost(tokens, price.Input), true
+}
+
+// OutputCost estimates the cost of model generating tokens.
+func (t Table) OutputCost(model string, tokens int) (cost float64, ok bool) {
+    price, ok := t.Price(model)
+    if !ok {
+        return 0, false
+    }
+    return Cost(tokens, price.Output), true
+}
+
+// IndexingCost estimates the cost of storing or syncing a repository from
+// the counts reported by the token-count endpoints. ok is false when either
+// indexing model has no price.
+func (t Table) IndexingCost(embeddingTokens, inferenceTokens int) (embedding, inference float64, ok bool) {
+    embedding, embeddingOK := t.InputCost(t.EmbeddingModel, embeddingTokens)
+    inference, inferenceOK := t.InputCost(t.InferenceModel, inferenceTokens)
+    return embedding, inference, embeddingOK && inferenceOK
+}
+
+// EntryCost estimates the cost of a ledger entry: embedding and inference
+// tokens at the indexing models' input prices, prompt and completion tokens
+// at entry.Model's prices. ok is false when a model with tokens has no price.
+func (t Table) EntryCost(entry usage.Entry) (cost float64, ok bool) {
+    ok = true
+    add := func(model string, tokens int, output bool) {
+        if tokens == 0 {
+            return
+        }
+        price, found := t.Price(model)
+        if !found {
+            ok = false
+            return
+        }
+        perMillion := price.Input
+        if output {
+            perMillion = price.Output
+        }
+        cost += Cost(tokens, perMillion)
+    }
+    add(t.EmbeddingModel, entry.EmbeddingTokens, false)
+    add(t.InferenceModel, entry.InferenceTokens, false)
+    add(entry.Model, entry.PromptTokens, false)
+    add(entry.Model, entry.CompletionTokens, true)
+    return cost, ok
+}
+
+// Cost returns the cost of tokens at perMillion dollars per million tokens.
+func Cost(tokens int, perMillion float64) float64 {
+    return float64(tokens) * perMillion / 1e6
+}
+
+// FormatUSD formats a dollar amount, keeping enough precision that small
+// estimates do not round to zero.
+func FormatUSD(amount float64) string {
+    switch {
+    case amount == 0:
+        return "$0.00"
+    case amount > 0 && amount < 0.0001:
+        return "<$0.0001"
+    case math.Abs(amount) < 0.01:
+        return fmt.Sprintf("$%.4f", amount)
+    default:
+        return fmt.Sprintf("$%.2f", amount)
+    }
+}
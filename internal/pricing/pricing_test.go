@@ -0,0 +1,92 @@
+package pricing
+
+import (
+    "math"
+    "testing"
+
+    "github.com/7db9a/machtiani/internal/utils"
+)
+
+func TestFromConfig_OverridesDefaults(t *testing.T) {
+    var config utils.Config
+    config.Pricing.InferenceModel = "gpt-4o"
+    config.Pricing.Models = map[string]utils.ModelPricing{
+        "gpt-4o":    {Input: 5, Output: 15},
+        "local-llm": {Input: 0, Output: 0},
+    }
+
+    table, err := FromConfig(config)
+    if err != nil {
+        t.Fatalf("Unexpected error: %v", err)
+    }
+    if price, _ := table.Price("gpt-4o"); price.Input != 5 || price.Output != 15 {
+        t.Errorf("Expected the configured gpt-4o price, got %+v", price)
+    }
+    if _, ok := table.Price("gpt-4o-mini"); !ok {
+        t.Errorf("Expected built-in prices to be kept")
+    }
+    if _, ok := table.Price("local-llm"); !ok {
+        t.Errorf("Expected configured models to be added")
+    }
+    if table.EmbeddingModel != DefaultEmbeddingModel || table.InferenceModel != "gpt-4o" {
+        t.Errorf("Unexpected indexing models: %s, %s", table.EmbeddingModel, table.InferenceModel)
+    }
+}
+
+func TestFromConfig_RejectsNegativePrices(t *testing.T) {
+    var config utils.Config
+    config.Pricing.Models = map[string]utils.ModelPricing{"gpt-4o": {Input: -1}}
+
+    if _, err := FromConfig(config); err == nil {
+        t.Errorf("Expected an error for a negative price")
+    }
+}
+
+func TestIndexingCost(t *testing.T) {
+    table := Default()
+
+    embedding, inference, ok := table.IndexingCost(1000000, 2000000)
+    if !ok {
+        t.Fatalf("Expected the default indexing models to be priced")
+    }
+    if math.Abs(embedding-0.13) > 1e-9 || math.Abs(inference-0.30) > 1e-9 {
+        t.Errorf("Unexpected costs: embedding %v, inference %v", embedding, inference)
+    }
+
+    table.InferenceModel = "unknown-model"
+    if _, _, ok := table.IndexingCost(1, 1); ok {
+        t.Errorf("Expected an unpriced model to report ok=false")
+    }
+}
+
+func TestFormatUSD(t *testing.T) {
+    tests := map[float64]string{
+        0:       "$0.00",
+        0.00002: "<$0.0001",
+        0.00042: "$0.0004",
+        0.5:     "$0.50",
+        12.345:  "$12.35",
+    }
+    for amount, want := range tests {
+        if got := FormatUSD(amount); got != want {
+            t.Errorf("FormatUSD(%v) = %q, want %q", amount, got, want)
+        }
+    }
+}
+
+func TestEstimateTokens(t *testing.T) {
+    tests := []struct {
+        text string
+        want int
+    }{
+        {"", 0},
+        {"The quick brown fox jumps over the lazy dog.", 10},
+        {"2024", 2},
+        {"func main() {}", 4},
+    }
+    for _, test := range tests {
+        if got := EstimateTokens(test.text); got != test.want {
+            t.Errorf("EstimateTokens(%q) = %d, want %d", test.text, got, test.want)
+        }
+    }
+}
@@ -0,0 +1,92 @@
+package pricing
+
+import (
+    "unicode"
+    "unicode/utf8"
+)
+
+// EstimateTokens approximates how many tokens an OpenAI tokenizer produces
+// for text, without downloading its vocabulary. Text is split the way the
+// cl100k tokenizer pre-splits it (words with their leading space, runs of up
+// to three digits, punctuation and whitespace), and each piece is charged by
+// length. It is a heuristic, not a tokenizer: counts for English prose and
+// code are usually in the right neighbourhood, but other languages, long
+// identifiers and unusual symbols can be off by much more. Anything derived
+// from it must be presented as approximate.
+func EstimateTokens(text string) int {
+    tokens := 0
+    for len(text) > 0 {
+        piece, rest := nextPiece(text)
+        tokens += pieceTokens(piece)
+        text = rest
+    }
+    return tokens
+}
+
+// nextPiece splits the next pre-token off text.
+func nextPiece(text string) (string, string) {
+    r, size := utf8.DecodeRuneInString(text)
+    end := size
+
+    // A single space attaches to the word or punctuation that follows it.
+    if r == ' ' && end < len(text) {
+        next, nextSize := utf8.DecodeRuneInString(text[end:])
+        if !unicode.IsSpace(next) {
+            r = next
+            end += nextSize
+        }
+    }
+
+    switch {
+    case unicode.IsLetter(r):
+        end = scan(text, end, unicode.IsLetter)
+    case unicode.IsDigit(r):
+        for digits := 1; digits < 3 && end < len(text); digits++ {
+            next, nextSize := utf8.DecodeRuneInString(text[end:])
+            if !unicode.IsDigit(next) {
+                break
+            }
+            end += nextSize
+        }
+    case unicode.IsSpace(r):
+        end = scan(text, end, unicode.IsSpace)
+    default:
+        end = scan(text, end, func(r rune) bool {
+            return !unicode.IsLetter(r) && !unicode.IsDigit(r) && !unicode.IsSpace(r)
+        })
+    }
+    return text[:end], text[end:]
+}
+
+func scan(text string, end int, match func(rune) bool) int {
+    for end < len(text) {
+        r, size := utf8.DecodeRuneInString(text[end:])
+        if !match(r) {
+            break
+        }
+        end += size
+    }
+    return end
+}
+
+// pieceTokens charges a pre-token: ASCII pieces of up to eight characters
+// are usually a single token, longer ones about one token per five
+// characters, and non-ASCII text about one token per character.
+func pieceTokens(piece string) int {
+    ascii, other := 0, 0
+    for _, r := range piece {
+        if r < utf8.RuneSelf {
+            ascii++
+        } else {
+            other++
+        }
+    }
+    tokens := other
+    switch {
+    case ascii > 8:
+        tokens += (ascii + 4) / 5
+    case ascii > 0:
+        tokens++
+    }
+    return tokens
+}
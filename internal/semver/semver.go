@@ -0,0 +1,118 @@
+// Package semver parses and compares semantic versions (https://semver.org).
+// Build metadata is accepted and ignored, and a leading "v" is allowed.
+package semver
+
+import (
+    "fmt"
+    "strconv"
+    "strings"
+)
+
+// Version is a parsed semantic version.
+type Version struct {
+    Major, Minor, Patch int
+    Prerelease          []string // dot-separated identifiers after "-"
+}
+
+// Parse parses s, such as "1.4.0", "v2.0.0-rc.1" or "1.4.0+build.5".
+func Parse(s string) (Version, error) {
+    var v Version
+    rest := strings.TrimPrefix(strings.TrimSpace(s), "v")
+    if i := strings.IndexByte(rest, '+'); i >= 0 {
+        rest = rest[:i]
+    }
+    if i := strings.IndexByte(rest, '-'); i >= 0 {
+        for _, id := range strings.Split(rest[i+1:], ".") {
+            if id == "" {
+                return v, fmt.Errorf("invalid version %q: empty prerelease identifier", s)
+            }
+            v.Prerelease = append(v.Prerelease, id)
+        }
+        rest = rest[:i]
+    }
+
+    parts := strings.Split(rest, ".")
+    if len(parts) != 3 {
+        return v, fmt.Errorf("invalid version %q: want MAJOR.MINOR.PATCH", s)
+    }
+    numbers := make([]int, 3)
+    for i, part := range parts {
+        n, err := strconv.Atoi(part)
+        if err != nil || n < 0 || (len(part) > 1 && part[0] == '0') {
+            return v, fmt.Errorf("invalid version %q: bad number %q", s, part)
+        }
+        numbers[i] = n
+    }
+    v.Major, v.Minor, v.Patch = numbers[0], numbers[1], numbers[2]
+    return v, nil
+}
+
+// MustParse is like Parse but panics on error. It is meant for constants.
+func MustParse(s string) Version {
+    v, err := Parse(s)
+    if err != nil {
+        panic(err)
+    }
+    return v
+}
+
+// String formats v without a leading "v".
+func (v Version) String() string {
+    s := fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+    if len(v.Prerelease) > 0 {
+        s += "-" + strings.Join(v.Prerelease, ".")
+    }
+    return s
+}
+
+// Compare returns -1, 0 or 1 as v sorts before, equal to or after w,
+// following semver precedence rules.
+func (v Version) Compare(w Version) int {
+    for _, d := range [][2]int{{v.Major, w.Major}, {v.Minor, w.Minor}, {v.Patch, w.Patch}} {
+        if d[0] != d[1] {
+            return sign(d[0] - d[1])
+        }
+    }
+
+    // A version without prerelease identifiers sorts after one with them.
+    switch {
+    case len(v.Prerelease) == 0 && len(w.Prerelease) == 0:
+        return 0
+    case len(v.Prerelease) == 0:
+        return 1
+    case len(w.Prerelease) == 0:
+        return -1
+    }
+    for i := 0; i < len(v.Prerelease) && i < len(w.Prerelease); i++ {
+        if c := compareIdentifier(v.Prerelease[i], w.Prerelease[i]); c != 0 {
+            return c
+        }
+    }
+    return sign(len(v.Prerelease) - len(w.Prerelease))
+}
+
+// compareIdentifier compares prerelease identifiers: numeric ones
+// numerically and before alphanumeric ones, which compare as strings.
+func compareIdentifier(a, b string) int {
+    an, aErr := strconv.Atoi(a)
+    bn, bErr := strconv.Atoi(b)
+    switch {
+    case aErr == nil && bErr == nil:
+        return sign(an - bn)
+    case aErr == nil:
+        return -1
+    case bErr == nil:
+        return 1
+    }
+    return strings.Compare(a, b)
+}
+
+func sign(n int) int {
+    switch {
+    case n < 0:
+        return -1
+    case n > 0:
+        return 1
+    }
+    return 0
+}
@@ -0,0 +1,44 @@
+package semver
+
+import "testing"
+
+func TestParse(t *testing.T) {
+    v, err := Parse("v1.4.2-rc.1+build.7")
+    if err != nil {
+        t.Fatalf("Unexpected error: %v", err)
+    }
+    if v.Major != 1 || v.Minor != 4 || v.Patch != 2 || v.String() != "1.4.2-rc.1" {
+        t.Errorf("Unexpected version: %+v", v)
+    }
+
+    for _, bad := range []string{"", "1.4", "1.4.x", "01.2.3", "1.2.3-", "1.2.3-a..b"} {
+        if _, err := Parse(bad); err == nil {
+            t.Errorf("Expected %q to be rejected", bad)
+        }
+    }
+}
+
+func TestCompare(t *testing.T) {
+    // Each version sorts strictly before the next.
+    ordered := []string{
+        "1.0.0-alpha",
+        "1.0.0-alpha.1",
+        "1.0.0-alpha.beta",
+        "1.0.0-beta.2",
+        "1.0.0-beta.11",
+        "1.0.0-rc.1",
+        "1.0.0",
+        "1.0.1",
+        "1.2.0",
+        "2.0.0",
+    }
+    for i := 0; i < len(ordered)-1; i++ {
+        a, b := MustParse(ordered[i]), MustParse(ordered[i+1])
+        if a.Compare(b) != -1 || b.Compare(a) != 1 {
+            t.Errorf("Expected %s < %s", a, b)
+        }
+    }
+    if MustParse("1.2.3+meta").Compare(MustParse("1.2.3")) != 0 {
+        t.Errorf("Expected build metadata to be ignored")
+    }
+}
@@ -0,0 +1,407 @@
+// Package testserver provides a fake Machtiani backend for offline
+// integration tests. A single httptest server implements the machtiani and
+// repo-manager endpoints with the same shapes as the real services, and each
+// endpoint's behavior can be scripted: added latency, error responses, lock
+// states and canned answers.
+package testserver
+
+import (
+    "encoding/json"
+    "fmt"
+    "io"
+    "net/http"
+    "net/http/httptest"
+    "net/url"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/7db9a/machtiani/internal/api"
+)
+
+// Endpoint paths served by the fake.
+const (
+    PathGenerateResponse   = "/generate-response"
+    PathGenerateFilename   = "/generate-filename"
+    PathAddRepository      = "/add-repository/"
+    PathAddRepositoryCount = "/add-repository/token-count"
+    PathFetchAndCheckout   = "/fetch-and-checkout/"
+    PathFetchCount         = "/fetch-and-checkout/token-count"
+    PathDeleteStore        = "/delete-store/"
+    PathStatus             = "/status"
+    PathHeadOID            = "/get-head-oid"
+    PathCompatibility      = "/compatibility"
+)
+
+// Behavior scripts how an endpoint answers. The zero value serves the normal
+// canned response.
+type Behavior struct {
+    Latency time.Duration     // delay before answering
+    Status  int               // if non-zero, answer with this status and Body instead
+    Body    string
+    Header  map[string]string // extra response headers
+    Times   int               // apply to the next Times requests only; 0 means always
+}
+
+// Request is a request the fake received.
+type Request struct {
+    Method string
+    Path   string
+    Query  url.Values
+    Header http.Header
+    Body   map[string]interface{}
+}
+
+// Answer is the canned reply of /generate-response.
+type Answer struct {
+    Text               string
+    RetrievedFilePaths []string
+    Machtiani          string // if set, sent instead of an answer
+    Error              string // if set, sent as the "error" key
+    Extra              map[string]interface{}
+}
+
+// Server is a running fake backend. Its fields may be changed between
+// requests; use the setters when requests may be in flight.
+type Server struct {
+    *httptest.Server
+
+    mu              sync.Mutex
+    behaviors       map[string][]Behavior
+    requests        []Request
+    locked          bool
+    lockDuration    float64
+    unlockAfter     int
+    phase           string
+    progress        *float64
+    headOID         string
+    compatibility   map[string]interface{} // nil serves 404, like servers that predate the endpoint
+    installMessage  string
+    answer          Answer
+    filename        string
+    embeddingTokens int
+    inferenceTokens int
+}
+
+// New starts a fake backend. Close it when done.
+func New() *Server {
+    s := &Server{
+        behaviors:       map[string][]Behavior{},
+        headOID:         api.HeadOID,
+        installMessage:  "Run the installer to update machtiani.",
+        answer:          Answer{Text: "This is a canned answer.", RetrievedFilePaths: []string{"main.go"}},
+        filename:        "canned_answer",
+        embeddingTokens: 1000,
+        inferenceTokens: 200,
+    }
+    s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+    return s
+}
+
+// On scripts the behavior of the endpoint at path. Behaviors queue up: one
+// with Times set is used up before the next takes over.
+func (s *Server) On(path string, behavior Behavior) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.behaviors[path] = append(s.behaviors[path], behavior)
+}
+
+// SetLocked sets the lock state reported by /status. While locked, the
+// repository endpoints answer 423 with a lock_present code.
+func (s *Server) SetLocked(locked bool, duration time.Duration) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.locked = locked
+    s.lockDuration = duration.Seconds()
+}
+
+// UnlockAfter makes /status report the project unlocked after it has been
+// polled polls more times while locked.
+func (s *Server) UnlockAfter(polls int) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.unlockAfter = polls
+}
+
+// SetProgress sets the phase and completed fraction reported by /status
+// while locked. A negative progress omits it.
+func (s *Server) SetProgress(phase string, progress float64) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.phase = phase
+    s.progress = nil
+    if progress >= 0 {
+        s.progress = &progress
+    }
+}
+
+// SetAnswer sets the reply of /generate-response.
+func (s *Server) SetAnswer(answer Answer) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.answer = answer
+}
+
+// SetFilename sets the reply of /generate-filename.
+func (s *Server) SetFilename(filename string) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.filename = filename
+}
+
+// SetHeadOID sets the head_oid reported by /get-head-oid. Any value other
+// than the client's api.HeadOID makes the client incompatible.
+func (s *Server) SetHeadOID(headOID string) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.headOID = headOID
+}
+
+// SetCompatibility makes the fake answer /compatibility with the supported
+// version range and every capability of the client; empty bounds are
+// omitted. Until it is called the endpoint answers 404 and clients fall back
+// to /get-head-oid.
+func (s *Server) SetCompatibility(minVersion, maxVersion string, deprecations ...string) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.compatibility = map[string]interface{}{
+        "server_version": "1.0.0",
+        "deprecations":   deprecations,
+        "capabilities":   api.Capabilities,
+        "message":        s.installMessage,
+    }
+    if minVersion != "" {
+        s.compatibility["min_version"] = minVersion
+    }
+    if maxVersion != "" {
+        s.compatibility["max_version"] = maxVersion
+    }
+}
+
+// SetTokenCounts sets the estimate returned by the token-count endpoints.
+func (s *Server) SetTokenCounts(embedding, inference int) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.embeddingTokens = embedding
+    s.inferenceTokens = inference
+}
+
+// Requests returns the requests received at path, or every request if path
+// is empty.
+func (s *Server) Requests(path string) []Request {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    var out []Request
+    for _, r := range s.requests {
+        if path == "" || r.Path == path {
+            out = append(out, r)
+        }
+    }
+    return out
+}
+
+// ConfigYAML returns a .machtiani-config.yml pointing at the fake. Retries
+// are kept fast so scripted failures do not slow tests down.
+func (s *Server) ConfigYAML() string {
+    return fmt.Sprintf(`environment:
+  MODEL_API_KEY: "sk-test"
+  MACHTIANI_URL: %q
+  MACHTIANI_REPO_MANAGER_URL: %q
+  CODE_HOST_URL: "https://github.com"
+  CODE_HOST_API_KEY: "ghp_test"
+  API_GATEWAY_HOST_KEY: ""
+  API_GATEWAY_HOST_VALUE: ""
+  CONTENT_TYPE_KEY: "Content-Type"
+  CONTENT_TYPE_VALUE: "application/json"
+retry:
+  MAX_ATTEMPTS: 2
+  INITIAL_BACKOFF: "1ms"
+  MAX_BACKOFF: "1ms"
+`, s.URL, s.URL)
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+    request := Request{
+        Method: r.Method,
+        Path:   r.URL.Path,
+        Query:  r.URL.Query(),
+        Header: r.Header.Clone(),
+    }
+    if data, _ := io.ReadAll(r.Body); len(data) > 0 {
+        json.Unmarshal(data, &request.Body)
+    }
+
+    s.mu.Lock()
+    s.requests = append(s.requests, request)
+    behavior, scripted := s.nextBehavior(r.URL.Path)
+    s.mu.Unlock()
+
+    if scripted {
+        if behavior.Latency > 0 {
+            select {
+            case <-time.After(behavior.Latency):
+            case <-r.Context().Done():
+                return
+            }
+        }
+        for key, value := range behavior.Header {
+            w.Header().Set(key, value)
+        }
+        if behavior.Status != 0 {
+            w.WriteHeader(behavior.Status)
+            io.WriteString(w, behavior.Body)
+            return
+        }
+    }
+
+    switch {
+    case r.URL.Path == PathGenerateResponse && r.Method == http.MethodPost:
+        s.generateResponse(w, r, request)
+    case r.URL.Path == PathGenerateFilename && r.Method == http.MethodGet:
+        s.mu.Lock()
+        filename := s.filename
+        s.mu.Unlock()
+        writeJSON(w, http.StatusOK, filename)
+    case (r.URL.Path == PathAddRepositoryCount || r.URL.Path == PathFetchCount) && r.Method == http.MethodPost:
+        s.mu.Lock()
+        counts := api.LoadResponse{EmbeddingTokens: s.embeddingTokens, InferenceTokens: s.inferenceTokens}
+        s.mu.Unlock()
+        writeJSON(w, http.StatusOK, counts)
+    case r.URL.Path == PathAddRepository && r.Method == http.MethodPost:
+        if s.refuseWhileLocked(w) {
+            return
+        }
+        writeJSON(w, http.StatusOK, api.AddRepositoryResponse{
+            Message:              "Repository added",
+            FullPath:             "/data/" + fmt.Sprint(request.Body["project_name"]),
+            ApiKeyProvided:       request.Body["api_key"] != nil,
+            OpenAiApiKeyProvided: request.Body["model_api_key"] != "",
+        })
+    case r.URL.Path == PathFetchAndCheckout && r.Method == http.MethodPost:
+        if s.refuseWhileLocked(w) {
+            return
+        }
+        writeJSON(w, http.StatusOK, map[string]string{"message": "Fetched and checked out " + fmt.Sprint(request.Body["branch_name"])})
+    case r.URL.Path == PathDeleteStore && r.Method == http.MethodPost:
+        if s.refuseWhileLocked(w) {
+            return
+        }
+        writeJSON(w, http.StatusOK, api.DeleteStoreResponse{Message: "Store deleted"})
+    case r.URL.Path == PathStatus && r.Method == http.MethodGet:
+        s.mu.Lock()
+        status := api.StatusResponse{LockFilePresent: s.locked, LockTimeDuration: s.lockDuration}
+        if s.locked {
+            status.Phase = s.phase
+            status.Progress = s.progress
+            if s.unlockAfter > 0 {
+                s.unlockAfter--
+                if s.unlockAfter == 0 {
+                    s.locked = false
+                }
+            }
+        }
+        s.mu.Unlock()
+        writeJSON(w, http.StatusOK, status)
+    case r.URL.Path == PathCompatibility && r.Method == http.MethodPost:
+        s.mu.Lock()
+        compatibility := s.compatibility
+        s.mu.Unlock()
+        if compatibility == nil {
+            writeJSON(w, http.StatusNotFound, map[string]string{"detail": "Not Found"})
+            return
+        }
+        writeJSON(w, http.StatusOK, compatibility)
+    case r.URL.Path == PathHeadOID && r.Method == http.MethodGet:
+        s.mu.Lock()
+        info := map[string]string{"head_oid": s.headOID, "message": s.installMessage}
+        s.mu.Unlock()
+        writeJSON(w, http.StatusOK, info)
+    default:
+        writeJSON(w, http.StatusNotFound, map[string]string{"detail": "Not Found"})
+    }
+}
+
+// nextBehavior pops the scripted behavior for path. The caller holds s.mu.
+func (s *Server) nextBehavior(path string) (Behavior, bool) {
+    queue := s.behaviors[path]
+    if len(queue) == 0 {
+        return Behavior{}, false
+    }
+    behavior := queue[0]
+    if behavior.Times > 0 {
+        behavior.Times--
+        if behavior.Times == 0 {
+            s.behaviors[path] = queue[1:]
+        } else {
+            queue[0].Times = behavior.Times
+        }
+    }
+    return behavior, true
+}
+
+func (s *Server) refuseWhileLocked(w http.ResponseWriter) bool {
+    s.mu.Lock()
+    locked := s.locked
+    s.mu.Unlock()
+    if locked {
+        writeJSON(w, http.StatusLocked, map[string]string{"code": api.CodeLockPresent, "message": "project is still being processed"})
+    }
+    return locked
+}
+
+// generateResponse answers with the canned answer, streamed word by word as
+// server-sent events when the client asks for a stream.
+func (s *Server) generateResponse(w http.ResponseWriter, r *http.Request, request Request) {
+    s.mu.Lock()
+    answer := s.answer
+    s.mu.Unlock()
+
+    body := map[string]interface{}{}
+    for key, value := range answer.Extra {
+        body[key] = value
+    }
+    switch {
+    case answer.Error != "":
+        body["error"] = answer.Error
+        writeJSON(w, http.StatusOK, body)
+        return
+    case answer.Machtiani != "":
+        body["machtiani"] = answer.Machtiani
+        writeJSON(w, http.StatusOK, body)
+        return
+    }
+
+    paths := answer.RetrievedFilePaths
+    if paths == nil {
+        paths = []string{}
+    }
+    body["retrieved_file_paths"] = paths
+
+    stream, _ := request.Body["stream"].(bool)
+    if !stream || !strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+        body["openai_response"] = answer.Text
+        writeJSON(w, http.StatusOK, body)
+        return
+    }
+
+    w.Header().Set("Content-Type", "text/event-stream")
+    flusher, _ := w.(http.Flusher)
+    for i, word := range strings.SplitAfter(answer.Text, " ") {
+        if word == "" && i > 0 {
+            continue
+        }
+        chunk, _ := json.Marshal(map[string]string{"token": word})
+        fmt.Fprintf(w, "data: %s\n\n", chunk)
+        if flusher != nil {
+            flusher.Flush()
+        }
+    }
+    final, _ := json.Marshal(body)
+    fmt.Fprintf(w, "data: %s\n\ndata: [DONE]\n\n", final)
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(status)
+    json.NewEncoder(w).Encode(value)
+}
@@ -0,0 +1,331 @@
+// Package update replaces the running machtiani binary with a newer release.
+// Releases are described by a JSON manifest that lists one artifact per
+// platform, named like the binaries build.sh produces. The manifest is signed
+// with the release key, binding the version to the name and SHA-256 checksum
+// of every artifact, and every artifact must match its checksum and carry its
+// own signature before it is installed. Only the key built into the binary is
+// trusted.
+package update
+
+import (
+    "context"
+    "crypto/ed25519"
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "net/http"
+    "net/url"
+    "os"
+    "os/exec"
+    "path/filepath"
+    "runtime"
+    "strings"
+    "time"
+
+    "github.com/7db9a/machtiani/internal/semver"
+)
+
+// DefaultManifestURL and PublicKey are set at build time. PublicKey is the
+// base64 ed25519 key that release manifests and artifacts are signed with; it
+// cannot be changed at run time, so a mirror that signs its own builds has to
+// ship binaries built with its key.
+var (
+    DefaultManifestURL = ""
+    PublicKey          = ""
+)
+
+// devVersion matches api.DevVersion, the version of unreleased builds.
+const devVersion = "0.0.0-dev"
+
+// Manifest describes a release. Signature is the base64 ed25519 signature
+// of SignedPayload.
+type Manifest struct {
+    Version   string     `json:"version"`
+    Notes     string     `json:"notes,omitempty"`
+    Artifacts []Artifact `json:"artifacts"`
+    Signature string     `json:"signature"`
+}
+
+// SignedPayload is the part of the manifest its signature covers: the
+// version and the name and checksum of every artifact, one per line. Signing
+// them together keeps a mirror from passing off an old release as a new one
+// or serving one platform's binary as another's.
+func (m Manifest) SignedPayload() []byte {
+    var b strings.Builder
+    fmt.Fprintf(&b, "machtiani release %s\n", m.Version)
+    for _, artifact := range m.Artifacts {
+        fmt.Fprintf(&b, "%s %s\n", artifact.Name, strings.ToLower(artifact.SHA256))
+    }
+    return []byte(b.String())
+}
+
+// Artifact is a release binary for one platform. URL may be relative to the
+// manifest. Signature is the base64 ed25519 signature of the binary.
+type Artifact struct {
+    Name      string `json:"name"`
+    URL       string `json:"url"`
+    SHA256    string `json:"sha256"`
+    Signature string `json:"signature"`
+}
+
+// ArtifactName returns the binary name build.sh uses for a platform.
+func ArtifactName(goos, goarch string) string {
+    return fmt.Sprintf("machtiani-%s-%s", goos, goarch)
+}
+
+// ErrNoArtifact is returned when a release has no binary for this platform.
+var ErrNoArtifact = errors.New("release has no artifact for this platform")
+
+// Updater checks for and installs releases.
+type Updater struct {
+    ManifestURL    string
+    PublicKey      ed25519.PublicKey
+    CurrentVersion string
+    ExecutablePath string // binary to replace
+    GOOS, GOARCH   string
+    HTTPClient     *http.Client
+
+    // SmokeTest runs the downloaded binary before it is installed. The
+    // default runs "<binary> help" and expects it to succeed.
+    SmokeTest func(ctx context.Context, path string) error
+}
+
+// New returns an Updater for the running binary that trusts the release key
+// built into it.
+func New(manifestURL, currentVersion string) (*Updater, error) {
+    if manifestURL == "" {
+        manifestURL = DefaultManifestURL
+    }
+    if manifestURL == "" {
+        return nil, fmt.Errorf("no release manifest URL: set MANIFEST_URL in the update section of .machtiani-config.yml")
+    }
+    if PublicKey == "" {
+        return nil, fmt.Errorf("this build has no release signing key, so updates cannot be verified")
+    }
+    key, err := base64.StdEncoding.DecodeString(PublicKey)
+    if err != nil || len(key) != ed25519.PublicKeySize {
+        return nil, fmt.Errorf("invalid release signing key")
+    }
+
+    executable, err := os.Executable()
+    if err != nil {
+        return nil, fmt.Errorf("failed to locate the running binary: %w", err)
+    }
+    if resolved, err := filepath.EvalSymlinks(executable); err == nil {
+        executable = resolved
+    }
+
+    return &Updater{
+        ManifestURL:    manifestURL,
+        PublicKey:      ed25519.PublicKey(key),
+        CurrentVersion: currentVersion,
+        ExecutablePath: executable,
+        GOOS:           runtime.GOOS,
+        GOARCH:         runtime.GOARCH,
+        HTTPClient:     &http.Client{Timeout: 10 * time.Minute},
+    }, nil
+}
+
+// Check fetches the manifest, verifies its signature and returns it with the
+// artifact for this platform. newer reports whether the release is newer than the running
+// version; development builds are older than any release. When it is not,
+// the artifact is left empty so an up-to-date binary is not reported as
+// unsupported just because the release skips its platform.
+func (u *Updater) Check(ctx context.Context) (manifest Manifest, artifact Artifact, newer bool, err error) {
+    body, err := u.get(ctx, u.ManifestURL)
+    if err != nil {
+        return manifest, artifact, false, fmt.Errorf("fetching release manifest: %w", err)
+    }
+    defer body.Close()
+    if err := json.NewDecoder(body).Decode(&manifest); err != nil {
+        return manifest, artifact, false, fmt.Errorf("decoding release manifest: %w", err)
+    }
+    signature, err := base64.StdEncoding.DecodeString(manifest.Signature)
+    if err != nil || !ed25519.Verify(u.PublicKey, manifest.SignedPayload(), signature) {
+        return Manifest{}, artifact, false, fmt.Errorf("release manifest signature verification failed")
+    }
+
+    latest, err := semver.Parse(manifest.Version)
+    if err != nil {
+        return manifest, artifact, false, fmt.Errorf("release manifest: %w", err)
+    }
+    newer = true
+    if current, err := semver.Parse(u.CurrentVersion); err == nil && u.CurrentVersion != devVersion {
+        newer = latest.Compare(current) > 0
+    }
+
+    if !newer {
+        return manifest, artifact, false, nil
+    }
+    artifact, err = u.Artifact(manifest)
+    return manifest, artifact, true, err
+}
+
+// Artifact returns the binary for this platform from a verified manifest.
+func (u *Updater) Artifact(manifest Manifest) (Artifact, error) {
+    name := ArtifactName(u.GOOS, u.GOARCH)
+    for _, candidate := range manifest.Artifacts {
+        if candidate.Name == name {
+            return candidate, nil
+        }
+    }
+    return Artifact{}, fmt.Errorf("%w: %s", ErrNoArtifact, name)
+}
+
+// Apply downloads artifact, verifies its checksum and signature, smoke tests
+// it and atomically replaces the running binary. If any step fails the
+// installed binary is left as it was.
+func (u *Updater) Apply(ctx context.Context, artifact Artifact) error {
+    dir := filepath.Dir(u.ExecutablePath)
+    // The download goes next to the binary so the final rename stays on one
+    // filesystem and is atomic.
+    tmp, err := ioutil.TempFile(dir, ".machtiani-update-*")
+    if err != nil {
+        return fmt.Errorf("creating download file in %s: %w", dir, err)
+    }
+    tmpPath := tmp.Name()
+    defer os.Remove(tmpPath)
+
+    if err := u.download(ctx, artifact, tmp); err != nil {
+        tmp.Close()
+        return err
+    }
+    if err := tmp.Close(); err != nil {
+        return fmt.Errorf("writing download: %w", err)
+    }
+
+    if err := u.verify(tmpPath, artifact); err != nil {
+        return err
+    }
+
+    mode := os.FileMode(0755)
+    if info, err := os.Stat(u.ExecutablePath); err == nil {
+        mode = info.Mode().Perm() | 0111
+    }
+    if err := os.Chmod(tmpPath, mode); err != nil {
+        return fmt.Errorf("making download executable: %w", err)
+    }
+
+    smokeTest := u.SmokeTest
+    if smokeTest == nil {
+        smokeTest = runHelp
+    }
+    if err := smokeTest(ctx, tmpPath); err != nil {
+        return fmt.Errorf("new binary failed its smoke test: %w", err)
+    }
+
+    return replace(u.ExecutablePath, tmpPath)
+}
+
+// replace swaps newPath in for target with a single rename, so target always
+// names a complete binary. A backup is linked, or copied, beside it first and
+// removed once the swap has succeeded.
+func replace(target, newPath string) error {
+    backup := target + ".old"
+    os.Remove(backup)
+    if err := os.Link(target, backup); err != nil {
+        if err := copyFile(target, backup); err != nil {
+            os.Remove(backup)
+            return fmt.Errorf("backing up current binary: %w", err)
+        }
+    }
+    if err := os.Rename(newPath, target); err != nil {
+        os.Remove(backup)
+        return fmt.Errorf("installing new binary (previous binary kept): %w", err)
+    }
+    os.Remove(backup)
+    return nil
+}
+
+func copyFile(src, dst string) error {
+    info, err := os.Stat(src)
+    if err != nil {
+        return err
+    }
+    data, err := ioutil.ReadFile(src)
+    if err != nil {
+        return err
+    }
+    return ioutil.WriteFile(dst, data, info.Mode().Perm())
+}
+
+func (u *Updater) download(ctx context.Context, artifact Artifact, dst io.Writer) error {
+    artifactURL, err := u.resolve(artifact.URL)
+    if err != nil {
+        return err
+    }
+    body, err := u.get(ctx, artifactURL)
+    if err != nil {
+        return fmt.Errorf("downloading %s: %w", artifact.Name, err)
+    }
+    defer body.Close()
+    if _, err := io.Copy(dst, body); err != nil {
+        return fmt.Errorf("downloading %s: %w", artifact.Name, err)
+    }
+    return nil
+}
+
+// verify checks the downloaded file against the artifact's checksum and
+// signature.
+func (u *Updater) verify(path string, artifact Artifact) error {
+    data, err := ioutil.ReadFile(path)
+    if err != nil {
+        return fmt.Errorf("reading download: %w", err)
+    }
+
+    sum := sha256.Sum256(data)
+    if !strings.EqualFold(hex.EncodeToString(sum[:]), artifact.SHA256) {
+        return fmt.Errorf("checksum mismatch for %s: got %x, manifest lists %s", artifact.Name, sum, artifact.SHA256)
+    }
+
+    signature, err := base64.StdEncoding.DecodeString(artifact.Signature)
+    if err != nil || !ed25519.Verify(u.PublicKey, data, signature) {
+        return fmt.Errorf("signature verification failed for %s", artifact.Name)
+    }
+    return nil
+}
+
+func (u *Updater) resolve(ref string) (string, error) {
+    base, err := url.Parse(u.ManifestURL)
+    if err != nil {
+        return "", fmt.Errorf("invalid manifest URL: %w", err)
+    }
+    target, err := url.Parse(ref)
+    if err != nil {
+        return "", fmt.Errorf("invalid artifact URL %q: %w", ref, err)
+    }
+    return base.ResolveReference(target).String(), nil
+}
+
+func (u *Updater) get(ctx context.Context, rawURL string) (io.ReadCloser, error) {
+    req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+    if err != nil {
+        return nil, err
+    }
+    client := u.HTTPClient
+    if client == nil {
+        client = http.DefaultClient
+    }
+    resp, err := client.Do(req)
+    if err != nil {
+        return nil, err
+    }
+    if resp.StatusCode != http.StatusOK {
+        resp.Body.Close()
+        return nil, fmt.Errorf("GET %s returned %s", rawURL, resp.Status)
+    }
+    return resp.Body, nil
+}
+
+func runHelp(ctx context.Context, path string) error {
+    cmd := exec.CommandContext(ctx, path, "help")
+    if output, err := cmd.CombinedOutput(); err != nil {
+        return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(output)))
+    }
+    return nil
+}
@@ -0,0 +1,271 @@
+package update
+
+import (
+    "context"
+    "crypto/ed25519"
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "io/ioutil"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+)
+
+// release serves a signed manifest and one signed artifact per platform.
+type release struct {
+    server   *httptest.Server
+    key      ed25519.PrivateKey
+    manifest Manifest
+    binaries map[string][]byte
+}
+
+func newRelease(t *testing.T, version string, binary []byte) *release {
+    _, private, err := ed25519.GenerateKey(nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    r := &release{key: private, binaries: map[string][]byte{}}
+    r.manifest.Version = version
+
+    mux := http.NewServeMux()
+    mux.HandleFunc("/releases/manifest.json", func(w http.ResponseWriter, req *http.Request) {
+        json.NewEncoder(w).Encode(r.manifest)
+    })
+    mux.HandleFunc("/releases/", func(w http.ResponseWriter, req *http.Request) {
+        data, ok := r.binaries[filepath.Base(req.URL.Path)]
+        if !ok {
+            http.NotFound(w, req)
+            return
+        }
+        w.Write(data)
+    })
+    r.server = httptest.NewServer(mux)
+    t.Cleanup(r.server.Close)
+
+    for _, platform := range [][2]string{{"darwin", "amd64"}, {"darwin", "arm64"}, {"linux", "amd64"}} {
+        r.add(ArtifactName(platform[0], platform[1]), binary)
+    }
+    r.sign()
+    return r
+}
+
+func (r *release) sign() {
+    r.manifest.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(r.key, r.manifest.SignedPayload()))
+}
+
+func (r *release) add(name string, binary []byte) {
+    sum := sha256.Sum256(binary)
+    r.binaries[name] = binary
+    r.manifest.Artifacts = append(r.manifest.Artifacts, Artifact{
+        Name:      name,
+        URL:       name, // relative to the manifest
+        SHA256:    hex.EncodeToString(sum[:]),
+        Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(r.key, binary)),
+    })
+}
+
+// updater returns an Updater that replaces a fake installed binary.
+func (r *release) updater(t *testing.T, current string) *Updater {
+    executable := filepath.Join(t.TempDir(), "machtiani")
+    if err := ioutil.WriteFile(executable, []byte("old binary"), 0755); err != nil {
+        t.Fatal(err)
+    }
+    return &Updater{
+        ManifestURL:    r.server.URL + "/releases/manifest.json",
+        PublicKey:      r.key.Public().(ed25519.PublicKey),
+        CurrentVersion: current,
+        ExecutablePath: executable,
+        GOOS:           "linux",
+        GOARCH:         "amd64",
+        SmokeTest:      func(ctx context.Context, path string) error { return nil },
+    }
+}
+
+func installed(t *testing.T, u *Updater) string {
+    data, err := ioutil.ReadFile(u.ExecutablePath)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return string(data)
+}
+
+func TestUpdate_InstallsNewerRelease(t *testing.T) {
+    r := newRelease(t, "1.2.0", []byte("new binary"))
+    u := r.updater(t, "1.1.0")
+
+    manifest, artifact, newer, err := u.Check(context.Background())
+    if err != nil {
+        t.Fatalf("Unexpected error: %v", err)
+    }
+    if !newer || manifest.Version != "1.2.0" || artifact.Name != "machtiani-linux-amd64" {
+        t.Fatalf("Unexpected check result: newer=%v manifest=%+v artifact=%+v", newer, manifest, artifact)
+    }
+
+    if err := u.Apply(context.Background(), artifact); err != nil {
+        t.Fatalf("Unexpected error: %v", err)
+    }
+    if got := installed(t, u); got != "new binary" {
+        t.Errorf("Expected the new binary to be installed, got %q", got)
+    }
+    info, err := os.Stat(u.ExecutablePath)
+    if err != nil || info.Mode().Perm()&0111 == 0 {
+        t.Errorf("Expected the installed binary to be executable, got %v (%v)", info.Mode(), err)
+    }
+    entries, _ := ioutil.ReadDir(filepath.Dir(u.ExecutablePath))
+    if len(entries) != 1 {
+        t.Errorf("Expected no leftover files next to the binary, got %d entries", len(entries))
+    }
+}
+
+func TestCheck_Versions(t *testing.T) {
+    r := newRelease(t, "1.2.0", []byte("new binary"))
+    for current, want := range map[string]bool{
+        "1.1.9":     true,
+        "1.2.0":     false,
+        "1.3.0":     false,
+        "0.0.0-dev": true,
+    } {
+        _, _, newer, err := r.updater(t, current).Check(context.Background())
+        if err != nil {
+            t.Fatalf("Unexpected error: %v", err)
+        }
+        if newer != want {
+            t.Errorf("Expected newer=%v for %s, got %v", want, current, newer)
+        }
+    }
+
+    u := r.updater(t, "1.1.0")
+    u.GOOS, u.GOARCH = "windows", "amd64"
+    if _, _, _, err := u.Check(context.Background()); !errors.Is(err, ErrNoArtifact) {
+        t.Errorf("Expected ErrNoArtifact, got %v", err)
+    }
+
+    u = r.updater(t, "1.2.0")
+    u.GOOS, u.GOARCH = "windows", "amd64"
+    if _, _, newer, err := u.Check(context.Background()); err != nil || newer {
+        t.Errorf("Expected an up-to-date binary on an unpublished platform to report no update, got newer=%v, err=%v", newer, err)
+    }
+}
+
+func TestApply_RejectsTamperedArtifacts(t *testing.T) {
+    r := newRelease(t, "1.2.0", []byte("new binary"))
+
+    cases := map[string]func(*Artifact){
+        "checksum": func(a *Artifact) {
+            a.SHA256 = strings.Repeat("0", 64)
+        },
+        "signature": func(a *Artifact) {
+            a.Signature = base64.StdEncoding.EncodeToString(make([]byte, ed25519.SignatureSize))
+        },
+    }
+    for name, tamper := range cases {
+        u := r.updater(t, "1.1.0")
+        _, artifact, _, err := u.Check(context.Background())
+        if err != nil {
+            t.Fatalf("Unexpected error: %v", err)
+        }
+        tamper(&artifact)
+        err = u.Apply(context.Background(), artifact)
+        if err == nil || !strings.Contains(err.Error(), name) {
+            t.Errorf("Expected a %s error, got %v", name, err)
+        }
+        if got := installed(t, u); got != "old binary" {
+            t.Errorf("Expected the old binary to be kept after a bad %s, got %q", name, got)
+        }
+    }
+
+    // A binary signed by another key is rejected even if the manifest
+    // checksum matches it.
+    u := r.updater(t, "1.1.0")
+    _, artifact, _, _ := u.Check(context.Background())
+    _, other, _ := ed25519.GenerateKey(nil)
+    u.PublicKey = other.Public().(ed25519.PublicKey)
+    if err := u.Apply(context.Background(), artifact); err == nil || !strings.Contains(err.Error(), "signature") {
+        t.Errorf("Expected a signature error, got %v", err)
+    }
+}
+
+func TestCheck_RejectsTamperedManifests(t *testing.T) {
+    cases := map[string]func(*Manifest){
+        "version": func(m *Manifest) {
+            m.Version = "9.0.0"
+        },
+        "mixed platform": func(m *Manifest) {
+            m.Artifacts[1].URL, m.Artifacts[1].SHA256 = m.Artifacts[0].URL, m.Artifacts[0].SHA256
+        },
+        "unsigned": func(m *Manifest) {
+            m.Signature = ""
+        },
+    }
+    for name, tamper := range cases {
+        r := newRelease(t, "1.2.0", nil)
+        r.manifest.Artifacts = nil
+        r.add(ArtifactName("darwin", "amd64"), []byte("darwin binary"))
+        r.add(ArtifactName("linux", "amd64"), []byte("linux binary"))
+        r.sign()
+        tamper(&r.manifest)
+        if _, _, _, err := r.updater(t, "1.1.0").Check(context.Background()); err == nil || !strings.Contains(err.Error(), "manifest signature") {
+            t.Errorf("Expected a manifest signature error for a %s manifest, got %v", name, err)
+        }
+    }
+}
+
+func TestApply_SmokeTestFailureKeepsOldBinary(t *testing.T) {
+    r := newRelease(t, "1.2.0", []byte("broken binary"))
+    u := r.updater(t, "1.1.0")
+    u.SmokeTest = func(ctx context.Context, path string) error {
+        return errors.New("exit status 2")
+    }
+
+    _, artifact, _, err := u.Check(context.Background())
+    if err != nil {
+        t.Fatalf("Unexpected error: %v", err)
+    }
+    if err := u.Apply(context.Background(), artifact); err == nil || !strings.Contains(err.Error(), "smoke test") {
+        t.Errorf("Expected a smoke test error, got %v", err)
+    }
+    if got := installed(t, u); got != "old binary" {
+        t.Errorf("Expected the old binary to be kept, got %q", got)
+    }
+}
+
+func TestReplace_KeepsOldBinaryWhenInstallFails(t *testing.T) {
+    dir := t.TempDir()
+    target := filepath.Join(dir, "machtiani")
+    if err := ioutil.WriteFile(target, []byte("old binary"), 0755); err != nil {
+        t.Fatal(err)
+    }
+
+    err := replace(target, filepath.Join(dir, "missing"))
+    if err == nil || !strings.Contains(err.Error(), "previous binary kept") {
+        t.Fatalf("Expected an install error, got %v", err)
+    }
+    data, err := ioutil.ReadFile(target)
+    if err != nil || string(data) != "old binary" {
+        t.Errorf("Expected the old binary to stay in place, got %q (%v)", data, err)
+    }
+    if _, err := os.Stat(target + ".old"); !os.IsNotExist(err) {
+        t.Errorf("Expected the backup to be removed, got %v", err)
+    }
+}
+
+func TestNew_RequiresManifestAndKey(t *testing.T) {
+    defer func(key string) { PublicKey = key }(PublicKey)
+    PublicKey = ""
+    if _, err := New("", "1.0.0"); err == nil || !strings.Contains(err.Error(), "MANIFEST_URL") {
+        t.Errorf("Expected a missing manifest URL error, got %v", err)
+    }
+    if _, err := New("https://example.com/manifest.json", "1.0.0"); err == nil || !strings.Contains(err.Error(), "signing key") {
+        t.Errorf("Expected a missing key error, got %v", err)
+    }
+    PublicKey = "bm90IGEga2V5"
+    if _, err := New("https://example.com/manifest.json", "1.0.0"); err == nil || !strings.Contains(err.Error(), "invalid") {
+        t.Errorf("Expected an invalid key error, got %v", err)
+    }
+}
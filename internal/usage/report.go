@@ -0,0 +1,172 @@
+package usage
+
+import (
+    "encoding/csv"
+    "encoding/json"
+    "fmt"
+    "io"
+    "sort"
+    "strconv"
+    "text/tabwriter"
+    "time"
+)
+
+// Groupings accepted by Summarize.
+const (
+    ByDay     = "day"
+    ByProject = "project"
+    ByModel   = "model"
+    ByCommand = "command"
+)
+
+// Groupings lists the groupings in the order they are documented.
+var Groupings = []string{ByDay, ByProject, ByModel, ByCommand}
+
+// Summary totals the entries that share a key.
+type Summary struct {
+    Key              string  `json:"key"`
+    Operations       int     `json:"operations"`
+    EmbeddingTokens  int     `json:"embedding_tokens"`
+    InferenceTokens  int     `json:"inference_tokens"`
+    PromptTokens     int     `json:"prompt_tokens"`
+    CompletionTokens int     `json:"completion_tokens"`
+    TotalTokens      int     `json:"total_tokens"`
+    Cost             float64 `json:"cost_usd"`
+    Duration         float64 `json:"duration_seconds"`
+}
+
+// Summarize groups entries by one of the Groupings, sorted by key.
+func Summarize(entries []Entry, by string) ([]Summary, error) {
+    key, err := groupKey(by)
+    if err != nil {
+        return nil, err
+    }
+
+    totals := map[string]*Summary{}
+    for _, entry := range entries {
+        k := key(entry)
+        summary, ok := totals[k]
+        if !ok {
+            summary = &Summary{Key: k}
+            totals[k] = summary
+        }
+        summary.Operations++
+        summary.EmbeddingTokens += entry.EmbeddingTokens
+        summary.InferenceTokens += entry.InferenceTokens
+        summary.PromptTokens += entry.PromptTokens
+        summary.CompletionTokens += entry.CompletionTokens
+        summary.TotalTokens += entry.Tokens()
+        summary.Cost += entry.Cost
+        summary.Duration += entry.Duration
+    }
+
+    summaries := make([]Summary, 0, len(totals))
+    for _, summary := range totals {
+        summaries = append(summaries, *summary)
+    }
+    sort.Slice(summaries, func(i, j int) bool { return summaries[i].Key < summaries[j].Key })
+    return summaries, nil
+}
+
+func groupKey(by string) (func(Entry) string, error) {
+    orNone := func(s string) string {
+        if s == "" {
+            return "(none)"
+        }
+        return s
+    }
+    switch by {
+    case ByDay:
+        return func(e Entry) string { return e.Time.Local().Format("2006-01-02") }, nil
+    case ByProject:
+        return func(e Entry) string { return orNone(e.Project) }, nil
+    case ByModel:
+        return func(e Entry) string { return orNone(e.Model) }, nil
+    case ByCommand:
+        return func(e Entry) string { return e.Command }, nil
+    }
+    return nil, fmt.Errorf("unknown grouping %q (options: day, project, model, command)", by)
+}
+
+var summaryHeader = []string{"operations", "embedding_tokens", "inference_tokens", "prompt_tokens", "completion_tokens", "total_tokens", "cost_usd", "duration_seconds"}
+
+func (s Summary) fields() []string {
+    return []string{
+        strconv.Itoa(s.Operations),
+        strconv.Itoa(s.EmbeddingTokens),
+        strconv.Itoa(s.InferenceTokens),
+        strconv.Itoa(s.PromptTokens),
+        strconv.Itoa(s.CompletionTokens),
+        strconv.Itoa(s.TotalTokens),
+        strconv.FormatFloat(s.Cost, 'f', 4, 64),
+        strconv.FormatFloat(s.Duration, 'f', 1, 64),
+    }
+}
+
+// WriteTable writes summaries as an aligned table with a total row.
+func WriteTable(w io.Writer, by string, summaries []Summary) error {
+    tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+    fmt.Fprintf(tw, "%s\tOPS\tEMBEDDING\tINFERENCE\tPROMPT\tCOMPLETION\tTOTAL\tCOST (USD)\t\n", by)
+
+    row := func(s Summary) {
+        fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t%d\t%d\t%.4f\t\n", s.Key, s.Operations, s.EmbeddingTokens,
+            s.InferenceTokens, s.PromptTokens, s.CompletionTokens, s.TotalTokens, s.Cost)
+    }
+    total := Summary{Key: "total"}
+    for _, s := range summaries {
+        row(s)
+        total.Operations += s.Operations
+        total.EmbeddingTokens += s.EmbeddingTokens
+        total.InferenceTokens += s.InferenceTokens
+        total.PromptTokens += s.PromptTokens
+        total.CompletionTokens += s.CompletionTokens
+        total.TotalTokens += s.TotalTokens
+        total.Cost += s.Cost
+    }
+    row(total)
+    return tw.Flush()
+}
+
+// WriteSummaryCSV writes summaries as CSV with a header row.
+func WriteSummaryCSV(w io.Writer, by string, summaries []Summary) error {
+    cw := csv.NewWriter(w)
+    cw.Write(append([]string{by}, summaryHeader...))
+    for _, s := range summaries {
+        cw.Write(append([]string{s.Key}, s.fields()...))
+    }
+    cw.Flush()
+    return cw.Error()
+}
+
+// WriteEntriesCSV writes the raw ledger entries as CSV with a header row.
+func WriteEntriesCSV(w io.Writer, entries []Entry) error {
+    cw := csv.NewWriter(w)
+    cw.Write([]string{"time", "command", "project", "model", "mode", "embedding_tokens", "inference_tokens",
+        "prompt_tokens", "completion_tokens", "total_tokens", "estimated", "cost_usd", "duration_seconds"})
+    for _, e := range entries {
+        cw.Write([]string{
+            e.Time.Format(time.RFC3339),
+            e.Command,
+            e.Project,
+            e.Model,
+            e.Mode,
+            strconv.Itoa(e.EmbeddingTokens),
+            strconv.Itoa(e.InferenceTokens),
+            strconv.Itoa(e.PromptTokens),
+            strconv.Itoa(e.CompletionTokens),
+            strconv.Itoa(e.Tokens()),
+            strconv.FormatBool(e.Estimated),
+            strconv.FormatFloat(e.Cost, 'f', 6, 64),
+            strconv.FormatFloat(e.Duration, 'f', 3, 64),
+        })
+    }
+    cw.Flush()
+    return cw.Error()
+}
+
+// WriteJSON writes v, summaries or entries, as indented JSON.
+func WriteJSON(w io.Writer, v interface{}) error {
+    encoder := json.NewEncoder(w)
+    encoder.SetIndent("", "  ")
+    return encoder.Encode(v)
+}
@@ -0,0 +1,152 @@
+// Package usage keeps a local ledger of the tokens spent by each command, one
+// JSON object per line. Budgets look back over it, and `machtiani usage`
+// summarizes it for chargeback.
+package usage
+
+import (
+    "bufio"
+    "encoding/json"
+    "fmt"
+    "os"
+    "path/filepath"
+    "strings"
+    "time"
+
+    "github.com/7db9a/machtiani/internal/utils"
+)
+
+// Commands recorded in the ledger.
+const (
+    CommandStore  = "git-store"
+    CommandSync   = "git-sync"
+    CommandDelete = "git-delete"
+    CommandPrompt = "prompt"
+)
+
+// Entry is one ledger line.
+type Entry struct {
+    Time             time.Time `json:"time"`
+    Command          string    `json:"command"`
+    Project          string    `json:"project,omitempty"`
+    Model            string    `json:"model,omitempty"`
+    Mode             string    `json:"mode,omitempty"`
+    EmbeddingTokens  int       `json:"embedding_tokens,omitempty"`
+    InferenceTokens  int       `json:"inference_tokens,omitempty"`
+    PromptTokens     int       `json:"prompt_tokens,omitempty"`
+    CompletionTokens int       `json:"completion_tokens,omitempty"`
+    Duration         float64   `json:"duration_seconds,omitempty"`
+    // Cost is the estimated cost in US dollars, or 0 when a model involved
+    // had no price.
+    Cost float64 `json:"cost_usd,omitempty"`
+    // Estimated is set when the counts are estimates rather than usage
+    // reported by the server.
+    Estimated bool `json:"estimated,omitempty"`
+}
+
+// Tokens returns the total tokens of the entry.
+func (e Entry) Tokens() int {
+    return e.EmbeddingTokens + e.InferenceTokens + e.PromptTokens + e.CompletionTokens
+}
+
+// Ledger is an append-only usage file.
+type Ledger struct {
+    Path string
+}
+
+// DefaultPath returns ~/.machtiani/usage.jsonl.
+func DefaultPath() (string, error) {
+    homeDir, err := os.UserHomeDir()
+    if err != nil {
+        return "", fmt.Errorf("failed to get home directory: %w", err)
+    }
+    return filepath.Join(homeDir, ".machtiani", "usage.jsonl"), nil
+}
+
+// LedgerFromConfig returns the ledger at the configured path, or at
+// DefaultPath when none is set. A leading "~/" is expanded.
+func LedgerFromConfig(config utils.Config) (*Ledger, error) {
+    path := config.Usage.LedgerPath
+    switch {
+    case path == "":
+        var err error
+        if path, err = DefaultPath(); err != nil {
+            return nil, err
+        }
+    case strings.HasPrefix(path, "~/"):
+        homeDir, err := os.UserHomeDir()
+        if err != nil {
+            return nil, fmt.Errorf("failed to get home directory: %w", err)
+        }
+        path = filepath.Join(homeDir, path[2:])
+    }
+    return &Ledger{Path: path}, nil
+}
+
+// Append adds entry to the ledger, stamping it with the current time if it
+// has none.
+func (l *Ledger) Append(entry Entry) error {
+    if entry.Time.IsZero() {
+        entry.Time = time.Now()
+    }
+    data, err := json.Marshal(entry)
+    if err != nil {
+        return fmt.Errorf("failed to encode usage entry: %w", err)
+    }
+
+    if err := os.MkdirAll(filepath.Dir(l.Path), 0755); err != nil {
+        return fmt.Errorf("failed to create usage directory: %w", err)
+    }
+    file, err := os.OpenFile(l.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+    if err != nil {
+        return fmt.Errorf("failed to open usage ledger: %w", err)
+    }
+    defer file.Close()
+
+    if _, err := file.Write(append(data, '\n')); err != nil {
+        return fmt.Errorf("failed to write usage ledger: %w", err)
+    }
+    return nil
+}
+
+// Entries returns the entries recorded at or after since, oldest first. A
+// missing ledger has no entries; malformed lines are skipped.
+func (l *Ledger) Entries(since time.Time) ([]Entry, error) {
+    file, err := os.Open(l.Path)
+    if os.IsNotExist(err) {
+        return nil, nil
+    }
+    if err != nil {
+        return nil, fmt.Errorf("failed to open usage ledger: %w", err)
+    }
+    defer file.Close()
+
+    var entries []Entry
+    scanner := bufio.NewScanner(file)
+    scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+    for scanner.Scan() {
+        var entry Entry
+        if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+            continue
+        }
+        if !entry.Time.Before(since) {
+            entries = append(entries, entry)
+        }
+    }
+    if err := scanner.Err(); err != nil {
+        return nil, fmt.Errorf("failed to read usage ledger: %w", err)
+    }
+    return entries, nil
+}
+
+// TokensSince sums the tokens of the entries recorded at or after since.
+func (l *Ledger) TokensSince(since time.Time) (int, error) {
+    entries, err := l.Entries(since)
+    if err != nil {
+        return 0, err
+    }
+    total := 0
+    for _, entry := range entries {
+        total += entry.Tokens()
+    }
+    return total, nil
+}
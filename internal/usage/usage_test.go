@@ -0,0 +1,78 @@
+package usage
+
+import (
+    "bytes"
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestLedger_AppendAndEntries(t *testing.T) {
+    ledger := &Ledger{Path: filepath.Join(t.TempDir(), "nested", "usage.jsonl")}
+    now := time.Now()
+    ledger.Append(Entry{Time: now.Add(-48 * time.Hour), Command: CommandStore, EmbeddingTokens: 100})
+    ledger.Append(Entry{Time: now, Command: CommandPrompt, PromptTokens: 10, CompletionTokens: 5})
+
+    entries, err := ledger.Entries(now.Add(-24 * time.Hour))
+    if err != nil {
+        t.Fatalf("Unexpected error: %v", err)
+    }
+    if len(entries) != 1 || entries[0].Command != CommandPrompt {
+        t.Fatalf("Expected only the recent entry, got %+v", entries)
+    }
+    if total, _ := ledger.TokensSince(time.Time{}); total != 115 {
+        t.Errorf("Expected 115 tokens in total, got %d", total)
+    }
+}
+
+func TestLedger_MissingFile(t *testing.T) {
+    ledger := &Ledger{Path: filepath.Join(t.TempDir(), "usage.jsonl")}
+    entries, err := ledger.Entries(time.Time{})
+    if err != nil || len(entries) != 0 {
+        t.Errorf("Expected no entries and no error, got %v, %v", entries, err)
+    }
+}
+
+func TestSummarize(t *testing.T) {
+    day := time.Date(2024, 3, 1, 12, 0, 0, 0, time.Local)
+    entries := []Entry{
+        {Time: day, Command: CommandStore, Project: "repo-a", EmbeddingTokens: 1000, InferenceTokens: 200, Cost: 0.5},
+        {Time: day, Command: CommandPrompt, Project: "repo-a", Model: "gpt-4o", PromptTokens: 50, CompletionTokens: 20, Cost: 0.25},
+        {Time: day.AddDate(0, 0, 1), Command: CommandPrompt, Project: "repo-b", Model: "gpt-4o", PromptTokens: 30},
+    }
+
+    byProject, err := Summarize(entries, ByProject)
+    if err != nil {
+        t.Fatalf("Unexpected error: %v", err)
+    }
+    if len(byProject) != 2 || byProject[0].Key != "repo-a" || byProject[0].TotalTokens != 1270 || byProject[0].Cost != 0.75 || byProject[0].Operations != 2 {
+        t.Errorf("Unexpected project summary: %+v", byProject)
+    }
+
+    byModel, _ := Summarize(entries, ByModel)
+    if len(byModel) != 2 || byModel[0].Key != "(none)" || byModel[1].Key != "gpt-4o" {
+        t.Errorf("Unexpected model summary: %+v", byModel)
+    }
+
+    byDay, _ := Summarize(entries, ByDay)
+    if len(byDay) != 2 || byDay[0].Key != "2024-03-01" || byDay[1].Key != "2024-03-02" {
+        t.Errorf("Unexpected day summary: %+v", byDay)
+    }
+
+    if _, err := Summarize(entries, "week"); err == nil {
+        t.Errorf("Expected an unknown grouping to fail")
+    }
+}
+
+func TestWriteSummaryCSV(t *testing.T) {
+    var buf bytes.Buffer
+    summaries := []Summary{{Key: "git-store", Operations: 1, EmbeddingTokens: 1000, TotalTokens: 1000, Cost: 0.13}}
+    if err := WriteSummaryCSV(&buf, ByCommand, summaries); err != nil {
+        t.Fatalf("Unexpected error: %v", err)
+    }
+    lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+    if len(lines) != 2 || !strings.HasPrefix(lines[0], "command,operations,") || lines[1] != "git-store,1,1000,0,0,0,1000,0.1300,0.0" {
+        t.Errorf("Unexpected CSV:\n%s", buf.String())
+    }
+}
@@ -1,7 +1,9 @@
 package utils
 
 import (
+    "errors"
     "fmt"
+    "io"
     "io/ioutil"
     "os"
     "path/filepath"
@@ -11,29 +13,58 @@ import (
     "flag"
     "time"
     "os/exec"
+    "strconv"
+    "sync"
 
     "gopkg.in/yaml.v2"
     "github.com/7db9a/machtiani/internal/git"
+    "github.com/mattn/go-isatty"
 )
 
-func CreateTempMarkdownFile(content string, filename string) (string, error) {
-    // Define the directory where files will be saved
-    chatDir := ".machtiani/chat"
-
-    // Check if the directory exists, create if it doesn't
-    if _, err := os.Stat(chatDir); os.IsNotExist(err) {
-        if err := os.MkdirAll(chatDir, 0755); err != nil {
-            return "", fmt.Errorf("failed to create directory: %v", err)
+// DefaultChatDir is where answers and chat sessions are saved unless the
+// config sets chat.DIR.
+const DefaultChatDir = ".machtiani/chat"
+
+// ChatDir returns the directory chats are saved in. A leading "~/" is the
+// home directory.
+func ChatDir(config Config) string {
+    dir := config.Chat.Dir
+    switch {
+    case dir == "":
+        return DefaultChatDir
+    case strings.HasPrefix(dir, "~/"):
+        if homeDir, err := os.UserHomeDir(); err == nil {
+            return filepath.Join(homeDir, dir[2:])
         }
     }
+    return dir
+}
 
-    // Create a markdown file with the provided filename
-    tempFile := fmt.Sprintf("%s/%s.md", chatDir, filename)
-    if err := ioutil.WriteFile(tempFile, []byte(content), 0644); err != nil {
-        return "", err
+// WriteFileAtomic writes data to path through a temporary file in the same
+// directory, so readers and crashes see either the old or the new content,
+// never a partial write.
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) error {
+    dir := filepath.Dir(path)
+    tmp, err := ioutil.TempFile(dir, "."+filepath.Base(path)+".tmp-*")
+    if err != nil {
+        return err
     }
-
-    return tempFile, nil
+    defer os.Remove(tmp.Name()) // fails harmlessly once renamed
+    if _, err := tmp.Write(data); err != nil {
+        tmp.Close()
+        return err
+    }
+    if err := tmp.Sync(); err != nil {
+        tmp.Close()
+        return err
+    }
+    if err := tmp.Close(); err != nil {
+        return err
+    }
+    if err := os.Chmod(tmp.Name(), perm); err != nil {
+        return err
+    }
+    return os.Rename(tmp.Name(), path)
 }
 
 var dryRun bool
@@ -61,26 +92,96 @@ type Config struct {
         ContentTypeKey       string `yaml:"CONTENT_TYPE_KEY"`
         ContentTypeValue     string `yaml:"CONTENT_TYPE_VALUE"`
     } `yaml:"environment"`
+    // Retry tunes retries of repo-manager calls. Durations use Go syntax,
+    // e.g. "500ms" or "30s". Unset values fall back to the client defaults.
+    Retry struct {
+        MaxAttempts    int    `yaml:"MAX_ATTEMPTS"`
+        InitialBackoff string `yaml:"INITIAL_BACKOFF"`
+        MaxBackoff     string `yaml:"MAX_BACKOFF"`
+    } `yaml:"retry"`
+    // Wait tunes --wait polling of the project status. Unset values fall
+    // back to polling every 5s for up to 30m.
+    Wait struct {
+        Interval string `yaml:"INTERVAL"`
+        Timeout  string `yaml:"TIMEOUT"`
+    } `yaml:"wait"`
+    // Pricing overrides or extends the built-in price table used for cost
+    // estimates. Indexing is priced with EMBEDDING_MODEL and INFERENCE_MODEL.
+    Pricing struct {
+        EmbeddingModel string                  `yaml:"EMBEDDING_MODEL"`
+        InferenceModel string                  `yaml:"INFERENCE_MODEL"`
+        Models         map[string]ModelPricing `yaml:"MODELS"`
+    } `yaml:"pricing"`
+    // Budget caps the tokens an operation may use. Zero means no limit. The
+    // daily limit covers the last 24 hours of the usage ledger.
+    Budget struct {
+        MaxTokensPerStore  int `yaml:"MAX_TOKENS_PER_STORE"`
+        MaxTokensPerSync   int `yaml:"MAX_TOKENS_PER_SYNC"`
+        MaxTokensPerPrompt int `yaml:"MAX_TOKENS_PER_PROMPT"`
+        MaxTokensPerDay    int `yaml:"MAX_TOKENS_PER_DAY"`
+    } `yaml:"budget"`
+    // Usage sets where the local usage ledger is kept. It defaults to
+    // ~/.machtiani/usage.jsonl.
+    Usage struct {
+        LedgerPath string `yaml:"LEDGER_PATH"`
+    } `yaml:"usage"`
+    // Compatibility sets how long a successful server compatibility check
+    // is cached, e.g. "1h". "0s" checks before every command.
+    Compatibility struct {
+        CacheTTL string `yaml:"CACHE_TTL"`
+    } `yaml:"compatibility"`
+    // Chat sets where answers and chat sessions are saved. It defaults to
+    // .machtiani/chat in the current directory.
+    Chat struct {
+        Dir string `yaml:"DIR"`
+    } `yaml:"chat"`
+    // Update points self-update at a release manifest, e.g. an internal
+    // mirror. Releases are still verified against the key built into the
+    // binary.
+    Update struct {
+        ManifestURL string `yaml:"MANIFEST_URL"`
+    } `yaml:"update"`
+}
+
+// ModelPricing is the price of a model in US dollars per million tokens.
+// Embedding models only use Input.
+type ModelPricing struct {
+    Input  float64 `yaml:"INPUT"`
+    Output float64 `yaml:"OUTPUT"`
+}
+
+// FindConfigFile returns the path LoadConfig reads: .machtiani-config.yml in
+// the current directory, or else in the home directory.
+func FindConfigFile() (string, error) {
+    // First, try the current directory
+    configPath := ".machtiani-config.yml"
+    if _, err := os.Stat(configPath); err == nil {
+        return configPath, nil
+    }
+
+    // If it doesn't exist, try the home directory
+    homeDir, err := os.UserHomeDir()
+    if err != nil {
+        return "", fmt.Errorf("failed to get home directory: %w", err)
+    }
+    configPath = filepath.Join(homeDir, ".machtiani-config.yml")
+    if _, err := os.Stat(configPath); err != nil {
+        return "", fmt.Errorf("failed to read config from both locations: %w", err)
+    }
+    return configPath, nil
 }
 
 // LoadConfig reads the configuration from the YAML file and prioritizes the environment variable
 func LoadConfig() (Config, error) {
     var config Config
 
-    // First, try to load from the current directory
-    configPath := ".machtiani-config.yml"
+    configPath, err := FindConfigFile()
+    if err != nil {
+        return config, err
+    }
     data, err := ioutil.ReadFile(configPath)
     if err != nil {
-        // If it doesn't exist, try to load from the home directory
-        homeDir, homeErr := os.UserHomeDir()
-        if homeErr != nil {
-            return config, fmt.Errorf("failed to get home directory: %w", homeErr)
-        }
-        configPath = filepath.Join(homeDir, ".machtiani-config.yml")
-        data, err = ioutil.ReadFile(configPath)
-        if err != nil {
-            return config, fmt.Errorf("failed to read config from both locations: %w", err)
-        }
+        return config, fmt.Errorf("failed to read config: %w", err)
     }
 
     err = yaml.Unmarshal(data, &config)
@@ -107,16 +208,26 @@ func LoadConfigAndIgnoreFiles() (Config, []string, error) {
         return config, nil, fmt.Errorf("error loading config: %w", err)
     }
 
+    ignoreFiles, err := LoadIgnoreFiles()
+    if err != nil {
+        return config, nil, err
+    }
+
+    return config, ignoreFiles, nil
+}
+
+// LoadIgnoreFiles reads .machtiani.ignore from the current directory.
+func LoadIgnoreFiles() ([]string, error) {
     ignoreFilePath := ".machtiani.ignore"
     ignoreFiles, err := ReadIgnoreFile(ignoreFilePath)
     if err != nil {
-        return config, nil, fmt.Errorf("error reading ignore file: %w", err)
+        return nil, fmt.Errorf("error reading ignore file: %w", err)
     }
     if ignoreFiles == nil {
         ignoreFiles = []string{}  // Default to empty list if nil
     }
 
-    return config, ignoreFiles, nil
+    return ignoreFiles, nil
 }
 
 func validateConfig(config Config) error {
@@ -196,39 +307,163 @@ func GetProjectOrDefault(projectFlag *string) (string, error) {
     return *projectFlag, nil
 }
 
-func ValidateFlags(modelFlag, matchStrengthFlag, modeFlag *string) {
-    model := *modelFlag
-    if model != "gpt-4o" && model != "gpt-4o-mini" {
-        log.Fatalf("Error: Invalid model selected. Choose either 'gpt-4o' or 'gpt-4o-mini'.")
+// CheckChoice returns an error if value is not one of options, suggesting
+// the closest option when there is one.
+func CheckChoice(name, value string, options []string) error {
+    for _, option := range options {
+        if value == option {
+            return nil
+        }
     }
+    message := fmt.Sprintf("invalid %s %q (options: %s)", name, value, strings.Join(options, ", "))
+    if suggestion := Suggest(value, options); suggestion != "" {
+        message += fmt.Sprintf("; did you mean %q?", suggestion)
+    }
+    return errors.New(message)
+}
 
-    matchStrength := *matchStrengthFlag
-    if matchStrength != "high" && matchStrength != "mid" && matchStrength != "low" {
-        log.Fatalf("Error: Invalid match strength selected. Choose either 'high', 'mid', or 'low'.")
+// Suggest returns the candidate closest to input, or "" if none is close
+// enough to be a likely typo.
+func Suggest(input string, candidates []string) string {
+    best, bestDistance := "", -1
+    for _, candidate := range candidates {
+        d := editDistance(strings.ToLower(input), strings.ToLower(candidate))
+        if bestDistance < 0 || d < bestDistance {
+            best, bestDistance = candidate, d
+        }
+    }
+    // Allow one edit per four characters, and at least one.
+    limit := len(input) / 4
+    if limit < 1 {
+        limit = 1
     }
+    if bestDistance < 0 || bestDistance > limit || bestDistance >= len(input) {
+        return ""
+    }
+    return best
+}
 
-    mode := *modeFlag
-    if mode != "pure-chat" && mode != "commit" && mode != "super" {
-        log.Fatalf("Error: Invalid mode selected. Choose either 'chat', 'commit', or 'super'.")
+// editDistance is the Levenshtein distance between a and b, counting an
+// adjacent transposition as one edit.
+func editDistance(a, b string) int {
+    ra, rb := []rune(a), []rune(b)
+    prev2 := make([]int, len(rb)+1)
+    prev := make([]int, len(rb)+1)
+    curr := make([]int, len(rb)+1)
+    for j := range prev {
+        prev[j] = j
     }
+    for i := 1; i <= len(ra); i++ {
+        curr[0] = i
+        for j := 1; j <= len(rb); j++ {
+            cost := 1
+            if ra[i-1] == rb[j-1] {
+                cost = 0
+            }
+            curr[j] = min3(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+            if i > 1 && j > 1 && ra[i-1] == rb[j-2] && ra[i-2] == rb[j-1] && prev2[j-2]+1 < curr[j] {
+                curr[j] = prev2[j-2] + 1
+            }
+        }
+        prev2, prev, curr = prev, curr, prev2
+    }
+    return prev[len(rb)]
 }
 
-func Spinner(done chan bool) {
-    symbols := []rune{'|', '/', '-', '\\'}
-    i := 0
+func min3(a, b, c int) int {
+    if b < a {
+        a = b
+    }
+    if c < a {
+        a = c
+    }
+    return a
+}
+
+// NonInteractiveEnv names the environment variable that turns off terminal
+// features, for CI systems that run commands on a pseudo-terminal.
+const NonInteractiveEnv = "MACHTIANI_NONINTERACTIVE"
+
+// NonInteractive reports whether MACHTIANI_NONINTERACTIVE is set to anything
+// other than an empty or false value.
+func NonInteractive() bool {
+    value := strings.TrimSpace(os.Getenv(NonInteractiveEnv))
+    if value == "" {
+        return false
+    }
+    set, err := strconv.ParseBool(value)
+    return err != nil || set
+}
+
+// IsTerminal reports whether w is an interactive terminal. It is always
+// false when MACHTIANI_NONINTERACTIVE is set, and for anything but a file.
+func IsTerminal(w interface{}) bool {
+    f, ok := w.(*os.File)
+    if !ok || f == nil || NonInteractive() {
+        return false
+    }
+    return isatty.IsTerminal(f.Fd()) || isatty.IsCygwinTerminal(f.Fd())
+}
+
+// SpinnerLogInterval is how often a spinner that is not on a terminal logs
+// that the operation is still running.
+var SpinnerLogInterval = 30 * time.Second
+
+// StartSpinnerOn draws a spinner on w until the returned stop func is
+// called. stop clears the spinner from the line and is safe to call more
+// than once, so callers can simply defer it. When w is not a terminal the
+// carriage-return frames would only clutter logs, so it prints a line every
+// SpinnerLogInterval instead.
+func StartSpinnerOn(w io.Writer) (stop func()) {
+    done := make(chan struct{})
+    finished := make(chan struct{})
+
+    go func() {
+        defer close(finished)
+        if !IsTerminal(w) {
+            logProgress(w, done)
+            return
+        }
+        symbols := []rune{'|', '/', '-', '\\'}
+        ticker := time.NewTicker(100 * time.Millisecond) // adjust the speed of the spinner here
+        defer ticker.Stop()
+        for i := 0; ; i = (i + 1) % len(symbols) {
+            fmt.Fprintf(w, "\r%c", symbols[i])
+            select {
+            case <-done:
+                fmt.Fprint(w, "\r \r") // Clear the spinner output
+                return
+            case <-ticker.C:
+            }
+        }
+    }()
+
+    var once sync.Once
+    return func() {
+        once.Do(func() {
+            close(done)
+            <-finished
+        })
+    }
+}
+
+
+// logProgress prints how long the operation has been running every
+// SpinnerLogInterval until done is closed.
+func logProgress(w io.Writer, done <-chan struct{}) {
+    start := time.Now()
+    ticker := time.NewTicker(SpinnerLogInterval)
+    defer ticker.Stop()
     for {
         select {
         case <-done:
             return
-        default:
-            fmt.Printf("\r%c", symbols[i])
-            i = (i + 1) % len(symbols)
-            time.Sleep(100 * time.Millisecond) // adjust the speed of the spinner here
+        case <-ticker.C:
+            fmt.Fprintf(w, "Still working... (%s elapsed)\n", time.Since(start).Round(time.Second))
         }
     }
 }
 
-
 // GetCodehostURLFromCurrentRepository retrieves the codehost URL from the current Git repository.
 func GetCodehostURLFromCurrentRepository() (string, error) {
     // Run the `git remote get-url origin` command to get the URL of the origin remote.
@@ -6,6 +6,8 @@ import (
     "os"
     "testing"
     "strings"
+    "sync"
+    "time"
 )
 
 func createTempConfigFile(content string) (string, error) {
@@ -222,3 +224,107 @@ environment:
     }
 }
 
+
+func TestSuggest(t *testing.T) {
+    options := []string{"gpt-4o", "gpt-4o-mini"}
+    for input, want := range map[string]string{
+        "gpt4o":       "gpt-4o",
+        "gpt-4o-mni":  "gpt-4o-mini",
+        "gtp-4o-mini": "gpt-4o-mini",
+        "claude":      "",
+        "x":           "",
+    } {
+        if got := Suggest(input, options); got != want {
+            t.Errorf("Suggest(%q) = %q, want %q", input, got, want)
+        }
+    }
+
+    err := CheckChoice("match-strength", "hihg", []string{"high", "mid", "low"})
+    if err == nil || !strings.Contains(err.Error(), `did you mean "high"?`) {
+        t.Errorf("Expected a suggestion for the match strength, got %v", err)
+    }
+    if err := CheckChoice("mode", "commit", []string{"pure-chat", "commit", "super"}); err != nil {
+        t.Errorf("Unexpected error for a valid choice: %v", err)
+    }
+}
+
+func TestNonInteractive(t *testing.T) {
+    for value, want := range map[string]bool{"": false, "0": false, "false": false, "1": true, "true": true, "yes": true} {
+        t.Setenv(NonInteractiveEnv, value)
+        if got := NonInteractive(); got != want {
+            t.Errorf("NonInteractive() with %q = %v, want %v", value, got, want)
+        }
+    }
+
+    reader, writer, err := os.Pipe()
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer reader.Close()
+    defer writer.Close()
+    if IsTerminal(writer) || IsTerminal(&strings.Builder{}) {
+        t.Errorf("Expected a pipe and a buffer not to be terminals")
+    }
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+    dir := t.TempDir()
+    path := dir + "/chat.md"
+    for _, content := range []string{"first", "second"} {
+        if err := WriteFileAtomic(path, []byte(content), 0644); err != nil {
+            t.Fatalf("Unexpected error: %v", err)
+        }
+    }
+    if content, _ := ioutil.ReadFile(path); string(content) != "second" {
+        t.Errorf("Expected the file to be replaced, got %q", content)
+    }
+    if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+        t.Errorf("Expected no temporary files to be left, got %d files", len(files))
+    }
+
+    var config Config
+    if dir := ChatDir(config); dir != DefaultChatDir {
+        t.Errorf("Expected the default chat directory, got %q", dir)
+    }
+    config.Chat.Dir = "answers"
+    if dir := ChatDir(config); dir != "answers" {
+        t.Errorf("Expected the configured chat directory, got %q", dir)
+    }
+}
+
+func TestSpinner_LogsWhenNotATerminal(t *testing.T) {
+    interval := SpinnerLogInterval
+    SpinnerLogInterval = 10 * time.Millisecond
+    defer func() { SpinnerLogInterval = interval }()
+
+    var buf syncBuffer
+    stop := StartSpinnerOn(&buf)
+    time.Sleep(35 * time.Millisecond)
+    stop()
+
+    out := buf.String()
+    if strings.Contains(out, "\r") {
+        t.Errorf("Expected no carriage returns off a terminal, got %q", out)
+    }
+    if !strings.Contains(out, "Still working...") {
+        t.Errorf("Expected periodic progress lines, got %q", out)
+    }
+}
+
+// syncBuffer is a strings.Builder safe for use by the spinner goroutine.
+type syncBuffer struct {
+    mu  sync.Mutex
+    buf strings.Builder
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    return b.buf.String()
+}